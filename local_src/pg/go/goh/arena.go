@@ -2,28 +2,40 @@ package main
 
 import (
 	"errors"
+	"reflect"
 	"unsafe"
 )
 
+// arenaSlabLen is the number of values of one type allocated at a time by
+// Emplace.
+const arenaSlabLen = 256
+
 type ArenaAllocator struct {
 	size   uintptr
 	buffer []byte
 	offset uintptr
+	// AST nodes hold Go pointers, which the garbage collector does not see
+	// inside buffer, so Emplace carves them out of typed slabs instead. The
+	// slabs count against the same size limit.
+	slabs map[reflect.Type]interface{}
 }
 
 func NewArenaAllocator(maxNumBytes uintptr) *ArenaAllocator {
-	buffer := make([]byte, maxNumBytes)
 	return &ArenaAllocator{
 		size:   maxNumBytes,
-		buffer: buffer,
 		offset: 0,
+		slabs:  make(map[reflect.Type]interface{}),
 	}
 }
 
+// Alloc returns size bytes of pointer-free memory.
 func (a *ArenaAllocator) Alloc(size uintptr, align uintptr) (unsafe.Pointer, error) {
-	if a.buffer == nil {
+	if a.slabs == nil {
 		return nil, errors.New("arena allocator has been moved")
 	}
+	if a.buffer == nil {
+		a.buffer = make([]byte, a.size)
+	}
 
 	// Calculate aligned address
 	currentAddr := uintptr(unsafe.Pointer(&a.buffer[0])) + a.offset
@@ -39,15 +51,26 @@ func (a *ArenaAllocator) Alloc(size uintptr, align uintptr) (unsafe.Pointer, err
 }
 
 func Emplace[T any](a *ArenaAllocator, value T) (*T, error) {
-	size := unsafe.Sizeof(value)
-	align := unsafe.Alignof(value)
+	if a.slabs == nil {
+		return nil, errors.New("arena allocator has been moved")
+	}
 
-	ptr, err := a.Alloc(size, align)
-	if err != nil {
-		return nil, err
+	key := reflect.TypeOf((*T)(nil))
+	slab, _ := a.slabs[key].(*[]T)
+	if slab == nil {
+		slab = new([]T)
+		a.slabs[key] = slab
+	}
+	if len(*slab) == cap(*slab) {
+		bytes := unsafe.Sizeof(value) * arenaSlabLen
+		if a.offset+bytes > a.size {
+			return nil, errors.New("not enough memory in arena")
+		}
+		a.offset += bytes
+		// A fresh slab rather than append, so earlier values never move
+		*slab = make([]T, 0, arenaSlabLen)
 	}
 
-	result := (*T)(ptr)
-	*result = value
-	return result, nil
-}
\ No newline at end of file
+	*slab = append(*slab, value)
+	return &(*slab)[len(*slab)-1], nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// backendPrograms each exercise a part of the language every backend has
+// to lower, along with the status they exit with.
+var backendPrograms = []struct {
+	name  string
+	src   string
+	debug bool
+	want  int
+}{
+	{"arithmetic", "let x = 7;\nlet y = 3;\nexit(x*y - x/y + x%y - (1 + 2));", false, 17},
+	{"updates", "let mut x = 10;\nx += 5;\nx -= 2;\nx *= 3;\nx /= 2;\nx %= 7;\nx++;\nx++;\nx--;\nexit(x);", false, 6},
+	{"bitwise", "let a = 0xF0;\nlet b = 0x3C;\nlet mut s = 65;\ns <<= 2;\ns >>>= 3;\nexit((a & b) + (a ^ b) + ~a + ((0 - 16) >> 2) + ((0 - 16) >>> 60) + (1 << 65) + s);", false, 56},
+	{"comparisons", "let n = 5;\nlet mut total = 0;\nfor (let mut i = 0; i < n; i++) {\n    total += i;\n}\nexit(total + (1 == 1) + (1 != 1)*2 + (3 <= 3)*4 + (4 >= 5)*8 + (0 - 1 < 0)*16 + (2 > 1)*32);", false, 63},
+	{"control flow", "let mut sum = 0;\nfor (let mut i = 1; 11 - i; i++) {\n    if (i - 5) {\n    } elif (0) {\n        exit(1);\n    } else {\n        continue;\n    }\n    if (i - 9) {\n        sum += i;\n    } else {\n        break;\n    }\n}\nexit(sum);", false, 31},
+	{"match", "let mut total = 0;\nfor (let mut i = 0; 8 - i; i++) {\n    match (i) {\n        0 => { total += 1; }\n        1 | 2 => { total += 2; }\n        5 => { continue; }\n        7 => { break; }\n        _ => { total += 10; }\n    }\n    total++;\n}\nmatch (total) {\n    1000 => { exit(1); }\n    _ => { exit(total); }\n}", false, 41},
+	{"arrays", "const N = 4;\nlet mut a: [i64; N];\nlet b = [3, 1, 4, 1];\nfor (let mut i = 0; N - i; i++) {\n    a[i] = b[i] * 2;\n}\na[0] += 1;\na[3]--;\nexit(a[0] + a[1] + a[2] + a[3]);", false, 18},
+	{"pointers", "let mut x = 3;\nlet mut a = [1, 2, 3];\nlet mut p = &a[1];\n*p += 5;\nlet pp = &p;\n**pp = **pp * 2;\n*pp = &x;\n*p = 20;\nlet q: *i64 = 0;\nexit(x + a[1] + (q == 0) + (p != 0));", false, 36},
+	{"statics and consts", "static counter: i64;\nconst N = 5;\nstatic base = N * 2;\nfor (let mut i = 0; N - i; i++) {\n    counter += i;\n}\nbase++;\nexit(counter + base);", false, 21},
+	{"large exit code", "exit(300);", false, 44},
+	{"bounds fault", "let a = [1, 2, 3];\nlet mut i = 1;\ni = i + 2;\nexit(a[i]);", true, exitBoundsFault},
+	{"null fault", "let mut x = 1;\nlet mut p = &x;\np = 0;\nexit(*p);", true, exitNullFault},
+	{"division fault", "let mut m = 0 - 9223372036854775807 - 1;\nlet mut d = 0 - 1;\nd = d * 1;\nexit(m % d);", false, exitDivFault},
+	{"evaluation order", "let a = [1, 2, 3];\nlet mut i = 1;\ni = i + 4;\nlet mut z = 0;\nz = z * 5;\nexit(a[i] + (a[0] + 7 / z));", true, exitDivFault},
+}
+
+// runCommands runs each command in dir, failing the test if any of them
+// does.
+func runCommands(t *testing.T, dir string, commands [][]string) {
+	t.Helper()
+	for _, args := range commands {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s: %v\n%s", args[0], err, out)
+		}
+	}
+}
+
+// backend compiles prog in dir, runs it and returns its exit status.
+type backend struct {
+	name     string
+	optLevel int
+	tools    []string
+	run      func(t *testing.T, prog NodeProg, debug bool, dir string) int
+}
+
+// exitStatus runs args in dir and returns the status it exits with, or
+// 128 plus the signal that killed it, as a shell reports it.
+func exitStatus(t *testing.T, dir string, args ...string) int {
+	t.Helper()
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0
+}
+
+// writeOutputs writes the files a target generates into dir.
+func writeOutputs(t *testing.T, dir string, outputs []outputFile) {
+	t.Helper()
+	for _, output := range outputs {
+		if err := os.WriteFile(filepath.Join(dir, output.Name), output.Data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// runTarget generates prog for opts.Target, builds it and runs the result.
+func runTarget(t *testing.T, prog NodeProg, opts Options, dir string) int {
+	outputs, commands := genTarget(prog, opts)
+	writeOutputs(t, dir, outputs)
+	runCommands(t, dir, commands)
+	return exitStatus(t, dir, "./out")
+}
+
+// wasiRunner runs out.wasm under node's WASI and exits with its status.
+const wasiRunner = `
+const fs = require('fs');
+const { WASI } = require('wasi');
+const wasi = new WASI({ version: 'preview1', returnOnExit: true });
+const module = new WebAssembly.Module(fs.readFileSync('out.wasm'));
+process.exit(wasi.start(new WebAssembly.Instance(module, wasi.getImportObject())));
+`
+
+func x86Backend(name string, asm string, optLevel int) backend {
+	tools := []string{"as", "ld"}
+	if asm == "nasm" {
+		tools = []string{"nasm", "ld"}
+	}
+	return backend{name, optLevel, tools, func(t *testing.T, prog NodeProg, debug bool, dir string) int {
+		if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+			t.Skip("x86-64 executables only run on linux/amd64")
+		}
+		return runTarget(t, prog, Options{Target: "x86_64-linux", Asm: asm, OptLevel: optLevel, Debug: debug}, dir)
+	}}
+}
+
+var backends = []backend{
+	x86Backend("gas -O0", "gas", 0),
+	x86Backend("gas -O1", "gas", 1),
+	x86Backend("nasm -O1", "nasm", 1),
+	{"jit", 1, nil, func(t *testing.T, prog NodeProg, debug bool, dir string) int {
+		if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+			t.Skip("the JIT only runs on linux/amd64")
+		}
+		value, err := NewJIT().Run(prog)
+		var fault *faultError
+		if errors.As(err, &fault) {
+			return fault.status()
+		}
+		if errors.Is(err, errDivFault) {
+			return exitDivFault
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(value & 0xff)
+	}},
+	{"c", 1, []string{"cc"}, func(t *testing.T, prog NodeProg, debug bool, dir string) int {
+		return runTarget(t, prog, Options{Target: "c", Debug: debug}, dir)
+	}},
+	{"llvm", 1, []string{"lli"}, func(t *testing.T, prog NodeProg, debug bool, dir string) int {
+		generator := NewLLVMGenerator(prog)
+		generator.Debug = debug
+		writeOutputs(t, dir, []outputFile{{"out.ll", []byte(generator.GenProg())}})
+		return exitStatus(t, dir, "lli", "out.ll")
+	}},
+	{"wasm", 1, []string{"node"}, func(t *testing.T, prog NodeProg, debug bool, dir string) int {
+		outputs, _ := genTarget(prog, Options{Target: "wasm32-wasi", Debug: debug})
+		writeOutputs(t, dir, outputs)
+		return exitStatus(t, dir, "node", "--no-warnings", "-e", wasiRunner)
+	}},
+}
+
+// compile parses and checks src and, from -O1 up, removes its dead stores,
+// as the compiler does before handing a program to a backend.
+func compile(t *testing.T, src string, optLevel int) NodeProg {
+	t.Helper()
+	tokens, err := NewTokenizer(src).Tokenize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := NewParser(tokens).ParseProg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewChecker().Check(prog); err != nil {
+		t.Fatal(err)
+	}
+	liveness := NewLiveness()
+	liveness.Analyze(prog)
+	if optLevel >= 1 {
+		liveness.Eliminate(&prog)
+	}
+	return prog
+}
+
+func TestBackends(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs every program on every backend")
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			for _, tool := range b.tools {
+				if _, err := exec.LookPath(tool); err != nil {
+					t.Skipf("%s is not installed", tool)
+				}
+			}
+			for _, program := range backendPrograms {
+				t.Run(program.name, func(t *testing.T) {
+					prog := compile(t, program.src, b.optLevel)
+					if got := b.run(t, prog, program.debug, t.TempDir()); got != program.want {
+						t.Errorf("exited with %d, want %d", got, program.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+// TestBackendsAgree checks the expected statuses against the interpreter,
+// which every backend has to match.
+func TestBackendsAgree(t *testing.T) {
+	for _, program := range backendPrograms {
+		prog := compile(t, program.src, 0)
+		got, err := NewInterpreter().Run(prog)
+		var fault *faultError
+		if errors.As(err, &fault) {
+			got, err = int64(fault.status()), nil
+		}
+		if errors.Is(err, errDivFault) {
+			got, err = exitDivFault, nil
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", program.name, err)
+		}
+		if int(got&0xff) != program.want {
+			t.Errorf("%s: interpreter exits with %d, want %d", program.name, got&0xff, program.want)
+		}
+	}
+}
+
+// TestCrossTargets assembles the aarch64 and riscv64 output, which cannot
+// run here, to catch instructions or operands the assembler rejects.
+func TestCrossTargets(t *testing.T) {
+	if _, err := exec.LookPath("llvm-mc"); err != nil {
+		t.Skip("llvm-mc is not installed")
+	}
+	targets := []struct {
+		target string
+		args   []string
+	}{
+		{"aarch64-linux", []string{"--triple=aarch64"}},
+		{"riscv64-linux", []string{"--triple=riscv64", "-mattr=+m"}},
+	}
+	for _, target := range targets {
+		for _, program := range backendPrograms {
+			t.Run(target.target+"/"+program.name, func(t *testing.T) {
+				dir := t.TempDir()
+				outputs, _ := genTarget(compile(t, program.src, 1), Options{Target: target.target, Debug: program.debug})
+				writeOutputs(t, dir, outputs)
+				args := append([]string{"llvm-mc", "-filetype=obj", "-o", "out.o", "out.s"}, target.args...)
+				runCommands(t, dir, [][]string{args})
+			})
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// benchSource returns a program of at least size bytes made of blocks that
+// exercise every kind of token and statement, each block in its own scope
+// so the names it declares do not pile up.
+func benchSource(size int) string {
+	var src strings.Builder
+	for i := 0; src.Len() < size; i++ {
+		fmt.Fprintf(&src, "// block %d\n{\n", i)
+		fmt.Fprintf(&src, "    let mut total%d = 0x%X + 0b1010_1010 * %d; /* seed */\n", i, i, i%97)
+		fmt.Fprintf(&src, "    let values: [i64; 4] = [%d, 'a', '\\n', 1_000];\n", i)
+		src.WriteString("    for (let mut j = 0; 4 - j; j++) {\n")
+		fmt.Fprintf(&src, "        total%d += values[j] << 2 >> 1 ^ ~j | (j & 3) %% 5;\n", i)
+		src.WriteString("        if (j - 2) {\n            continue;\n        } elif (j) {\n            break;\n        } else {\n")
+		fmt.Fprintf(&src, "            total%d = total%d / (j + 1) - 1;\n        }\n    }\n", i, i)
+		fmt.Fprintf(&src, "    match (total%d %% 3) {\n        0 | 1 => {\n            total%d--;\n        }\n        _ => {\n        }\n    }\n}\n", i, i)
+	}
+	src.WriteString("exit(0);\n")
+	return src.String()
+}
+
+const benchSize = 4 << 20
+
+func BenchmarkTokenize(b *testing.B) {
+	src := benchSource(benchSize)
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewTokenizer(src).Tokenize(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	src := benchSource(benchSize)
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewStreamParser(NewTokenizer(src)).ParseProg(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestBenchSource keeps the generated program valid, so the benchmarks
+// measure a full pass over it rather than an early error.
+func TestBenchSource(t *testing.T) {
+	prog, err := NewStreamParser(NewTokenizer(benchSource(1 << 10))).ParseProg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewChecker().Check(prog); err != nil {
+		t.Fatal(err)
+	}
+}
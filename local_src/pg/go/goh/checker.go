@@ -0,0 +1,586 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Symbol is a variable declared by a `let` or `static`, or a `const`, with
+// every identifier that refers to it.
+type Symbol struct {
+	Decl    Token
+	Refs    []Token
+	Mutable bool
+	Const   bool
+	Static  bool
+	Value   int64 // Value of a const
+	Type    *Type
+	Let     *NodeStmtLet // Declaration of a variable
+}
+
+// Keyword returns the keywords that declared the symbol, such as `let mut`.
+func (s *Symbol) Keyword() string {
+	switch {
+	case s.Static:
+		return "static"
+	case s.Const:
+		return "const"
+	case s.Mutable:
+		return "let mut"
+	}
+	return "let"
+}
+
+// Checker performs the semantic checks shared by every backend, so that the
+// generators can assume each identifier they see has been declared exactly
+// once in an enclosing scope, each integer literal fits in 64 bits and
+// every `break` and `continue` is inside a loop. Only mutable variables are
+// assigned to, arrays are only indexed, only pointers are dereferenced and
+// every use of a const is replaced with its value. It records what each
+// identifier resolves to in Symbols, the type of each `let` in its VarType
+// and whether its address is taken in Addressed, and problems that do not
+// stop compilation in Warnings.
+type Checker struct {
+	vars     []*Symbol
+	scopes   []int
+	loops    int // Number of loops enclosing the statement being checked
+	Symbols  []*Symbol
+	Warnings []Diagnostic
+}
+
+func NewChecker() *Checker {
+	return &Checker{
+		vars:    make([]*Symbol, 0),
+		scopes:  make([]int, 0),
+		Symbols: make([]*Symbol, 0),
+	}
+}
+
+func (c *Checker) Check(prog NodeProg) (err error) {
+	defer recoverDiagnostic(&err)
+	for _, stmt := range prog.Stmts {
+		c.checkStmt(stmt)
+	}
+	return nil
+}
+
+// CheckExpr checks an expression evaluated on its own against the
+// variables declared so far, and returns its type.
+func (c *Checker) CheckExpr(expr *NodeExpr) (typ *Type, err error) {
+	defer recoverDiagnostic(&err)
+	return c.checkExpr(expr), nil
+}
+
+func (c *Checker) warn(token Token, message string) {
+	c.Warnings = append(c.Warnings, tokenDiagnostic(token, "[Warning] "+message))
+}
+
+func (c *Checker) lookup(name string) *Symbol {
+	for i := len(c.vars) - 1; i >= 0; i-- {
+		if *c.vars[i].Decl.Value == name {
+			return c.vars[i]
+		}
+	}
+	return nil
+}
+
+// declare declares ident in the innermost scope, after checking that the
+// name is not already in use.
+func (c *Checker) declare(ident Token) *Symbol {
+	if c.lookup(*ident.Value) != nil {
+		panic(tokenDiagnostic(ident, fmt.Sprintf("Identifier already used: %s on line %d", *ident.Value, ident.Line)))
+	}
+	symbol := &Symbol{Decl: ident, Type: typeI64}
+	c.vars = append(c.vars, symbol)
+	c.Symbols = append(c.Symbols, symbol)
+	return symbol
+}
+
+func (c *Checker) checkIdent(ident Token) *Symbol {
+	symbol := c.lookup(*ident.Value)
+	if symbol == nil {
+		panic(tokenDiagnostic(ident, fmt.Sprintf("Undeclared identifier: %s on line %d", *ident.Value, ident.Line)))
+	}
+	symbol.Refs = append(symbol.Refs, ident)
+	return symbol
+}
+
+// checkAssign checks the target of an assignment or update, which is the
+// element at index when that is set, or what deref points to, and returns
+// its type.
+func (c *Checker) checkAssign(ident Token, index *NodeExpr, deref *NodeTermDeref) *Type {
+	if deref != nil {
+		return c.checkDeref(deref)
+	}
+	symbol := c.checkIdent(ident)
+	typ := symbol.Type
+	if index != nil {
+		typ = c.checkIndex(ident, symbol, index)
+	} else if symbol.Type.Kind == TypeArray {
+		panic(tokenDiagnostic(ident, fmt.Sprintf("Cannot assign to array: %s on line %d", *ident.Value, ident.Line)))
+	}
+	c.checkMutable(ident, symbol, "assign to")
+	return typ
+}
+
+// checkMutable checks that the variable ident refers to can be changed,
+// as doing is about to do to it.
+func (c *Checker) checkMutable(ident Token, symbol *Symbol, doing string) {
+	if symbol.Mutable {
+		return
+	}
+	what := "immutable variable"
+	if symbol.Const {
+		what = "constant"
+	}
+	diag := tokenDiagnostic(ident, fmt.Sprintf("Cannot %s %s: %s on line %d", doing, what, *ident.Value, ident.Line))
+	// Bindings a REPL carries over from earlier input have no position
+	if decl := symbol.Decl; decl.Line > 0 {
+		diag.Message += fmt.Sprintf(", declared on line %d", decl.Line)
+		diag.Related = []Diagnostic{tokenDiagnostic(decl, fmt.Sprintf("%s declared here", *decl.Value))}
+	}
+	panic(diag)
+}
+
+// checkIndex checks that the variable ident refers to is an array, and
+// the index into it, and returns the type of its elements.
+func (c *Checker) checkIndex(ident Token, symbol *Symbol, index *NodeExpr) *Type {
+	if symbol.Type.Kind != TypeArray {
+		panic(tokenDiagnostic(ident, fmt.Sprintf("Cannot index %s, which is not an array, on line %d", *ident.Value, ident.Line)))
+	}
+	c.checkI64("an index", index)
+	return symbol.Type.Elem
+}
+
+// checkDeref checks a dereference and returns the type it reads.
+func (c *Checker) checkDeref(deref *NodeTermDeref) *Type {
+	typ := c.checkExpr(deref.Expr)
+	if typ.Kind != TypePointer {
+		panic(tokenDiagnostic(deref.Star, fmt.Sprintf("Cannot dereference %s, which is not a pointer, on line %d", typ, deref.Star.Line)))
+	}
+	return typ.Elem
+}
+
+// checkAddr checks that `&` is applied to a mutable variable on the stack,
+// or an element of one, since what it points to can be stored through.
+func (c *Checker) checkAddr(addr *NodeTermAddr) *Type {
+	ident := addr.Ident
+	symbol := c.checkIdent(ident)
+	typ := symbol.Type
+	if addr.Index != nil {
+		typ = c.checkIndex(ident, symbol, addr.Index)
+	} else if typ.Kind == TypeArray {
+		panic(tokenDiagnostic(ident, fmt.Sprintf("Cannot take the address of array %s, only of its elements, on line %d", *ident.Value, ident.Line)))
+	}
+	if symbol.Static {
+		panic(tokenDiagnostic(ident, fmt.Sprintf("Cannot take the address of static: %s on line %d", *ident.Value, ident.Line)))
+	}
+	c.checkMutable(ident, symbol, "take the address of")
+	// Bindings a REPL carries over from earlier input have no `let`
+	if addr.Index == nil && symbol.Let != nil {
+		symbol.Let.Addressed = true
+	}
+	return pointerType(typ)
+}
+
+// checkTerm checks a term, replacing a const with its value, and returns
+// its type.
+func (c *Checker) checkTerm(term *NodeTerm) *Type {
+	switch t := term.Var.(type) {
+	case *NodeTermIdent:
+		symbol := c.checkIdent(t.Ident)
+		if symbol.Type.Kind == TypeArray {
+			panic(tokenDiagnostic(t.Ident, fmt.Sprintf("Array used as a value: %s on line %d", *t.Ident.Value, t.Ident.Line)))
+		}
+		if symbol.Const {
+			text := strconv.FormatInt(symbol.Value, 10)
+			literal := Token{Type: TokenIntLit, Line: t.Ident.Line, Col: t.Ident.Col, Raw: text, Value: &text, Int: symbol.Value}
+			term.Var = &NodeTermIntLit{IntLit: literal}
+		}
+		return symbol.Type
+	case *NodeTermIndex:
+		return c.checkIndex(t.Ident, c.checkIdent(t.Ident), t.Index)
+	case *NodeTermAddr:
+		return c.checkAddr(t)
+	case *NodeTermDeref:
+		return c.checkDeref(t)
+	case *NodeTermParen:
+		return c.checkExpr(t.Expr)
+	case *NodeTermBitNot:
+		c.checkI64("the operand of `~`", t.Expr)
+	}
+	return typeI64
+}
+
+// checkExpr checks an expression and returns its type. Only i64s take part
+// in arithmetic, and pointers can also be tested for equality.
+func (c *Checker) checkExpr(expr *NodeExpr) *Type {
+	switch v := expr.Var.(type) {
+	case *NodeTerm:
+		return c.checkTerm(v)
+	case *NodeBinExpr:
+		op := binExprOp(v)
+		what := fmt.Sprintf("an operand of `%s`", Token{Type: op}.Text())
+		lhs, rhs := binOperands(v)
+		if op == TokenEqEq || op == TokenNe {
+			c.checkEquality(what, lhs, rhs)
+			return typeI64
+		}
+		c.checkI64(what, lhs)
+		c.checkI64(what, rhs)
+	}
+	return typeI64
+}
+
+// checkEquality checks the operands of `==` or `!=`, which are two i64s or
+// two pointers of the same type. A literal 0 compares with any pointer.
+func (c *Checker) checkEquality(what string, lhs *NodeExpr, rhs *NodeExpr) {
+	lhsType, rhsType := c.checkExpr(lhs), c.checkExpr(rhs)
+	switch {
+	case lhsType.Kind == TypePointer:
+		checkStore(lhsType, rhsType, rhs)
+	case rhsType.Kind == TypePointer:
+		checkStore(rhsType, lhsType, lhs)
+	default:
+		requireI64(what, lhsType, lhs)
+		requireI64(what, rhsType, rhs)
+	}
+}
+
+// checkI64 checks an expression used as what, which has to be an i64.
+func (c *Checker) checkI64(what string, expr *NodeExpr) {
+	requireI64(what, c.checkExpr(expr), expr)
+}
+
+// requireI64 reports expr, already checked to have type typ, unless it is
+// an i64.
+func requireI64(what string, typ *Type, expr *NodeExpr) {
+	if typ.Kind != TypeI64 {
+		token := firstToken(expr)
+		panic(tokenDiagnostic(token, fmt.Sprintf("Cannot use %s as %s on line %d", typ, what, token.Line)))
+	}
+}
+
+// checkCond checks the condition of an if, elif or for, which may also
+// be a pointer, true when it is not null.
+func (c *Checker) checkCond(expr *NodeExpr) {
+	if typ := c.checkExpr(expr); typ.Kind != TypeI64 && typ.Kind != TypePointer {
+		token := firstToken(expr)
+		panic(tokenDiagnostic(token, fmt.Sprintf("Cannot use %s as a condition on line %d", typ, token.Line)))
+	}
+}
+
+// checkStore checks that expr, whose type is typ, can be stored where a
+// value of type want goes. A literal 0 is also the null pointer of every
+// pointer type.
+func checkStore(want *Type, typ *Type, expr *NodeExpr) {
+	if typ.Equal(want) || (want.Kind == TypePointer && isZeroLit(expr)) {
+		return
+	}
+	token := firstToken(expr)
+	panic(tokenDiagnostic(token, fmt.Sprintf("Cannot use %s as %s on line %d", typ, want, token.Line)))
+}
+
+// isZeroLit reports whether expr is the literal 0, possibly in
+// parentheses.
+func isZeroLit(expr *NodeExpr) bool {
+	if term, ok := expr.Var.(*NodeTerm); ok {
+		switch t := term.Var.(type) {
+		case *NodeTermIntLit:
+			return t.IntLit.Int == 0
+		case *NodeTermParen:
+			return isZeroLit(t.Expr)
+		}
+	}
+	return false
+}
+
+// checkConst checks a constant expression, such as the initializer of a
+// static or const, and returns its value. Once consts have been replaced
+// with their values, it may only combine literals, so that its value is
+// known before the program runs. what names the expression in errors,
+// which point at token when they are not about an identifier in it.
+func (c *Checker) checkConst(what string, token Token, expr *NodeExpr) int64 {
+	c.checkExpr(expr)
+	if variable := firstIdent(expr); variable != nil {
+		panic(tokenDiagnostic(*variable, fmt.Sprintf("%s is not constant: %s on line %d", what, *variable.Value, variable.Line)))
+	}
+	value, err := evalConst(expr)
+	if err != nil {
+		panic(tokenDiagnostic(token, fmt.Sprintf("%s: %v on line %d", what, err, token.Line)))
+	}
+	return value
+}
+
+// checkType resolves a type written out in a declaration.
+func (c *Checker) checkType(nodeType *NodeType) *Type {
+	if nodeType.Elem == nil {
+		return typeI64
+	}
+	if !nodeType.IsArray() {
+		elem := c.checkType(nodeType.Elem)
+		if elem.Kind == TypeArray {
+			panic(tokenDiagnostic(nodeType.Elem.Token, fmt.Sprintf("Cannot point to an array, only to its elements, on line %d", nodeType.Elem.Token.Line)))
+		}
+		return pointerType(elem)
+	}
+	open := nodeType.Token
+	elem := c.checkType(nodeType.Elem)
+	if elem.Kind != TypeI64 {
+		panic(tokenDiagnostic(nodeType.Elem.Token, fmt.Sprintf("Array elements must be i64 on line %d", nodeType.Elem.Token.Line)))
+	}
+	length := c.checkConst("Array length", open, nodeType.Len)
+	if length < 1 || length > maxArrayLen {
+		panic(tokenDiagnostic(open, fmt.Sprintf("Array length out of range: %d on line %d", length, open.Line)))
+	}
+	return arrayType(elem, int(length))
+}
+
+// checkLet checks a `let` and returns the type of the variable it
+// declares, which is inferred from the initializer when not written out.
+func (c *Checker) checkLet(stmtLet *NodeStmtLet) *Type {
+	ident := stmtLet.Ident
+	var typ *Type
+	if stmtLet.Type != nil {
+		typ = c.checkType(stmtLet.Type)
+	}
+	if stmtLet.Expr != nil {
+		if typ == nil {
+			return c.checkExpr(stmtLet.Expr)
+		}
+		if typ.Kind == TypeArray {
+			panic(tokenDiagnostic(ident, fmt.Sprintf("Array %s must be initialized with an array literal on line %d", *ident.Value, ident.Line)))
+		}
+		checkStore(typ, c.checkExpr(stmtLet.Expr), stmtLet.Expr)
+		return typ
+	}
+	if arrayLit := stmtLet.Array; arrayLit != nil {
+		open := arrayLit.Open
+		if typ != nil && typ.Kind != TypeArray {
+			panic(tokenDiagnostic(open, fmt.Sprintf("Cannot initialize %s: %s with an array literal on line %d", *ident.Value, typ, open.Line)))
+		}
+		if len(arrayLit.Elems) == 0 {
+			panic(tokenDiagnostic(open, fmt.Sprintf("Empty array literal on line %d", open.Line)))
+		}
+		if typ != nil && typ.Len != len(arrayLit.Elems) {
+			panic(tokenDiagnostic(open, fmt.Sprintf("Array literal has %d elements, expected %d on line %d", len(arrayLit.Elems), typ.Len, open.Line)))
+		}
+		for _, elem := range arrayLit.Elems {
+			checkStore(typeI64, c.checkExpr(elem), elem)
+		}
+		if typ == nil {
+			typ = arrayType(typeI64, len(arrayLit.Elems))
+		}
+	}
+	return typ
+}
+
+// checkScalarType checks that the type a static or const is declared
+// with, if any, is i64.
+func (c *Checker) checkScalarType(ident Token, nodeType *NodeType) {
+	if nodeType != nil && c.checkType(nodeType).Kind != TypeI64 {
+		panic(tokenDiagnostic(nodeType.Token, fmt.Sprintf("%s must be an i64 on line %d", *ident.Value, nodeType.Token.Line)))
+	}
+}
+
+// firstIdent returns the first identifier expr reads, or nil.
+func firstIdent(expr *NodeExpr) *Token {
+	switch v := expr.Var.(type) {
+	case *NodeTerm:
+		switch t := v.Var.(type) {
+		case *NodeTermIdent:
+			return &t.Ident
+		case *NodeTermIndex:
+			return &t.Ident
+		case *NodeTermAddr:
+			return &t.Ident
+		case *NodeTermParen:
+			return firstIdent(t.Expr)
+		case *NodeTermBitNot:
+			return firstIdent(t.Expr)
+		case *NodeTermDeref:
+			return firstIdent(t.Expr)
+		}
+	case *NodeBinExpr:
+		lhs, rhs := binOperands(v)
+		if ident := firstIdent(lhs); ident != nil {
+			return ident
+		}
+		return firstIdent(rhs)
+	}
+	return nil
+}
+
+// firstToken returns the token an expression starts with, or for one in
+// parentheses, the token inside them.
+func firstToken(expr *NodeExpr) Token {
+	switch v := expr.Var.(type) {
+	case *NodeTerm:
+		switch t := v.Var.(type) {
+		case *NodeTermIntLit:
+			return t.IntLit
+		case *NodeTermIdent:
+			return t.Ident
+		case *NodeTermIndex:
+			return t.Ident
+		case *NodeTermAddr:
+			return t.Amp
+		case *NodeTermDeref:
+			return t.Star
+		case *NodeTermParen:
+			return firstToken(t.Expr)
+		case *NodeTermBitNot:
+			return firstToken(t.Expr)
+		}
+	case *NodeBinExpr:
+		lhs, _ := binOperands(v)
+		return firstToken(lhs)
+	}
+	panic("Unreachable")
+}
+
+func (c *Checker) checkStatic(stmtStatic *NodeStmtStatic) {
+	ident := stmtStatic.Ident
+	if len(c.scopes) > 0 {
+		panic(tokenDiagnostic(ident, fmt.Sprintf("`static` outside of the top level on line %d", ident.Line)))
+	}
+	c.checkScalarType(ident, stmtStatic.Type)
+	if stmtStatic.Expr != nil {
+		c.checkConst("Initializer of "+*ident.Value, ident, stmtStatic.Expr)
+	}
+	symbol := c.declare(ident)
+	symbol.Mutable = true
+	symbol.Static = true
+}
+
+func (c *Checker) checkConstStmt(stmtConst *NodeStmtConst) {
+	c.checkScalarType(stmtConst.Ident, stmtConst.Type)
+	value := c.checkConst("Initializer of "+*stmtConst.Ident.Value, stmtConst.Ident, stmtConst.Expr)
+	symbol := c.declare(stmtConst.Ident)
+	symbol.Const = true
+	symbol.Value = value
+}
+
+func (c *Checker) checkScope(scope *NodeScope) {
+	c.beginScope()
+	for _, stmt := range scope.Stmts {
+		c.checkStmt(stmt)
+	}
+	c.endScope()
+}
+
+// checkMatch warns about patterns that an earlier arm already matches,
+// since their arm can never run for them, and about a missing `_` arm.
+func (c *Checker) checkMatch(stmtMatch *NodeStmtMatch) {
+	c.checkI64("the value of a `match`", stmtMatch.Expr)
+	seen := make(map[int64]bool)
+	hasDefault := false
+	for _, arm := range stmtMatch.Arms {
+		for _, pattern := range arm.Patterns {
+			if pattern.Type == TokenUnderscore {
+				if hasDefault {
+					c.warn(pattern, fmt.Sprintf("duplicate `_` arm on line %d", pattern.Line))
+				}
+				hasDefault = true
+				continue
+			}
+			if seen[pattern.Int] {
+				c.warn(pattern, fmt.Sprintf("duplicate pattern `%s` on line %d", pattern.Text(), pattern.Line))
+			}
+			seen[pattern.Int] = true
+		}
+		c.checkScope(arm.Scope)
+	}
+	if !hasDefault {
+		c.warn(stmtMatch.Match, fmt.Sprintf("`match` has no `_` arm on line %d", stmtMatch.Match.Line))
+	}
+}
+
+func (c *Checker) beginScope() {
+	c.scopes = append(c.scopes, len(c.vars))
+}
+
+func (c *Checker) endScope() {
+	c.vars = c.vars[:c.scopes[len(c.scopes)-1]]
+	c.scopes = c.scopes[:len(c.scopes)-1]
+}
+
+// checkFor checks a loop, whose Init declares its variable in a scope of
+// its own around the rest of the loop.
+func (c *Checker) checkFor(stmtFor *NodeStmtFor) {
+	c.beginScope()
+	if stmtFor.Init != nil {
+		c.checkStmt(stmtFor.Init)
+	}
+	if stmtFor.Cond != nil {
+		c.checkCond(stmtFor.Cond)
+	}
+	c.loops++
+	c.checkScope(stmtFor.Scope)
+	c.loops--
+	if stmtFor.Step != nil {
+		c.checkStmt(stmtFor.Step)
+	}
+	c.endScope()
+}
+
+func (c *Checker) checkIfPred(pred *NodeIfPred) {
+	switch v := pred.Var.(type) {
+	case *NodeIfPredElif:
+		c.checkCond(v.Expr)
+		c.checkScope(v.Scope)
+		if v.Pred != nil {
+			c.checkIfPred(v.Pred)
+		}
+	case *NodeIfPredElse:
+		c.checkScope(v.Scope)
+	}
+}
+
+func (c *Checker) checkStmt(stmt *NodeStmt) {
+	switch v := stmt.Var.(type) {
+	case *NodeStmtExit:
+		c.checkI64("an exit code", v.Expr)
+	case *NodeStmtLet:
+		typ := c.checkLet(v)
+		symbol := c.declare(v.Ident)
+		symbol.Mutable = v.Mut
+		symbol.Type = typ
+		symbol.Let = v
+		v.VarType = typ
+	case *NodeStmtAssign:
+		// The value is checked first, as it is evaluated first
+		typ := c.checkExpr(v.Expr)
+		checkStore(c.checkAssign(v.Ident, v.Index, v.Deref), typ, v.Expr)
+	case *NodeStmtUpdate:
+		what := fmt.Sprintf("an operand of `%s`", v.Op.Text())
+		c.checkI64(what, v.Expr)
+		if typ := c.checkAssign(v.Ident, v.Index, v.Deref); typ.Kind != TypeI64 {
+			panic(tokenDiagnostic(v.Op, fmt.Sprintf("Cannot use %s as %s on line %d", typ, what, v.Op.Line)))
+		}
+	case *NodeScope:
+		c.checkScope(v)
+	case *NodeStmtIf:
+		c.checkCond(v.Expr)
+		c.checkScope(v.Scope)
+		if v.Pred != nil {
+			c.checkIfPred(v.Pred)
+		}
+	case *NodeStmtFor:
+		c.checkFor(v)
+	case *NodeStmtMatch:
+		c.checkMatch(v)
+	case *NodeStmtStatic:
+		c.checkStatic(v)
+	case *NodeStmtConst:
+		c.checkConstStmt(v)
+	case *NodeStmtBreak:
+		if c.loops == 0 {
+			panic(tokenDiagnostic(v.Token, fmt.Sprintf("`break` outside of a loop on line %d", v.Token.Line)))
+		}
+	case *NodeStmtContinue:
+		if c.loops == 0 {
+			panic(tokenDiagnostic(v.Token, fmt.Sprintf("`continue` outside of a loop on line %d", v.Token.Line)))
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// checkError parses src and returns the Diagnostic the checker rejects it
+// with.
+func checkError(t *testing.T, src string) Diagnostic {
+	t.Helper()
+	prog, err := NewStreamParser(NewTokenizer(src)).ParseProg()
+	if err != nil {
+		t.Fatalf("%q: %v", src, err)
+	}
+	err = NewChecker().Check(prog)
+	var diag Diagnostic
+	if !errors.As(err, &diag) {
+		t.Fatalf("%q: got %v, want a Diagnostic", src, err)
+	}
+	return diag
+}
+
+func TestCheckerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+		line int
+	}{
+		{"assign immutable", "let x = 1;\nx = 2;\nexit(x);", "Cannot assign to immutable variable: x on line 2, declared on line 1", 2},
+		{"update immutable", "let x = 1;\nx += 2;\nexit(x);", "Cannot assign to immutable variable: x on line 2, declared on line 1", 2},
+		{"assign immutable element", "let a = [1, 2];\na[0] = 2;\nexit(0);", "Cannot assign to immutable variable: a on line 2, declared on line 1", 2},
+		{"assign constant", "const N = 3;\nN = 4;\nexit(N);", "Cannot assign to constant: N on line 2, declared on line 1", 2},
+		{"variable in const", "let mut x = 1;\nconst N = x;\nexit(N);", "Initializer of N is not constant: x on line 2", 2},
+		{"const divides by zero", "const N = 1 / 0;\nexit(N);", "Initializer of N: division by zero or overflow on line 1", 1},
+		{"variable in static", "let mut x = 1;\nstatic s = x + 1;\nexit(s);", "Initializer of s is not constant: x on line 2", 2},
+		{"empty array", "let a: [i64; 0];\nexit(0);", "Array length out of range: 0 on line 1", 1},
+		{"negative array length", "let a: [i64; 0 - 1];\nexit(0);", "Array length out of range: -1 on line 1", 1},
+		{"array copied", "let a = [1, 2];\nlet b = a;\nexit(0);", "Array used as a value: a on line 2", 2},
+		{"array as operand", "let a = [1, 2];\nexit(a + 1);", "Array used as a value: a on line 2", 2},
+		{"pointer added", "let mut x = 1;\nlet p = &x;\nexit(p + 1);", "Cannot use *i64 as an operand of `+` on line 3", 3},
+		{"pointer multiplied", "let mut x = 1;\nlet p = &x;\nexit(p * 2);", "Cannot use *i64 as an operand of `*` on line 3", 3},
+		{"address of immutable", "let x = 1;\nlet p = &x;\nexit(0);", "Cannot take the address of immutable variable: x on line 2, declared on line 1", 2},
+		{"address of static", "static s = 1;\nlet p = &s;\nexit(0);", "Cannot take the address of static: s on line 2", 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diag := checkError(t, test.src)
+			if diag.Message != test.want || diag.Line != test.line {
+				t.Errorf("got %q on line %d, want %q on line %d", diag.Message, diag.Line, test.want, test.line)
+			}
+		})
+	}
+}
+
+func TestCheckerRelated(t *testing.T) {
+	diag := checkError(t, "let x = 1;\n  x = 2;\nexit(x);")
+	want := Diagnostic{
+		Line:    2,
+		Col:     3,
+		Len:     1,
+		Message: "Cannot assign to immutable variable: x on line 2, declared on line 1",
+		Related: []Diagnostic{{Line: 1, Col: 5, Len: 1, Message: "x declared here"}},
+	}
+	if !reflect.DeepEqual(diag, want) {
+		t.Errorf("got %+v, want %+v", diag, want)
+	}
+}
+
+func TestCheckerWarnings(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"exhaustive", "match (1) {\n    1 => { }\n    _ => { }\n}\nexit(0);", nil},
+		{"duplicate pattern", "match (1) {\n    1 => { }\n    1 => { }\n    _ => { }\n}\nexit(0);", []string{"[Warning] duplicate pattern `1` on line 3"}},
+		{"duplicate alternative", "match (1) {\n    1 | 2 => { }\n    2 => { }\n    _ => { }\n}\nexit(0);", []string{"[Warning] duplicate pattern `2` on line 3"}},
+		{"duplicate default", "match (1) {\n    _ => { }\n    _ => { }\n}\nexit(0);", []string{"[Warning] duplicate `_` arm on line 3"}},
+		{"no default", "match (1) {\n    1 => { }\n}\nexit(0);", []string{"[Warning] `match` has no `_` arm on line 1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prog, err := NewStreamParser(NewTokenizer(test.src)).ParseProg()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checker := NewChecker()
+			if err := checker.Check(prog); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, warning := range checker.Warnings {
+				got = append(got, warning.Message)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
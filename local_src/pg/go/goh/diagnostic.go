@@ -0,0 +1,36 @@
+package main
+
+// Diagnostic is an error in the program being compiled. Message is the
+// complete text shown to the user; the position of the offending Len
+// bytes is kept separately for tools that need to place it in the source.
+// Related holds other places the message refers to, such as the
+// declaration behind an error at a use.
+type Diagnostic struct {
+	Line    int
+	Col     int
+	Len     int
+	Message string
+	Related []Diagnostic
+}
+
+// tokenDiagnostic returns a Diagnostic covering token.
+func tokenDiagnostic(token Token, message string) Diagnostic {
+	return Diagnostic{Line: token.Line, Col: token.Col, Len: token.Len(), Message: message}
+}
+
+func (d Diagnostic) Error() string {
+	return d.Message
+}
+
+// recoverDiagnostic stops a panic raised with a Diagnostic and stores it in
+// err. The tokenizer, parser and checker bail out this way from deep inside
+// a recursive descent; any other panic is a bug and keeps unwinding.
+func recoverDiagnostic(err *error) {
+	if r := recover(); r != nil {
+		diag, ok := r.(Diagnostic)
+		if !ok {
+			panic(r)
+		}
+		*err = diag
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect renders Instrs in the syntax of a particular x86-64 assembler.
+// Both dialects use Intel operand order, so only the spelling of
+// directives, memory operands and comments differs.
+type Dialect interface {
+	Prologue() string
+	Global(symbol string) string
+	Section(name string) string
+	Quad(value string) string
+	Space(bytes int) string
+	Ascii(text string) string
+	Addr(o Operand) string
+	Mem(o Operand) string
+	Comment(text string) string
+}
+
+type NasmDialect struct{}
+
+func (NasmDialect) Prologue() string {
+	return ""
+}
+
+func (NasmDialect) Global(symbol string) string {
+	return "global " + symbol
+}
+
+// Section starts a section aligned for the quads placed in it.
+func (NasmDialect) Section(name string) string {
+	return "section " + name + " align=8"
+}
+
+func (NasmDialect) Quad(value string) string {
+	return "dq " + value
+}
+
+func (NasmDialect) Space(bytes int) string {
+	return fmt.Sprintf("resb %d", bytes)
+}
+
+// Ascii uses a backquoted string, the only kind in which nasm expands
+// escapes.
+func (NasmDialect) Ascii(text string) string {
+	return "db `" + escapeAscii(text) + "`"
+}
+
+func (NasmDialect) Addr(o Operand) string {
+	if o.Reg == "rip" {
+		return "[rel " + o.Label + "]"
+	}
+	return "[" + memAddr(o) + "]"
+}
+
+func (d NasmDialect) Mem(o Operand) string {
+	return "QWORD " + d.Addr(o)
+}
+
+func (NasmDialect) Comment(text string) string {
+	return ";; " + text
+}
+
+// GasDialect targets GNU as in `.intel_syntax noprefix` mode.
+type GasDialect struct{}
+
+func (GasDialect) Prologue() string {
+	return ".intel_syntax noprefix\n"
+}
+
+func (GasDialect) Global(symbol string) string {
+	return ".globl " + symbol
+}
+
+func (GasDialect) Section(name string) string {
+	return ".section " + name + "\n    .balign 8"
+}
+
+func (GasDialect) Quad(value string) string {
+	return ".quad " + value
+}
+
+func (GasDialect) Space(bytes int) string {
+	return fmt.Sprintf(".zero %d", bytes)
+}
+
+func (GasDialect) Ascii(text string) string {
+	return `.ascii "` + escapeAscii(text) + `"`
+}
+
+func (GasDialect) Addr(o Operand) string {
+	if o.Reg == "rip" {
+		return "[rip + " + o.Label + "]"
+	}
+	return "[" + memAddr(o) + "]"
+}
+
+func (d GasDialect) Mem(o Operand) string {
+	return "QWORD PTR " + d.Addr(o)
+}
+
+func (GasDialect) Comment(text string) string {
+	return "# " + text
+}
+
+func DialectByName(name string) (Dialect, bool) {
+	switch name {
+	case "nasm":
+		return NasmDialect{}, true
+	case "gas":
+		return GasDialect{}, true
+	}
+	return nil, false
+}
+
+// escapeAscii escapes text for a string that both dialects read with C
+// escapes.
+func escapeAscii(text string) string {
+	var output strings.Builder
+	for _, c := range []byte(text) {
+		switch c {
+		case '\\', '"', '`':
+			output.WriteByte('\\')
+			output.WriteByte(c)
+		case '\n':
+			output.WriteString(`\n`)
+		default:
+			output.WriteByte(c)
+		}
+	}
+	return output.String()
+}
+
+// memAddr spells out [base + index*8 + disp], which both dialects share.
+func memAddr(o Operand) string {
+	if o.Index != "" {
+		return fmt.Sprintf("%s + %s*8 + %d", o.Reg, o.Index, o.Disp)
+	}
+	return fmt.Sprintf("%s + %d", o.Reg, o.Disp)
+}
+
+func FormatOperand(o Operand, dialect Dialect) string {
+	switch o.Kind {
+	case OperandReg:
+		return o.Reg
+	case OperandImm:
+		return fmt.Sprintf("%d", o.Imm)
+	case OperandMem:
+		return dialect.Mem(o)
+	case OperandLabel:
+		return o.Label
+	}
+	panic("invalid operand kind")
+}
+
+func FormatInstr(i Instr, dialect Dialect) string {
+	switch i.Op {
+	case OpGlobal:
+		return dialect.Global(i.Text)
+	case OpLabel:
+		return i.Text + ":"
+	case OpComment:
+		return "    " + dialect.Comment(i.Text)
+	case OpSection:
+		return dialect.Section(i.Text)
+	case OpQuad:
+		return "    " + dialect.Quad(FormatOperand(i.Args[0], dialect))
+	case OpSpace:
+		return "    " + dialect.Space(int(i.Args[0].Imm))
+	case OpAscii:
+		return "    " + dialect.Ascii(i.Text)
+	case OpLea:
+		// The address is computed, not loaded, so it takes no size
+		return "    lea " + i.Args[0].Reg + ", " + dialect.Addr(i.Args[1])
+	}
+	if len(i.Args) == 0 {
+		return "    " + i.Op.String()
+	}
+	args := make([]string, len(i.Args))
+	for n, arg := range i.Args {
+		args[n] = FormatOperand(arg, dialect)
+	}
+	return "    " + i.Op.String() + " " + strings.Join(args, ", ")
+}
+
+func FormatInstrs(instrs []Instr, dialect Dialect) string {
+	var output strings.Builder
+	output.WriteString(dialect.Prologue())
+	for _, instr := range instrs {
+		output.WriteString(FormatInstr(instr, dialect) + "\n")
+	}
+	return output.String()
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// x86RegNums maps register names onto their hardware encoding. Registers
+// r8-r15 need the REX extension bit for the top bit.
+var x86RegNums = map[string]int{
+	"rax": 0, "rcx": 1, "rdx": 2, "rbx": 3, "rsp": 4, "rbp": 5, "rsi": 6, "rdi": 7,
+	"r8": 8, "r9": 9, "r10": 10, "r11": 11, "r12": 12, "r13": 13, "r14": 14, "r15": 15,
+}
+
+// x86ShiftExts holds the /digit of the shift-by-cl form of each shift.
+var x86ShiftExts = map[Opcode]int{
+	OpShl: 4,
+	OpShr: 5,
+	OpSar: 7,
+}
+
+// x86AluOps holds the encodings of the two operand integer instructions:
+// the r/m, reg form, the reg, r/m form and the /digit of the imm form.
+var x86AluOps = map[Opcode]struct {
+	store byte
+	load  byte
+	ext   int
+}{
+	OpAdd: {0x01, 0x03, 0},
+	OpOr:  {0x09, 0x0b, 1},
+	OpAnd: {0x21, 0x23, 4},
+	OpSub: {0x29, 0x2b, 5},
+	OpXor: {0x31, 0x33, 6},
+	OpCmp: {0x39, 0x3b, 7},
+}
+
+// x86CondJumps holds the second opcode byte of the rel32 form of each
+// conditional jump.
+var x86CondJumps = map[Opcode]byte{
+	OpJz: 0x84,
+	OpJa: 0x87,
+	OpJg: 0x8f,
+}
+
+// x86SetConds holds the second opcode byte of each setcc.
+var x86SetConds = map[Opcode]byte{
+	OpSete:  0x94,
+	OpSetne: 0x95,
+	OpSetl:  0x9c,
+	OpSetge: 0x9d,
+	OpSetle: 0x9e,
+	OpSetg:  0x9f,
+}
+
+type labelFixup struct {
+	at    int // Offset of the rel32 field, or of the 8 byte slot of an OpQuad
+	end   int // Offset of the end of the instruction, which rel32 is relative to
+	label string
+}
+
+// encoderPageSize is the granularity of memory protection on x86-64.
+const encoderPageSize = 4096
+
+// Encoder assembles an instruction list into x86-64 machine code. Every
+// jump uses a rel32 displacement, so a single pass plus patching is enough.
+// The quads of a jump table hold absolute addresses, which Encode leaves
+// as offsets into the code for Relocate to finish once the code's address
+// is known. Writable sections start on a page of their own, so that the
+// code before them can be made read-only.
+type Encoder struct {
+	code      []byte
+	labels    map[string]int
+	fixups    []labelFixup
+	quads     []labelFixup
+	dataStart int
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{
+		code:      make([]byte, 0),
+		labels:    make(map[string]int),
+		fixups:    make([]labelFixup, 0),
+		quads:     make([]labelFixup, 0),
+		dataStart: -1,
+	}
+}
+
+// DataStart returns the offset of the first writable byte of the encoded
+// image, or its length if nothing in it is writable.
+func (e *Encoder) DataStart() int {
+	if e.dataStart < 0 {
+		return len(e.code)
+	}
+	return e.dataStart
+}
+
+// Encode returns the machine code for instrs. Globals and comments only
+// matter to an assembler and produce nothing.
+func (e *Encoder) Encode(instrs []Instr) ([]byte, error) {
+	for _, instr := range instrs {
+		pending := len(e.fixups)
+		if err := e.encodeInstr(instr); err != nil {
+			return nil, err
+		}
+		for i := pending; i < len(e.fixups); i++ {
+			e.fixups[i].end = len(e.code)
+		}
+	}
+	for _, fixup := range e.fixups {
+		target, ok := e.labels[fixup.label]
+		if !ok {
+			return nil, fmt.Errorf("undefined label: %s", fixup.label)
+		}
+		rel := int32(target - fixup.end)
+		binary.LittleEndian.PutUint32(e.code[fixup.at:], uint32(rel))
+	}
+	for _, quad := range e.quads {
+		target, ok := e.labels[quad.label]
+		if !ok {
+			return nil, fmt.Errorf("undefined label: %s", quad.label)
+		}
+		binary.LittleEndian.PutUint64(e.code[quad.at:], uint64(target))
+	}
+	return e.code, nil
+}
+
+// Relocate turns the offsets Encode left in the quads of image, a copy of
+// the code loaded at base, into addresses.
+func (e *Encoder) Relocate(image []byte, base uintptr) {
+	for _, quad := range e.quads {
+		offset := binary.LittleEndian.Uint64(image[quad.at:])
+		binary.LittleEndian.PutUint64(image[quad.at:], offset+uint64(base))
+	}
+}
+
+func (e *Encoder) encodeInstr(instr Instr) error {
+	args := instr.Args
+	switch instr.Op {
+	case OpGlobal, OpComment:
+		return nil
+	case OpLabel:
+		e.labels[instr.Text] = len(e.code)
+		return nil
+	case OpSection:
+		// Everything lives in one image, so a section only needs aligning
+		writable := instr.Text == ".data" || instr.Text == ".bss"
+		if writable && e.dataStart < 0 {
+			e.pad(encoderPageSize)
+			e.dataStart = len(e.code)
+		}
+		e.pad(8)
+		return nil
+	case OpQuad:
+		if args[0].Kind == OperandImm {
+			e.code = binary.LittleEndian.AppendUint64(e.code, uint64(args[0].Imm))
+			return nil
+		}
+		e.quads = append(e.quads, labelFixup{at: len(e.code), label: args[0].Label})
+		e.code = append(e.code, 0, 0, 0, 0, 0, 0, 0, 0)
+		return nil
+	case OpSpace:
+		e.code = append(e.code, make([]byte, args[0].Imm)...)
+		return nil
+	case OpAscii:
+		e.code = append(e.code, instr.Text...)
+		return nil
+	case OpMov:
+		dst, src := args[0], args[1]
+		switch {
+		case dst.Kind == OperandReg && src.Kind == OperandImm && !fitsImm32(src.Imm):
+			reg := x86RegNums[dst.Reg]
+			e.code = append(e.code, 0x48|byte(reg>>3), 0xb8+byte(reg&7))
+			e.code = binary.LittleEndian.AppendUint64(e.code, uint64(src.Imm))
+			return nil
+		case src.Kind == OperandImm && dst.Kind != OperandLabel:
+			e.modRM(true, []byte{0xc7}, 0, dst)
+			e.imm32(src.Imm)
+			return nil
+		case src.Kind == OperandReg && dst.Kind != OperandImm && dst.Kind != OperandLabel:
+			e.modRM(true, []byte{0x89}, x86RegNums[src.Reg], dst)
+			return nil
+		case dst.Kind == OperandReg && src.Kind == OperandMem:
+			e.modRM(true, []byte{0x8b}, x86RegNums[dst.Reg], src)
+			return nil
+		}
+	case OpMovzx:
+		// The byte registers share their numbers with the full ones
+		if src, ok := x86ByteRegs[args[1].Reg]; ok && args[0].Kind == OperandReg {
+			e.modRM(true, []byte{0x0f, 0xb6}, x86RegNums[args[0].Reg], Reg(src))
+			return nil
+		}
+	case OpPush:
+		switch arg := args[0]; arg.Kind {
+		case OperandReg:
+			e.shortReg(0x50, arg.Reg)
+			return nil
+		case OperandImm:
+			if arg.Imm >= -128 && arg.Imm <= 127 {
+				e.code = append(e.code, 0x6a, byte(arg.Imm))
+				return nil
+			}
+			if fitsImm32(arg.Imm) {
+				e.code = append(e.code, 0x68)
+				e.imm32(arg.Imm)
+				return nil
+			}
+		case OperandMem:
+			e.modRM(false, []byte{0xff}, 6, arg)
+			return nil
+		}
+	case OpPop:
+		switch arg := args[0]; arg.Kind {
+		case OperandReg:
+			e.shortReg(0x58, arg.Reg)
+			return nil
+		case OperandMem:
+			e.modRM(false, []byte{0x8f}, 0, arg)
+			return nil
+		}
+	case OpAdd, OpSub, OpAnd, OpOr, OpXor, OpCmp:
+		op := x86AluOps[instr.Op]
+		dst, src := args[0], args[1]
+		switch {
+		case src.Kind == OperandReg && (dst.Kind == OperandReg || dst.Kind == OperandMem):
+			e.modRM(true, []byte{op.store}, x86RegNums[src.Reg], dst)
+			return nil
+		case dst.Kind == OperandReg && src.Kind == OperandMem:
+			e.modRM(true, []byte{op.load}, x86RegNums[dst.Reg], src)
+			return nil
+		case src.Kind == OperandImm && src.Imm >= -128 && src.Imm <= 127:
+			e.modRM(true, []byte{0x83}, op.ext, dst)
+			e.code = append(e.code, byte(src.Imm))
+			return nil
+		case src.Kind == OperandImm && fitsImm32(src.Imm):
+			e.modRM(true, []byte{0x81}, op.ext, dst)
+			e.imm32(src.Imm)
+			return nil
+		}
+	case OpNot:
+		e.modRM(true, []byte{0xf7}, 2, args[0])
+		return nil
+	case OpShl, OpSar, OpShr:
+		if args[1] == Reg("cl") {
+			e.modRM(true, []byte{0xd3}, x86ShiftExts[instr.Op], args[0])
+			return nil
+		}
+	case OpLea:
+		if args[0].Kind == OperandReg && args[1].Kind == OperandMem {
+			e.modRM(true, []byte{0x8d}, x86RegNums[args[0].Reg], args[1])
+			return nil
+		}
+	case OpTest:
+		if args[1].Kind == OperandReg {
+			e.modRM(true, []byte{0x85}, x86RegNums[args[1].Reg], args[0])
+			return nil
+		}
+	case OpSete, OpSetne, OpSetl, OpSetle, OpSetg, OpSetge:
+		if dst, ok := x86ByteRegs[args[0].Reg]; ok {
+			e.code = append(e.code, 0x0f, x86SetConds[instr.Op], 0xc0|byte(x86RegNums[dst]))
+			return nil
+		}
+	case OpMul:
+		e.modRM(true, []byte{0xf7}, 4, args[0])
+		return nil
+	case OpIdiv:
+		e.modRM(true, []byte{0xf7}, 7, args[0])
+		return nil
+	case OpCqo:
+		e.code = append(e.code, 0x48, 0x99)
+		return nil
+	case OpJz, OpJa, OpJg:
+		e.code = append(e.code, 0x0f, x86CondJumps[instr.Op])
+		e.rel32(args[0].Label)
+		return nil
+	case OpJmp:
+		if args[0].Kind == OperandMem {
+			e.modRM(false, []byte{0xff}, 4, args[0])
+			return nil
+		}
+		e.code = append(e.code, 0xe9)
+		e.rel32(args[0].Label)
+		return nil
+	case OpRepStos:
+		e.code = append(e.code, 0xf3, 0x48, 0xab)
+		return nil
+	case OpSyscall:
+		e.code = append(e.code, 0x0f, 0x05)
+		return nil
+	case OpRet:
+		e.code = append(e.code, 0xc3)
+		return nil
+	}
+	return fmt.Errorf("cannot encode: %s", strings.TrimSpace(FormatInstr(instr, NasmDialect{})))
+}
+
+// modRM appends an instruction whose ModRM byte has reg (or an opcode
+// extension) in the reg field and addresses rm, which is either a register
+// or [base + index*8 + disp] or [rip + label]. An index, or rsp and r12
+// as a base, need a SIB byte, and rbp and r13 cannot be used without a
+// displacement.
+func (e *Encoder) modRM(wide bool, opcode []byte, reg int, rm Operand) {
+	rex := byte(0x40)
+	if wide {
+		rex |= 0x08
+	}
+	rex |= byte(reg>>3) << 2
+	base := x86RegNums[rm.Reg]
+	rex |= byte(base >> 3)
+	index := -1
+	if rm.Index != "" {
+		index = x86RegNums[rm.Index]
+		rex |= byte(index>>3) << 1
+	}
+	if rex != 0x40 {
+		e.code = append(e.code, rex)
+	}
+	e.code = append(e.code, opcode...)
+
+	regField := byte(reg&7) << 3
+	if rm.Kind == OperandReg {
+		e.code = append(e.code, 0xc0|regField|byte(base&7))
+		return
+	}
+	if rm.Reg == "rip" {
+		// Like a jump, the displacement is relative to the end of the
+		// instruction, which comes after any immediate
+		e.code = append(e.code, regField|0x05)
+		e.rel32(rm.Label)
+		return
+	}
+	var mod byte
+	switch {
+	case rm.Disp == 0 && base&7 != 5:
+		mod = 0x00
+	case rm.Disp >= -128 && rm.Disp <= 127:
+		mod = 0x40
+	default:
+		mod = 0x80
+	}
+	switch {
+	case index >= 0:
+		e.code = append(e.code, mod|regField|0x04, 0xc0|byte(index&7)<<3|byte(base&7))
+	case base&7 == 4:
+		e.code = append(e.code, mod|regField|0x04, 0x24)
+	default:
+		e.code = append(e.code, mod|regField|byte(base&7))
+	}
+	switch mod {
+	case 0x40:
+		e.code = append(e.code, byte(rm.Disp))
+	case 0x80:
+		e.imm32(int64(rm.Disp))
+	}
+}
+
+// shortReg appends the one byte push/pop form with the register in the
+// low bits of the opcode.
+func (e *Encoder) shortReg(opcode byte, reg string) {
+	num := x86RegNums[reg]
+	if num >= 8 {
+		e.code = append(e.code, 0x41)
+	}
+	e.code = append(e.code, opcode+byte(num&7))
+}
+
+// pad fills the code with int3 up to a multiple of align.
+func (e *Encoder) pad(align int) {
+	for len(e.code)%align != 0 {
+		e.code = append(e.code, 0xcc)
+	}
+}
+
+func (e *Encoder) imm32(value int64) {
+	e.code = binary.LittleEndian.AppendUint32(e.code, uint32(int32(value)))
+}
+
+func (e *Encoder) rel32(label string) {
+	e.fixups = append(e.fixups, labelFixup{at: len(e.code), label: label})
+	e.code = append(e.code, 0, 0, 0, 0)
+}
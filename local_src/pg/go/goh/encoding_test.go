@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// encode returns the machine code for instrs as spaced hex.
+func encode(t *testing.T, instrs ...Instr) string {
+	t.Helper()
+	code, err := NewEncoder().Encode(instrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spacedHex(code)
+}
+
+func spacedHex(code []byte) string {
+	var parts []string
+	for _, b := range code {
+		parts = append(parts, hex.EncodeToString([]byte{b}))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestEncodeInstr(t *testing.T) {
+	tests := []struct {
+		instr Instr
+		want  string
+	}{
+		{instr(OpMov, Reg("rax"), Imm(60)), "48 c7 c0 3c 00 00 00"},
+		{instr(OpMov, Reg("rax"), Imm(0x123456789)), "48 b8 89 67 45 23 01 00 00 00"},
+		{instr(OpMov, Reg("r13"), Reg("rsp")), "49 89 e5"},
+		{instr(OpMov, Mem("rsp", 8), Reg("rax")), "48 89 44 24 08"},
+		{instr(OpMov, Reg("rax"), Mem("rbp", 0)), "48 8b 45 00"},
+		{instr(OpMov, Reg("rax"), Mem("r13", 0)), "49 8b 45 00"},
+		{instr(OpMov, Reg("rcx"), Operand{Kind: OperandMem, Reg: "rsp", Index: "rax", Disp: 16}), "48 8b 4c c4 10"},
+		{instr(OpMov, Mem("rsp", 512), Imm(7)), "48 c7 84 24 00 02 00 00 07 00 00 00"},
+		{instr(OpMovzx, Reg("rax"), Reg("al")), "48 0f b6 c0"},
+		{instr(OpPush, Reg("rax")), "50"},
+		{instr(OpPush, Reg("r13")), "41 55"},
+		{instr(OpPush, Imm(5)), "6a 05"},
+		{instr(OpPush, Imm(1000)), "68 e8 03 00 00"},
+		{instr(OpPush, Mem("rsp", 8)), "ff 74 24 08"},
+		{instr(OpPop, Reg("rbx")), "5b"},
+		{instr(OpPop, Mem("rbx", 0)), "8f 03"},
+		{instr(OpAdd, Reg("rax"), Reg("rbx")), "48 01 d8"},
+		{instr(OpSub, Reg("rsp"), Imm(8)), "48 83 ec 08"},
+		{instr(OpAnd, Reg("rax"), Imm(1000)), "48 81 e0 e8 03 00 00"},
+		{instr(OpCmp, Reg("rax"), Mem("rsp", 0)), "48 3b 04 24"},
+		{instr(OpNot, Reg("rax")), "48 f7 d0"},
+		{instr(OpShl, Reg("rax"), Reg("cl")), "48 d3 e0"},
+		{instr(OpSar, Reg("rax"), Reg("cl")), "48 d3 f8"},
+		{instr(OpShr, Reg("rax"), Reg("cl")), "48 d3 e8"},
+		{instr(OpLea, Reg("rax"), Mem("rsp", 16)), "48 8d 44 24 10"},
+		{instr(OpTest, Reg("rax"), Reg("rax")), "48 85 c0"},
+		{instr(OpSete, Reg("al")), "0f 94 c0"},
+		{instr(OpSetl, Reg("cl")), "0f 9c c1"},
+		{instr(OpMul, Reg("rbx")), "48 f7 e3"},
+		{instr(OpIdiv, Reg("rbx")), "48 f7 fb"},
+		{instr(OpCqo), "48 99"},
+		{instr(OpRepStos), "f3 48 ab"},
+		{instr(OpSyscall), "0f 05"},
+		{instr(OpRet), "c3"},
+	}
+	for _, test := range tests {
+		if got := encode(t, test.instr); got != test.want {
+			t.Errorf("%s: got %s, want %s", FormatInstr(test.instr, GasDialect{}), got, test.want)
+		}
+	}
+}
+
+func TestEncodeLabels(t *testing.T) {
+	label := func(name string) Instr { return Instr{Op: OpLabel, Text: name} }
+	tests := []struct {
+		name   string
+		instrs []Instr
+		want   string
+	}{
+		{
+			"forward jump",
+			[]Instr{instr(OpJmp, LabelRef("end")), instr(OpRet), label("end")},
+			"e9 01 00 00 00 c3",
+		},
+		{
+			"backward conditional jump",
+			[]Instr{label("top"), instr(OpRet), instr(OpJz, LabelRef("top"))},
+			"c3 0f 84 f9 ff ff ff",
+		},
+		{
+			// The displacement is relative to the end of the instruction,
+			// after its immediate
+			"rip relative store",
+			[]Instr{instr(OpMov, RipRel("x"), Imm(1)), instr(OpRet), label("x")},
+			"48 c7 05 01 00 00 00 01 00 00 00 c3",
+		},
+		{
+			"comments and globals",
+			[]Instr{{Op: OpGlobal, Text: "_start"}, {Op: OpComment, Text: "exit"}, instr(OpRet)},
+			"c3",
+		},
+	}
+	for _, test := range tests {
+		if got := encode(t, test.instrs...); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEncodeSections(t *testing.T) {
+	encoder := NewEncoder()
+	code, err := encoder.Encode([]Instr{
+		{Op: OpLabel, Text: "label0"},
+		instr(OpLea, Reg("rbx"), RipRel("table")),
+		instr(OpJmp, MemIndex("rbx", "rax")),
+		{Op: OpSection, Text: ".rodata"},
+		{Op: OpLabel, Text: "table"},
+		instr(OpQuad, LabelRef("label0")),
+		{Op: OpSection, Text: ".data"},
+		instr(OpQuad, Imm(-1)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "48 8d 1d 09 00 00 00 ff 24 c3 cc cc cc cc cc cc"; spacedHex(code[:16]) != want {
+		t.Errorf("code: got %s, want %s", spacedHex(code[:16]), want)
+	}
+	if got := encoder.DataStart(); got != encoderPageSize {
+		t.Fatalf("data starts at %d, want %d", got, encoderPageSize)
+	}
+	if got := binary.LittleEndian.Uint64(code[encoderPageSize:]); got != 1<<64-1 {
+		t.Errorf("data: got %#x", got)
+	}
+	encoder.Relocate(code, 0x10000)
+	if got := binary.LittleEndian.Uint64(code[16:]); got != 0x10000 {
+		t.Errorf("relocated quad: got %#x, want 0x10000", got)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		instr Instr
+		want  string
+	}{
+		{instr(OpJmp, LabelRef("nowhere")), "undefined label: nowhere"},
+		{instr(OpShl, Reg("rax"), Imm(3)), "cannot encode: shl rax, 3"},
+		{instr(OpPush, Imm(1<<40)), "cannot encode: push 1099511627776"},
+	}
+	for _, test := range tests {
+		_, err := NewEncoder().Encode([]Instr{test.instr})
+		if err == nil || err.Error() != test.want {
+			t.Errorf("got error %v, want %q", err, test.want)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import "strings"
+
+// fmtIndent is one level of indentation inside a NodeScope.
+const fmtIndent = "    "
+
+// Formatter prints a parsed program back as canonical source. Comments
+// come from the trivia the tokenizer attached to each token; the parser's
+// spans say which tokens belong to which statement.
+type Formatter struct {
+	tokens     []Token
+	parser     *Parser
+	output     strings.Builder
+	indent     int
+	blockStart bool // Nothing printed yet in the current block
+}
+
+// Format returns src in canonical form, or the first diagnostic that stops
+// it from parsing.
+func Format(src string) (string, error) {
+	tokenizer := NewTokenizer(src)
+	tokenizer.KeepTrivia = true
+	parser := NewStreamParser(tokenizer)
+	parser.KeepTokens = true
+	prog, err := parser.ParseProg()
+	if err != nil {
+		return "", err
+	}
+
+	f := &Formatter{
+		tokens:     parser.tokens,
+		parser:     parser,
+		indent:     0,
+		blockStart: true,
+	}
+	for _, stmt := range prog.Stmts {
+		f.formatStmt(stmt)
+	}
+	f.leading(tokenizer.EOFTrivia, f.newlinesAfter(len(f.tokens)-1))
+	return f.output.String(), nil
+}
+
+func (f *Formatter) formatStmt(stmt *NodeStmt) {
+	span := f.parser.stmtSpans[stmt]
+	if f.leading(f.tokens[span.first].Leading, f.newlinesAfter(span.first-1)) >= 2 {
+		f.blank()
+	}
+
+	switch v := stmt.Var.(type) {
+	case *NodeStmtExit:
+		f.line("exit(" + formatExpr(v.Expr) + ");" + f.inner(span.first, span.last) + f.trailing(span.last))
+	case *NodeStmtLet, *NodeStmtAssign, *NodeStmtUpdate:
+		f.line(formatSimpleStmt(stmt) + ";" + f.inner(span.first, span.last) + f.trailing(span.last))
+	case *NodeStmtStatic:
+		f.line(formatStatic(v) + ";" + f.inner(span.first, span.last) + f.trailing(span.last))
+	case *NodeStmtConst:
+		f.line(formatConst(v) + ";" + f.inner(span.first, span.last) + f.trailing(span.last))
+	case *NodeStmtBreak:
+		f.line("break;" + f.inner(span.first, span.last) + f.trailing(span.last))
+	case *NodeStmtContinue:
+		f.line("continue;" + f.inner(span.first, span.last) + f.trailing(span.last))
+	case *NodeScope:
+		f.formatScope("{", v)
+		f.line("}" + f.trailing(span.last))
+	case *NodeStmtIf:
+		scopeSpan := f.parser.scopeSpans[v.Scope]
+		f.formatScope("if ("+formatExpr(v.Expr)+") {"+f.inner(span.first, scopeSpan.first), v.Scope)
+		close := scopeSpan.last
+		for pred := v.Pred; pred != nil; {
+			switch p := pred.Var.(type) {
+			case *NodeIfPredElif:
+				close = f.formatPred("} elif ("+formatExpr(p.Expr)+") {", close, p.Scope)
+				pred = p.Pred
+			case *NodeIfPredElse:
+				close = f.formatPred("} else {", close, p.Scope)
+				pred = nil
+			}
+		}
+		f.line("}" + f.trailing(close))
+	case *NodeStmtFor:
+		scopeSpan := f.parser.scopeSpans[v.Scope]
+		header := "for ("
+		if v.Init != nil {
+			header += formatSimpleStmt(v.Init)
+		}
+		header += ";"
+		if v.Cond != nil {
+			header += " " + formatExpr(v.Cond)
+		}
+		header += ";"
+		if v.Step != nil {
+			header += " " + formatSimpleStmt(v.Step)
+		}
+		f.formatScope(header+") {"+f.inner(span.first, scopeSpan.first), v.Scope)
+		f.line("}" + f.trailing(scopeSpan.last))
+	case *NodeStmtMatch:
+		f.formatMatch(v, span)
+	}
+}
+
+// formatMatch prints a `match` with one arm after another inside its
+// braces. Each arm starts right after the scope of the one before it.
+func (f *Formatter) formatMatch(stmtMatch *NodeStmtMatch, span tokenSpan) {
+	curly := span.first
+	for f.tokens[curly].Type != TokenOpenCurly {
+		curly++
+	}
+	f.line("match (" + formatExpr(stmtMatch.Expr) + ") {" + f.inner(span.first, curly) + f.trailing(curly))
+	f.indent++
+	f.blockStart = true
+	prev := curly
+	for _, arm := range stmtMatch.Arms {
+		scopeSpan := f.parser.scopeSpans[arm.Scope]
+		if f.leading(f.tokens[prev+1].Leading, f.newlinesAfter(prev)) >= 2 {
+			f.blank()
+		}
+		patterns := make([]string, len(arm.Patterns))
+		for i, pattern := range arm.Patterns {
+			patterns[i] = pattern.Text()
+		}
+		f.formatScope(strings.Join(patterns, " | ")+" => {"+f.inner(prev+1, scopeSpan.first), arm.Scope)
+		f.line("}" + f.trailing(scopeSpan.last))
+		prev = scopeSpan.last
+	}
+	f.leading(f.tokens[span.last].Leading, f.newlinesAfter(span.last-1))
+	f.indent--
+	f.line("}" + f.trailing(span.last))
+}
+
+// formatSimpleStmt prints a `let`, assignment or update without its `;`.
+func formatSimpleStmt(stmt *NodeStmt) string {
+	switch v := stmt.Var.(type) {
+	case *NodeStmtLet:
+		text := "let " + *v.Ident.Value
+		if v.Mut {
+			text = "let mut " + *v.Ident.Value
+		}
+		if v.Type != nil {
+			text += ": " + formatType(v.Type)
+		}
+		if v.Array != nil {
+			return text + " = " + formatArrayLit(v.Array)
+		}
+		if v.Expr != nil {
+			return text + " = " + formatExpr(v.Expr)
+		}
+		return text
+	case *NodeStmtAssign:
+		return formatTarget(v.Ident, v.Index, v.Deref) + " = " + formatExpr(v.Expr)
+	case *NodeStmtUpdate:
+		target := formatTarget(v.Ident, v.Index, v.Deref)
+		if v.Op.Type == TokenPlusPlus || v.Op.Type == TokenMinusMinus {
+			return target + v.Op.Text()
+		}
+		return target + " " + v.Op.Text() + " " + formatExpr(v.Expr)
+	}
+	panic("Unreachable")
+}
+
+// formatTarget prints the variable, array element or pointer an
+// assignment or update stores to.
+func formatTarget(ident Token, index *NodeExpr, deref *NodeTermDeref) string {
+	if deref != nil {
+		return "*" + newFmtExpr(deref.Expr).format(0)
+	}
+	if index != nil {
+		return *ident.Value + "[" + formatExpr(index) + "]"
+	}
+	return *ident.Value
+}
+
+func formatArrayLit(arrayLit *NodeArrayLit) string {
+	elems := make([]string, len(arrayLit.Elems))
+	for i, elem := range arrayLit.Elems {
+		elems[i] = formatExpr(elem)
+	}
+	return "[" + strings.Join(elems, ", ") + "]"
+}
+
+func formatType(nodeType *NodeType) string {
+	if nodeType.IsArray() {
+		return "[" + formatType(nodeType.Elem) + "; " + formatExpr(nodeType.Len) + "]"
+	}
+	if nodeType.Elem != nil {
+		return "*" + formatType(nodeType.Elem)
+	}
+	return nodeType.Token.Text()
+}
+
+// formatStatic prints a `static` without its `;`.
+func formatStatic(stmtStatic *NodeStmtStatic) string {
+	text := "static " + *stmtStatic.Ident.Value
+	if stmtStatic.Type != nil {
+		text += ": " + formatType(stmtStatic.Type)
+	}
+	if stmtStatic.Expr != nil {
+		text += " = " + formatExpr(stmtStatic.Expr)
+	}
+	return text
+}
+
+// formatConst prints a `const` without its `;`.
+func formatConst(stmtConst *NodeStmtConst) string {
+	text := "const " + *stmtConst.Ident.Value
+	if stmtConst.Type != nil {
+		text += ": " + formatType(stmtConst.Type)
+	}
+	return text + " = " + formatExpr(stmtConst.Expr)
+}
+
+// formatScope prints header, which ends in the scope's `{`, and the scope's
+// body, leaving the closing brace to the caller.
+func (f *Formatter) formatScope(header string, scope *NodeScope) {
+	span := f.parser.scopeSpans[scope]
+	f.line(header + f.trailing(span.first))
+	f.indent++
+	f.blockStart = true
+	for _, stmt := range scope.Stmts {
+		f.formatStmt(stmt)
+	}
+	f.leading(f.tokens[span.last].Leading, f.newlinesAfter(span.last-1))
+	f.indent--
+}
+
+// formatPred prints an elif or else arm following the scope closed by the
+// token at close, and returns the index of its own closing brace. Comments
+// after that brace stay on its line, which the arm's header shares.
+func (f *Formatter) formatPred(header string, close int, scope *NodeScope) int {
+	span := f.parser.scopeSpans[scope]
+	f.formatScope(header+f.inner(close, span.first), scope)
+	return span.last
+}
+
+// leading prints the comments in trivia on lines of their own, keeping a
+// single blank line wherever the source had one. newlines is the number of
+// line breaks already seen before trivia starts; leading returns the count
+// after its last comment.
+func (f *Formatter) leading(trivia []Trivia, newlines int) int {
+	for _, t := range trivia {
+		switch t.Kind {
+		case TriviaNewline:
+			newlines++
+		case TriviaComment:
+			if newlines >= 2 {
+				f.blank()
+			}
+			f.line(t.Text)
+			newlines = 0
+		}
+	}
+	return newlines
+}
+
+// inner returns the comments found inside the tokens first to last, in
+// order. The tokens all go on one line, so the comments stay on the line of
+// the token they follow by going at its end, ahead of the trailing comments
+// of last.
+func (f *Formatter) inner(first int, last int) string {
+	var text string
+	for k := first; k <= last; k++ {
+		for _, t := range f.tokens[k].Leading {
+			if t.Kind == TriviaComment && k != first {
+				text += " " + t.Text
+			}
+		}
+		if k != last {
+			text += f.trailing(k)
+		}
+	}
+	return text
+}
+
+// trailing returns the comments after the token at index on its line.
+func (f *Formatter) trailing(index int) string {
+	var text string
+	for _, t := range f.tokens[index].Trailing {
+		if t.Kind == TriviaComment {
+			text += " " + t.Text
+		}
+	}
+	return text
+}
+
+// newlinesAfter counts the line breaks in a token's Trailing trivia.
+func (f *Formatter) newlinesAfter(index int) int {
+	if index < 0 {
+		return 0
+	}
+	count := 0
+	for _, t := range f.tokens[index].Trailing {
+		if t.Kind == TriviaNewline {
+			count++
+		}
+	}
+	return count
+}
+
+func (f *Formatter) line(text string) {
+	f.output.WriteString(strings.Repeat(fmtIndent, f.indent) + text + "\n")
+	f.blockStart = false
+}
+
+// blank separates what follows from what came before in the same block.
+func (f *Formatter) blank() {
+	if !f.blockStart {
+		f.output.WriteString("\n")
+		f.blockStart = true
+	}
+}
+
+// binExprOp returns the operator token of a binary expression.
+func binExprOp(binExpr *NodeBinExpr) TokenType {
+	switch binExpr.Var.(type) {
+	case *NodeBinExprAdd:
+		return TokenPlus
+	case *NodeBinExprSub:
+		return TokenMinus
+	case *NodeBinExprMulti:
+		return TokenStar
+	case *NodeBinExprDiv:
+		return TokenFslash
+	case *NodeBinExprMod:
+		return TokenPercent
+	case *NodeBinExprAnd:
+		return TokenAmp
+	case *NodeBinExprOr:
+		return TokenPipe
+	case *NodeBinExprXor:
+		return TokenCaret
+	case *NodeBinExprShl:
+		return TokenShl
+	case *NodeBinExprShr:
+		return TokenShr
+	case *NodeBinExprUshr:
+		return TokenUshr
+	case *NodeBinExprEq:
+		return TokenEqEq
+	case *NodeBinExprNe:
+		return TokenNe
+	case *NodeBinExprLt:
+		return TokenLt
+	case *NodeBinExprLe:
+		return TokenLe
+	case *NodeBinExprGt:
+		return TokenGt
+	case *NodeBinExprGe:
+		return TokenGe
+	}
+	panic("Unreachable")
+}
+
+// fmtExpr is an expression with its parentheses decided: paren is set only
+// where the source had parentheses that precedence requires.
+type fmtExpr struct {
+	leaf  string
+	op    TokenType
+	prec  int
+	lhs   *fmtExpr
+	rhs   *fmtExpr
+	paren bool
+}
+
+func newFmtExpr(expr *NodeExpr) *fmtExpr {
+	switch v := expr.Var.(type) {
+	case *NodeTerm:
+		switch t := v.Var.(type) {
+		case *NodeTermIntLit:
+			return &fmtExpr{leaf: *t.IntLit.Value}
+		case *NodeTermIdent:
+			return &fmtExpr{leaf: *t.Ident.Value}
+		case *NodeTermIndex:
+			return &fmtExpr{leaf: formatTarget(t.Ident, t.Index, nil)}
+		case *NodeTermAddr:
+			return &fmtExpr{leaf: "&" + formatTarget(t.Ident, t.Index, nil)}
+		case *NodeTermDeref:
+			return &fmtExpr{leaf: formatTarget(Token{}, nil, t)}
+		case *NodeTermParen:
+			inner := newFmtExpr(t.Expr)
+			if inner.lhs != nil {
+				inner.paren = true
+			}
+			return inner
+		case *NodeTermBitNot:
+			operand := newFmtExpr(t.Expr)
+			return &fmtExpr{leaf: "~" + operand.format(0)}
+		}
+	case *NodeBinExpr:
+		op := binExprOp(v)
+		prec, _ := BinPrec(op)
+		lhs, rhs := binOperands(v)
+		e := &fmtExpr{op: op, prec: prec, lhs: newFmtExpr(lhs), rhs: newFmtExpr(rhs)}
+		// Operators are left associative, so a parenthesized operand of
+		// the same precedence only needs its parentheses on the right
+		if e.lhs.paren && e.lhs.prec >= prec {
+			e.lhs.paren = false
+		}
+		if e.rhs.paren && e.rhs.prec > prec {
+			e.rhs.paren = false
+		}
+		return e
+	}
+	panic("Unreachable")
+}
+
+// formatExpr prints expr the way gofmt spaces Go expressions: operators
+// get spaces around them, except those of the highest precedence in an
+// expression that mixes precedences, which bind tightly as in `a + b*c`.
+func formatExpr(expr *NodeExpr) string {
+	e := newFmtExpr(expr)
+	e.paren = false
+	return e.formatGroup()
+}
+
+// formatGroup prints e and the operators below it up to the next
+// parentheses.
+func (e *fmtExpr) formatGroup() string {
+	minPrec, maxPrec := e.precRange()
+	tight := maxPrec + 1
+	if minPrec < maxPrec {
+		tight = maxPrec
+	}
+	return e.format(tight)
+}
+
+func (e *fmtExpr) precRange() (int, int) {
+	if e.lhs == nil || e.paren {
+		return e.prec, e.prec - 1
+	}
+	minPrec, maxPrec := e.prec, e.prec
+	for _, operand := range []*fmtExpr{e.lhs, e.rhs} {
+		lo, hi := operand.precRange()
+		if lo <= hi {
+			minPrec = min(minPrec, lo)
+			maxPrec = max(maxPrec, hi)
+		}
+	}
+	return minPrec, maxPrec
+}
+
+func (e *fmtExpr) format(tight int) string {
+	if e.lhs == nil {
+		return e.leaf
+	}
+	if e.paren {
+		inner := *e
+		inner.paren = false
+		return "(" + inner.formatGroup() + ")"
+	}
+	op := Token{Type: e.op}.Text()
+	// An operand that starts with `*` or `&` keeps the spaces, as `a/*p`
+	// would start a comment
+	if e.prec >= tight && !strings.HasPrefix(e.rhs.leaf, "*") && !strings.HasPrefix(e.rhs.leaf, "&") {
+		return e.lhs.format(tight) + op + e.rhs.format(tight)
+	}
+	return e.lhs.format(tight) + " " + op + " " + e.rhs.format(tight)
+}
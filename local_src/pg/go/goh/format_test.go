@@ -0,0 +1,101 @@
+package main
+
+import "testing"
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			"spacing",
+			"let  x=1+2*3;exit( x<<1 );",
+			"let x = 1 + 2*3;\nexit(x << 1);\n",
+		},
+		{
+			"parentheses",
+			"let x = (1 + 2) * (3);\nlet y = 1 - (2 - 3);\nlet z = (1 - 2) - 3;\nexit(x + y + z);",
+			"let x = (1 + 2) * 3;\nlet y = 1 - (2 - 3);\nlet z = 1 - 2 - 3;\nexit(x + y + z);\n",
+		},
+		{
+			"pointers",
+			"let mut a = 4;\nlet p = &a;\n*p = 1+a/ *p;\nexit(2*&a - *p);",
+			"let mut a = 4;\nlet p = &a;\n*p = 1 + a / *p;\nexit(2 * &a - *p);\n",
+		},
+		{
+			"comparisons",
+			"let n=3;\nfor (let mut i=0;i<n-1;i++) {}\nexit(1+1==2 & (n>=1)!=0);",
+			"let n = 3;\nfor (let mut i = 0; i < n-1; i++) {\n}\nexit(1+1 == 2 & n >= 1 != 0);\n",
+		},
+		{
+			"blocks",
+			"let mut x = 1;\nif (x) { x = 2; }\nelif (x - 1) { x = 3; }\nelse { x++; }\nfor (;;) { break; }\nexit(x);",
+			"let mut x = 1;\nif (x) {\n    x = 2;\n} elif (x - 1) {\n    x = 3;\n} else {\n    x++;\n}\nfor (;;) {\n    break;\n}\nexit(x);\n",
+		},
+		{
+			"declarations",
+			"static  s : i64 = 1;\nconst N = 2;\nlet a: [i64; N] = [1,2];\nexit(a[1] + s);",
+			"static s: i64 = 1;\nconst N = 2;\nlet a: [i64; N] = [1, 2];\nexit(a[1] + s);\n",
+		},
+		{
+			"match",
+			"match (1) { 1 | 2 => { exit(1); } _ => { exit(0); } }",
+			"match (1) {\n    1 | 2 => {\n        exit(1);\n    }\n    _ => {\n        exit(0);\n    }\n}\n",
+		},
+		{
+			"blank lines",
+			"let x = 1;\n\n\n\nexit(x);\n\n",
+			"let x = 1;\n\nexit(x);\n",
+		},
+		{
+			"comment lines",
+			"// head\n\n  // about x\nlet x = 1;\n{\n// inside\n}\nexit(x);\n// tail",
+			"// head\n\n// about x\nlet x = 1;\n{\n    // inside\n}\nexit(x);\n// tail\n",
+		},
+		{
+			"trailing comments",
+			"let x = 1;   // one\nif (x) { // two\n    exit(x); /* three */\n} // four\nexit(0); // five",
+			"let x = 1; // one\nif (x) { // two\n    exit(x); /* three */\n} // four\nexit(0); // five\n",
+		},
+		{
+			"comment after if before else",
+			"let mut x = 1;\nif (x) {\n    x = 2;\n} // after if\nelse { // else\n    x = 3;\n} // after else\nexit(x);",
+			"let mut x = 1;\nif (x) {\n    x = 2;\n} else { // after if // else\n    x = 3;\n} // after else\nexit(x);\n",
+		},
+		{
+			"comments inside a statement",
+			"let x = 1 /* one */ + 2; // three\nlet y = [1, // first\n    2];\nexit(x +\n    // last\n    y[0]);",
+			"let x = 1 + 2; /* one */ // three\nlet y = [1, 2]; // first\nexit(x + y[0]); // last\n",
+		},
+		{
+			"comments inside a header",
+			"for (let mut i = 0; /* cond */ 2 - i; i++) {\n}\nmatch (0) /* m */ {\n    _ /* arm */ => {\n    }\n}\nexit(0);",
+			"for (let mut i = 0; 2 - i; i++) { /* cond */\n}\nmatch (0) { /* m */\n    _ => { /* arm */\n    }\n}\nexit(0);\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Format(test.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Fatalf("got\n%s\nwant\n%s", got, test.want)
+			}
+			again, err := Format(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again != got {
+				t.Errorf("not idempotent, formatting again gives\n%s", again)
+			}
+		})
+	}
+}
+
+func TestFormatError(t *testing.T) {
+	if _, err := Format("exit(1"); err == nil {
+		t.Error("Format of a program that does not parse succeeded")
+	}
+}
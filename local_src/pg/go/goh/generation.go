@@ -2,25 +2,286 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 )
 
+// Var is a variable on the stack. An array occupies Len slots, with
+// element 0 in the one at StackLoc, which is the lowest address, and each
+// later element in the slot above; Len is 0 for any other variable.
 type Var struct {
 	Name     string
 	StackLoc int
+	Len      int
 }
 
+// Slots returns the number of 8-byte stack slots the variable occupies.
+func (v Var) Slots() int {
+	if v.Len > 0 {
+		return v.Len
+	}
+	return 1
+}
+
+// Static is a variable with a fixed address, placed in .data, or in .bss
+// when it starts at zero. Symbols are numbered rather than named after the
+// variable, which need not be a valid assembler symbol.
+type Static struct {
+	Name   string
+	Symbol string
+	Value  int64
+}
+
+// newStatic returns the Static for a declaration the Checker has accepted,
+// so its initializer is constant.
+func newStatic(stmtStatic *NodeStmtStatic, index int) Static {
+	static := Static{Name: *stmtStatic.Ident.Value, Symbol: "static" + strconv.Itoa(index)}
+	if stmtStatic.Expr != nil {
+		static.Value, _ = evalConst(stmtStatic.Expr)
+	}
+	return static
+}
+
+// lookupStatic returns the Static named name, or nil.
+func lookupStatic(statics []Static, name string) *Static {
+	for i := range statics {
+		if statics[i].Name == name {
+			return &statics[i]
+		}
+	}
+	return nil
+}
+
+// letLen returns the number of elements of the array a `let` the Checker
+// has accepted declares, or 0 if it declares an i64.
+func letLen(stmtLet *NodeStmtLet) int {
+	if stmtLet.Array != nil {
+		return len(stmtLet.Array.Elems)
+	}
+	if stmtLet.Type != nil && stmtLet.Type.IsArray() {
+		length, _ := evalConst(stmtLet.Type.Len)
+		return int(length)
+	}
+	return 0
+}
+
+// Exit statuses of a debug build that indexes outside of an array, or
+// dereferences a null pointer, after it prints the faultError.
+const (
+	exitBoundsFault = 101
+	exitNullFault   = 102
+)
+
+// exitDivFault is the exit status of a division by zero or of INT64_MIN by
+// -1: that of a process killed by the SIGFPE idiv raises, which backends
+// without a faulting division give by hand.
+const exitDivFault = 128 + 8
+
+// faultFree reports whether evaluating expr cannot fault: it is a literal,
+// a variable, or one of these in parentheses. Evaluating the other operand
+// of a binary operator before or after it stops on the same fault, if any.
+func faultFree(expr *NodeExpr) bool {
+	term, ok := expr.Var.(*NodeTerm)
+	if !ok {
+		return false
+	}
+	switch v := term.Var.(type) {
+	case *NodeTermIntLit, *NodeTermIdent:
+		return true
+	case *NodeTermParen:
+		return faultFree(v.Expr)
+	}
+	return false
+}
+
+// status returns the exit status of a debug build that faults with e.
+func (e *faultError) status() int {
+	if e.kind == faultNull {
+		return exitNullFault
+	}
+	return exitBoundsFault
+}
+
+// text returns what a debug build prints to stderr when it faults with e.
+func (e *faultError) text() string {
+	return e.Error() + "\n"
+}
+
+// faultTrap is the code a debug build jumps to when it detects Fault,
+// which prints the text at Message. Every generator makes a debug build
+// when its Debug field is set: each index into an array is checked against
+// the length of the array, and each pointer that is dereferenced against
+// null. Checks for the same fault on the same line share a trap.
+type faultTrap struct {
+	Label   string
+	Message string
+	Fault   faultError
+}
+
+// faultTrapLabel returns the label of the trap in traps for fault, adding
+// one named by createLabel if there is none yet.
+func faultTrapLabel(traps *[]faultTrap, fault faultError, createLabel func() string) string {
+	for _, trap := range *traps {
+		if trap.Fault == fault {
+			return trap.Label
+		}
+	}
+	trap := faultTrap{Label: createLabel(), Message: createLabel(), Fault: fault}
+	*traps = append(*traps, trap)
+	return trap.Label
+}
+
+// writeFaultMessages writes the messages of traps to a GNU assembler
+// .rodata section.
+func writeFaultMessages(output *strings.Builder, traps []faultTrap) {
+	if len(traps) == 0 {
+		return
+	}
+	output.WriteString(".section .rodata\n")
+	for _, trap := range traps {
+		output.WriteString(fmt.Sprintf("%s:\n    .ascii \"%s\"\n", trap.Message, escapeAscii(trap.Fault.text())))
+	}
+}
+
+// Loop is the jump targets of a loop being generated. StackSize is the
+// stack size at the top of the loop, which `break` and `continue` unwind
+// to before jumping.
+type Loop struct {
+	BreakLabel    string
+	ContinueLabel string
+	StackSize     int
+}
+
+// matchCase is a value a match dispatches on and the index of the arm it
+// selects.
+type matchCase struct {
+	Value int64
+	Arm   int
+}
+
+// matchCases returns the values a match dispatches on in ascending order,
+// each with the first arm that lists it, along with the index of the
+// default arm, or -1 if there is none.
+func matchCases(stmtMatch *NodeStmtMatch) ([]matchCase, int) {
+	cases := make([]matchCase, 0)
+	seen := make(map[int64]bool)
+	defaultArm := -1
+	for i, arm := range stmtMatch.Arms {
+		for _, pattern := range arm.Patterns {
+			if pattern.Type == TokenUnderscore {
+				if defaultArm < 0 {
+					defaultArm = i
+				}
+			} else if !seen[pattern.Int] {
+				seen[pattern.Int] = true
+				cases = append(cases, matchCase{Value: pattern.Int, Arm: i})
+			}
+		}
+	}
+	sort.Slice(cases, func(i, j int) bool { return cases[i].Value < cases[j].Value })
+	return cases, defaultArm
+}
+
+// denseCases reports whether cases fill enough of their range that a jump
+// table indexed by the value beats searching for it: at least four cases,
+// covering at least half of the table.
+func denseCases(cases []matchCase) bool {
+	if len(cases) < 4 {
+		return false
+	}
+	span := uint64(cases[len(cases)-1].Value) - uint64(cases[0].Value)
+	return span < uint64(2*len(cases))
+}
+
+// jumpTableEntries returns the label to jump to for each value from the
+// lowest case to the highest.
+func jumpTableEntries(cases []matchCase, armLabels []string, defaultLabel string) []string {
+	low := cases[0].Value
+	entries := make([]string, uint64(cases[len(cases)-1].Value)-uint64(low)+1)
+	for i := range entries {
+		entries[i] = defaultLabel
+	}
+	for _, c := range cases {
+		entries[uint64(c.Value)-uint64(low)] = armLabels[c.Arm]
+	}
+	return entries
+}
+
+// jumpTable is a table of arm addresses placed in .rodata after the code.
+type jumpTable struct {
+	Label   string
+	Entries []string
+}
+
+// writeJumpTables writes tables to a GNU assembler .rodata section.
+func writeJumpTables(output *strings.Builder, tables []jumpTable) {
+	if len(tables) == 0 {
+		return
+	}
+	output.WriteString(".section .rodata\n    .balign 8\n")
+	for _, table := range tables {
+		output.WriteString(table.Label + ":\n")
+		for _, entry := range table.Entries {
+			output.WriteString("    .quad " + entry + "\n")
+		}
+	}
+}
+
+// writeStatics writes statics to GNU assembler .data and .bss sections.
+func writeStatics(output *strings.Builder, statics []Static) {
+	var data, bss []Static
+	for _, static := range statics {
+		if static.Value != 0 {
+			data = append(data, static)
+		} else {
+			bss = append(bss, static)
+		}
+	}
+	if len(data) > 0 {
+		output.WriteString(".section .data\n    .balign 8\n")
+		for _, static := range data {
+			output.WriteString(fmt.Sprintf("%s:\n    .quad %d\n", static.Symbol, static.Value))
+		}
+	}
+	if len(bss) > 0 {
+		output.WriteString(".section .bss\n    .balign 8\n")
+		for _, static := range bss {
+			output.WriteString(static.Symbol + ":\n    .zero 8\n")
+		}
+	}
+}
+
+// Generator generates x86-64 code. When Debug is set, or for host code,
+// every index into an array is checked against its length, and every
+// pointer dereferenced against null.
 type Generator struct {
-	prog        NodeProg
-	output      strings.Builder
-	stackSize   int
-	vars        []Var
-	scopes      []int
-	labelCount  int
+	prog       NodeProg
+	instrs     []Instr
+	stackSize  int
+	vars       []Var
+	scopes     []int
+	loops      []Loop
+	tables     []jumpTable
+	statics    []Static
+	faultTraps []faultTrap
+	labelCount int
+	host       bool
+	trapLabel  string
+	Debug      bool
 }
 
+// Status codes host code hands back in rdx alongside the value in rax.
+// With hostStatusBoundsFault and hostStatusNullFault, rax holds the line
+// of the fault.
+const (
+	hostStatusExit        = 0
+	hostStatusDivFault    = 1
+	hostStatusBoundsFault = 2
+	hostStatusNullFault   = 3
+)
+
 func NewGenerator(prog NodeProg) *Generator {
 	return &Generator{
 		prog:       prog,
@@ -31,29 +292,77 @@ func NewGenerator(prog NodeProg) *Generator {
 	}
 }
 
+// NewHostGenerator returns a Generator for code that is called from inside
+// the compiler process rather than run as an executable. On entry r13
+// records the caller's stack pointer, and `exit` unwinds to it and returns
+// the exit value in rax with hostStatusExit in rdx. Faults would take down
+// the host along with the program, so divisions that would fault return
+// hostStatusDivFault instead of raising SIGFPE, and indices and pointers
+// are checked as in a debug build.
+func NewHostGenerator(prog NodeProg) *Generator {
+	generator := NewGenerator(prog)
+	generator.host = true
+	return generator
+}
+
 func (g *Generator) genTerm(term *NodeTerm) {
 	switch v := term.Var.(type) {
 	case *NodeTermIntLit:
-		g.output.WriteString("    mov rax, " + *v.IntLit.Value + "\n")
-		g.push("rax")
+		g.emit(OpMov, Reg("rax"), Imm(intLitValue(v.IntLit)))
+		g.push(Reg("rax"))
 	case *NodeTermIdent:
-		found := false
-		var stackLoc int
-		for _, variable := range g.vars {
-			if variable.Name == *v.Ident.Value {
-				stackLoc = variable.StackLoc
-				found = true
-				break
-			}
-		}
-		if !found {
-			fmt.Fprintf(os.Stderr, "Undeclared identifier: %s\n", *v.Ident.Value)
-			os.Exit(1)
+		g.push(g.varMem(*v.Ident.Value))
+	case *NodeTermIndex:
+		g.genIndex(v.Ident, v.Index, "rax")
+		g.push(g.elemMem(*v.Ident.Value, "rax"))
+	case *NodeTermAddr:
+		index := ""
+		if v.Index != nil {
+			index = "rax"
+			g.genIndex(v.Ident, v.Index, index)
 		}
-		offset := fmt.Sprintf("QWORD [rsp + %d]", (g.stackSize-stackLoc-1)*8)
-		g.push(offset)
+		g.emit(OpLea, Reg("rax"), g.elemMem(*v.Ident.Value, index))
+		g.push(Reg("rax"))
+	case *NodeTermDeref:
+		g.genPointer(v, "rax")
+		g.push(Mem("rax", 0))
 	case *NodeTermParen:
 		g.genExpr(v.Expr)
+	case *NodeTermBitNot:
+		g.genExpr(v.Expr)
+		g.pop(Reg("rax"))
+		g.emit(OpNot, Reg("rax"))
+		g.push(Reg("rax"))
+	}
+}
+
+// checked reports whether indices and pointers are checked at run time.
+func (g *Generator) checked() bool {
+	return g.Debug || g.host
+}
+
+// genIndex evaluates an index into the array ident names into reg. A checked
+// build compares it with the length of the array, as unsigned so that a
+// negative index is caught by the same compare.
+func (g *Generator) genIndex(ident Token, index *NodeExpr, reg string) {
+	g.genExpr(index)
+	g.pop(Reg(reg))
+	if g.checked() {
+		trap := faultTrapLabel(&g.faultTraps, faultError{kind: faultBounds, line: ident.Line}, g.createLabel)
+		g.emit(OpCmp, Reg(reg), Imm(int64(g.lookupVar(*ident.Value).Len-1)))
+		g.emit(OpJa, LabelRef(trap))
+	}
+}
+
+// genPointer evaluates the pointer deref dereferences into reg, which a
+// checked build tests is not null.
+func (g *Generator) genPointer(deref *NodeTermDeref, reg string) {
+	g.genExpr(deref.Expr)
+	g.pop(Reg(reg))
+	if g.checked() {
+		trap := faultTrapLabel(&g.faultTraps, faultError{kind: faultNull, line: deref.Star.Line}, g.createLabel)
+		g.emit(OpTest, Reg(reg), Reg(reg))
+		g.emit(OpJz, LabelRef(trap))
 	}
 }
 
@@ -62,34 +371,182 @@ func (g *Generator) genBinExpr(binExpr *NodeBinExpr) {
 	case *NodeBinExprSub:
 		g.genExpr(v.Rhs)
 		g.genExpr(v.Lhs)
-		g.pop("rax")
-		g.pop("rbx")
-		g.output.WriteString("    sub rax, rbx\n")
-		g.push("rax")
+		g.pop(Reg("rax"))
+		g.pop(Reg("rbx"))
+		g.emit(OpSub, Reg("rax"), Reg("rbx"))
+		g.push(Reg("rax"))
 	case *NodeBinExprAdd:
 		g.genExpr(v.Rhs)
 		g.genExpr(v.Lhs)
-		g.pop("rax")
-		g.pop("rbx")
-		g.output.WriteString("    add rax, rbx\n")
-		g.push("rax")
+		g.pop(Reg("rax"))
+		g.pop(Reg("rbx"))
+		g.emit(OpAdd, Reg("rax"), Reg("rbx"))
+		g.push(Reg("rax"))
 	case *NodeBinExprMulti:
 		g.genExpr(v.Rhs)
 		g.genExpr(v.Lhs)
-		g.pop("rax")
-		g.pop("rbx")
-		g.output.WriteString("    mul rbx\n")
-		g.push("rax")
+		g.pop(Reg("rax"))
+		g.pop(Reg("rbx"))
+		g.emit(OpMul, Reg("rbx"))
+		g.push(Reg("rax"))
 	case *NodeBinExprDiv:
 		g.genExpr(v.Rhs)
 		g.genExpr(v.Lhs)
-		g.pop("rax")
-		g.pop("rbx")
-		g.output.WriteString("    div rbx\n")
-		g.push("rax")
+		g.pop(Reg("rax"))
+		g.pop(Reg("rbx"))
+		if g.host {
+			g.genDivCheck()
+		}
+		g.emit(OpCqo)
+		g.emit(OpIdiv, Reg("rbx"))
+		g.push(Reg("rax"))
+	case *NodeBinExprMod:
+		g.genExpr(v.Rhs)
+		g.genExpr(v.Lhs)
+		g.pop(Reg("rax"))
+		g.pop(Reg("rbx"))
+		if g.host {
+			g.genDivCheck()
+		}
+		g.emit(OpCqo)
+		g.emit(OpIdiv, Reg("rbx"))
+		g.push(Reg("rdx"))
+	case *NodeBinExprAnd:
+		g.genBitwise(OpAnd, v.Lhs, v.Rhs)
+	case *NodeBinExprOr:
+		g.genBitwise(OpOr, v.Lhs, v.Rhs)
+	case *NodeBinExprXor:
+		g.genBitwise(OpXor, v.Lhs, v.Rhs)
+	case *NodeBinExprShl:
+		g.genShift(OpShl, v.Lhs, v.Rhs)
+	case *NodeBinExprShr:
+		g.genShift(OpSar, v.Lhs, v.Rhs)
+	case *NodeBinExprUshr:
+		g.genShift(OpShr, v.Lhs, v.Rhs)
+	case *NodeBinExprEq:
+		g.genComparison(OpSete, v.Lhs, v.Rhs)
+	case *NodeBinExprNe:
+		g.genComparison(OpSetne, v.Lhs, v.Rhs)
+	case *NodeBinExprLt:
+		g.genComparison(OpSetl, v.Lhs, v.Rhs)
+	case *NodeBinExprLe:
+		g.genComparison(OpSetle, v.Lhs, v.Rhs)
+	case *NodeBinExprGt:
+		g.genComparison(OpSetg, v.Lhs, v.Rhs)
+	case *NodeBinExprGe:
+		g.genComparison(OpSetge, v.Lhs, v.Rhs)
 	}
 }
 
+// x86Shifts maps each shift operator to its instruction.
+var x86Shifts = map[TokenType]Opcode{
+	TokenShl:  OpShl,
+	TokenShr:  OpSar,
+	TokenUshr: OpShr,
+}
+
+func (g *Generator) genBitwise(op Opcode, lhs *NodeExpr, rhs *NodeExpr) {
+	g.genExpr(rhs)
+	g.genExpr(lhs)
+	g.pop(Reg("rax"))
+	g.pop(Reg("rbx"))
+	g.emit(op, Reg("rax"), Reg("rbx"))
+	g.push(Reg("rax"))
+}
+
+// genShift shifts by cl, which x86 masks to the low six bits, matching the
+// other targets.
+func (g *Generator) genShift(op Opcode, lhs *NodeExpr, rhs *NodeExpr) {
+	g.genExpr(rhs)
+	g.genExpr(lhs)
+	g.pop(Reg("rax"))
+	g.pop(Reg("rcx"))
+	g.emit(op, Reg("rax"), Reg("cl"))
+	g.push(Reg("rax"))
+}
+
+// genComparison pushes 1 if lhs and rhs compare as the setcc op tests, and 0
+// otherwise.
+func (g *Generator) genComparison(op Opcode, lhs *NodeExpr, rhs *NodeExpr) {
+	g.genExpr(rhs)
+	g.genExpr(lhs)
+	g.pop(Reg("rax"))
+	g.pop(Reg("rbx"))
+	g.emit(OpCmp, Reg("rax"), Reg("rbx"))
+	g.emit(op, Reg("al"))
+	g.emit(OpMovzx, Reg("rax"), Reg("al"))
+	g.push(Reg("rax"))
+}
+
+// genUpdate applies an update to the variable's stack slot, that of the
+// element it indexes, whose index is kept in rdi, or what it points to,
+// which is kept in rdi. Addition, subtraction, the bitwise operators and
+// the shifts work on the slot directly; multiplication and division go
+// through rax, which mul and idiv need.
+func (g *Generator) genUpdate(update *NodeStmtUpdate) {
+	g.genExpr(update.Expr)
+	index := ""
+	if update.Deref != nil {
+		g.genPointer(update.Deref, "rdi")
+	} else if update.Index != nil {
+		index = "rdi"
+		g.genIndex(update.Ident, update.Index, index)
+	}
+	g.pop(Reg("rbx"))
+	slot := Mem("rdi", 0)
+	if update.Deref == nil {
+		slot = g.elemMem(*update.Ident.Value, index)
+	}
+	switch op := updateOp(update); op {
+	case TokenPlus:
+		g.emit(OpAdd, slot, Reg("rbx"))
+	case TokenMinus:
+		g.emit(OpSub, slot, Reg("rbx"))
+	case TokenAmp:
+		g.emit(OpAnd, slot, Reg("rbx"))
+	case TokenPipe:
+		g.emit(OpOr, slot, Reg("rbx"))
+	case TokenCaret:
+		g.emit(OpXor, slot, Reg("rbx"))
+	case TokenShl, TokenShr, TokenUshr:
+		g.emit(OpMov, Reg("rcx"), Reg("rbx"))
+		g.emit(x86Shifts[op], slot, Reg("cl"))
+	case TokenStar:
+		g.emit(OpMov, Reg("rax"), slot)
+		g.emit(OpMul, Reg("rbx"))
+		g.emit(OpMov, slot, Reg("rax"))
+	case TokenFslash, TokenPercent:
+		g.emit(OpMov, Reg("rax"), slot)
+		if g.host {
+			g.genDivCheck()
+		}
+		g.emit(OpCqo)
+		g.emit(OpIdiv, Reg("rbx"))
+		if op == TokenFslash {
+			g.emit(OpMov, slot, Reg("rax"))
+		} else {
+			g.emit(OpMov, slot, Reg("rdx"))
+		}
+	}
+}
+
+// genDivCheck leaves to the trap when rbx is zero, or when rax is INT64_MIN
+// and rbx is -1. The second case is tested without branching, since that
+// would need a label in the middle of an expression.
+func (g *Generator) genDivCheck() {
+	if g.trapLabel == "" {
+		g.trapLabel = g.createLabel()
+	}
+	g.emit(OpTest, Reg("rbx"), Reg("rbx"))
+	g.emit(OpJz, LabelRef(g.trapLabel))
+	g.emit(OpMov, Reg("rcx"), Reg("rbx"))
+	g.emit(OpAdd, Reg("rcx"), Imm(1))
+	g.emit(OpMov, Reg("rdx"), Imm(math.MinInt64))
+	g.emit(OpXor, Reg("rdx"), Reg("rax"))
+	g.emit(OpOr, Reg("rcx"), Reg("rdx"))
+	g.emit(OpJz, LabelRef(g.trapLabel))
+}
+
 func (g *Generator) genExpr(expr *NodeExpr) {
 	switch v := expr.Var.(type) {
 	case *NodeTerm:
@@ -110,20 +567,20 @@ func (g *Generator) genScope(scope *NodeScope) {
 func (g *Generator) genIfPred(pred *NodeIfPred, endLabel string) {
 	switch v := pred.Var.(type) {
 	case *NodeIfPredElif:
-		g.output.WriteString("    ;; elif\n")
+		g.comment("elif")
 		g.genExpr(v.Expr)
-		g.pop("rax")
+		g.pop(Reg("rax"))
 		label := g.createLabel()
-		g.output.WriteString("    test rax, rax\n")
-		g.output.WriteString("    jz " + label + "\n")
+		g.emit(OpTest, Reg("rax"), Reg("rax"))
+		g.emit(OpJz, LabelRef(label))
 		g.genScope(v.Scope)
-		g.output.WriteString("    jmp " + endLabel + "\n")
+		g.emit(OpJmp, LabelRef(endLabel))
+		g.label(label)
 		if v.Pred != nil {
-			g.output.WriteString(label + ":\n")
 			g.genIfPred(v.Pred, endLabel)
 		}
 	case *NodeIfPredElse:
-		g.output.WriteString("    ;; else\n")
+		g.comment("else")
 		g.genScope(v.Scope)
 	}
 }
@@ -131,101 +588,425 @@ func (g *Generator) genIfPred(pred *NodeIfPred, endLabel string) {
 func (g *Generator) genStmt(stmt *NodeStmt) {
 	switch v := stmt.Var.(type) {
 	case *NodeStmtExit:
-		g.output.WriteString("    ;; exit\n")
+		g.comment("exit")
 		g.genExpr(v.Expr)
-		g.output.WriteString("    mov rax, 60\n")
-		g.pop("rdi")
-		g.output.WriteString("    syscall\n")
-		g.output.WriteString("    ;; /exit\n")
+		if g.host {
+			g.pop(Reg("rax"))
+			g.genReturn(hostStatusExit)
+		} else {
+			g.emit(OpMov, Reg("rax"), Imm(60))
+			g.pop(Reg("rdi"))
+			g.emit(OpSyscall)
+		}
+		g.comment("/exit")
 	case *NodeStmtLet:
-		g.output.WriteString("    ;; let\n")
-		for _, variable := range g.vars {
-			if variable.Name == *v.Ident.Value {
-				fmt.Fprintf(os.Stderr, "Identifier already used: %s\n", *v.Ident.Value)
-				os.Exit(1)
+		g.comment("let")
+		if length := letLen(v); length > 0 {
+			g.genArray(v, length)
+		} else {
+			g.vars = append(g.vars, Var{Name: *v.Ident.Value, StackLoc: g.stackSize})
+			if v.Expr != nil {
+				g.genExpr(v.Expr)
+			} else {
+				g.reserve()
 			}
 		}
-		g.vars = append(g.vars, Var{Name: *v.Ident.Value, StackLoc: g.stackSize})
-		g.genExpr(v.Expr)
-		g.output.WriteString("    ;; /let\n")
+		g.comment("/let")
+	case *NodeStmtStatic:
+		// The value is in place before the program starts
+		g.statics = append(g.statics, newStatic(v, len(g.statics)))
 	case *NodeStmtAssign:
-		found := false
-		var stackLoc int
-		for _, variable := range g.vars {
-			if variable.Name == *v.Ident.Value {
-				stackLoc = variable.StackLoc
-				found = true
-				break
-			}
+		g.genExpr(v.Expr)
+		if v.Deref != nil {
+			g.genPointer(v.Deref, "rax")
+			g.pop(Reg("rbx"))
+			g.emit(OpMov, Mem("rax", 0), Reg("rbx"))
+			break
 		}
-		if !found {
-			fmt.Fprintf(os.Stderr, "Undeclared identifier: %s\n", *v.Ident.Value)
-			os.Exit(1)
+		if v.Index != nil {
+			g.genIndex(v.Ident, v.Index, "rax")
+			g.pop(Reg("rbx"))
+			g.emit(OpMov, g.elemMem(*v.Ident.Value, "rax"), Reg("rbx"))
+			break
 		}
-		g.genExpr(v.Expr)
-		g.pop("rax")
-		g.output.WriteString(fmt.Sprintf("    mov [rsp + %d], rax\n", (g.stackSize-stackLoc-1)*8))
+		g.pop(Reg("rax"))
+		g.emit(OpMov, g.varMem(*v.Ident.Value), Reg("rax"))
+	case *NodeStmtUpdate:
+		g.genUpdate(v)
 	case *NodeScope:
-		g.output.WriteString("    ;; scope\n")
+		g.comment("scope")
 		g.genScope(v)
-		g.output.WriteString("    ;; /scope\n")
+		g.comment("/scope")
 	case *NodeStmtIf:
-		g.output.WriteString("    ;; if\n")
+		g.comment("if")
 		g.genExpr(v.Expr)
-		g.pop("rax")
+		g.pop(Reg("rax"))
 		label := g.createLabel()
-		g.output.WriteString("    test rax, rax\n")
-		g.output.WriteString("    jz " + label + "\n")
+		g.emit(OpTest, Reg("rax"), Reg("rax"))
+		g.emit(OpJz, LabelRef(label))
 		g.genScope(v.Scope)
 		if v.Pred != nil {
 			endLabel := g.createLabel()
-			g.output.WriteString("    jmp " + endLabel + "\n")
-			g.output.WriteString(label + ":\n")
+			g.emit(OpJmp, LabelRef(endLabel))
+			g.label(label)
 			g.genIfPred(v.Pred, endLabel)
-			g.output.WriteString(endLabel + ":\n")
+			g.label(endLabel)
 		} else {
-			g.output.WriteString(label + ":\n")
+			g.label(label)
+		}
+		g.comment("/if")
+	case *NodeStmtFor:
+		g.comment("for")
+		g.genFor(v)
+		g.comment("/for")
+	case *NodeStmtMatch:
+		g.comment("match")
+		g.genMatch(v)
+		g.comment("/match")
+	case *NodeStmtBreak:
+		g.genJumpOut(g.loops[len(g.loops)-1].BreakLabel)
+	case *NodeStmtContinue:
+		g.genJumpOut(g.loops[len(g.loops)-1].ContinueLabel)
+	}
+}
+
+// genArray allocates the length slots of an array, then stores each
+// element of its literal in turn, or zeroes them all.
+func (g *Generator) genArray(stmtLet *NodeStmtLet, length int) {
+	g.emit(OpSub, Reg("rsp"), Imm(int64(length*8)))
+	g.stackSize += length
+	variable := Var{Name: *stmtLet.Ident.Value, StackLoc: g.stackSize - 1, Len: length}
+	if stmtLet.Array == nil {
+		g.emit(OpMov, Reg("rdi"), Reg("rsp"))
+		g.emit(OpMov, Reg("rcx"), Imm(int64(length)))
+		g.emit(OpMov, Reg("rax"), Imm(0))
+		g.emit(OpRepStos)
+	}
+	g.vars = append(g.vars, variable)
+	if stmtLet.Array != nil {
+		for i, elem := range stmtLet.Array.Elems {
+			g.genExpr(elem)
+			g.pop(Reg("rax"))
+			slot := g.varMem(variable.Name)
+			slot.Disp += i * 8
+			g.emit(OpMov, slot, Reg("rax"))
+		}
+	}
+}
+
+// genFor lays a loop out as init, a test at the top, the body, then the
+// step, which `continue` jumps to.
+func (g *Generator) genFor(stmtFor *NodeStmtFor) {
+	g.beginScope()
+	if stmtFor.Init != nil {
+		g.genStmt(stmtFor.Init)
+	}
+	topLabel := g.createLabel()
+	loop := Loop{BreakLabel: g.createLabel(), ContinueLabel: g.createLabel(), StackSize: g.stackSize}
+	g.label(topLabel)
+	if stmtFor.Cond != nil {
+		g.genExpr(stmtFor.Cond)
+		g.pop(Reg("rax"))
+		g.emit(OpTest, Reg("rax"), Reg("rax"))
+		g.emit(OpJz, LabelRef(loop.BreakLabel))
+	}
+	g.loops = append(g.loops, loop)
+	g.genScope(stmtFor.Scope)
+	g.loops = g.loops[:len(g.loops)-1]
+	g.label(loop.ContinueLabel)
+	if stmtFor.Step != nil {
+		g.genStmt(stmtFor.Step)
+	}
+	g.emit(OpJmp, LabelRef(topLabel))
+	g.label(loop.BreakLabel)
+	g.endScope()
+}
+
+// genMatch leaves the value being matched on the stack while it
+// dispatches, so that no register is live across the jumps, and releases
+// it after the arms.
+func (g *Generator) genMatch(stmtMatch *NodeStmtMatch) {
+	g.genExpr(stmtMatch.Expr)
+	cases, defaultArm := matchCases(stmtMatch)
+	armLabels := make([]string, len(stmtMatch.Arms))
+	for i := range armLabels {
+		armLabels[i] = g.createLabel()
+	}
+	endLabel := g.createLabel()
+	defaultLabel := endLabel
+	if defaultArm >= 0 {
+		defaultLabel = armLabels[defaultArm]
+	}
+	if denseCases(cases) {
+		g.genJumpTable(cases, armLabels, defaultLabel)
+	} else {
+		g.genSearch(cases, armLabels, defaultLabel)
+	}
+	for i, arm := range stmtMatch.Arms {
+		g.label(armLabels[i])
+		g.genScope(arm.Scope)
+		g.emit(OpJmp, LabelRef(endLabel))
+	}
+	g.label(endLabel)
+	g.emit(OpAdd, Reg("rsp"), Imm(8))
+	g.stackSize--
+}
+
+// genJumpTable jumps through the entry for the value on top of the stack,
+// or to defaultLabel if the value lies outside the table. Values below the
+// lowest case wrap around to large unsigned offsets, so one compare checks
+// both ends.
+func (g *Generator) genJumpTable(cases []matchCase, armLabels []string, defaultLabel string) {
+	table := jumpTable{Label: g.createLabel(), Entries: jumpTableEntries(cases, armLabels, defaultLabel)}
+	g.tables = append(g.tables, table)
+	g.emit(OpMov, Reg("rax"), Mem("rsp", 0))
+	if low := cases[0].Value; low != 0 {
+		g.emit(OpMov, Reg("rbx"), Imm(low))
+		g.emit(OpSub, Reg("rax"), Reg("rbx"))
+	}
+	g.emit(OpCmp, Reg("rax"), Imm(int64(len(table.Entries)-1)))
+	g.emit(OpJa, LabelRef(defaultLabel))
+	g.emit(OpLea, Reg("rbx"), RipRel(table.Label))
+	g.emit(OpJmp, MemIndex("rbx", "rax"))
+}
+
+// genSearch finds the value on top of the stack among the sorted cases by
+// binary search, finishing short runs with a chain of compares.
+func (g *Generator) genSearch(cases []matchCase, armLabels []string, defaultLabel string) {
+	if len(cases) <= 3 {
+		for _, c := range cases {
+			g.genCompare(c.Value)
+			g.emit(OpJz, LabelRef(armLabels[c.Arm]))
 		}
-		g.output.WriteString("    ;; /if\n")
+		g.emit(OpJmp, LabelRef(defaultLabel))
+		return
+	}
+	mid := len(cases) / 2
+	upperLabel := g.createLabel()
+	g.genCompare(cases[mid].Value)
+	g.emit(OpJz, LabelRef(armLabels[cases[mid].Arm]))
+	g.emit(OpJg, LabelRef(upperLabel))
+	g.genSearch(cases[:mid], armLabels, defaultLabel)
+	g.label(upperLabel)
+	g.genSearch(cases[mid+1:], armLabels, defaultLabel)
+}
+
+// genCompare compares the value on top of the stack with value.
+func (g *Generator) genCompare(value int64) {
+	if fitsImm32(value) {
+		g.emit(OpCmp, Mem("rsp", 0), Imm(value))
+		return
+	}
+	g.emit(OpMov, Reg("rax"), Imm(value))
+	g.emit(OpCmp, Mem("rsp", 0), Reg("rax"))
+}
+
+// genJumpOut jumps to a label of the innermost loop, first releasing the
+// slots of the scopes it leaves.
+func (g *Generator) genJumpOut(label string) {
+	if popCount := g.stackSize - g.loops[len(g.loops)-1].StackSize; popCount != 0 {
+		g.emit(OpAdd, Reg("rsp"), Imm(int64(popCount*8)))
 	}
+	g.emit(OpJmp, LabelRef(label))
 }
 
-func (g *Generator) GenProg() string {
-	g.output.WriteString("global _start\n_start:\n")
+func (g *Generator) GenProg() []Instr {
+	if g.host {
+		g.label("_start")
+		g.emit(OpMov, Reg("r13"), Reg("rsp"))
+	} else {
+		g.instrs = append(g.instrs, Instr{Op: OpGlobal, Text: "_start"})
+		g.label("_start")
+	}
 
 	for _, stmt := range g.prog.Stmts {
 		g.genStmt(stmt)
 	}
 
-	g.output.WriteString("    mov rax, 60\n")
-	g.output.WriteString("    mov rdi, 0\n")
-	g.output.WriteString("    syscall\n")
-	return g.output.String()
+	if g.host {
+		g.emit(OpMov, Reg("rax"), Imm(0))
+		g.genReturn(hostStatusExit)
+		if g.trapLabel != "" {
+			g.label(g.trapLabel)
+			g.emit(OpMov, Reg("rax"), Imm(0))
+			g.genReturn(hostStatusDivFault)
+		}
+	} else {
+		g.emit(OpMov, Reg("rax"), Imm(60))
+		g.emit(OpMov, Reg("rdi"), Imm(0))
+		g.emit(OpSyscall)
+	}
+	g.genFaultTraps()
+
+	if len(g.tables) > 0 || len(g.faultTraps) > 0 {
+		g.section(".rodata")
+		for _, table := range g.tables {
+			g.label(table.Label)
+			for _, entry := range table.Entries {
+				g.emit(OpQuad, LabelRef(entry))
+			}
+		}
+		for _, trap := range g.faultTraps {
+			g.label(trap.Message)
+			g.instrs = append(g.instrs, Instr{Op: OpAscii, Text: trap.Fault.text()})
+		}
+	}
+	g.genStatics()
+	return g.instrs
+}
+
+// genFaultTraps generates the traps that failed checks jump to, which
+// print their message to stderr. Host code leaves the message unused and
+// returns the line to its caller instead.
+func (g *Generator) genFaultTraps() {
+	for _, trap := range g.faultTraps {
+		g.label(trap.Label)
+		if g.host {
+			g.emit(OpMov, Reg("rax"), Imm(int64(trap.Fault.line)))
+			if trap.Fault.kind == faultNull {
+				g.genReturn(hostStatusNullFault)
+			} else {
+				g.genReturn(hostStatusBoundsFault)
+			}
+			continue
+		}
+		g.emit(OpMov, Reg("rax"), Imm(1))
+		g.emit(OpMov, Reg("rdi"), Imm(2))
+		g.emit(OpLea, Reg("rsi"), RipRel(trap.Message))
+		g.emit(OpMov, Reg("rdx"), Imm(int64(len(trap.Fault.text()))))
+		g.emit(OpSyscall)
+		g.emit(OpMov, Reg("rax"), Imm(60))
+		g.emit(OpMov, Reg("rdi"), Imm(int64(trap.Fault.status())))
+		g.emit(OpSyscall)
+	}
+}
+
+func (g *Generator) genStatics() {
+	var data, bss []Static
+	for _, static := range g.statics {
+		if static.Value != 0 {
+			data = append(data, static)
+		} else {
+			bss = append(bss, static)
+		}
+	}
+	if len(data) > 0 {
+		g.section(".data")
+		for _, static := range data {
+			g.label(static.Symbol)
+			g.emit(OpQuad, Imm(static.Value))
+		}
+	}
+	if len(bss) > 0 {
+		g.section(".bss")
+		for _, static := range bss {
+			g.label(static.Symbol)
+			g.emit(OpSpace, Imm(8))
+		}
+	}
+}
+
+// genReturn returns from host code with rax and the given status,
+// discarding whatever is still on the stack.
+func (g *Generator) genReturn(status int64) {
+	g.emit(OpMov, Reg("rdx"), Imm(status))
+	g.emit(OpMov, Reg("rsp"), Reg("r13"))
+	g.emit(OpRet)
+}
+
+func (g *Generator) emit(op Opcode, args ...Operand) {
+	g.instrs = append(g.instrs, Instr{Op: op, Args: args})
+}
+
+func (g *Generator) section(name string) {
+	g.instrs = append(g.instrs, Instr{Op: OpSection, Text: name})
+}
+
+func (g *Generator) label(name string) {
+	g.instrs = append(g.instrs, Instr{Op: OpLabel, Text: name})
 }
 
-func (g *Generator) push(reg string) {
-	g.output.WriteString("    push " + reg + "\n")
+func (g *Generator) comment(text string) {
+	g.instrs = append(g.instrs, Instr{Op: OpComment, Text: text})
+}
+
+func (g *Generator) push(operand Operand) {
+	g.emit(OpPush, operand)
 	g.stackSize++
 }
 
-func (g *Generator) pop(reg string) {
-	g.output.WriteString("    pop " + reg + "\n")
+func (g *Generator) pop(operand Operand) {
+	g.emit(OpPop, operand)
 	g.stackSize--
 }
 
+// varMem returns the stack slot or static of a variable the Checker has
+// already verified is declared. For an array it is the slot of element 0.
+// A slot's displacement from rsp follows from stackSize, so `&` takes the
+// address of one with lea.
+func (g *Generator) varMem(name string) Operand {
+	if variable := g.lookupVar(name); variable != nil {
+		return Mem("rsp", (g.stackSize-variable.StackLoc-1)*8)
+	}
+	if static := lookupStatic(g.statics, name); static != nil {
+		return RipRel(static.Symbol)
+	}
+	panic("Unreachable")
+}
+
+// elemMem returns the slot of the variable name, or when index is not
+// empty, that of the element of the array name at the index in it.
+func (g *Generator) elemMem(name string, index string) Operand {
+	mem := g.varMem(name)
+	mem.Index = index
+	return mem
+}
+
+// lookupVar returns the stack variable named name, or nil.
+func (g *Generator) lookupVar(name string) *Var {
+	for i := range g.vars {
+		if g.vars[i].Name == name {
+			return &g.vars[i]
+		}
+	}
+	return nil
+}
+
+// bind declares name as the next stack variable, an array when length is
+// nonzero, without emitting any code, for code generated to run on top of
+// a frame that is already set up.
+func (g *Generator) bind(name string, length int) {
+	variable := Var{Name: name, Len: length}
+	g.stackSize += variable.Slots()
+	variable.StackLoc = g.stackSize - 1
+	g.vars = append(g.vars, variable)
+}
+
+// bindStatic declares name as a static holding value, like bind.
+func (g *Generator) bindStatic(name string, value int64) {
+	g.statics = append(g.statics, Static{Name: name, Symbol: "static" + strconv.Itoa(len(g.statics)), Value: value})
+}
+
+// reserve allocates an uninitialized stack slot.
+func (g *Generator) reserve() {
+	g.emit(OpSub, Reg("rsp"), Imm(8))
+	g.stackSize++
+}
+
 func (g *Generator) beginScope() {
 	g.scopes = append(g.scopes, len(g.vars))
 }
 
 func (g *Generator) endScope() {
-	popCount := len(g.vars) - g.scopes[len(g.scopes)-1]
+	popCount := 0
+	for _, variable := range g.vars[g.scopes[len(g.scopes)-1]:] {
+		popCount += variable.Slots()
+	}
 	if popCount != 0 {
-		g.output.WriteString(fmt.Sprintf("    add rsp, %d\n", popCount*8))
+		g.emit(OpAdd, Reg("rsp"), Imm(int64(popCount*8)))
 	}
 	g.stackSize -= popCount
-	for i := 0; i < popCount; i++ {
-		g.vars = g.vars[:len(g.vars)-1]
-	}
+	g.vars = g.vars[:g.scopes[len(g.scopes)-1]]
 	g.scopes = g.scopes[:len(g.scopes)-1]
 }
 
@@ -233,4 +1014,4 @@ func (g *Generator) createLabel() string {
 	label := "label" + strconv.Itoa(g.labelCount)
 	g.labelCount++
 	return label
-}
\ No newline at end of file
+}
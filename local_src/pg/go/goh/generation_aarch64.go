@@ -0,0 +1,611 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// AArch64Generator emits GNU assembler source for arm64 Linux. It mirrors
+// Generator: every value lives in a stack slot, x0 and x1 are scratch
+// registers. sp has to stay 16-byte aligned on arm64, so each slot takes
+// 16 bytes, and an array packs two elements into each of its slots. sdiv
+// does not fault, so division checks its operands and raises SIGFPE where
+// idiv would. Debug adds the checks described at faultTrap.
+type AArch64Generator struct {
+	prog       NodeProg
+	output     strings.Builder
+	stackSize  int
+	vars       []Var
+	scopes     []int
+	loops      []Loop
+	tables     []jumpTable
+	statics    []Static
+	faultTraps []faultTrap
+	trapLabel  string
+	labelCount int
+	Debug      bool
+}
+
+const aarch64SlotSize = 16
+
+// aarch64Slots returns the number of stack slots variable occupies.
+func aarch64Slots(variable Var) int {
+	return (variable.Slots() + 1) / 2
+}
+
+func NewAArch64Generator(prog NodeProg) *AArch64Generator {
+	return &AArch64Generator{
+		prog:       prog,
+		stackSize:  0,
+		vars:       make([]Var, 0),
+		scopes:     make([]int, 0),
+		labelCount: 0,
+	}
+}
+
+func (g *AArch64Generator) genTerm(term *NodeTerm) {
+	switch v := term.Var.(type) {
+	case *NodeTermIntLit:
+		g.loadImm("x0", intLitValue(v.IntLit))
+		g.push("x0")
+	case *NodeTermIdent:
+		g.loadVar("x0", *v.Ident.Value)
+		g.push("x0")
+	case *NodeTermIndex:
+		g.genIndex(v.Ident, v.Index, "x1")
+		g.arrayBase(*v.Ident.Value)
+		g.output.WriteString("    ldr x0, [x9, x1, lsl #3]\n")
+		g.push("x0")
+	case *NodeTermAddr:
+		if v.Index != nil {
+			g.genIndex(v.Ident, v.Index, "x1")
+			g.arrayBase(*v.Ident.Value)
+			g.output.WriteString("    add x0, x9, x1, lsl #3\n")
+		} else {
+			g.varPtr("x0", *v.Ident.Value)
+		}
+		g.push("x0")
+	case *NodeTermDeref:
+		g.genPointer(v, "x0")
+		g.output.WriteString("    ldr x0, [x0]\n")
+		g.push("x0")
+	case *NodeTermParen:
+		g.genExpr(v.Expr)
+	case *NodeTermBitNot:
+		g.genExpr(v.Expr)
+		g.pop("x0")
+		g.output.WriteString("    mvn x0, x0\n")
+		g.push("x0")
+	}
+}
+
+// genIndex evaluates an index into the array ident names into reg. A debug
+// build checks it against the length of the array, as unsigned so that a
+// negative index is caught by the same compare.
+func (g *AArch64Generator) genIndex(ident Token, index *NodeExpr, reg string) {
+	g.genExpr(index)
+	g.pop(reg)
+	if g.Debug {
+		trap := faultTrapLabel(&g.faultTraps, faultError{kind: faultBounds, line: ident.Line}, g.createLabel)
+		g.loadImm("x10", int64(g.lookupVar(*ident.Value).Len-1))
+		g.output.WriteString(fmt.Sprintf("    cmp %s, x10\n", reg))
+		g.output.WriteString("    b.hi " + trap + "\n")
+	}
+}
+
+// genPointer evaluates the pointer deref dereferences into reg, which a
+// debug build checks is not null.
+func (g *AArch64Generator) genPointer(deref *NodeTermDeref, reg string) {
+	g.genExpr(deref.Expr)
+	g.pop(reg)
+	if g.Debug {
+		trap := faultTrapLabel(&g.faultTraps, faultError{kind: faultNull, line: deref.Star.Line}, g.createLabel)
+		g.output.WriteString(fmt.Sprintf("    cbz %s, %s\n", reg, trap))
+	}
+}
+
+func (g *AArch64Generator) genBinExpr(binExpr *NodeBinExpr) {
+	lhs, rhs := binOperands(binExpr)
+	g.genExpr(rhs)
+	g.genExpr(lhs)
+	g.pop("x0")
+	g.pop("x1")
+	g.genOp(binExprOp(binExpr))
+	g.push("x0")
+}
+
+// genOp computes x0 = x0 op x1.
+func (g *AArch64Generator) genOp(op TokenType) {
+	switch op {
+	case TokenMinus:
+		g.output.WriteString("    sub x0, x0, x1\n")
+	case TokenPlus:
+		g.output.WriteString("    add x0, x0, x1\n")
+	case TokenStar:
+		g.output.WriteString("    mul x0, x0, x1\n")
+	case TokenFslash:
+		g.genDivCheck()
+		g.output.WriteString("    sdiv x0, x0, x1\n")
+	case TokenPercent:
+		g.genDivCheck()
+		g.output.WriteString("    sdiv x2, x0, x1\n")
+		g.output.WriteString("    msub x0, x2, x1, x0\n")
+	case TokenAmp:
+		g.output.WriteString("    and x0, x0, x1\n")
+	case TokenPipe:
+		g.output.WriteString("    orr x0, x0, x1\n")
+	case TokenCaret:
+		g.output.WriteString("    eor x0, x0, x1\n")
+	case TokenShl:
+		g.output.WriteString("    lsl x0, x0, x1\n")
+	case TokenShr:
+		g.output.WriteString("    asr x0, x0, x1\n")
+	case TokenUshr:
+		g.output.WriteString("    lsr x0, x0, x1\n")
+	case TokenEqEq, TokenNe, TokenLt, TokenLe, TokenGt, TokenGe:
+		g.output.WriteString("    cmp x0, x1\n")
+		g.output.WriteString("    cset x0, " + aarch64Conds[op] + "\n")
+	}
+}
+
+// genDivCheck leaves to the trap when x1 is zero, or when x0 is INT64_MIN
+// and x1 is -1, where sdiv would quietly give 0 or INT64_MIN.
+func (g *AArch64Generator) genDivCheck() {
+	if g.trapLabel == "" {
+		g.trapLabel = g.createLabel()
+	}
+	g.output.WriteString("    cbz x1, " + g.trapLabel + "\n")
+	g.loadImm("x10", math.MinInt64)
+	g.output.WriteString("    cmp x0, x10\n")
+	g.output.WriteString("    ccmn x1, #1, #0, eq\n")
+	g.output.WriteString("    b.eq " + g.trapLabel + "\n")
+}
+
+// aarch64Conds maps each comparison onto the condition cset tests.
+var aarch64Conds = map[TokenType]string{
+	TokenEqEq: "eq",
+	TokenNe:   "ne",
+	TokenLt:   "lt",
+	TokenLe:   "le",
+	TokenGt:   "gt",
+	TokenGe:   "ge",
+}
+
+func (g *AArch64Generator) genExpr(expr *NodeExpr) {
+	switch v := expr.Var.(type) {
+	case *NodeTerm:
+		g.genTerm(v)
+	case *NodeBinExpr:
+		g.genBinExpr(v)
+	}
+}
+
+func (g *AArch64Generator) genScope(scope *NodeScope) {
+	g.beginScope()
+	for _, stmt := range scope.Stmts {
+		g.genStmt(stmt)
+	}
+	g.endScope()
+}
+
+func (g *AArch64Generator) genIfPred(pred *NodeIfPred, endLabel string) {
+	switch v := pred.Var.(type) {
+	case *NodeIfPredElif:
+		g.output.WriteString("    // elif\n")
+		g.genExpr(v.Expr)
+		g.pop("x0")
+		label := g.createLabel()
+		g.output.WriteString("    cbz x0, " + label + "\n")
+		g.genScope(v.Scope)
+		g.output.WriteString("    b " + endLabel + "\n")
+		g.output.WriteString(label + ":\n")
+		if v.Pred != nil {
+			g.genIfPred(v.Pred, endLabel)
+		}
+	case *NodeIfPredElse:
+		g.output.WriteString("    // else\n")
+		g.genScope(v.Scope)
+	}
+}
+
+func (g *AArch64Generator) genStmt(stmt *NodeStmt) {
+	switch v := stmt.Var.(type) {
+	case *NodeStmtExit:
+		g.output.WriteString("    // exit\n")
+		g.genExpr(v.Expr)
+		g.pop("x0")
+		g.output.WriteString("    mov x8, #93\n")
+		g.output.WriteString("    svc #0\n")
+		g.output.WriteString("    // /exit\n")
+	case *NodeStmtLet:
+		g.output.WriteString("    // let\n")
+		if length := letLen(v); length > 0 {
+			g.genArray(v, length)
+		} else {
+			g.vars = append(g.vars, Var{Name: *v.Ident.Value, StackLoc: g.stackSize})
+			if v.Expr != nil {
+				g.genExpr(v.Expr)
+			} else {
+				g.allocate(1)
+				g.stackSize++
+			}
+		}
+		g.output.WriteString("    // /let\n")
+	case *NodeStmtAssign:
+		g.genExpr(v.Expr)
+		if v.Deref != nil {
+			g.genPointer(v.Deref, "x1")
+			g.pop("x0")
+			g.output.WriteString("    str x0, [x1]\n")
+			break
+		}
+		if v.Index != nil {
+			g.genIndex(v.Ident, v.Index, "x1")
+			g.pop("x0")
+			g.arrayBase(*v.Ident.Value)
+			g.output.WriteString("    str x0, [x9, x1, lsl #3]\n")
+			break
+		}
+		g.pop("x0")
+		g.storeVar("x0", *v.Ident.Value)
+	case *NodeStmtUpdate:
+		g.genExpr(v.Expr)
+		if v.Deref != nil {
+			// genOp leaves x3 alone
+			g.genPointer(v.Deref, "x3")
+			g.pop("x1")
+			g.output.WriteString("    ldr x0, [x3]\n")
+			g.genOp(updateOp(v))
+			g.output.WriteString("    str x0, [x3]\n")
+			break
+		}
+		if v.Index != nil {
+			// genOp leaves x3 and x9 alone
+			g.genIndex(v.Ident, v.Index, "x3")
+			g.pop("x1")
+			g.arrayBase(*v.Ident.Value)
+			g.output.WriteString("    ldr x0, [x9, x3, lsl #3]\n")
+			g.genOp(updateOp(v))
+			g.output.WriteString("    str x0, [x9, x3, lsl #3]\n")
+			break
+		}
+		g.pop("x1")
+		g.loadVar("x0", *v.Ident.Value)
+		g.genOp(updateOp(v))
+		g.storeVar("x0", *v.Ident.Value)
+	case *NodeScope:
+		g.output.WriteString("    // scope\n")
+		g.genScope(v)
+		g.output.WriteString("    // /scope\n")
+	case *NodeStmtIf:
+		g.output.WriteString("    // if\n")
+		g.genExpr(v.Expr)
+		g.pop("x0")
+		label := g.createLabel()
+		g.output.WriteString("    cbz x0, " + label + "\n")
+		g.genScope(v.Scope)
+		if v.Pred != nil {
+			endLabel := g.createLabel()
+			g.output.WriteString("    b " + endLabel + "\n")
+			g.output.WriteString(label + ":\n")
+			g.genIfPred(v.Pred, endLabel)
+			g.output.WriteString(endLabel + ":\n")
+		} else {
+			g.output.WriteString(label + ":\n")
+		}
+		g.output.WriteString("    // /if\n")
+	case *NodeStmtFor:
+		g.output.WriteString("    // for\n")
+		g.genFor(v)
+		g.output.WriteString("    // /for\n")
+	case *NodeStmtStatic:
+		g.statics = append(g.statics, newStatic(v, len(g.statics)))
+	case *NodeStmtMatch:
+		g.output.WriteString("    // match\n")
+		g.genMatch(v)
+		g.output.WriteString("    // /match\n")
+	case *NodeStmtBreak:
+		g.genJumpOut(g.loops[len(g.loops)-1].BreakLabel)
+	case *NodeStmtContinue:
+		g.genJumpOut(g.loops[len(g.loops)-1].ContinueLabel)
+	}
+}
+
+// genArray allocates the slots of an array, then stores each element of
+// its literal in turn, or zeroes them all.
+func (g *AArch64Generator) genArray(stmtLet *NodeStmtLet, length int) {
+	variable := Var{Name: *stmtLet.Ident.Value, Len: length}
+	slots := aarch64Slots(variable)
+	g.allocate(slots)
+	g.stackSize += slots
+	variable.StackLoc = g.stackSize - 1
+	g.vars = append(g.vars, variable)
+	if stmtLet.Array == nil {
+		label := g.createLabel()
+		g.output.WriteString("    mov x9, sp\n")
+		g.loadImm("x10", int64(slots))
+		g.output.WriteString(label + ":\n")
+		g.output.WriteString("    stp xzr, xzr, [x9], #16\n")
+		g.output.WriteString("    subs x10, x10, #1\n")
+		g.output.WriteString("    b.ne " + label + "\n")
+		return
+	}
+	for i, elem := range stmtLet.Array.Elems {
+		g.genExpr(elem)
+		g.pop("x0")
+		g.loadImm("x1", int64(i))
+		g.arrayBase(variable.Name)
+		g.output.WriteString("    str x0, [x9, x1, lsl #3]\n")
+	}
+}
+
+func (g *AArch64Generator) genFor(stmtFor *NodeStmtFor) {
+	g.beginScope()
+	if stmtFor.Init != nil {
+		g.genStmt(stmtFor.Init)
+	}
+	topLabel := g.createLabel()
+	loop := Loop{BreakLabel: g.createLabel(), ContinueLabel: g.createLabel(), StackSize: g.stackSize}
+	g.output.WriteString(topLabel + ":\n")
+	if stmtFor.Cond != nil {
+		g.genExpr(stmtFor.Cond)
+		g.pop("x0")
+		g.output.WriteString("    cbz x0, " + loop.BreakLabel + "\n")
+	}
+	g.loops = append(g.loops, loop)
+	g.genScope(stmtFor.Scope)
+	g.loops = g.loops[:len(g.loops)-1]
+	g.output.WriteString(loop.ContinueLabel + ":\n")
+	if stmtFor.Step != nil {
+		g.genStmt(stmtFor.Step)
+	}
+	g.output.WriteString("    b " + topLabel + "\n")
+	g.output.WriteString(loop.BreakLabel + ":\n")
+	g.endScope()
+}
+
+// genMatch keeps the value being matched in its stack slot until after the
+// arms, like Generator, and dispatches on it in x0.
+func (g *AArch64Generator) genMatch(stmtMatch *NodeStmtMatch) {
+	g.genExpr(stmtMatch.Expr)
+	cases, defaultArm := matchCases(stmtMatch)
+	armLabels := make([]string, len(stmtMatch.Arms))
+	for i := range armLabels {
+		armLabels[i] = g.createLabel()
+	}
+	endLabel := g.createLabel()
+	defaultLabel := endLabel
+	if defaultArm >= 0 {
+		defaultLabel = armLabels[defaultArm]
+	}
+	g.output.WriteString("    ldr x0, [sp]\n")
+	if denseCases(cases) {
+		g.genJumpTable(cases, armLabels, defaultLabel)
+	} else {
+		g.genSearch(cases, armLabels, defaultLabel)
+	}
+	for i, arm := range stmtMatch.Arms {
+		g.output.WriteString(armLabels[i] + ":\n")
+		g.genScope(arm.Scope)
+		g.output.WriteString("    b " + endLabel + "\n")
+	}
+	g.output.WriteString(endLabel + ":\n")
+	g.release(1)
+	g.stackSize--
+}
+
+// genJumpTable jumps through the entry for x0, or to defaultLabel if x0
+// lies outside the table.
+func (g *AArch64Generator) genJumpTable(cases []matchCase, armLabels []string, defaultLabel string) {
+	table := jumpTable{Label: g.createLabel(), Entries: jumpTableEntries(cases, armLabels, defaultLabel)}
+	g.tables = append(g.tables, table)
+	if low := cases[0].Value; low != 0 {
+		g.loadImm("x1", low)
+		g.output.WriteString("    sub x0, x0, x1\n")
+	}
+	g.loadImm("x1", int64(len(table.Entries)-1))
+	g.output.WriteString("    cmp x0, x1\n")
+	g.output.WriteString("    b.hi " + defaultLabel + "\n")
+	g.output.WriteString("    adrp x1, " + table.Label + "\n")
+	g.output.WriteString("    add x1, x1, :lo12:" + table.Label + "\n")
+	g.output.WriteString("    ldr x1, [x1, x0, lsl #3]\n")
+	g.output.WriteString("    br x1\n")
+}
+
+// genSearch finds x0 among the sorted cases by binary search, finishing
+// short runs with a chain of compares.
+func (g *AArch64Generator) genSearch(cases []matchCase, armLabels []string, defaultLabel string) {
+	if len(cases) <= 3 {
+		for _, c := range cases {
+			g.loadImm("x1", c.Value)
+			g.output.WriteString("    cmp x0, x1\n")
+			g.output.WriteString("    b.eq " + armLabels[c.Arm] + "\n")
+		}
+		g.output.WriteString("    b " + defaultLabel + "\n")
+		return
+	}
+	mid := len(cases) / 2
+	upperLabel := g.createLabel()
+	g.loadImm("x1", cases[mid].Value)
+	g.output.WriteString("    cmp x0, x1\n")
+	g.output.WriteString("    b.eq " + armLabels[cases[mid].Arm] + "\n")
+	g.output.WriteString("    b.gt " + upperLabel + "\n")
+	g.genSearch(cases[:mid], armLabels, defaultLabel)
+	g.output.WriteString(upperLabel + ":\n")
+	g.genSearch(cases[mid+1:], armLabels, defaultLabel)
+}
+
+// genJumpOut jumps to a label of the innermost loop, first releasing the
+// slots of the scopes it leaves.
+func (g *AArch64Generator) genJumpOut(label string) {
+	g.release(g.stackSize - g.loops[len(g.loops)-1].StackSize)
+	g.output.WriteString("    b " + label + "\n")
+}
+
+func (g *AArch64Generator) GenProg() string {
+	g.output.WriteString(".global _start\n_start:\n")
+
+	for _, stmt := range g.prog.Stmts {
+		g.genStmt(stmt)
+	}
+
+	g.output.WriteString("    mov x0, #0\n")
+	g.output.WriteString("    mov x8, #93\n")
+	g.output.WriteString("    svc #0\n")
+	if g.trapLabel != "" {
+		// kill(getpid(), SIGFPE), as x86 faults on the same division, then
+		// exit_group(136) with the status the signal would have given
+		g.output.WriteString(g.trapLabel + ":\n")
+		g.output.WriteString("    mov x8, #172\n")
+		g.output.WriteString("    svc #0\n")
+		g.output.WriteString("    mov x1, #8\n")
+		g.output.WriteString("    mov x8, #129\n")
+		g.output.WriteString("    svc #0\n")
+		g.output.WriteString("    mov x0, #136\n")
+		g.output.WriteString("    mov x8, #94\n")
+		g.output.WriteString("    svc #0\n")
+	}
+	g.genFaultTraps()
+	writeJumpTables(&g.output, g.tables)
+	writeFaultMessages(&g.output, g.faultTraps)
+	writeStatics(&g.output, g.statics)
+	return g.output.String()
+}
+
+// genFaultTraps generates the traps that failed checks jump to, which
+// print their message to stderr and exit.
+func (g *AArch64Generator) genFaultTraps() {
+	for _, trap := range g.faultTraps {
+		g.output.WriteString(trap.Label + ":\n")
+		g.output.WriteString("    mov x0, #2\n")
+		g.output.WriteString("    adrp x1, " + trap.Message + "\n")
+		g.output.WriteString("    add x1, x1, :lo12:" + trap.Message + "\n")
+		g.loadImm("x2", int64(len(trap.Fault.text())))
+		g.output.WriteString("    mov x8, #64\n")
+		g.output.WriteString("    svc #0\n")
+		g.output.WriteString(fmt.Sprintf("    mov x0, #%d\n", trap.Fault.status()))
+		g.output.WriteString("    mov x8, #93\n")
+		g.output.WriteString("    svc #0\n")
+	}
+}
+
+// loadImm materializes a 64-bit constant 16 bits at a time.
+func (g *AArch64Generator) loadImm(reg string, value int64) {
+	bits := uint64(value)
+	g.output.WriteString(fmt.Sprintf("    movz %s, #%d\n", reg, bits&0xffff))
+	for shift := 16; shift < 64; shift += 16 {
+		if chunk := (bits >> shift) & 0xffff; chunk != 0 {
+			g.output.WriteString(fmt.Sprintf("    movk %s, #%d, lsl #%d\n", reg, chunk, shift))
+		}
+	}
+}
+
+// varAddr returns the addressing mode for a variable's slot, going through
+// x9 when the offset is out of range for an immediate, or for the address
+// of a static.
+func (g *AArch64Generator) varAddr(name string) string {
+	if variable := g.lookupVar(name); variable != nil {
+		offset := (g.stackSize - variable.StackLoc - 1) * aarch64SlotSize
+		if offset <= 32760 {
+			return fmt.Sprintf("[sp, #%d]", offset)
+		}
+		g.loadImm("x9", int64(offset))
+		return "[sp, x9]"
+	}
+	if static := lookupStatic(g.statics, name); static != nil {
+		g.output.WriteString("    adrp x9, " + static.Symbol + "\n")
+		g.output.WriteString("    add x9, x9, :lo12:" + static.Symbol + "\n")
+		return "[x9]"
+	}
+	panic("Unreachable")
+}
+
+// varPtr leaves the address of the slot of the stack variable name in reg.
+func (g *AArch64Generator) varPtr(reg string, name string) {
+	offset := (g.stackSize - g.lookupVar(name).StackLoc - 1) * aarch64SlotSize
+	if offset <= 4095 {
+		g.output.WriteString(fmt.Sprintf("    add %s, sp, #%d\n", reg, offset))
+		return
+	}
+	g.loadImm(reg, int64(offset))
+	g.output.WriteString(fmt.Sprintf("    add %s, sp, %s\n", reg, reg))
+}
+
+// arrayBase leaves the address of element 0 of the array name in x9.
+func (g *AArch64Generator) arrayBase(name string) {
+	g.varPtr("x9", name)
+}
+
+// lookupVar returns the stack variable named name, or nil.
+func (g *AArch64Generator) lookupVar(name string) *Var {
+	for i := range g.vars {
+		if g.vars[i].Name == name {
+			return &g.vars[i]
+		}
+	}
+	return nil
+}
+
+func (g *AArch64Generator) loadVar(reg string, name string) {
+	g.output.WriteString(fmt.Sprintf("    ldr %s, %s\n", reg, g.varAddr(name)))
+}
+
+func (g *AArch64Generator) storeVar(reg string, name string) {
+	g.output.WriteString(fmt.Sprintf("    str %s, %s\n", reg, g.varAddr(name)))
+}
+
+func (g *AArch64Generator) push(reg string) {
+	g.output.WriteString(fmt.Sprintf("    str %s, [sp, #-%d]!\n", reg, aarch64SlotSize))
+	g.stackSize++
+}
+
+func (g *AArch64Generator) pop(reg string) {
+	g.output.WriteString(fmt.Sprintf("    ldr %s, [sp], #%d\n", reg, aarch64SlotSize))
+	g.stackSize--
+}
+
+func (g *AArch64Generator) beginScope() {
+	g.scopes = append(g.scopes, len(g.vars))
+}
+
+func (g *AArch64Generator) endScope() {
+	popCount := 0
+	for _, variable := range g.vars[g.scopes[len(g.scopes)-1]:] {
+		popCount += aarch64Slots(variable)
+	}
+	g.release(popCount)
+	g.stackSize -= popCount
+	g.vars = g.vars[:g.scopes[len(g.scopes)-1]]
+	g.scopes = g.scopes[:len(g.scopes)-1]
+}
+
+// allocate pushes count uninitialized slots without changing stackSize.
+func (g *AArch64Generator) allocate(count int) {
+	if bytes := count * aarch64SlotSize; bytes <= 4095 {
+		g.output.WriteString(fmt.Sprintf("    sub sp, sp, #%d\n", bytes))
+	} else {
+		g.loadImm("x9", int64(bytes))
+		g.output.WriteString("    sub sp, sp, x9\n")
+	}
+}
+
+// release pops count slots off the stack without changing stackSize.
+func (g *AArch64Generator) release(count int) {
+	if count == 0 {
+		return
+	}
+	if bytes := count * aarch64SlotSize; bytes <= 4095 {
+		g.output.WriteString(fmt.Sprintf("    add sp, sp, #%d\n", bytes))
+	} else {
+		g.loadImm("x9", int64(bytes))
+		g.output.WriteString("    add sp, sp, x9\n")
+	}
+}
+
+func (g *AArch64Generator) createLabel() string {
+	label := "label" + strconv.Itoa(g.labelCount)
+	g.labelCount++
+	return label
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// cPrelude defines the arithmetic helpers the generated code calls. Going
+// through uint64_t gives the same two's complement wraparound as the
+// assembly backends instead of signed overflow, and division raises the
+// SIGFPE idiv raises on the same cases, then exits with exitDivFault in
+// case the signal is ignored. Shift counts are masked to six bits like the
+// hardware shifts, and hy_sar shifts a negative value by shifting its
+// complement, since >> on a negative int64_t is implementation-defined.
+// Debug builds pass every index through hy_index, which exits with
+// exitBoundsFault when it is out of bounds, and every pointer that is
+// dereferenced through hy_ptr, which exits with exitNullFault when it is
+// null.
+const cPrelude = `#include <signal.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+
+static inline int64_t hy_add(int64_t a, int64_t b) { return (int64_t)((uint64_t)a + (uint64_t)b); }
+static inline int64_t hy_sub(int64_t a, int64_t b) { return (int64_t)((uint64_t)a - (uint64_t)b); }
+static inline int64_t hy_mul(int64_t a, int64_t b) { return (int64_t)((uint64_t)a * (uint64_t)b); }
+static inline int64_t hy_div(int64_t a, int64_t b) {
+    if (b == 0 || (a == INT64_MIN && b == -1)) {
+        raise(SIGFPE);
+        _Exit(136);
+    }
+    return a / b;
+}
+static inline int64_t hy_mod(int64_t a, int64_t b) {
+    if (b == 0 || (a == INT64_MIN && b == -1)) {
+        raise(SIGFPE);
+        _Exit(136);
+    }
+    return a % b;
+}
+static inline int64_t hy_and(int64_t a, int64_t b) { return a & b; }
+static inline int64_t hy_or(int64_t a, int64_t b) { return a | b; }
+static inline int64_t hy_xor(int64_t a, int64_t b) { return a ^ b; }
+static inline int64_t hy_shl(int64_t a, int64_t b) { return (int64_t)((uint64_t)a << (b & 63)); }
+static inline int64_t hy_sar(int64_t a, int64_t b) { return a < 0 ? ~(~a >> (b & 63)) : a >> (b & 63); }
+static inline int64_t hy_shr(int64_t a, int64_t b) { return (int64_t)((uint64_t)a >> (b & 63)); }
+static inline int64_t hy_eq(int64_t a, int64_t b) { return a == b; }
+static inline int64_t hy_ne(int64_t a, int64_t b) { return a != b; }
+static inline int64_t hy_lt(int64_t a, int64_t b) { return a < b; }
+static inline int64_t hy_le(int64_t a, int64_t b) { return a <= b; }
+static inline int64_t hy_gt(int64_t a, int64_t b) { return a > b; }
+static inline int64_t hy_ge(int64_t a, int64_t b) { return a >= b; }
+static inline int64_t hy_index(int64_t i, size_t len, int line) {
+    if ((uint64_t)i >= len) {
+        fprintf(stderr, "index out of bounds on line %d\n", line);
+        exit(101);
+    }
+    return i;
+}
+static inline int64_t *hy_ptr(int64_t p, int line) {
+    if (p == 0) {
+        fprintf(stderr, "null pointer dereference on line %d\n", line);
+        exit(102);
+    }
+    return (int64_t *)(intptr_t)p;
+}
+`
+
+// cLoop tracks a loop being generated. Inside a C switch, `break` would
+// leave the switch rather than the loop, so a `break` there jumps to Label
+// after the loop instead.
+type cLoop struct {
+	Label    string
+	Switches int // Switches entered since the loop
+	Used     bool
+}
+
+// CGenerator translates a program into a single portable C file. Every
+// NodeScope becomes a C block, so `let` maps directly onto a C local with
+// the same lifetime. Statics can only be declared at the top level, so they
+// become file-scope C statics ahead of main. Arrays are C arrays, and a
+// pointer is an int64_t holding an address like every other value. Debug
+// adds the checks described at faultTrap, through the helpers in cPrelude.
+type CGenerator struct {
+	prog       NodeProg
+	output     strings.Builder
+	indent     int
+	loops      []*cLoop
+	labelCount int
+	temps      int // Temporaries in use
+	maxTemps   int
+	updatePtr  bool // Whether an update goes through p
+	Debug      bool
+}
+
+func NewCGenerator(prog NodeProg) *CGenerator {
+	return &CGenerator{
+		prog:       prog,
+		indent:     0,
+		labelCount: 0,
+	}
+}
+
+// cIdent mangles a variable name so it cannot collide with C keywords or
+// the helpers above.
+func cIdent(name string) string {
+	return "v_" + name
+}
+
+// cInt returns a C constant for value. The literal for INT64_MIN would be
+// the negation of a constant too large for int64_t.
+func cInt(value int64) string {
+	if value == math.MinInt64 {
+		return "INT64_MIN"
+	}
+	return fmt.Sprintf("INT64_C(%d)", value)
+}
+
+func (g *CGenerator) genTerm(term *NodeTerm) string {
+	switch v := term.Var.(type) {
+	case *NodeTermIntLit:
+		return cInt(intLitValue(v.IntLit))
+	case *NodeTermIdent:
+		return cIdent(*v.Ident.Value)
+	case *NodeTermIndex:
+		return g.genElem(v.Ident, v.Index)
+	case *NodeTermAddr:
+		return "((int64_t)(intptr_t)&" + g.genTarget(v.Ident, v.Index, nil) + ")"
+	case *NodeTermDeref:
+		return g.genDeref(v)
+	case *NodeTermParen:
+		return g.genExpr(v.Expr)
+	case *NodeTermBitNot:
+		return "(~" + g.genExpr(v.Expr) + ")"
+	}
+	panic("Unreachable")
+}
+
+// genElem returns the element of the array ident names at index.
+func (g *CGenerator) genElem(ident Token, index *NodeExpr) string {
+	name := cIdent(*ident.Value)
+	if g.Debug {
+		return fmt.Sprintf("%s[hy_index(%s, sizeof %s / sizeof *%s, %d)]", name, g.genExpr(index), name, name, ident.Line)
+	}
+	return name + "[" + g.genExpr(index) + "]"
+}
+
+// genDeref returns what the pointer deref dereferences points to.
+func (g *CGenerator) genDeref(deref *NodeTermDeref) string {
+	if g.Debug {
+		return fmt.Sprintf("(*hy_ptr(%s, %d))", g.genExpr(deref.Expr), deref.Star.Line)
+	}
+	return "(*(int64_t *)(intptr_t)" + g.genExpr(deref.Expr) + ")"
+}
+
+// genTarget returns the variable, or the element of it at index when that
+// is set, or what deref points to when that is set, that an assignment or
+// update stores to or `&` takes.
+func (g *CGenerator) genTarget(ident Token, index *NodeExpr, deref *NodeTermDeref) string {
+	if deref != nil {
+		return g.genDeref(deref)
+	}
+	if index != nil {
+		return g.genElem(ident, index)
+	}
+	return cIdent(*ident.Value)
+}
+
+// cHelper returns the prelude function that implements a binary operator.
+func cHelper(op TokenType) string {
+	switch op {
+	case TokenMinus:
+		return "hy_sub"
+	case TokenPlus:
+		return "hy_add"
+	case TokenStar:
+		return "hy_mul"
+	case TokenFslash:
+		return "hy_div"
+	case TokenPercent:
+		return "hy_mod"
+	case TokenAmp:
+		return "hy_and"
+	case TokenPipe:
+		return "hy_or"
+	case TokenCaret:
+		return "hy_xor"
+	case TokenShl:
+		return "hy_shl"
+	case TokenShr:
+		return "hy_sar"
+	case TokenUshr:
+		return "hy_shr"
+	case TokenEqEq:
+		return "hy_eq"
+	case TokenNe:
+		return "hy_ne"
+	case TokenLt:
+		return "hy_lt"
+	case TokenLe:
+		return "hy_le"
+	case TokenGt:
+		return "hy_gt"
+	case TokenGe:
+		return "hy_ge"
+	}
+	panic("Unreachable")
+}
+
+// genBinExpr calls the helper for the operator. C leaves the order the
+// arguments are evaluated in unspecified, so when both operands can fault
+// the right one goes in a temporary first, as the other backends evaluate
+// it first.
+func (g *CGenerator) genBinExpr(binExpr *NodeBinExpr) string {
+	lhs, rhs := binOperands(binExpr)
+	helper := cHelper(binExprOp(binExpr))
+	if faultFree(lhs) || faultFree(rhs) {
+		return helper + "(" + g.genExpr(lhs) + ", " + g.genExpr(rhs) + ")"
+	}
+	temp := g.pushTemp()
+	value := g.genExpr(rhs)
+	call := helper + "(" + g.genExpr(lhs) + ", " + temp + ")"
+	g.temps--
+	return "(" + temp + " = " + value + ", " + call + ")"
+}
+
+func (g *CGenerator) genExpr(expr *NodeExpr) string {
+	switch v := expr.Var.(type) {
+	case *NodeTerm:
+		return g.genTerm(v)
+	case *NodeBinExpr:
+		return g.genBinExpr(v)
+	}
+	panic("Unreachable")
+}
+
+func (g *CGenerator) genScope(scope *NodeScope) {
+	g.indent++
+	for _, stmt := range scope.Stmts {
+		g.genStmt(stmt)
+	}
+	g.indent--
+}
+
+func (g *CGenerator) genIfPred(pred *NodeIfPred) {
+	switch v := pred.Var.(type) {
+	case *NodeIfPredElif:
+		g.line("} else if (" + g.genExpr(v.Expr) + ") {")
+		g.genScope(v.Scope)
+		if v.Pred != nil {
+			g.genIfPred(v.Pred)
+		}
+	case *NodeIfPredElse:
+		g.line("} else {")
+		g.genScope(v.Scope)
+	}
+}
+
+func (g *CGenerator) genStmt(stmt *NodeStmt) {
+	switch v := stmt.Var.(type) {
+	case *NodeStmtExit:
+		g.line("exit((int)((uint64_t)" + g.genExpr(v.Expr) + " & 0xff));")
+	case *NodeStmtLet, *NodeStmtAssign, *NodeStmtUpdate:
+		g.line(g.genSimpleStmt(stmt) + ";")
+	case *NodeScope:
+		g.line("{")
+		g.genScope(v)
+		g.line("}")
+	case *NodeStmtIf:
+		g.line("if (" + g.genExpr(v.Expr) + ") {")
+		g.genScope(v.Scope)
+		if v.Pred != nil {
+			g.genIfPred(v.Pred)
+		}
+		g.line("}")
+	case *NodeStmtFor:
+		var init, cond, step string
+		if v.Init != nil {
+			init = g.genSimpleStmt(v.Init)
+		}
+		if v.Cond != nil {
+			cond = " " + g.genExpr(v.Cond)
+		}
+		if v.Step != nil {
+			step = " " + g.genSimpleStmt(v.Step)
+		}
+		loop := &cLoop{Label: g.createLabel()}
+		g.loops = append(g.loops, loop)
+		g.line("for (" + init + ";" + cond + ";" + step + ") {")
+		g.genScope(v.Scope)
+		g.line("}")
+		g.loops = g.loops[:len(g.loops)-1]
+		if loop.Used {
+			g.line(loop.Label + ":;")
+		}
+	case *NodeStmtMatch:
+		g.genMatch(v)
+	case *NodeStmtBreak:
+		if loop := g.loops[len(g.loops)-1]; loop.Switches > 0 {
+			loop.Used = true
+			g.line("goto " + loop.Label + ";")
+		} else {
+			g.line("break;")
+		}
+	case *NodeStmtContinue:
+		g.line("continue;")
+	case *NodeStmtStatic:
+		// Declared at file scope by GenProg
+	}
+}
+
+// genMatch translates a match into a C switch with a block per arm. C
+// rejects repeated case values, so each value only labels the first arm
+// that lists it, and arms left without a label are dropped.
+func (g *CGenerator) genMatch(stmtMatch *NodeStmtMatch) {
+	cases, defaultArm := matchCases(stmtMatch)
+	labels := make([][]string, len(stmtMatch.Arms))
+	for _, c := range cases {
+		labels[c.Arm] = append(labels[c.Arm], "case "+cInt(c.Value)+":")
+	}
+	if defaultArm >= 0 {
+		labels[defaultArm] = append(labels[defaultArm], "default:")
+	}
+	for _, loop := range g.loops {
+		loop.Switches++
+	}
+	g.line("switch (" + g.genExpr(stmtMatch.Expr) + ") {")
+	for i, arm := range stmtMatch.Arms {
+		if len(labels[i]) == 0 {
+			continue
+		}
+		g.line(strings.Join(labels[i], " ") + " {")
+		g.genScope(arm.Scope)
+		g.indent++
+		g.line("break;")
+		g.indent--
+		g.line("}")
+	}
+	g.line("}")
+	for _, loop := range g.loops {
+		loop.Switches--
+	}
+}
+
+// genSimpleStmt translates a `let`, assignment or update into a C
+// declaration or expression without its `;`, so that it can also serve as
+// a clause of a C `for`.
+func (g *CGenerator) genSimpleStmt(stmt *NodeStmt) string {
+	switch v := stmt.Var.(type) {
+	case *NodeStmtLet:
+		if length := letLen(v); length > 0 {
+			decl := fmt.Sprintf("int64_t %s[%d] = ", cIdent(*v.Ident.Value), length)
+			if v.Array == nil {
+				return decl + "{0}"
+			}
+			elems := make([]string, len(v.Array.Elems))
+			for i, elem := range v.Array.Elems {
+				elems[i] = g.genExpr(elem)
+			}
+			return decl + "{" + strings.Join(elems, ", ") + "}"
+		}
+		if v.Expr != nil {
+			return "int64_t " + cIdent(*v.Ident.Value) + " = " + g.genExpr(v.Expr)
+		}
+		return "int64_t " + cIdent(*v.Ident.Value) + " = 0"
+	case *NodeStmtAssign:
+		if (v.Index == nil && v.Deref == nil) || faultFree(v.Expr) {
+			return g.genTarget(v.Ident, v.Index, v.Deref) + " = " + g.genExpr(v.Expr)
+		}
+		// The operands of = are unsequenced too
+		temp := g.pushTemp()
+		value := g.genExpr(v.Expr)
+		target := g.genTarget(v.Ident, v.Index, v.Deref)
+		g.temps--
+		return "(" + temp + " = " + value + ", " + target + " = " + temp + ")"
+	case *NodeStmtUpdate:
+		return g.genUpdate(v)
+	}
+	panic("Unreachable")
+}
+
+// genUpdate translates an update into a C expression. The value is
+// evaluated before the element or pointer it updates, as the assembly
+// backends do, so it goes in a temporary unless evaluating it cannot
+// fault. The target is only evaluated once, through the pointer p. A plain
+// variable needs neither.
+func (g *CGenerator) genUpdate(update *NodeStmtUpdate) string {
+	helper := cHelper(updateOp(update))
+	if update.Index == nil && update.Deref == nil {
+		name := cIdent(*update.Ident.Value)
+		return name + " = " + helper + "(" + name + ", " + g.genExpr(update.Expr) + ")"
+	}
+	g.updatePtr = true
+	if faultFree(update.Expr) {
+		target := g.genTarget(update.Ident, update.Index, update.Deref)
+		return "(p = &" + target + ", *p = " + helper + "(*p, " + g.genExpr(update.Expr) + "))"
+	}
+	temp := g.pushTemp()
+	value := g.genExpr(update.Expr)
+	target := g.genTarget(update.Ident, update.Index, update.Deref)
+	g.temps--
+	return "(" + temp + " = " + value + ", p = &" + target + ", *p = " + helper + "(*p, " + temp + "))"
+}
+
+// pushTemp returns a temporary that is free until the matching g.temps--.
+// Temporaries are declared once at the top of main and reused, like
+// registers, by every expression that needs one at the same depth.
+func (g *CGenerator) pushTemp() string {
+	temp := "t" + strconv.Itoa(g.temps)
+	g.temps++
+	g.maxTemps = max(g.maxTemps, g.temps)
+	return temp
+}
+
+func (g *CGenerator) GenProg() string {
+	g.output.WriteString(cPrelude)
+	for _, stmt := range g.prog.Stmts {
+		if stmtStatic, ok := stmt.Var.(*NodeStmtStatic); ok {
+			static := newStatic(stmtStatic, 0)
+			g.output.WriteString("static int64_t " + cIdent(static.Name) + " = " + cInt(static.Value) + ";\n")
+		}
+	}
+	g.output.WriteString("\nint main(void) {\n")
+	body := g.output.Len()
+
+	g.indent++
+	for _, stmt := range g.prog.Stmts {
+		g.genStmt(stmt)
+	}
+	g.line("return 0;")
+	g.indent--
+
+	g.output.WriteString("}\n")
+	output := g.output.String()
+	var decls strings.Builder
+	if g.maxTemps > 0 {
+		temps := make([]string, g.maxTemps)
+		for i := range temps {
+			temps[i] = "t" + strconv.Itoa(i)
+		}
+		decls.WriteString("    int64_t " + strings.Join(temps, ", ") + ";\n")
+	}
+	if g.updatePtr {
+		decls.WriteString("    int64_t *p;\n")
+	}
+	return output[:body] + decls.String() + output[body:]
+}
+
+func (g *CGenerator) createLabel() string {
+	label := "label" + strconv.Itoa(g.labelCount)
+	g.labelCount++
+	return label
+}
+
+func (g *CGenerator) line(text string) {
+	g.output.WriteString(strings.Repeat("    ", g.indent) + text + "\n")
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// LLVMGenerator emits textual LLVM IR. Every `let` gets an alloca in the
+// entry block, so mem2reg can promote them, and if/elif/else branches are
+// basic blocks named with the same labels createLabel hands out in
+// Generator. Statics are internal globals, and an array is an alloca of
+// an LLVM array type. A pointer is an i64 like every other value, which
+// goes through inttoptr to be dereferenced. Debug adds the checks described
+// at faultTrap.
+type LLVMGenerator struct {
+	prog       NodeProg
+	allocas    strings.Builder
+	body       strings.Builder
+	vars       []Var
+	statics    []Static
+	scopes     []int
+	loops      []Loop
+	faultTraps []faultTrap
+	tempCount  int
+	allocCount int
+	labelCount int
+	trapLabel  string
+	Debug      bool
+}
+
+func NewLLVMGenerator(prog NodeProg) *LLVMGenerator {
+	return &LLVMGenerator{
+		prog:       prog,
+		vars:       make([]Var, 0),
+		scopes:     make([]int, 0),
+		tempCount:  0,
+		allocCount: 0,
+		labelCount: 0,
+	}
+}
+
+// genTerm returns the i64 operand holding the term's value.
+func (g *LLVMGenerator) genTerm(term *NodeTerm) string {
+	switch v := term.Var.(type) {
+	case *NodeTermIntLit:
+		return strconv.FormatInt(intLitValue(v.IntLit), 10)
+	case *NodeTermIdent:
+		temp := g.createTemp()
+		g.inst(fmt.Sprintf("%s = load i64, i64* %s", temp, g.varPtr(*v.Ident.Value)))
+		return temp
+	case *NodeTermIndex:
+		temp := g.createTemp()
+		g.inst(fmt.Sprintf("%s = load i64, i64* %s", temp, g.elemPtr(v.Ident, v.Index)))
+		return temp
+	case *NodeTermAddr:
+		temp := g.createTemp()
+		g.inst(fmt.Sprintf("%s = ptrtoint i64* %s to i64", temp, g.targetPtr(v.Ident, v.Index, nil)))
+		return temp
+	case *NodeTermDeref:
+		temp := g.createTemp()
+		g.inst(fmt.Sprintf("%s = load i64, i64* %s", temp, g.derefPtr(v)))
+		return temp
+	case *NodeTermParen:
+		return g.genExpr(v.Expr)
+	case *NodeTermBitNot:
+		val := g.genExpr(v.Expr)
+		temp := g.createTemp()
+		g.inst(fmt.Sprintf("%s = xor i64 %s, -1", temp, val))
+		return temp
+	}
+	panic("Unreachable")
+}
+
+// elemPtr returns a pointer to the element of the array ident names at
+// index. A debug build first branches to a trap if the index, compared as
+// unsigned so that negative ones are caught too, is out of bounds.
+func (g *LLVMGenerator) elemPtr(ident Token, index *NodeExpr) string {
+	indexVal := g.genExpr(index)
+	length := g.lookupVar(*ident.Value).Len
+	if g.Debug {
+		trap := faultTrapLabel(&g.faultTraps, faultError{kind: faultBounds, line: ident.Line}, g.createLabel)
+		bad := g.createTemp()
+		g.inst(fmt.Sprintf("%s = icmp ugt i64 %s, %d", bad, indexVal, length-1))
+		label := g.createLabel()
+		g.inst(fmt.Sprintf("br i1 %s, label %%%s, label %%%s", bad, trap, label))
+		g.block(label)
+	}
+	ptr := g.createTemp()
+	g.inst(fmt.Sprintf("%s = getelementptr [%d x i64], [%d x i64]* %s, i64 0, i64 %s", ptr, length, length, g.varPtr(*ident.Value), indexVal))
+	return ptr
+}
+
+// derefPtr returns the pointer deref dereferences. A debug build first
+// branches to a trap if it is null.
+func (g *LLVMGenerator) derefPtr(deref *NodeTermDeref) string {
+	val := g.genExpr(deref.Expr)
+	if g.Debug {
+		trap := faultTrapLabel(&g.faultTraps, faultError{kind: faultNull, line: deref.Star.Line}, g.createLabel)
+		bad := g.createTemp()
+		g.inst(fmt.Sprintf("%s = icmp eq i64 %s, 0", bad, val))
+		label := g.createLabel()
+		g.inst(fmt.Sprintf("br i1 %s, label %%%s, label %%%s", bad, trap, label))
+		g.block(label)
+	}
+	ptr := g.createTemp()
+	g.inst(fmt.Sprintf("%s = inttoptr i64 %s to i64*", ptr, val))
+	return ptr
+}
+
+func (g *LLVMGenerator) genBinExpr(binExpr *NodeBinExpr) string {
+	lhs, rhs := binOperands(binExpr)
+	// The right operand first, like the other backends
+	rhsVal := g.genExpr(rhs)
+	lhsVal := g.genExpr(lhs)
+	return g.genOp(binExprOp(binExpr), lhsVal, rhsVal)
+}
+
+// genOp returns a temp holding lhsVal op rhsVal.
+func (g *LLVMGenerator) genOp(op TokenType, lhsVal string, rhsVal string) string {
+	var inst string
+	switch op {
+	case TokenMinus:
+		inst = "sub"
+	case TokenPlus:
+		inst = "add"
+	case TokenStar:
+		inst = "mul"
+	case TokenFslash:
+		g.genDivCheck(lhsVal, rhsVal)
+		inst = "sdiv"
+	case TokenPercent:
+		g.genDivCheck(lhsVal, rhsVal)
+		inst = "srem"
+	case TokenAmp:
+		inst = "and"
+	case TokenPipe:
+		inst = "or"
+	case TokenCaret:
+		inst = "xor"
+	case TokenShl, TokenShr, TokenUshr:
+		// Shifting by 64 or more is poison, so mask the count like the
+		// hardware shifts do
+		count := g.createTemp()
+		g.inst(fmt.Sprintf("%s = and i64 %s, 63", count, rhsVal))
+		rhsVal = count
+		inst = llvmShifts[op]
+	case TokenEqEq, TokenNe, TokenLt, TokenLe, TokenGt, TokenGe:
+		cond := g.createTemp()
+		g.inst(fmt.Sprintf("%s = icmp %s i64 %s, %s", cond, llvmConds[op], lhsVal, rhsVal))
+		temp := g.createTemp()
+		g.inst(fmt.Sprintf("%s = zext i1 %s to i64", temp, cond))
+		return temp
+	}
+	temp := g.createTemp()
+	g.inst(fmt.Sprintf("%s = %s i64 %s, %s", temp, inst, lhsVal, rhsVal))
+	return temp
+}
+
+// llvmConds maps each comparison onto its icmp condition.
+var llvmConds = map[TokenType]string{
+	TokenEqEq: "eq",
+	TokenNe:   "ne",
+	TokenLt:   "slt",
+	TokenLe:   "sle",
+	TokenGt:   "sgt",
+	TokenGe:   "sge",
+}
+
+// llvmShifts maps each shift operator to its instruction.
+var llvmShifts = map[TokenType]string{
+	TokenShl:  "shl",
+	TokenShr:  "ashr",
+	TokenUshr: "lshr",
+}
+
+// genDivCheck branches to a trap on the operands idiv traps on, which
+// would otherwise be undefined behaviour for sdiv and srem. The trap
+// raises SIGFPE, then exits with exitDivFault in case it is ignored.
+func (g *LLVMGenerator) genDivCheck(lhsVal string, rhsVal string) {
+	if g.trapLabel == "" {
+		g.trapLabel = g.createLabel()
+	}
+	zero := g.createTemp()
+	g.inst(fmt.Sprintf("%s = icmp eq i64 %s, 0", zero, rhsVal))
+	minLhs := g.createTemp()
+	g.inst(fmt.Sprintf("%s = icmp eq i64 %s, -9223372036854775808", minLhs, lhsVal))
+	negRhs := g.createTemp()
+	g.inst(fmt.Sprintf("%s = icmp eq i64 %s, -1", negRhs, rhsVal))
+	overflow := g.createTemp()
+	g.inst(fmt.Sprintf("%s = and i1 %s, %s", overflow, minLhs, negRhs))
+	bad := g.createTemp()
+	g.inst(fmt.Sprintf("%s = or i1 %s, %s", bad, zero, overflow))
+	label := g.createLabel()
+	g.inst(fmt.Sprintf("br i1 %s, label %%%s, label %%%s", bad, g.trapLabel, label))
+	g.block(label)
+}
+
+func (g *LLVMGenerator) genExpr(expr *NodeExpr) string {
+	switch v := expr.Var.(type) {
+	case *NodeTerm:
+		return g.genTerm(v)
+	case *NodeBinExpr:
+		return g.genBinExpr(v)
+	}
+	panic("Unreachable")
+}
+
+// genCond returns an i1 that is true when expr is nonzero.
+func (g *LLVMGenerator) genCond(expr *NodeExpr) string {
+	val := g.genExpr(expr)
+	cond := g.createTemp()
+	g.inst(fmt.Sprintf("%s = icmp ne i64 %s, 0", cond, val))
+	return cond
+}
+
+func (g *LLVMGenerator) genScope(scope *NodeScope) {
+	g.scopes = append(g.scopes, len(g.vars))
+	for _, stmt := range scope.Stmts {
+		g.genStmt(stmt)
+	}
+	g.vars = g.vars[:g.scopes[len(g.scopes)-1]]
+	g.scopes = g.scopes[:len(g.scopes)-1]
+}
+
+func (g *LLVMGenerator) genIfPred(pred *NodeIfPred, endLabel string) {
+	switch v := pred.Var.(type) {
+	case *NodeIfPredElif:
+		cond := g.genCond(v.Expr)
+		thenLabel := g.createLabel()
+		label := g.createLabel()
+		g.inst(fmt.Sprintf("br i1 %s, label %%%s, label %%%s", cond, thenLabel, label))
+		g.block(thenLabel)
+		g.genScope(v.Scope)
+		g.inst("br label %" + endLabel)
+		g.block(label)
+		if v.Pred != nil {
+			g.genIfPred(v.Pred, endLabel)
+		}
+	case *NodeIfPredElse:
+		g.genScope(v.Scope)
+	}
+}
+
+func (g *LLVMGenerator) genStmt(stmt *NodeStmt) {
+	switch v := stmt.Var.(type) {
+	case *NodeStmtExit:
+		val := g.genExpr(v.Expr)
+		code := g.createTemp()
+		g.inst(fmt.Sprintf("%s = trunc i64 %s to i32", code, val))
+		g.inst(fmt.Sprintf("call void @exit(i32 %s)", code))
+		g.inst("unreachable")
+		// Anything after exit lands in an unreachable block of its own
+		g.block(g.createLabel())
+	case *NodeStmtLet:
+		if length := letLen(v); length > 0 {
+			g.genArray(v, length)
+			break
+		}
+		var val string
+		if v.Expr != nil {
+			val = g.genExpr(v.Expr)
+		}
+		g.vars = append(g.vars, Var{Name: *v.Ident.Value, StackLoc: g.allocCount})
+		g.allocCount++
+		ptr := g.varPtr(*v.Ident.Value)
+		g.allocas.WriteString("  " + ptr + " = alloca i64\n")
+		if v.Expr != nil {
+			g.inst(fmt.Sprintf("store i64 %s, i64* %s", val, ptr))
+		}
+	case *NodeStmtStatic:
+		g.statics = append(g.statics, newStatic(v, len(g.statics)))
+	case *NodeStmtAssign:
+		val := g.genExpr(v.Expr)
+		g.inst(fmt.Sprintf("store i64 %s, i64* %s", val, g.targetPtr(v.Ident, v.Index, v.Deref)))
+	case *NodeStmtUpdate:
+		rhsVal := g.genExpr(v.Expr)
+		ptr := g.targetPtr(v.Ident, v.Index, v.Deref)
+		lhsVal := g.createTemp()
+		g.inst(fmt.Sprintf("%s = load i64, i64* %s", lhsVal, ptr))
+		g.inst(fmt.Sprintf("store i64 %s, i64* %s", g.genOp(updateOp(v), lhsVal, rhsVal), ptr))
+	case *NodeScope:
+		g.genScope(v)
+	case *NodeStmtIf:
+		cond := g.genCond(v.Expr)
+		thenLabel := g.createLabel()
+		label := g.createLabel()
+		g.inst(fmt.Sprintf("br i1 %s, label %%%s, label %%%s", cond, thenLabel, label))
+		g.block(thenLabel)
+		g.genScope(v.Scope)
+		if v.Pred != nil {
+			endLabel := g.createLabel()
+			g.inst("br label %" + endLabel)
+			g.block(label)
+			g.genIfPred(v.Pred, endLabel)
+			g.inst("br label %" + endLabel)
+			g.block(endLabel)
+		} else {
+			g.inst("br label %" + label)
+			g.block(label)
+		}
+	case *NodeStmtFor:
+		g.genFor(v)
+	case *NodeStmtMatch:
+		g.genMatch(v)
+	case *NodeStmtBreak:
+		g.genJumpOut(g.loops[len(g.loops)-1].BreakLabel)
+	case *NodeStmtContinue:
+		g.genJumpOut(g.loops[len(g.loops)-1].ContinueLabel)
+	}
+}
+
+// targetPtr returns a pointer to the variable, or the element of it at
+// index when that is set, or the pointer deref dereferences when that is
+// set, that an assignment or update stores to or `&` takes.
+func (g *LLVMGenerator) targetPtr(ident Token, index *NodeExpr, deref *NodeTermDeref) string {
+	if deref != nil {
+		return g.derefPtr(deref)
+	}
+	if index != nil {
+		return g.elemPtr(ident, index)
+	}
+	return g.varPtr(*ident.Value)
+}
+
+// genArray gives an array an alloca in the entry block, and stores each
+// element of its literal, or zeroes it, where the `let` runs.
+func (g *LLVMGenerator) genArray(stmtLet *NodeStmtLet, length int) {
+	arrayType := fmt.Sprintf("[%d x i64]", length)
+	var vals []string
+	if stmtLet.Array != nil {
+		for _, elem := range stmtLet.Array.Elems {
+			vals = append(vals, g.genExpr(elem))
+		}
+	}
+	g.vars = append(g.vars, Var{Name: *stmtLet.Ident.Value, StackLoc: g.allocCount, Len: length})
+	g.allocCount++
+	ptr := g.varPtr(*stmtLet.Ident.Value)
+	g.allocas.WriteString(fmt.Sprintf("  %s = alloca %s\n", ptr, arrayType))
+	if stmtLet.Array == nil {
+		g.inst(fmt.Sprintf("store %s zeroinitializer, %s* %s", arrayType, arrayType, ptr))
+		return
+	}
+	for i, val := range vals {
+		elem := g.createTemp()
+		g.inst(fmt.Sprintf("%s = getelementptr %s, %s* %s, i64 0, i64 %d", elem, arrayType, arrayType, ptr, i))
+		g.inst(fmt.Sprintf("store i64 %s, i64* %s", val, elem))
+	}
+}
+
+// genFor tests the condition in a block of its own at the top of the
+// loop, and gives the step a block that `continue` branches to.
+func (g *LLVMGenerator) genFor(stmtFor *NodeStmtFor) {
+	g.scopes = append(g.scopes, len(g.vars))
+	if stmtFor.Init != nil {
+		g.genStmt(stmtFor.Init)
+	}
+	topLabel := g.createLabel()
+	bodyLabel := g.createLabel()
+	loop := Loop{BreakLabel: g.createLabel(), ContinueLabel: g.createLabel()}
+	g.inst("br label %" + topLabel)
+	g.block(topLabel)
+	if stmtFor.Cond != nil {
+		cond := g.genCond(stmtFor.Cond)
+		g.inst(fmt.Sprintf("br i1 %s, label %%%s, label %%%s", cond, bodyLabel, loop.BreakLabel))
+	} else {
+		g.inst("br label %" + bodyLabel)
+	}
+	g.block(bodyLabel)
+	g.loops = append(g.loops, loop)
+	g.genScope(stmtFor.Scope)
+	g.loops = g.loops[:len(g.loops)-1]
+	g.inst("br label %" + loop.ContinueLabel)
+	g.block(loop.ContinueLabel)
+	if stmtFor.Step != nil {
+		g.genStmt(stmtFor.Step)
+	}
+	g.inst("br label %" + topLabel)
+	g.block(loop.BreakLabel)
+	g.vars = g.vars[:g.scopes[len(g.scopes)-1]]
+	g.scopes = g.scopes[:len(g.scopes)-1]
+}
+
+// genMatch leaves the choice between a jump table and a search to LLVM's
+// switch lowering.
+func (g *LLVMGenerator) genMatch(stmtMatch *NodeStmtMatch) {
+	val := g.genExpr(stmtMatch.Expr)
+	cases, defaultArm := matchCases(stmtMatch)
+	armLabels := make([]string, len(stmtMatch.Arms))
+	for i := range armLabels {
+		armLabels[i] = g.createLabel()
+	}
+	endLabel := g.createLabel()
+	defaultLabel := endLabel
+	if defaultArm >= 0 {
+		defaultLabel = armLabels[defaultArm]
+	}
+	var targets strings.Builder
+	for _, c := range cases {
+		targets.WriteString(fmt.Sprintf(" i64 %d, label %%%s", c.Value, armLabels[c.Arm]))
+	}
+	g.inst(fmt.Sprintf("switch i64 %s, label %%%s [%s ]", val, defaultLabel, targets.String()))
+	for i, arm := range stmtMatch.Arms {
+		g.block(armLabels[i])
+		g.genScope(arm.Scope)
+		g.inst("br label %" + endLabel)
+	}
+	g.block(endLabel)
+}
+
+// genJumpOut branches to a label of the innermost loop. Anything after it
+// lands in an unreachable block of its own, as after exit.
+func (g *LLVMGenerator) genJumpOut(label string) {
+	g.inst("br label %" + label)
+	g.block(g.createLabel())
+}
+
+func (g *LLVMGenerator) GenProg() string {
+	for _, stmt := range g.prog.Stmts {
+		g.genStmt(stmt)
+	}
+	g.inst("ret i32 0")
+	if g.trapLabel != "" {
+		g.block(g.trapLabel)
+		// Like idiv, raise SIGFPE, which is 8 on every target lli runs
+		g.inst("call i32 @raise(i32 8)")
+		g.inst(fmt.Sprintf("call void @exit(i32 %d)", exitDivFault))
+		g.inst("unreachable")
+	}
+	for _, trap := range g.faultTraps {
+		message := trap.Fault.text()
+		g.block(trap.Label)
+		g.inst(fmt.Sprintf("call i64 @write(i32 2, i8* getelementptr ([%d x i8], [%d x i8]* @%s, i64 0, i64 0), i64 %d)",
+			len(message), len(message), trap.Message, len(message)))
+		g.inst(fmt.Sprintf("call void @exit(i32 %d)", trap.Fault.status()))
+		g.inst("unreachable")
+	}
+
+	var output strings.Builder
+	output.WriteString("declare void @exit(i32) noreturn\n")
+	if g.trapLabel != "" {
+		output.WriteString("declare i32 @raise(i32)\n")
+	}
+	if len(g.faultTraps) > 0 {
+		output.WriteString("declare i64 @write(i32, i8*, i64)\n")
+	}
+	if len(g.statics) > 0 || len(g.faultTraps) > 0 {
+		output.WriteString("\n")
+	}
+	for _, static := range g.statics {
+		output.WriteString(fmt.Sprintf("@%s = internal global i64 %d\n", static.Symbol, static.Value))
+	}
+	for _, trap := range g.faultTraps {
+		message := trap.Fault.text()
+		output.WriteString(fmt.Sprintf("@%s = private constant [%d x i8] c\"%s\"\n", trap.Message, len(message), llvmString(message)))
+	}
+	output.WriteString("\ndefine i32 @main() {\n")
+	output.WriteString("entry:\n")
+	output.WriteString(g.allocas.String())
+	output.WriteString(g.body.String())
+	output.WriteString("}\n")
+	return output.String()
+}
+
+func (g *LLVMGenerator) inst(text string) {
+	g.body.WriteString("  " + text + "\n")
+}
+
+// block starts a new basic block. The previous block must already end in a
+// terminator.
+func (g *LLVMGenerator) block(label string) {
+	g.body.WriteString(label + ":\n")
+}
+
+// varPtr returns the alloca of a variable, or the global of a static, the
+// Checker has already verified is declared. Names outside ASCII have to be
+// quoted in LLVM IR.
+func (g *LLVMGenerator) varPtr(name string) string {
+	if variable := g.lookupVar(name); variable != nil {
+		ptr := fmt.Sprintf("%s.%d", name, variable.StackLoc)
+		if !isASCII(ptr) {
+			return `%"` + ptr + `"`
+		}
+		return "%" + ptr
+	}
+	if static := lookupStatic(g.statics, name); static != nil {
+		return "@" + static.Symbol
+	}
+	panic("Unreachable")
+}
+
+// llvmString escapes s for a c"..." constant, which takes everything but
+// printable characters, quotes and backslashes as hex escapes.
+func llvmString(s string) string {
+	var output strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= ' ' && c <= '~' && c != '"' && c != '\\' {
+			output.WriteByte(c)
+		} else {
+			output.WriteString(fmt.Sprintf("\\%02X", c))
+		}
+	}
+	return output.String()
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupVar returns the local variable named name, or nil.
+func (g *LLVMGenerator) lookupVar(name string) *Var {
+	for i := range g.vars {
+		if g.vars[i].Name == name {
+			return &g.vars[i]
+		}
+	}
+	return nil
+}
+
+func (g *LLVMGenerator) createTemp() string {
+	temp := "%t" + strconv.Itoa(g.tempCount)
+	g.tempCount++
+	return temp
+}
+
+func (g *LLVMGenerator) createLabel() string {
+	label := "label" + strconv.Itoa(g.labelCount)
+	g.labelCount++
+	return label
+}
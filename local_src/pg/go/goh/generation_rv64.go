@@ -0,0 +1,603 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RISCVGenerator emits GNU assembler source for RV64IM Linux. It mirrors
+// Generator: every value lives in an 8-byte stack slot, t0 and t1 are
+// scratch registers and t2 holds out-of-range offsets and the addresses of
+// array elements. div and rem do not fault, so division checks its operands
+// and raises SIGFPE where idiv would. Debug adds the checks described at
+// faultTrap.
+type RISCVGenerator struct {
+	prog       NodeProg
+	output     strings.Builder
+	stackSize  int
+	vars       []Var
+	scopes     []int
+	loops      []Loop
+	tables     []jumpTable
+	statics    []Static
+	faultTraps []faultTrap
+	trapLabel  string
+	labelCount int
+	Debug      bool
+}
+
+const riscvSlotSize = 8
+
+func NewRISCVGenerator(prog NodeProg) *RISCVGenerator {
+	return &RISCVGenerator{
+		prog:       prog,
+		stackSize:  0,
+		vars:       make([]Var, 0),
+		scopes:     make([]int, 0),
+		labelCount: 0,
+	}
+}
+
+func (g *RISCVGenerator) genTerm(term *NodeTerm) {
+	switch v := term.Var.(type) {
+	case *NodeTermIntLit:
+		g.output.WriteString(fmt.Sprintf("    li t0, %d\n", intLitValue(v.IntLit)))
+		g.push("t0")
+	case *NodeTermIdent:
+		g.loadVar("t0", *v.Ident.Value)
+		g.push("t0")
+	case *NodeTermIndex:
+		g.genIndex(v.Ident, v.Index, "t1")
+		g.output.WriteString(fmt.Sprintf("    ld t0, %s\n", g.elemAddr(*v.Ident.Value, "t1")))
+		g.push("t0")
+	case *NodeTermAddr:
+		if v.Index != nil {
+			g.genIndex(v.Ident, v.Index, "t1")
+			g.genLea("t0", g.elemAddr(*v.Ident.Value, "t1"))
+		} else {
+			g.genLea("t0", g.varAddr(*v.Ident.Value))
+		}
+		g.push("t0")
+	case *NodeTermDeref:
+		g.genPointer(v, "t0")
+		g.output.WriteString("    ld t0, 0(t0)\n")
+		g.push("t0")
+	case *NodeTermParen:
+		g.genExpr(v.Expr)
+	case *NodeTermBitNot:
+		g.genExpr(v.Expr)
+		g.pop("t0")
+		g.output.WriteString("    not t0, t0\n")
+		g.push("t0")
+	}
+}
+
+// genIndex evaluates an index into the array ident names into reg. A debug
+// build checks it against the length of the array, as unsigned so that a
+// negative index is caught by the same compare.
+func (g *RISCVGenerator) genIndex(ident Token, index *NodeExpr, reg string) {
+	g.genExpr(index)
+	g.pop(reg)
+	if g.Debug {
+		trap := faultTrapLabel(&g.faultTraps, faultError{kind: faultBounds, line: ident.Line}, g.createLabel)
+		g.output.WriteString(fmt.Sprintf("    li t3, %d\n", g.lookupVar(*ident.Value).Len-1))
+		g.output.WriteString(fmt.Sprintf("    bgtu %s, t3, %s\n", reg, trap))
+	}
+}
+
+// genPointer evaluates the pointer deref dereferences into reg, which a
+// debug build checks is not null.
+func (g *RISCVGenerator) genPointer(deref *NodeTermDeref, reg string) {
+	g.genExpr(deref.Expr)
+	g.pop(reg)
+	if g.Debug {
+		trap := faultTrapLabel(&g.faultTraps, faultError{kind: faultNull, line: deref.Star.Line}, g.createLabel)
+		g.output.WriteString(fmt.Sprintf("    beqz %s, %s\n", reg, trap))
+	}
+}
+
+func (g *RISCVGenerator) genBinExpr(binExpr *NodeBinExpr) {
+	lhs, rhs := binOperands(binExpr)
+	g.genExpr(rhs)
+	g.genExpr(lhs)
+	g.pop("t0")
+	g.pop("t1")
+	g.genOp(binExprOp(binExpr))
+	g.push("t0")
+}
+
+// genOp computes t0 = t0 op t1.
+func (g *RISCVGenerator) genOp(op TokenType) {
+	switch op {
+	case TokenMinus:
+		g.output.WriteString("    sub t0, t0, t1\n")
+	case TokenPlus:
+		g.output.WriteString("    add t0, t0, t1\n")
+	case TokenStar:
+		g.output.WriteString("    mul t0, t0, t1\n")
+	case TokenFslash:
+		g.genDivCheck()
+		g.output.WriteString("    div t0, t0, t1\n")
+	case TokenPercent:
+		g.genDivCheck()
+		g.output.WriteString("    rem t0, t0, t1\n")
+	case TokenAmp:
+		g.output.WriteString("    and t0, t0, t1\n")
+	case TokenPipe:
+		g.output.WriteString("    or t0, t0, t1\n")
+	case TokenCaret:
+		g.output.WriteString("    xor t0, t0, t1\n")
+	case TokenShl:
+		g.output.WriteString("    sll t0, t0, t1\n")
+	case TokenShr:
+		g.output.WriteString("    sra t0, t0, t1\n")
+	case TokenUshr:
+		g.output.WriteString("    srl t0, t0, t1\n")
+	// slt is the only comparison, so the others swap its operands or
+	// invert its result
+	case TokenLt:
+		g.output.WriteString("    slt t0, t0, t1\n")
+	case TokenGt:
+		g.output.WriteString("    slt t0, t1, t0\n")
+	case TokenLe:
+		g.output.WriteString("    slt t0, t1, t0\n")
+		g.output.WriteString("    xori t0, t0, 1\n")
+	case TokenGe:
+		g.output.WriteString("    slt t0, t0, t1\n")
+		g.output.WriteString("    xori t0, t0, 1\n")
+	case TokenEqEq:
+		g.output.WriteString("    sub t0, t0, t1\n")
+		g.output.WriteString("    seqz t0, t0\n")
+	case TokenNe:
+		g.output.WriteString("    sub t0, t0, t1\n")
+		g.output.WriteString("    snez t0, t0\n")
+	}
+}
+
+// genDivCheck leaves to the trap when t1 is zero, or when t0 is INT64_MIN
+// and t1 is -1, where div and rem quietly give a result rather than fault
+// like idiv. The second case is tested without branching, in t3 and t5.
+func (g *RISCVGenerator) genDivCheck() {
+	if g.trapLabel == "" {
+		g.trapLabel = g.createLabel()
+	}
+	g.output.WriteString("    beqz t1, " + g.trapLabel + "\n")
+	g.output.WriteString("    addi t3, t1, 1\n")
+	g.output.WriteString("    li t5, 1\n")
+	g.output.WriteString("    slli t5, t5, 63\n")
+	g.output.WriteString("    xor t5, t5, t0\n")
+	g.output.WriteString("    or t3, t3, t5\n")
+	g.output.WriteString("    beqz t3, " + g.trapLabel + "\n")
+}
+
+func (g *RISCVGenerator) genExpr(expr *NodeExpr) {
+	switch v := expr.Var.(type) {
+	case *NodeTerm:
+		g.genTerm(v)
+	case *NodeBinExpr:
+		g.genBinExpr(v)
+	}
+}
+
+func (g *RISCVGenerator) genScope(scope *NodeScope) {
+	g.beginScope()
+	for _, stmt := range scope.Stmts {
+		g.genStmt(stmt)
+	}
+	g.endScope()
+}
+
+func (g *RISCVGenerator) genIfPred(pred *NodeIfPred, endLabel string) {
+	switch v := pred.Var.(type) {
+	case *NodeIfPredElif:
+		g.output.WriteString("    # elif\n")
+		g.genExpr(v.Expr)
+		g.pop("t0")
+		label := g.createLabel()
+		g.output.WriteString("    beqz t0, " + label + "\n")
+		g.genScope(v.Scope)
+		g.output.WriteString("    j " + endLabel + "\n")
+		g.output.WriteString(label + ":\n")
+		if v.Pred != nil {
+			g.genIfPred(v.Pred, endLabel)
+		}
+	case *NodeIfPredElse:
+		g.output.WriteString("    # else\n")
+		g.genScope(v.Scope)
+	}
+}
+
+func (g *RISCVGenerator) genStmt(stmt *NodeStmt) {
+	switch v := stmt.Var.(type) {
+	case *NodeStmtExit:
+		g.output.WriteString("    # exit\n")
+		g.genExpr(v.Expr)
+		g.pop("a0")
+		g.output.WriteString("    li a7, 93\n")
+		g.output.WriteString("    ecall\n")
+		g.output.WriteString("    # /exit\n")
+	case *NodeStmtLet:
+		g.output.WriteString("    # let\n")
+		if length := letLen(v); length > 0 {
+			g.genArray(v, length)
+		} else {
+			g.vars = append(g.vars, Var{Name: *v.Ident.Value, StackLoc: g.stackSize})
+			if v.Expr != nil {
+				g.genExpr(v.Expr)
+			} else {
+				g.allocate(1)
+				g.stackSize++
+			}
+		}
+		g.output.WriteString("    # /let\n")
+	case *NodeStmtAssign:
+		g.genExpr(v.Expr)
+		if v.Deref != nil {
+			g.genPointer(v.Deref, "t1")
+			g.pop("t0")
+			g.output.WriteString("    sd t0, 0(t1)\n")
+			break
+		}
+		if v.Index != nil {
+			g.genIndex(v.Ident, v.Index, "t1")
+			g.pop("t0")
+			g.output.WriteString(fmt.Sprintf("    sd t0, %s\n", g.elemAddr(*v.Ident.Value, "t1")))
+			break
+		}
+		g.pop("t0")
+		g.storeVar("t0", *v.Ident.Value)
+	case *NodeStmtUpdate:
+		g.genExpr(v.Expr)
+		if v.Deref != nil {
+			// genOp leaves t4 alone
+			g.genPointer(v.Deref, "t4")
+			g.pop("t1")
+			g.output.WriteString("    ld t0, 0(t4)\n")
+			g.genOp(updateOp(v))
+			g.output.WriteString("    sd t0, 0(t4)\n")
+			break
+		}
+		if v.Index != nil {
+			// genOp leaves t2 and t4 alone
+			g.genIndex(v.Ident, v.Index, "t4")
+			g.pop("t1")
+			addr := g.elemAddr(*v.Ident.Value, "t4")
+			g.output.WriteString(fmt.Sprintf("    ld t0, %s\n", addr))
+			g.genOp(updateOp(v))
+			g.output.WriteString(fmt.Sprintf("    sd t0, %s\n", addr))
+			break
+		}
+		g.pop("t1")
+		g.loadVar("t0", *v.Ident.Value)
+		g.genOp(updateOp(v))
+		g.storeVar("t0", *v.Ident.Value)
+	case *NodeScope:
+		g.output.WriteString("    # scope\n")
+		g.genScope(v)
+		g.output.WriteString("    # /scope\n")
+	case *NodeStmtIf:
+		g.output.WriteString("    # if\n")
+		g.genExpr(v.Expr)
+		g.pop("t0")
+		label := g.createLabel()
+		g.output.WriteString("    beqz t0, " + label + "\n")
+		g.genScope(v.Scope)
+		if v.Pred != nil {
+			endLabel := g.createLabel()
+			g.output.WriteString("    j " + endLabel + "\n")
+			g.output.WriteString(label + ":\n")
+			g.genIfPred(v.Pred, endLabel)
+			g.output.WriteString(endLabel + ":\n")
+		} else {
+			g.output.WriteString(label + ":\n")
+		}
+		g.output.WriteString("    # /if\n")
+	case *NodeStmtFor:
+		g.output.WriteString("    # for\n")
+		g.genFor(v)
+		g.output.WriteString("    # /for\n")
+	case *NodeStmtStatic:
+		g.statics = append(g.statics, newStatic(v, len(g.statics)))
+	case *NodeStmtMatch:
+		g.output.WriteString("    # match\n")
+		g.genMatch(v)
+		g.output.WriteString("    # /match\n")
+	case *NodeStmtBreak:
+		g.genJumpOut(g.loops[len(g.loops)-1].BreakLabel)
+	case *NodeStmtContinue:
+		g.genJumpOut(g.loops[len(g.loops)-1].ContinueLabel)
+	}
+}
+
+// genArray allocates the slots of an array, then stores each element of
+// its literal in turn, or zeroes them all.
+func (g *RISCVGenerator) genArray(stmtLet *NodeStmtLet, length int) {
+	g.allocate(length)
+	g.stackSize += length
+	variable := Var{Name: *stmtLet.Ident.Value, StackLoc: g.stackSize - 1, Len: length}
+	g.vars = append(g.vars, variable)
+	if stmtLet.Array == nil {
+		label := g.createLabel()
+		g.output.WriteString("    mv t2, sp\n")
+		g.output.WriteString(fmt.Sprintf("    li t3, %d\n", length))
+		g.output.WriteString(label + ":\n")
+		g.output.WriteString("    sd zero, 0(t2)\n")
+		g.output.WriteString(fmt.Sprintf("    addi t2, t2, %d\n", riscvSlotSize))
+		g.output.WriteString("    addi t3, t3, -1\n")
+		g.output.WriteString("    bnez t3, " + label + "\n")
+		return
+	}
+	for i, elem := range stmtLet.Array.Elems {
+		g.genExpr(elem)
+		g.pop("t0")
+		offset := (g.stackSize-variable.StackLoc-1)*riscvSlotSize + i*8
+		g.output.WriteString(fmt.Sprintf("    sd t0, %s\n", g.spAddr(offset)))
+	}
+}
+
+func (g *RISCVGenerator) genFor(stmtFor *NodeStmtFor) {
+	g.beginScope()
+	if stmtFor.Init != nil {
+		g.genStmt(stmtFor.Init)
+	}
+	topLabel := g.createLabel()
+	loop := Loop{BreakLabel: g.createLabel(), ContinueLabel: g.createLabel(), StackSize: g.stackSize}
+	g.output.WriteString(topLabel + ":\n")
+	if stmtFor.Cond != nil {
+		g.genExpr(stmtFor.Cond)
+		g.pop("t0")
+		g.output.WriteString("    beqz t0, " + loop.BreakLabel + "\n")
+	}
+	g.loops = append(g.loops, loop)
+	g.genScope(stmtFor.Scope)
+	g.loops = g.loops[:len(g.loops)-1]
+	g.output.WriteString(loop.ContinueLabel + ":\n")
+	if stmtFor.Step != nil {
+		g.genStmt(stmtFor.Step)
+	}
+	g.output.WriteString("    j " + topLabel + "\n")
+	g.output.WriteString(loop.BreakLabel + ":\n")
+	g.endScope()
+}
+
+// genMatch keeps the value being matched in its stack slot until after the
+// arms, like Generator, and dispatches on it in t0.
+func (g *RISCVGenerator) genMatch(stmtMatch *NodeStmtMatch) {
+	g.genExpr(stmtMatch.Expr)
+	cases, defaultArm := matchCases(stmtMatch)
+	armLabels := make([]string, len(stmtMatch.Arms))
+	for i := range armLabels {
+		armLabels[i] = g.createLabel()
+	}
+	endLabel := g.createLabel()
+	defaultLabel := endLabel
+	if defaultArm >= 0 {
+		defaultLabel = armLabels[defaultArm]
+	}
+	g.output.WriteString("    ld t0, 0(sp)\n")
+	if denseCases(cases) {
+		g.genJumpTable(cases, armLabels, defaultLabel)
+	} else {
+		g.genSearch(cases, armLabels, defaultLabel)
+	}
+	for i, arm := range stmtMatch.Arms {
+		g.output.WriteString(armLabels[i] + ":\n")
+		g.genScope(arm.Scope)
+		g.output.WriteString("    j " + endLabel + "\n")
+	}
+	g.output.WriteString(endLabel + ":\n")
+	g.release(1)
+	g.stackSize--
+}
+
+// genJumpTable jumps through the entry for t0, or to defaultLabel if t0
+// lies outside the table.
+func (g *RISCVGenerator) genJumpTable(cases []matchCase, armLabels []string, defaultLabel string) {
+	table := jumpTable{Label: g.createLabel(), Entries: jumpTableEntries(cases, armLabels, defaultLabel)}
+	g.tables = append(g.tables, table)
+	if low := cases[0].Value; low != 0 {
+		g.output.WriteString(fmt.Sprintf("    li t1, %d\n", low))
+		g.output.WriteString("    sub t0, t0, t1\n")
+	}
+	g.output.WriteString(fmt.Sprintf("    li t1, %d\n", len(table.Entries)-1))
+	g.output.WriteString("    bgtu t0, t1, " + defaultLabel + "\n")
+	g.output.WriteString("    la t1, " + table.Label + "\n")
+	g.output.WriteString("    slli t0, t0, 3\n")
+	g.output.WriteString("    add t1, t1, t0\n")
+	g.output.WriteString("    ld t1, 0(t1)\n")
+	g.output.WriteString("    jr t1\n")
+}
+
+// genSearch finds t0 among the sorted cases by binary search, finishing
+// short runs with a chain of compares.
+func (g *RISCVGenerator) genSearch(cases []matchCase, armLabels []string, defaultLabel string) {
+	if len(cases) <= 3 {
+		for _, c := range cases {
+			g.output.WriteString(fmt.Sprintf("    li t1, %d\n", c.Value))
+			g.output.WriteString("    beq t0, t1, " + armLabels[c.Arm] + "\n")
+		}
+		g.output.WriteString("    j " + defaultLabel + "\n")
+		return
+	}
+	mid := len(cases) / 2
+	upperLabel := g.createLabel()
+	g.output.WriteString(fmt.Sprintf("    li t1, %d\n", cases[mid].Value))
+	g.output.WriteString("    beq t0, t1, " + armLabels[cases[mid].Arm] + "\n")
+	g.output.WriteString("    bgt t0, t1, " + upperLabel + "\n")
+	g.genSearch(cases[:mid], armLabels, defaultLabel)
+	g.output.WriteString(upperLabel + ":\n")
+	g.genSearch(cases[mid+1:], armLabels, defaultLabel)
+}
+
+// genJumpOut jumps to a label of the innermost loop, first releasing the
+// slots of the scopes it leaves.
+func (g *RISCVGenerator) genJumpOut(label string) {
+	g.release(g.stackSize - g.loops[len(g.loops)-1].StackSize)
+	g.output.WriteString("    j " + label + "\n")
+}
+
+func (g *RISCVGenerator) GenProg() string {
+	g.output.WriteString(".global _start\n_start:\n")
+
+	for _, stmt := range g.prog.Stmts {
+		g.genStmt(stmt)
+	}
+
+	g.output.WriteString("    li a0, 0\n")
+	g.output.WriteString("    li a7, 93\n")
+	g.output.WriteString("    ecall\n")
+	if g.trapLabel != "" {
+		// kill(getpid(), SIGFPE), as x86 faults on the same division, then
+		// exit_group(136) with the status the signal would have given
+		g.output.WriteString(g.trapLabel + ":\n")
+		g.output.WriteString("    li a7, 172\n")
+		g.output.WriteString("    ecall\n")
+		g.output.WriteString("    li a1, 8\n")
+		g.output.WriteString("    li a7, 129\n")
+		g.output.WriteString("    ecall\n")
+		g.output.WriteString("    li a0, 136\n")
+		g.output.WriteString("    li a7, 94\n")
+		g.output.WriteString("    ecall\n")
+	}
+	g.genFaultTraps()
+	writeJumpTables(&g.output, g.tables)
+	writeFaultMessages(&g.output, g.faultTraps)
+	writeStatics(&g.output, g.statics)
+	return g.output.String()
+}
+
+// genFaultTraps generates the traps that failed checks jump to, which
+// print their message to stderr and exit.
+func (g *RISCVGenerator) genFaultTraps() {
+	for _, trap := range g.faultTraps {
+		g.output.WriteString(trap.Label + ":\n")
+		g.output.WriteString("    li a0, 2\n")
+		g.output.WriteString("    la a1, " + trap.Message + "\n")
+		g.output.WriteString(fmt.Sprintf("    li a2, %d\n", len(trap.Fault.text())))
+		g.output.WriteString("    li a7, 64\n")
+		g.output.WriteString("    ecall\n")
+		g.output.WriteString(fmt.Sprintf("    li a0, %d\n", trap.Fault.status()))
+		g.output.WriteString("    li a7, 93\n")
+		g.output.WriteString("    ecall\n")
+	}
+}
+
+// varAddr returns the addressing mode for a variable's slot, going through
+// t2 when the offset does not fit in a 12-bit immediate, or for the address
+// of a static.
+func (g *RISCVGenerator) varAddr(name string) string {
+	if variable := g.lookupVar(name); variable != nil {
+		return g.spAddr((g.stackSize - variable.StackLoc - 1) * riscvSlotSize)
+	}
+	if static := lookupStatic(g.statics, name); static != nil {
+		g.output.WriteString("    la t2, " + static.Symbol + "\n")
+		return "0(t2)"
+	}
+	panic("Unreachable")
+}
+
+// spAddr returns the addressing mode for offset bytes above sp.
+func (g *RISCVGenerator) spAddr(offset int) string {
+	if offset <= 2047 {
+		return fmt.Sprintf("%d(sp)", offset)
+	}
+	g.output.WriteString(fmt.Sprintf("    li t2, %d\n", offset))
+	g.output.WriteString("    add t2, sp, t2\n")
+	return "0(t2)"
+}
+
+// elemAddr returns the addressing mode for the element of the array name
+// at the index in reg, whose address it computes in t2.
+func (g *RISCVGenerator) elemAddr(name string, reg string) string {
+	offset := (g.stackSize - g.lookupVar(name).StackLoc - 1) * riscvSlotSize
+	g.output.WriteString(fmt.Sprintf("    slli t2, %s, 3\n", reg))
+	g.output.WriteString("    add t2, sp, t2\n")
+	if offset <= 2047 {
+		return fmt.Sprintf("%d(t2)", offset)
+	}
+	g.output.WriteString(fmt.Sprintf("    li t3, %d\n", offset))
+	g.output.WriteString("    add t2, t2, t3\n")
+	return "0(t2)"
+}
+
+// genLea computes the address an addressing mode from varAddr or elemAddr
+// refers to into reg, as lea does on x86-64.
+func (g *RISCVGenerator) genLea(reg string, addr string) {
+	open := strings.Index(addr, "(")
+	g.output.WriteString(fmt.Sprintf("    addi %s, %s, %s\n", reg, addr[open+1:len(addr)-1], addr[:open]))
+}
+
+// lookupVar returns the stack variable named name, or nil.
+func (g *RISCVGenerator) lookupVar(name string) *Var {
+	for i := range g.vars {
+		if g.vars[i].Name == name {
+			return &g.vars[i]
+		}
+	}
+	return nil
+}
+
+func (g *RISCVGenerator) loadVar(reg string, name string) {
+	g.output.WriteString(fmt.Sprintf("    ld %s, %s\n", reg, g.varAddr(name)))
+}
+
+func (g *RISCVGenerator) storeVar(reg string, name string) {
+	g.output.WriteString(fmt.Sprintf("    sd %s, %s\n", reg, g.varAddr(name)))
+}
+
+func (g *RISCVGenerator) push(reg string) {
+	g.output.WriteString(fmt.Sprintf("    addi sp, sp, -%d\n", riscvSlotSize))
+	g.output.WriteString(fmt.Sprintf("    sd %s, 0(sp)\n", reg))
+	g.stackSize++
+}
+
+func (g *RISCVGenerator) pop(reg string) {
+	g.output.WriteString(fmt.Sprintf("    ld %s, 0(sp)\n", reg))
+	g.output.WriteString(fmt.Sprintf("    addi sp, sp, %d\n", riscvSlotSize))
+	g.stackSize--
+}
+
+func (g *RISCVGenerator) beginScope() {
+	g.scopes = append(g.scopes, len(g.vars))
+}
+
+func (g *RISCVGenerator) endScope() {
+	popCount := 0
+	for _, variable := range g.vars[g.scopes[len(g.scopes)-1]:] {
+		popCount += variable.Slots()
+	}
+	g.release(popCount)
+	g.stackSize -= popCount
+	g.vars = g.vars[:g.scopes[len(g.scopes)-1]]
+	g.scopes = g.scopes[:len(g.scopes)-1]
+}
+
+// allocate pushes count uninitialized slots without changing stackSize.
+func (g *RISCVGenerator) allocate(count int) {
+	if bytes := count * riscvSlotSize; bytes <= 2048 {
+		g.output.WriteString(fmt.Sprintf("    addi sp, sp, -%d\n", bytes))
+	} else {
+		g.output.WriteString(fmt.Sprintf("    li t2, %d\n", bytes))
+		g.output.WriteString("    sub sp, sp, t2\n")
+	}
+}
+
+// release pops count slots off the stack without changing stackSize.
+func (g *RISCVGenerator) release(count int) {
+	if count == 0 {
+		return
+	}
+	if bytes := count * riscvSlotSize; bytes <= 2047 {
+		g.output.WriteString(fmt.Sprintf("    addi sp, sp, %d\n", bytes))
+	} else {
+		g.output.WriteString(fmt.Sprintf("    li t2, %d\n", bytes))
+		g.output.WriteString("    add sp, sp, t2\n")
+	}
+}
+
+func (g *RISCVGenerator) createLabel() string {
+	label := "label" + strconv.Itoa(g.labelCount)
+	g.labelCount++
+	return label
+}
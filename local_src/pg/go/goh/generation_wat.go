@@ -0,0 +1,954 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+type WasmOp int
+
+const (
+	WasmComment WasmOp = iota
+	WasmI64Const
+	WasmI32Const
+	WasmLocalGet
+	WasmLocalSet
+	WasmLocalTee
+	WasmGlobalGet
+	WasmGlobalSet
+	WasmI64Load
+	WasmI64Store
+	WasmMemoryFill
+	WasmI64Add
+	WasmI64Sub
+	WasmI64Mul
+	WasmI64DivS
+	WasmI64RemS
+	WasmI64And
+	WasmI64Or
+	WasmI64Xor
+	WasmI64Shl
+	WasmI64ShrS
+	WasmI64ShrU
+	WasmI64Eqz
+	WasmI64Eq
+	WasmI64Ne
+	WasmI64LtS
+	WasmI64LeS
+	WasmI64GtS
+	WasmI64GeS
+	WasmI64GtU
+	WasmI64ExtendI32U
+	WasmI32Eqz
+	WasmI32WrapI64
+	WasmIf
+	WasmElse
+	WasmEnd
+	WasmBlock
+	WasmLoop
+	WasmBr
+	WasmBrIf
+	WasmBrTable
+	WasmCall
+	WasmDrop
+	WasmUnreachable
+)
+
+func (o WasmOp) String() string {
+	switch o {
+	case WasmComment:
+		return "comment"
+	case WasmI64Const:
+		return "i64.const"
+	case WasmI32Const:
+		return "i32.const"
+	case WasmLocalGet:
+		return "local.get"
+	case WasmLocalSet:
+		return "local.set"
+	case WasmLocalTee:
+		return "local.tee"
+	case WasmGlobalGet:
+		return "global.get"
+	case WasmGlobalSet:
+		return "global.set"
+	case WasmI64Load:
+		return "i64.load"
+	case WasmI64Store:
+		return "i64.store"
+	case WasmMemoryFill:
+		return "memory.fill"
+	case WasmI64Add:
+		return "i64.add"
+	case WasmI64Sub:
+		return "i64.sub"
+	case WasmI64Mul:
+		return "i64.mul"
+	case WasmI64DivS:
+		return "i64.div_s"
+	case WasmI64RemS:
+		return "i64.rem_s"
+	case WasmI64And:
+		return "i64.and"
+	case WasmI64Or:
+		return "i64.or"
+	case WasmI64Xor:
+		return "i64.xor"
+	case WasmI64Shl:
+		return "i64.shl"
+	case WasmI64ShrS:
+		return "i64.shr_s"
+	case WasmI64ShrU:
+		return "i64.shr_u"
+	case WasmI64Eqz:
+		return "i64.eqz"
+	case WasmI64Eq:
+		return "i64.eq"
+	case WasmI64Ne:
+		return "i64.ne"
+	case WasmI64LtS:
+		return "i64.lt_s"
+	case WasmI64LeS:
+		return "i64.le_s"
+	case WasmI64GtS:
+		return "i64.gt_s"
+	case WasmI64GeS:
+		return "i64.ge_s"
+	case WasmI64GtU:
+		return "i64.gt_u"
+	case WasmI64ExtendI32U:
+		return "i64.extend_i32_u"
+	case WasmI32Eqz:
+		return "i32.eqz"
+	case WasmI32WrapI64:
+		return "i32.wrap_i64"
+	case WasmIf:
+		return "if"
+	case WasmElse:
+		return "else"
+	case WasmEnd:
+		return "end"
+	case WasmBlock:
+		return "block"
+	case WasmLoop:
+		return "loop"
+	case WasmBr:
+		return "br"
+	case WasmBrIf:
+		return "br_if"
+	case WasmBrTable:
+		return "br_table"
+	case WasmCall:
+		return "call"
+	case WasmDrop:
+		return "drop"
+	case WasmUnreachable:
+		return "unreachable"
+	}
+	panic("invalid wasm op")
+}
+
+type WasmInstr struct {
+	Op      WasmOp
+	Imm     int64   // Constant, local or global index, function index, branch depth or memory offset
+	Targets []int64 // Branch depths of a WasmBrTable, whose Imm is the default
+	Text    string  // Text for WasmComment
+}
+
+// The functions WASI provides come first: proc_exit, then fd_write if the
+// module prints anything. _start follows them.
+const (
+	wasmProcExitFunc = 0
+	wasmFdWriteFunc  = 1
+)
+
+// wasmPageSize is the unit linear memory is sized in.
+const wasmPageSize = 65536
+
+// WasmModule describes everything in a module apart from the body of
+// _start.
+type WasmModule struct {
+	NumLocals int
+	Statics   []Static
+	Pages     int  // Size of linear memory
+	FdWrite   bool // Whether fd_write is imported
+	DataStart int  // Address Data is loaded at
+	Data      []byte
+}
+
+// WasmGenerator lowers a program to a WebAssembly module exporting _start.
+// Values live on the wasm operand stack and every `let` gets its own i64
+// local; the vars/scopes bookkeeping only maps names to local indices.
+// Statics are mutable i64 globals, indexed in declaration order. Arrays,
+// and variables whose address is taken, live in linear memory, where each
+// one is given an address as if memory were a stack, StackLoc holding it
+// and Len its length, 1 for a variable; the messages of fault traps follow
+// the deepest they reach. A pointer is an address in linear memory, which
+// starts with a slot nothing is given so that no address is null. Debug
+// adds the checks described at faultTrap.
+type WasmGenerator struct {
+	prog      NodeProg
+	instrs    []WasmInstr
+	numLocals int
+	vars      []Var
+	statics   []Static
+	scopes    []int
+	loops     []wasmLoop
+	depth     int // Number of blocks open at the end of instrs
+	memSize   int // Bytes of memory taken by the arrays and variables in scope
+	memPeak   int
+	faults    []faultError // Fault of each trap
+	patches   []wasmPatch  // Addresses in the traps, known once memPeak is
+	divLocal  int64        // First of the two locals divisions check, or -1
+	Debug     bool
+}
+
+// wasmPatch is an i32.const in a fault trap that takes the address of
+// the iovec of the trap's message, or of the count fd_write stores when
+// Trap is -1.
+type wasmPatch struct {
+	Instr int
+	Trap  int
+}
+
+// wasmLoop is the depths of the blocks that `break` and `continue` branch
+// out of.
+type wasmLoop struct {
+	breakDepth    int
+	continueDepth int
+}
+
+func NewWasmGenerator(prog NodeProg) *WasmGenerator {
+	return &WasmGenerator{
+		prog:      prog,
+		numLocals: 0,
+		vars:      make([]Var, 0),
+		scopes:    make([]int, 0),
+		memSize:   8,
+		memPeak:   8,
+		divLocal:  -1,
+	}
+}
+
+func (g *WasmGenerator) genTerm(term *NodeTerm) {
+	switch v := term.Var.(type) {
+	case *NodeTermIntLit:
+		g.emit(WasmI64Const, intLitValue(v.IntLit))
+	case *NodeTermIdent:
+		g.get(*v.Ident.Value)
+	case *NodeTermIndex:
+		g.genAddr(v.Ident, v.Index)
+		g.emit(WasmI32WrapI64, 0)
+		g.emit(WasmI64Load, int64(g.lookupVar(*v.Ident.Value).StackLoc))
+	case *NodeTermAddr:
+		base := int64(g.lookupVar(*v.Ident.Value).StackLoc)
+		g.emit(WasmI64Const, base)
+		if v.Index != nil {
+			g.genAddr(v.Ident, v.Index)
+			g.emit(WasmI64Add, 0)
+		}
+	case *NodeTermDeref:
+		g.genPointer(v)
+		g.emit(WasmI32WrapI64, 0)
+		g.emit(WasmI64Load, 0)
+	case *NodeTermParen:
+		g.genExpr(v.Expr)
+	case *NodeTermBitNot:
+		g.genExpr(v.Expr)
+		g.emit(WasmI64Const, -1)
+		g.emit(WasmI64Xor, 0)
+	}
+}
+
+// genAddr leaves the offset of the element of the array ident names at
+// index from the start of the array, as an i64. A debug build checks the
+// index against the length of the array first, as unsigned so that a
+// negative index is caught by the same compare.
+func (g *WasmGenerator) genAddr(ident Token, index *NodeExpr) {
+	g.genExpr(index)
+	if g.Debug {
+		local := int64(g.numLocals)
+		g.numLocals++
+		g.emit(WasmLocalTee, local)
+		g.emit(WasmI64Const, int64(g.lookupVar(*ident.Value).Len-1))
+		g.emit(WasmI64GtU, 0)
+		g.emit(WasmIf, 0)
+		g.genFaultTrap(faultError{kind: faultBounds, line: ident.Line})
+		g.emit(WasmEnd, 0)
+		g.emit(WasmLocalGet, local)
+	}
+	g.emit(WasmI64Const, 3)
+	g.emit(WasmI64Shl, 0)
+}
+
+// genPointer leaves the pointer deref dereferences, as an i64, which a
+// debug build checks is not null.
+func (g *WasmGenerator) genPointer(deref *NodeTermDeref) {
+	g.genExpr(deref.Expr)
+	if g.Debug {
+		local := int64(g.numLocals)
+		g.numLocals++
+		g.emit(WasmLocalTee, local)
+		g.emit(WasmI64Eqz, 0)
+		g.emit(WasmIf, 0)
+		g.genFaultTrap(faultError{kind: faultNull, line: deref.Star.Line})
+		g.emit(WasmEnd, 0)
+		g.emit(WasmLocalGet, local)
+	}
+}
+
+// genFaultTrap prints the message for fault to stderr and exits.
+func (g *WasmGenerator) genFaultTrap(fault faultError) {
+	trap := -1
+	for i, other := range g.faults {
+		if other == fault {
+			trap = i
+		}
+	}
+	if trap < 0 {
+		trap = len(g.faults)
+		g.faults = append(g.faults, fault)
+	}
+	g.emit(WasmI32Const, 2)
+	g.patches = append(g.patches, wasmPatch{Instr: len(g.instrs), Trap: trap})
+	g.emit(WasmI32Const, 0)
+	g.emit(WasmI32Const, 1)
+	g.patches = append(g.patches, wasmPatch{Instr: len(g.instrs), Trap: -1})
+	g.emit(WasmI32Const, 0)
+	g.emit(WasmCall, wasmFdWriteFunc)
+	g.emit(WasmDrop, 0)
+	g.emit(WasmI32Const, int64(fault.status()))
+	g.emit(WasmCall, wasmProcExitFunc)
+	g.emit(WasmUnreachable, 0)
+}
+
+// genBinExpr evaluates the right operand before the left one, like the
+// other backends, which means holding it in a local until the left one is
+// on the stack. When either operand cannot fault the order makes no
+// difference, and the operands are pushed in order.
+func (g *WasmGenerator) genBinExpr(binExpr *NodeBinExpr) {
+	lhs, rhs := binOperands(binExpr)
+	if faultFree(lhs) || faultFree(rhs) {
+		g.genExpr(lhs)
+		g.genExpr(rhs)
+	} else {
+		value := int64(g.numLocals)
+		g.numLocals++
+		g.genExpr(rhs)
+		g.emit(WasmLocalSet, value)
+		g.genExpr(lhs)
+		g.emit(WasmLocalGet, value)
+	}
+	g.genOp(binExprOp(binExpr))
+}
+
+// genOp applies a binary operator to the top two values on the stack.
+func (g *WasmGenerator) genOp(op TokenType) {
+	switch op {
+	case TokenMinus:
+		g.emit(WasmI64Sub, 0)
+	case TokenPlus:
+		g.emit(WasmI64Add, 0)
+	case TokenStar:
+		g.emit(WasmI64Mul, 0)
+	case TokenFslash:
+		g.genDivCheck()
+		g.emit(WasmI64DivS, 0)
+	case TokenPercent:
+		g.genDivCheck()
+		g.emit(WasmI64RemS, 0)
+	case TokenAmp:
+		g.emit(WasmI64And, 0)
+	case TokenPipe:
+		g.emit(WasmI64Or, 0)
+	case TokenCaret:
+		g.emit(WasmI64Xor, 0)
+	case TokenShl:
+		g.emit(WasmI64Shl, 0)
+	case TokenShr:
+		g.emit(WasmI64ShrS, 0)
+	case TokenUshr:
+		g.emit(WasmI64ShrU, 0)
+	case TokenEqEq, TokenNe, TokenLt, TokenLe, TokenGt, TokenGe:
+		// Comparisons leave an i32
+		g.emit(wasmConds[op], 0)
+		g.emit(WasmI64ExtendI32U, 0)
+	}
+}
+
+// genDivCheck branches to the division fault path when the right operand
+// is zero, or when the left one is INT64_MIN and the right one -1, then
+// leaves both operands as they were. i64.div_s traps on these with a status
+// of its own, and i64.rem_s quietly gives 0 for the second. The fault path
+// is outside every block, so it is always g.depth blocks out. The operands
+// are only held for the check, so every division shares one pair of locals.
+func (g *WasmGenerator) genDivCheck() {
+	if g.divLocal < 0 {
+		g.divLocal = int64(g.numLocals)
+		g.numLocals += 2
+	}
+	lhs, rhs := g.divLocal, g.divLocal+1
+	g.emit(WasmLocalSet, rhs)
+	g.emit(WasmLocalSet, lhs)
+	g.emit(WasmLocalGet, rhs)
+	g.emit(WasmI64Eqz, 0)
+	g.emit(WasmBrIf, int64(g.depth))
+	// (lhs ^ INT64_MIN) | (rhs ^ -1) is zero only in the second case
+	g.emit(WasmLocalGet, lhs)
+	g.emit(WasmI64Const, math.MinInt64)
+	g.emit(WasmI64Xor, 0)
+	g.emit(WasmLocalGet, rhs)
+	g.emit(WasmI64Const, -1)
+	g.emit(WasmI64Xor, 0)
+	g.emit(WasmI64Or, 0)
+	g.emit(WasmI64Eqz, 0)
+	g.emit(WasmBrIf, int64(g.depth))
+	g.emit(WasmLocalGet, lhs)
+	g.emit(WasmLocalGet, rhs)
+}
+
+// wasmConds maps each comparison onto its instruction.
+var wasmConds = map[TokenType]WasmOp{
+	TokenEqEq: WasmI64Eq,
+	TokenNe:   WasmI64Ne,
+	TokenLt:   WasmI64LtS,
+	TokenLe:   WasmI64LeS,
+	TokenGt:   WasmI64GtS,
+	TokenGe:   WasmI64GeS,
+}
+
+func (g *WasmGenerator) genExpr(expr *NodeExpr) {
+	switch v := expr.Var.(type) {
+	case *NodeTerm:
+		g.genTerm(v)
+	case *NodeBinExpr:
+		g.genBinExpr(v)
+	}
+}
+
+// genCond leaves an i32 on the stack that is nonzero when expr is.
+func (g *WasmGenerator) genCond(expr *NodeExpr) {
+	g.genExpr(expr)
+	g.emit(WasmI64Eqz, 0)
+	g.emit(WasmI32Eqz, 0)
+}
+
+func (g *WasmGenerator) genScope(scope *NodeScope) {
+	g.beginScope()
+	for _, stmt := range scope.Stmts {
+		g.genStmt(stmt)
+	}
+	g.endScope()
+}
+
+func (g *WasmGenerator) beginScope() {
+	g.scopes = append(g.scopes, len(g.vars))
+}
+
+// endScope forgets the variables of the innermost scope and frees the
+// memory of its arrays.
+func (g *WasmGenerator) endScope() {
+	for _, variable := range g.vars[g.scopes[len(g.scopes)-1]:] {
+		g.memSize -= variable.Len * 8
+	}
+	g.vars = g.vars[:g.scopes[len(g.scopes)-1]]
+	g.scopes = g.scopes[:len(g.scopes)-1]
+}
+
+// genIfPred emits the else arm of the enclosing `if` block.
+func (g *WasmGenerator) genIfPred(pred *NodeIfPred) {
+	g.emit(WasmElse, 0)
+	switch v := pred.Var.(type) {
+	case *NodeIfPredElif:
+		g.comment("elif")
+		g.genCond(v.Expr)
+		g.emit(WasmIf, 0)
+		g.genScope(v.Scope)
+		if v.Pred != nil {
+			g.genIfPred(v.Pred)
+		}
+		g.emit(WasmEnd, 0)
+	case *NodeIfPredElse:
+		g.comment("else")
+		g.genScope(v.Scope)
+	}
+}
+
+func (g *WasmGenerator) genStmt(stmt *NodeStmt) {
+	switch v := stmt.Var.(type) {
+	case *NodeStmtExit:
+		g.comment("exit")
+		g.genExpr(v.Expr)
+		g.emit(WasmI32WrapI64, 0)
+		g.emit(WasmCall, wasmProcExitFunc)
+		g.emit(WasmUnreachable, 0)
+		g.comment("/exit")
+	case *NodeStmtLet:
+		g.comment("let")
+		if length := letLen(v); length > 0 {
+			g.genArray(v, length)
+			g.comment("/let")
+			break
+		}
+		if v.Addressed {
+			g.genAddressed(v)
+			g.comment("/let")
+			break
+		}
+		if v.Expr != nil {
+			g.genExpr(v.Expr)
+		}
+		g.vars = append(g.vars, Var{Name: *v.Ident.Value, StackLoc: g.numLocals})
+		g.numLocals++
+		if v.Expr != nil {
+			g.emit(WasmLocalSet, int64(g.local(*v.Ident.Value)))
+		}
+		g.comment("/let")
+	case *NodeStmtStatic:
+		g.statics = append(g.statics, newStatic(v, len(g.statics)))
+	case *NodeStmtAssign:
+		g.genExpr(v.Expr)
+		if v.Deref != nil {
+			value := int64(g.numLocals)
+			g.numLocals++
+			g.emit(WasmLocalSet, value)
+			g.genPointer(v.Deref)
+			g.emit(WasmI32WrapI64, 0)
+			g.emit(WasmLocalGet, value)
+			g.emit(WasmI64Store, 0)
+			break
+		}
+		if v.Index != nil {
+			// The store takes the address before the value
+			value := int64(g.numLocals)
+			g.numLocals++
+			g.emit(WasmLocalSet, value)
+			g.genAddr(v.Ident, v.Index)
+			g.emit(WasmI32WrapI64, 0)
+			g.emit(WasmLocalGet, value)
+			g.emit(WasmI64Store, int64(g.lookupVar(*v.Ident.Value).StackLoc))
+			break
+		}
+		g.set(*v.Ident.Value)
+	case *NodeStmtUpdate:
+		if v.Index != nil || v.Deref != nil {
+			g.genMemUpdate(v)
+			break
+		}
+		g.get(*v.Ident.Value)
+		g.genExpr(v.Expr)
+		g.genOp(updateOp(v))
+		g.set(*v.Ident.Value)
+	case *NodeScope:
+		g.comment("scope")
+		g.genScope(v)
+		g.comment("/scope")
+	case *NodeStmtIf:
+		g.comment("if")
+		g.genCond(v.Expr)
+		g.emit(WasmIf, 0)
+		g.genScope(v.Scope)
+		if v.Pred != nil {
+			g.genIfPred(v.Pred)
+		}
+		g.emit(WasmEnd, 0)
+		g.comment("/if")
+	case *NodeStmtFor:
+		g.comment("for")
+		g.genFor(v)
+		g.comment("/for")
+	case *NodeStmtMatch:
+		g.comment("match")
+		g.genMatch(v)
+		g.comment("/match")
+	case *NodeStmtBreak:
+		g.emit(WasmBr, int64(g.depth-g.loops[len(g.loops)-1].breakDepth))
+	case *NodeStmtContinue:
+		g.emit(WasmBr, int64(g.depth-g.loops[len(g.loops)-1].continueDepth))
+	}
+}
+
+// genArray gives an array the next free memory, then stores each element
+// of its literal in turn, or zeroes it.
+func (g *WasmGenerator) genArray(stmtLet *NodeStmtLet, length int) {
+	variable := Var{Name: *stmtLet.Ident.Value, StackLoc: g.memSize, Len: length}
+	g.memSize += length * 8
+	g.memPeak = max(g.memPeak, g.memSize)
+	if stmtLet.Array == nil {
+		g.emit(WasmI32Const, int64(variable.StackLoc))
+		g.emit(WasmI32Const, 0)
+		g.emit(WasmI32Const, int64(length*8))
+		g.emit(WasmMemoryFill, 0)
+	} else {
+		for i, elem := range stmtLet.Array.Elems {
+			g.emit(WasmI32Const, 0)
+			g.genExpr(elem)
+			g.emit(WasmI64Store, int64(variable.StackLoc+i*8))
+		}
+	}
+	g.vars = append(g.vars, variable)
+}
+
+// genAddressed gives a variable whose address is taken the next free
+// memory, and stores its initial value there.
+func (g *WasmGenerator) genAddressed(stmtLet *NodeStmtLet) {
+	variable := Var{Name: *stmtLet.Ident.Value, StackLoc: g.memSize, Len: 1}
+	g.memSize += 8
+	g.memPeak = max(g.memPeak, g.memSize)
+	if stmtLet.Expr != nil {
+		g.emit(WasmI32Const, 0)
+		g.genExpr(stmtLet.Expr)
+		g.emit(WasmI64Store, int64(variable.StackLoc))
+	}
+	g.vars = append(g.vars, variable)
+}
+
+// genMemUpdate applies an update to an element of an array, or to what a
+// pointer points to, keeping its address in a local, since both the load
+// and the store need it.
+func (g *WasmGenerator) genMemUpdate(update *NodeStmtUpdate) {
+	value := int64(g.numLocals)
+	offset := value + 1
+	g.numLocals += 2
+	g.genExpr(update.Expr)
+	g.emit(WasmLocalSet, value)
+	base := int64(0)
+	if update.Deref != nil {
+		g.genPointer(update.Deref)
+	} else {
+		base = int64(g.lookupVar(*update.Ident.Value).StackLoc)
+		g.genAddr(update.Ident, update.Index)
+	}
+	g.emit(WasmLocalTee, offset)
+	g.emit(WasmI32WrapI64, 0)
+	g.emit(WasmLocalGet, offset)
+	g.emit(WasmI32WrapI64, 0)
+	g.emit(WasmI64Load, base)
+	g.emit(WasmLocalGet, value)
+	g.genOp(updateOp(update))
+	g.emit(WasmI64Store, base)
+}
+
+// genFor nests a loop in the block `break` leaves, and the body in the
+// block `continue` leaves to reach the step.
+func (g *WasmGenerator) genFor(stmtFor *NodeStmtFor) {
+	g.beginScope()
+	if stmtFor.Init != nil {
+		g.genStmt(stmtFor.Init)
+	}
+	g.emit(WasmBlock, 0)
+	loop := wasmLoop{breakDepth: g.depth}
+	g.emit(WasmLoop, 0)
+	topDepth := g.depth
+	if stmtFor.Cond != nil {
+		g.genExpr(stmtFor.Cond)
+		g.emit(WasmI64Eqz, 0)
+		g.emit(WasmBrIf, int64(g.depth-loop.breakDepth))
+	}
+	g.emit(WasmBlock, 0)
+	loop.continueDepth = g.depth
+	g.loops = append(g.loops, loop)
+	g.genScope(stmtFor.Scope)
+	g.loops = g.loops[:len(g.loops)-1]
+	g.emit(WasmEnd, 0)
+	if stmtFor.Step != nil {
+		g.genStmt(stmtFor.Step)
+	}
+	g.emit(WasmBr, int64(g.depth-topDepth))
+	g.emit(WasmEnd, 0)
+	g.emit(WasmEnd, 0)
+	g.endScope()
+}
+
+// genMatch nests a block per arm inside a block for the end of the
+// match, with the dispatch innermost, so that branching out of an arm's
+// block lands on the arm's code. The value goes in a local of its own.
+func (g *WasmGenerator) genMatch(stmtMatch *NodeStmtMatch) {
+	value := int64(g.numLocals)
+	g.numLocals++
+	g.genExpr(stmtMatch.Expr)
+	g.emit(WasmLocalSet, value)
+	cases, defaultArm := matchCases(stmtMatch)
+	g.emit(WasmBlock, 0)
+	endDepth := g.depth
+	armDepths := make([]int, len(stmtMatch.Arms))
+	for i := len(armDepths) - 1; i >= 0; i-- {
+		g.emit(WasmBlock, 0)
+		armDepths[i] = g.depth
+	}
+	defaultDepth := endDepth
+	if defaultArm >= 0 {
+		defaultDepth = armDepths[defaultArm]
+	}
+	if denseCases(cases) {
+		g.genBrTable(value, cases, armDepths, defaultDepth)
+	} else {
+		for _, c := range cases {
+			g.emit(WasmLocalGet, value)
+			g.emit(WasmI64Const, c.Value)
+			g.emit(WasmI64Eq, 0)
+			g.emit(WasmBrIf, int64(g.depth-armDepths[c.Arm]))
+		}
+		g.emit(WasmBr, int64(g.depth-defaultDepth))
+	}
+	for _, arm := range stmtMatch.Arms {
+		g.emit(WasmEnd, 0)
+		g.genScope(arm.Scope)
+		g.emit(WasmBr, int64(g.depth-endDepth))
+	}
+	g.emit(WasmEnd, 0)
+}
+
+// genBrTable offsets the local holding the value to index a br_table.
+// Values outside the table have to be caught first, since only the low 32
+// bits of the index reach br_table.
+func (g *WasmGenerator) genBrTable(value int64, cases []matchCase, armDepths []int, defaultDepth int) {
+	low := cases[0].Value
+	targets := make([]int64, uint64(cases[len(cases)-1].Value)-uint64(low)+1)
+	for i := range targets {
+		targets[i] = int64(g.depth - defaultDepth)
+	}
+	for _, c := range cases {
+		targets[uint64(c.Value)-uint64(low)] = int64(g.depth - armDepths[c.Arm])
+	}
+	g.emit(WasmLocalGet, value)
+	g.emit(WasmI64Const, low)
+	g.emit(WasmI64Sub, 0)
+	g.emit(WasmLocalSet, value)
+	g.emit(WasmLocalGet, value)
+	g.emit(WasmI64Const, int64(len(targets)-1))
+	g.emit(WasmI64GtU, 0)
+	g.emit(WasmBrIf, int64(g.depth-defaultDepth))
+	g.emit(WasmLocalGet, value)
+	g.emit(WasmI32WrapI64, 0)
+	g.instrs = append(g.instrs, WasmInstr{Op: WasmBrTable, Imm: int64(g.depth - defaultDepth), Targets: targets})
+}
+
+// GenProg lowers the program to the body of _start. Module is valid once
+// it returns. If any division can fault, the body goes in a block that the
+// checks branch out of to the fault path, which exits with exitDivFault,
+// and a block around that which the body leaves when it runs to the end.
+func (g *WasmGenerator) GenProg() []WasmInstr {
+	for _, stmt := range g.prog.Stmts {
+		g.genStmt(stmt)
+	}
+	_, iovecs := g.faultData()
+	for _, patch := range g.patches {
+		if patch.Trap < 0 {
+			g.instrs[patch.Instr].Imm = int64(g.dataStart())
+		} else {
+			g.instrs[patch.Instr].Imm = int64(iovecs[patch.Trap])
+		}
+	}
+	if g.divLocal < 0 {
+		return g.instrs
+	}
+	instrs := append([]WasmInstr{{Op: WasmBlock}, {Op: WasmBlock}}, g.instrs...)
+	return append(instrs,
+		WasmInstr{Op: WasmBr, Imm: 1},
+		WasmInstr{Op: WasmEnd},
+		WasmInstr{Op: WasmComment, Text: "division fault"},
+		WasmInstr{Op: WasmI32Const, Imm: exitDivFault},
+		WasmInstr{Op: WasmCall, Imm: wasmProcExitFunc},
+		WasmInstr{Op: WasmUnreachable},
+		WasmInstr{Op: WasmEnd},
+	)
+}
+
+// dataStart returns the address of the data of the fault traps, which
+// comes after the arrays and variables in memory.
+func (g *WasmGenerator) dataStart() int {
+	return (g.memPeak + 7) &^ 7
+}
+
+// faultData lays out the data the fault traps print from: the count
+// fd_write stores, then for each trap an iovec followed by its message. It
+// returns the data along with the address of each iovec.
+func (g *WasmGenerator) faultData() ([]byte, []int) {
+	if len(g.faults) == 0 {
+		return nil, nil
+	}
+	start := g.dataStart()
+	data := make([]byte, 8)
+	iovecs := make([]int, len(g.faults))
+	for i, fault := range g.faults {
+		message := fault.text()
+		iovecs[i] = start + len(data)
+		data = binary.LittleEndian.AppendUint32(data, uint32(iovecs[i]+8))
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(message)))
+		data = append(data, message...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+	return data, iovecs
+}
+
+// Module describes the rest of the module around the body GenProg returns.
+func (g *WasmGenerator) Module() WasmModule {
+	data, _ := g.faultData()
+	end := g.dataStart() + len(data)
+	return WasmModule{
+		NumLocals: g.numLocals,
+		Statics:   g.statics,
+		Pages:     max(1, (end+wasmPageSize-1)/wasmPageSize),
+		FdWrite:   len(g.faults) > 0,
+		DataStart: g.dataStart(),
+		Data:      data,
+	}
+}
+
+func (g *WasmGenerator) emit(op WasmOp, imm int64) {
+	g.instrs = append(g.instrs, WasmInstr{Op: op, Imm: imm})
+	switch op {
+	case WasmIf, WasmBlock, WasmLoop:
+		g.depth++
+	case WasmEnd:
+		g.depth--
+	}
+}
+
+func (g *WasmGenerator) comment(text string) {
+	g.instrs = append(g.instrs, WasmInstr{Op: WasmComment, Text: text})
+}
+
+// local returns the local index of a variable the Checker has already
+// verified is declared, or -1 for a static.
+func (g *WasmGenerator) local(name string) int {
+	if variable := g.lookupVar(name); variable != nil {
+		return variable.StackLoc
+	}
+	if lookupStatic(g.statics, name) != nil {
+		return -1
+	}
+	panic("Unreachable")
+}
+
+// lookupVar returns the variable or array named name, or nil.
+func (g *WasmGenerator) lookupVar(name string) *Var {
+	for i := range g.vars {
+		if g.vars[i].Name == name {
+			return &g.vars[i]
+		}
+	}
+	return nil
+}
+
+// get pushes the value of a variable or static.
+func (g *WasmGenerator) get(name string) {
+	if variable := g.lookupVar(name); variable != nil && variable.Len > 0 {
+		g.emit(WasmI32Const, 0)
+		g.emit(WasmI64Load, int64(variable.StackLoc))
+		return
+	}
+	if local := g.local(name); local >= 0 {
+		g.emit(WasmLocalGet, int64(local))
+	} else {
+		g.emit(WasmGlobalGet, int64(g.global(name)))
+	}
+}
+
+// set pops a value into a variable or static.
+func (g *WasmGenerator) set(name string) {
+	if variable := g.lookupVar(name); variable != nil && variable.Len > 0 {
+		// The store takes the address before the value
+		value := int64(g.numLocals)
+		g.numLocals++
+		g.emit(WasmLocalSet, value)
+		g.emit(WasmI32Const, 0)
+		g.emit(WasmLocalGet, value)
+		g.emit(WasmI64Store, int64(variable.StackLoc))
+		return
+	}
+	if local := g.local(name); local >= 0 {
+		g.emit(WasmLocalSet, int64(local))
+	} else {
+		g.emit(WasmGlobalSet, int64(g.global(name)))
+	}
+}
+
+// global returns the global index of a static.
+func (g *WasmGenerator) global(name string) int {
+	for i, static := range g.statics {
+		if static.Name == name {
+			return i
+		}
+	}
+	panic("Unreachable")
+}
+
+// FormatWat renders a _start body as a complete module in the WebAssembly
+// text format.
+func FormatWat(instrs []WasmInstr, module WasmModule) string {
+	var output strings.Builder
+	output.WriteString("(module\n")
+	output.WriteString("  (import \"wasi_snapshot_preview1\" \"proc_exit\" (func $proc_exit (param i32)))\n")
+	if module.FdWrite {
+		output.WriteString("  (import \"wasi_snapshot_preview1\" \"fd_write\" (func $fd_write (param i32 i32 i32 i32) (result i32)))\n")
+	}
+	output.WriteString(fmt.Sprintf("  (memory (export \"memory\") %d)\n", module.Pages))
+	for _, static := range module.Statics {
+		output.WriteString(fmt.Sprintf("  (global (mut i64) (i64.const %d))\n", static.Value))
+	}
+	if len(module.Data) > 0 {
+		output.WriteString(fmt.Sprintf("  (data (i32.const %d) \"%s\")\n", module.DataStart, watString(module.Data)))
+	}
+	output.WriteString("  (func $_start (export \"_start\")\n")
+	if module.NumLocals > 0 {
+		output.WriteString("    (local" + strings.Repeat(" i64", module.NumLocals) + ")\n")
+	}
+	depth := 2
+	for _, instr := range instrs {
+		if instr.Op == WasmEnd || instr.Op == WasmElse {
+			depth--
+		}
+		indent := strings.Repeat("  ", depth)
+		switch instr.Op {
+		case WasmComment:
+			output.WriteString(indent + ";; " + instr.Text + "\n")
+		case WasmI64Const, WasmI32Const, WasmLocalGet, WasmLocalSet, WasmLocalTee, WasmGlobalGet, WasmGlobalSet, WasmBr, WasmBrIf:
+			output.WriteString(fmt.Sprintf("%s%s %d\n", indent, instr.Op, instr.Imm))
+		case WasmI64Load, WasmI64Store:
+			output.WriteString(fmt.Sprintf("%s%s offset=%d\n", indent, instr.Op, instr.Imm))
+		case WasmBrTable:
+			output.WriteString(indent + "br_table")
+			for _, target := range instr.Targets {
+				output.WriteString(fmt.Sprintf(" %d", target))
+			}
+			output.WriteString(fmt.Sprintf(" %d\n", instr.Imm))
+		case WasmCall:
+			switch instr.Imm {
+			case wasmProcExitFunc:
+				output.WriteString(indent + "call $proc_exit\n")
+			case wasmFdWriteFunc:
+				output.WriteString(indent + "call $fd_write\n")
+			default:
+				output.WriteString(fmt.Sprintf("%scall %d\n", indent, instr.Imm))
+			}
+		default:
+			output.WriteString(indent + instr.Op.String() + "\n")
+		}
+		if instr.Op == WasmIf || instr.Op == WasmElse || instr.Op == WasmBlock || instr.Op == WasmLoop {
+			depth++
+		}
+	}
+	output.WriteString("  )\n")
+	output.WriteString(")\n")
+	return output.String()
+}
+
+// watString escapes data for a string in the text format, writing bytes
+// other than printable ASCII as hex escapes.
+func watString(data []byte) string {
+	var output strings.Builder
+	for _, c := range data {
+		if c >= ' ' && c <= '~' && c != '"' && c != '\\' {
+			output.WriteByte(c)
+		} else {
+			output.WriteString(fmt.Sprintf("\\%02x", c))
+		}
+	}
+	return output.String()
+}
@@ -0,0 +1,324 @@
+package main
+
+type Opcode int
+
+const (
+	OpGlobal Opcode = iota
+	OpLabel
+	OpComment
+	OpSection
+	OpQuad
+	OpSpace
+	OpAscii
+	OpMov
+	OpMovzx
+	OpPush
+	OpPop
+	OpAdd
+	OpSub
+	OpAnd
+	OpOr
+	OpXor
+	OpNot
+	OpShl
+	OpSar
+	OpShr
+	OpMul
+	OpCqo
+	OpIdiv
+	OpTest
+	OpCmp
+	OpSete
+	OpSetne
+	OpSetl
+	OpSetle
+	OpSetg
+	OpSetge
+	OpLea
+	OpJz
+	OpJa
+	OpJg
+	OpJmp
+	OpRepStos
+	OpSyscall
+	OpRet
+)
+
+func (o Opcode) String() string {
+	switch o {
+	case OpGlobal:
+		return "global"
+	case OpLabel:
+		return "label"
+	case OpComment:
+		return "comment"
+	case OpSection:
+		return "section"
+	case OpQuad:
+		return "quad"
+	case OpSpace:
+		return "space"
+	case OpAscii:
+		return "ascii"
+	case OpMov:
+		return "mov"
+	case OpMovzx:
+		return "movzx"
+	case OpPush:
+		return "push"
+	case OpPop:
+		return "pop"
+	case OpAdd:
+		return "add"
+	case OpSub:
+		return "sub"
+	case OpAnd:
+		return "and"
+	case OpOr:
+		return "or"
+	case OpXor:
+		return "xor"
+	case OpNot:
+		return "not"
+	case OpShl:
+		return "shl"
+	case OpSar:
+		return "sar"
+	case OpShr:
+		return "shr"
+	case OpMul:
+		return "mul"
+	case OpCqo:
+		return "cqo"
+	case OpIdiv:
+		return "idiv"
+	case OpTest:
+		return "test"
+	case OpCmp:
+		return "cmp"
+	case OpSete:
+		return "sete"
+	case OpSetne:
+		return "setne"
+	case OpSetl:
+		return "setl"
+	case OpSetle:
+		return "setle"
+	case OpSetg:
+		return "setg"
+	case OpSetge:
+		return "setge"
+	case OpLea:
+		return "lea"
+	case OpJz:
+		return "jz"
+	case OpJa:
+		return "ja"
+	case OpJg:
+		return "jg"
+	case OpJmp:
+		return "jmp"
+	case OpRepStos:
+		return "rep stosq"
+	case OpSyscall:
+		return "syscall"
+	case OpRet:
+		return "ret"
+	}
+	panic("invalid opcode")
+}
+
+type OperandKind int
+
+const (
+	OperandReg OperandKind = iota
+	OperandImm
+	OperandMem
+	OperandLabel
+)
+
+// Operand is a single instruction argument. Memory operands are always
+// QWORD sized and addressed as [Reg + Index*8 + Disp], or as [rip + Label]
+// when Reg is rip.
+type Operand struct {
+	Kind  OperandKind
+	Reg   string
+	Index string
+	Imm   int64
+	Disp  int
+	Label string
+}
+
+func Reg(name string) Operand {
+	return Operand{Kind: OperandReg, Reg: name}
+}
+
+func Imm(value int64) Operand {
+	return Operand{Kind: OperandImm, Imm: value}
+}
+
+func Mem(base string, disp int) Operand {
+	return Operand{Kind: OperandMem, Reg: base, Disp: disp}
+}
+
+// MemIndex addresses the index'th QWORD of an array starting at base.
+func MemIndex(base string, index string) Operand {
+	return Operand{Kind: OperandMem, Reg: base, Index: index}
+}
+
+// RipRel addresses label relative to the next instruction.
+func RipRel(label string) Operand {
+	return Operand{Kind: OperandMem, Reg: "rip", Label: label}
+}
+
+func LabelRef(name string) Operand {
+	return Operand{Kind: OperandLabel, Label: name}
+}
+
+// x86ByteRegs maps the low byte registers the generator uses onto the
+// registers they are part of.
+var x86ByteRegs = map[string]string{
+	"al": "rax",
+	"cl": "rcx",
+}
+
+// usesReg reports whether the operand reads reg, either directly or as the
+// base or index of a memory reference.
+func (o Operand) usesReg(reg string) bool {
+	if o.Kind == OperandMem && o.Index == reg {
+		return true
+	}
+	return (o.Kind == OperandReg || o.Kind == OperandMem) && o.Reg == reg
+}
+
+type Instr struct {
+	Op   Opcode
+	Args []Operand
+	Text string // Symbol for OpGlobal and OpLabel, text for OpComment and OpAscii, name for OpSection
+}
+
+// IsReal reports whether the instruction is executable, as opposed to a
+// label, comment or directive.
+func (i Instr) IsReal() bool {
+	switch i.Op {
+	case OpGlobal, OpLabel, OpComment, OpSection, OpQuad, OpSpace, OpAscii:
+		return false
+	}
+	return true
+}
+
+// IsBarrier reports whether control may leave or enter the straight-line
+// sequence at this instruction.
+func (i Instr) IsBarrier() bool {
+	switch i.Op {
+	case OpLabel, OpJz, OpJa, OpJg, OpJmp, OpSyscall, OpRet:
+		return true
+	}
+	return false
+}
+
+// isCondJump reports whether the instruction is a conditional jump, which
+// falls through when not taken.
+func (i Instr) isCondJump() bool {
+	return i.Op == OpJz || i.Op == OpJa || i.Op == OpJg
+}
+
+// isScratch reports whether reg only ever carries values within a single
+// statement. Registers outside this set, like the r13 frame anchor used by
+// host code, stay live across labels and jumps.
+func isScratch(reg string) bool {
+	switch reg {
+	case "rax", "rbx", "rcx", "rdx", "rdi":
+		return true
+	}
+	return false
+}
+
+func (i Instr) reads(reg string) bool {
+	switch i.Op {
+	case OpMov:
+		return i.Args[1].usesReg(reg) || (i.Args[0].Kind == OperandMem && i.Args[0].usesReg(reg))
+	case OpPush:
+		return reg == "rsp" || i.Args[0].usesReg(reg)
+	case OpPop:
+		return reg == "rsp" || (i.Args[0].Kind == OperandMem && i.Args[0].usesReg(reg))
+	case OpAdd, OpSub, OpAnd, OpOr, OpXor, OpTest, OpCmp:
+		return i.Args[0].usesReg(reg) || i.Args[1].usesReg(reg)
+	case OpLea:
+		return i.Args[1].usesReg(reg)
+	case OpSete, OpSetne, OpSetl, OpSetle, OpSetg, OpSetge:
+		// Only the low byte is written, so the rest carries over
+		return x86ByteRegs[i.Args[0].Reg] == reg
+	case OpMovzx:
+		return x86ByteRegs[i.Args[1].Reg] == reg
+	case OpJmp:
+		// An indirect jump reads its target from memory
+		return i.Args[0].usesReg(reg)
+	case OpNot:
+		return i.Args[0].usesReg(reg)
+	case OpShl, OpSar, OpShr:
+		// The count is always cl
+		return reg == "rcx" || i.Args[0].usesReg(reg)
+	case OpMul:
+		return reg == "rax" || i.Args[0].usesReg(reg)
+	case OpCqo:
+		return reg == "rax"
+	case OpIdiv:
+		return reg == "rax" || reg == "rdx" || i.Args[0].usesReg(reg)
+	case OpRepStos:
+		// Stores rax to rcx QWORDs from rdi upwards
+		return reg == "rax" || reg == "rcx" || reg == "rdi"
+	case OpSyscall:
+		return true
+	case OpRet:
+		// Host code returns its value in rax and a status in rdx
+		return reg == "rax" || reg == "rdx" || reg == "rsp"
+	}
+	return false
+}
+
+func (i Instr) writes(reg string) bool {
+	switch i.Op {
+	case OpMov, OpMovzx, OpAdd, OpSub, OpAnd, OpOr, OpXor, OpNot, OpShl, OpSar, OpShr, OpLea:
+		return i.Args[0].Kind == OperandReg && i.Args[0].Reg == reg
+	case OpSete, OpSetne, OpSetl, OpSetle, OpSetg, OpSetge:
+		return x86ByteRegs[i.Args[0].Reg] == reg
+	case OpPush:
+		return reg == "rsp"
+	case OpPop:
+		return reg == "rsp" || (i.Args[0].Kind == OperandReg && i.Args[0].Reg == reg)
+	case OpMul, OpIdiv:
+		return reg == "rax" || reg == "rdx"
+	case OpCqo:
+		return reg == "rdx"
+	case OpRepStos:
+		return reg == "rcx" || reg == "rdi"
+	case OpSyscall:
+		return reg == "rax" || reg == "rcx" || reg == "r11"
+	case OpRet:
+		return reg == "rsp"
+	}
+	return false
+}
+
+// writesMem reports whether the instruction stores to memory other than by
+// pushing onto the stack.
+func (i Instr) writesMem() bool {
+	switch i.Op {
+	case OpMov, OpAdd, OpSub, OpAnd, OpOr, OpXor, OpNot, OpShl, OpSar, OpShr, OpPop:
+		return i.Args[0].Kind == OperandMem
+	case OpRepStos:
+		return true
+	}
+	return false
+}
+
+func CountInstrs(instrs []Instr) int {
+	count := 0
+	for _, instr := range instrs {
+		if instr.IsReal() {
+			count++
+		}
+	}
+	return count
+}
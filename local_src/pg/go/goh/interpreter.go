@@ -0,0 +1,559 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// errDivFault is returned when a program divides by zero or divides
+// INT64_MIN by -1, the two cases where idiv traps.
+var errDivFault = errors.New("division by zero or overflow")
+
+// faultKind is a fault that debug builds check for as the program runs,
+// and the interpreter always does.
+type faultKind int
+
+const (
+	faultBounds faultKind = iota // An index past the end of an array, or before its start
+	faultNull                    // A dereference of a null pointer
+)
+
+// faultError is returned when a program faults on line.
+type faultError struct {
+	kind faultKind
+	line int
+}
+
+func (e *faultError) Error() string {
+	if e.kind == faultNull {
+		return fmt.Sprintf("null pointer dereference on line %d", e.line)
+	}
+	return fmt.Sprintf("index out of bounds on line %d", e.line)
+}
+
+// errDangling is returned when a program dereferences a pointer to a
+// variable whose scope has ended. Compiled code reads whatever has since
+// taken its place.
+var errDangling = errors.New("dereference of a pointer to a variable that is out of scope")
+
+// exitSignal unwinds the interpreter when the program calls exit.
+type exitSignal struct {
+	value int64
+}
+
+func (e *exitSignal) Error() string {
+	return fmt.Sprintf("exit(%d)", e.value)
+}
+
+// errBreak and errContinue unwind the interpreter to the innermost
+// enclosing loop.
+var (
+	errBreak    = errors.New("break")
+	errContinue = errors.New("continue")
+)
+
+// interpVar is a binding, with how it was declared so that a REPL can
+// check later input against it.
+type interpVar struct {
+	Name    string
+	Value   int64
+	Elems   []int64 // Elements of an array, nil for any other variable
+	Mutable bool
+	Const   bool
+	Static  bool
+	typ     *Type // Type of a `let`, nil for an i64 static or const
+}
+
+// Type returns the type the variable was declared with.
+func (v interpVar) Type() *Type {
+	if v.typ != nil {
+		return v.typ
+	}
+	return typeI64
+}
+
+func (v interpVar) String() string {
+	if v.Elems == nil {
+		return fmt.Sprint(v.Value)
+	}
+	elems := make([]string, len(v.Elems))
+	for i, elem := range v.Elems {
+		elems[i] = fmt.Sprint(elem)
+	}
+	return "[" + strings.Join(elems, ", ") + "]"
+}
+
+// Interpreter runs a program straight from its AST, with the same 64-bit
+// wraparound and division faults as the compiled code. Top-level bindings
+// outlive each call to Exec, so a program can be run a few statements at a
+// time.
+//
+// A pointer is the position of the variable it points to in vars, plus one
+// so that no pointer is null, shifted left by pointerElemBits, and or'ed
+// with the index of the element it points to in an array.
+type Interpreter struct {
+	vars   []interpVar
+	scopes []int
+}
+
+// pointerElemBits is enough for any index into an array.
+const pointerElemBits = 20
+
+func NewInterpreter() *Interpreter {
+	return &Interpreter{
+		vars:   make([]interpVar, 0),
+		scopes: make([]int, 0),
+	}
+}
+
+// Run executes prog, which must already have passed the Checker, and
+// returns the value it passes to `exit`, or 0 if it runs off the end.
+func (in *Interpreter) Run(prog NodeProg) (int64, error) {
+	value, _, err := in.Exec(prog.Stmts)
+	return value, err
+}
+
+// Exec executes stmts after whatever ran before them. exited reports
+// whether they called `exit`, with value holding the exit value; bindings
+// made before the exit are kept. On an error nothing the statements did is
+// kept.
+func (in *Interpreter) Exec(stmts []*NodeStmt) (value int64, exited bool, err error) {
+	saved := in.Bindings()
+	for _, stmt := range stmts {
+		err = in.execStmt(stmt)
+		if err != nil {
+			break
+		}
+	}
+
+	var exit *exitSignal
+	switch {
+	case errors.As(err, &exit):
+		if len(in.scopes) > 0 {
+			in.vars = in.vars[:in.scopes[0]]
+		}
+		in.scopes = in.scopes[:0]
+		return exit.value, true, nil
+	case err != nil:
+		in.vars = saved
+		in.scopes = in.scopes[:0]
+		return 0, false, err
+	}
+	return 0, false, nil
+}
+
+// Names returns the bindings currently in scope, oldest first.
+// Bindings returns a copy of the bindings in scope, innermost last.
+func (in *Interpreter) Bindings() []interpVar {
+	vars := append([]interpVar(nil), in.vars...)
+	for i := range vars {
+		if vars[i].Elems != nil {
+			vars[i].Elems = append([]int64(nil), vars[i].Elems...)
+		}
+	}
+	return vars
+}
+
+// Lookup returns a binding that is in scope.
+func (in *Interpreter) Lookup(name string) (interpVar, bool) {
+	if variable := in.lookup(name); variable != nil {
+		return *variable, true
+	}
+	return interpVar{}, false
+}
+
+func (in *Interpreter) lookup(name string) *interpVar {
+	if i := in.position(name); i >= 0 {
+		return &in.vars[i]
+	}
+	return nil
+}
+
+// position returns the index in vars of the binding of name, or -1.
+func (in *Interpreter) position(name string) int {
+	for i := len(in.vars) - 1; i >= 0; i-- {
+		if in.vars[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// FormatValue returns how a REPL shows a value of type typ, naming what a
+// pointer points to.
+func (in *Interpreter) FormatValue(typ *Type, value int64) string {
+	if typ.Kind != TypePointer {
+		return fmt.Sprint(value)
+	}
+	if value == 0 {
+		return "null"
+	}
+	position, elem := int(value>>pointerElemBits)-1, value&(1<<pointerElemBits-1)
+	if position >= len(in.vars) {
+		return "dangling"
+	}
+	if in.vars[position].Elems != nil {
+		return fmt.Sprintf("&%s[%d]", in.vars[position].Name, elem)
+	}
+	return "&" + in.vars[position].Name
+}
+
+func (in *Interpreter) evalTerm(term *NodeTerm) (int64, error) {
+	switch v := term.Var.(type) {
+	case *NodeTermIntLit:
+		return intLitValue(v.IntLit), nil
+	case *NodeTermIdent:
+		return in.lookup(*v.Ident.Value).Value, nil
+	case *NodeTermIndex:
+		elem, err := in.element(v.Ident, v.Index)
+		if err != nil {
+			return 0, err
+		}
+		return *elem, nil
+	case *NodeTermAddr:
+		return in.address(v.Ident, v.Index)
+	case *NodeTermDeref:
+		target, err := in.deref(v)
+		if err != nil {
+			return 0, err
+		}
+		return *target, nil
+	case *NodeTermParen:
+		return in.evalExpr(v.Expr)
+	case *NodeTermBitNot:
+		value, err := in.evalExpr(v.Expr)
+		return ^value, err
+	}
+	panic("Unreachable")
+}
+
+// element returns the element of the array ident names at index, which is
+// always checked against the length of the array.
+func (in *Interpreter) element(ident Token, index *NodeExpr) (*int64, error) {
+	i, err := in.evalExpr(index)
+	if err != nil {
+		return nil, err
+	}
+	elems := in.lookup(*ident.Value).Elems
+	if uint64(i) >= uint64(len(elems)) {
+		return nil, &faultError{kind: faultBounds, line: ident.Line}
+	}
+	return &elems[i], nil
+}
+
+// address returns a pointer to the variable ident names, or to its
+// element at index when that is set.
+func (in *Interpreter) address(ident Token, index *NodeExpr) (int64, error) {
+	var i int64
+	if index != nil {
+		var err error
+		if i, err = in.evalExpr(index); err != nil {
+			return 0, err
+		}
+		if uint64(i) >= uint64(len(in.lookup(*ident.Value).Elems)) {
+			return 0, &faultError{kind: faultBounds, line: ident.Line}
+		}
+	}
+	return int64(in.position(*ident.Value)+1)<<pointerElemBits | i, nil
+}
+
+// deref returns what the pointer deref dereferences points to.
+func (in *Interpreter) deref(deref *NodeTermDeref) (*int64, error) {
+	pointer, err := in.evalExpr(deref.Expr)
+	if err != nil {
+		return nil, err
+	}
+	if pointer == 0 {
+		return nil, &faultError{kind: faultNull, line: deref.Star.Line}
+	}
+	position, elem := int(pointer>>pointerElemBits)-1, pointer&(1<<pointerElemBits-1)
+	if position >= len(in.vars) {
+		return nil, errDangling
+	}
+	variable := &in.vars[position]
+	if variable.Elems == nil {
+		if elem != 0 {
+			return nil, errDangling
+		}
+		return &variable.Value, nil
+	}
+	if elem >= int64(len(variable.Elems)) {
+		return nil, errDangling
+	}
+	return &variable.Elems[elem], nil
+}
+
+// target returns the variable, element or pointer target an assignment or
+// update stores to.
+func (in *Interpreter) target(ident Token, index *NodeExpr, deref *NodeTermDeref) (*int64, error) {
+	if deref != nil {
+		return in.deref(deref)
+	}
+	if index != nil {
+		return in.element(ident, index)
+	}
+	return &in.lookup(*ident.Value).Value, nil
+}
+
+// evalBinExpr evaluates the right operand before the left one, as every
+// backend does, so that a program stops on the same fault everywhere.
+func (in *Interpreter) evalBinExpr(binExpr *NodeBinExpr) (int64, error) {
+	lhsExpr, rhsExpr := binOperands(binExpr)
+	rhs, err := in.evalExpr(rhsExpr)
+	if err != nil {
+		return 0, err
+	}
+	lhs, err := in.evalExpr(lhsExpr)
+	if err != nil {
+		return 0, err
+	}
+	return applyBinOp(binExprOp(binExpr), lhs, rhs)
+}
+
+// applyBinOp applies a binary operator with the semantics of the compiled
+// code.
+func applyBinOp(op TokenType, lhs int64, rhs int64) (int64, error) {
+	switch op {
+	case TokenMinus:
+		return lhs - rhs, nil
+	case TokenPlus:
+		return lhs + rhs, nil
+	case TokenStar:
+		return lhs * rhs, nil
+	case TokenAmp:
+		return lhs & rhs, nil
+	case TokenPipe:
+		return lhs | rhs, nil
+	case TokenCaret:
+		return lhs ^ rhs, nil
+	// Shift counts use their low six bits, as the hardware does
+	case TokenShl:
+		return lhs << (rhs & 63), nil
+	case TokenShr:
+		return lhs >> (rhs & 63), nil
+	case TokenUshr:
+		return int64(uint64(lhs) >> (rhs & 63)), nil
+	case TokenEqEq:
+		return boolInt(lhs == rhs), nil
+	case TokenNe:
+		return boolInt(lhs != rhs), nil
+	case TokenLt:
+		return boolInt(lhs < rhs), nil
+	case TokenLe:
+		return boolInt(lhs <= rhs), nil
+	case TokenGt:
+		return boolInt(lhs > rhs), nil
+	case TokenGe:
+		return boolInt(lhs >= rhs), nil
+	case TokenFslash, TokenPercent:
+		if rhs == 0 || (lhs == math.MinInt64 && rhs == -1) {
+			return 0, errDivFault
+		}
+		if op == TokenPercent {
+			return lhs % rhs, nil
+		}
+		return lhs / rhs, nil
+	}
+	panic("Unreachable")
+}
+
+// boolInt returns the value of a comparison that came out as b.
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (in *Interpreter) evalExpr(expr *NodeExpr) (int64, error) {
+	switch v := expr.Var.(type) {
+	case *NodeTerm:
+		return in.evalTerm(v)
+	case *NodeBinExpr:
+		return in.evalBinExpr(v)
+	}
+	panic("Unreachable")
+}
+
+// evalConst evaluates an expression the Checker has verified is constant.
+// Division can still fault.
+func evalConst(expr *NodeExpr) (int64, error) {
+	return NewInterpreter().evalExpr(expr)
+}
+
+// evalCond evaluates the condition of an if, elif or for.
+func (in *Interpreter) evalCond(expr *NodeExpr) (bool, error) {
+	value, err := in.evalExpr(expr)
+	return value != 0, err
+}
+
+func (in *Interpreter) execScope(scope *NodeScope) error {
+	in.beginScope()
+	defer in.endScope()
+	for _, stmt := range scope.Stmts {
+		if err := in.execStmt(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (in *Interpreter) beginScope() {
+	in.scopes = append(in.scopes, len(in.vars))
+}
+
+func (in *Interpreter) endScope() {
+	in.vars = in.vars[:in.scopes[len(in.scopes)-1]]
+	in.scopes = in.scopes[:len(in.scopes)-1]
+}
+
+func (in *Interpreter) execFor(stmtFor *NodeStmtFor) error {
+	in.beginScope()
+	defer in.endScope()
+	if stmtFor.Init != nil {
+		if err := in.execStmt(stmtFor.Init); err != nil {
+			return err
+		}
+	}
+	for {
+		if stmtFor.Cond != nil {
+			cond, err := in.evalCond(stmtFor.Cond)
+			if err != nil {
+				return err
+			}
+			if !cond {
+				return nil
+			}
+		}
+		err := in.execScope(stmtFor.Scope)
+		if err == errBreak {
+			return nil
+		}
+		if err != nil && err != errContinue {
+			return err
+		}
+		if stmtFor.Step != nil {
+			if err := in.execStmt(stmtFor.Step); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (in *Interpreter) execIfPred(pred *NodeIfPred) error {
+	switch v := pred.Var.(type) {
+	case *NodeIfPredElif:
+		cond, err := in.evalCond(v.Expr)
+		if err != nil {
+			return err
+		}
+		if cond {
+			return in.execScope(v.Scope)
+		}
+		if v.Pred != nil {
+			return in.execIfPred(v.Pred)
+		}
+	case *NodeIfPredElse:
+		return in.execScope(v.Scope)
+	}
+	return nil
+}
+
+func (in *Interpreter) execStmt(stmt *NodeStmt) error {
+	switch v := stmt.Var.(type) {
+	case *NodeStmtExit:
+		value, err := in.evalExpr(v.Expr)
+		if err != nil {
+			return err
+		}
+		return &exitSignal{value: value}
+	case *NodeStmtLet:
+		variable := interpVar{Name: *v.Ident.Value, Mutable: v.Mut, typ: v.VarType}
+		if v.Expr != nil {
+			var err error
+			if variable.Value, err = in.evalExpr(v.Expr); err != nil {
+				return err
+			}
+		} else {
+			variable.Elems = make([]int64, letLen(v))
+			if v.Array != nil {
+				for i, elem := range v.Array.Elems {
+					var err error
+					if variable.Elems[i], err = in.evalExpr(elem); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		in.vars = append(in.vars, variable)
+	case *NodeStmtStatic:
+		var value int64
+		if v.Expr != nil {
+			var err error
+			if value, err = evalConst(v.Expr); err != nil {
+				return err
+			}
+		}
+		in.vars = append(in.vars, interpVar{Name: *v.Ident.Value, Value: value, Mutable: true, Static: true})
+	case *NodeStmtConst:
+		value, err := evalConst(v.Expr)
+		if err != nil {
+			return err
+		}
+		in.vars = append(in.vars, interpVar{Name: *v.Ident.Value, Value: value, Const: true})
+	case *NodeStmtAssign:
+		value, err := in.evalExpr(v.Expr)
+		if err != nil {
+			return err
+		}
+		target, err := in.target(v.Ident, v.Index, v.Deref)
+		if err != nil {
+			return err
+		}
+		*target = value
+	case *NodeStmtUpdate:
+		rhs, err := in.evalExpr(v.Expr)
+		if err != nil {
+			return err
+		}
+		target, err := in.target(v.Ident, v.Index, v.Deref)
+		if err != nil {
+			return err
+		}
+		value, err := applyBinOp(updateOp(v), *target, rhs)
+		if err != nil {
+			return err
+		}
+		*target = value
+	case *NodeScope:
+		return in.execScope(v)
+	case *NodeStmtIf:
+		cond, err := in.evalCond(v.Expr)
+		if err != nil {
+			return err
+		}
+		if cond {
+			return in.execScope(v.Scope)
+		}
+		if v.Pred != nil {
+			return in.execIfPred(v.Pred)
+		}
+	case *NodeStmtFor:
+		return in.execFor(v)
+	case *NodeStmtMatch:
+		value, err := in.evalExpr(v.Expr)
+		if err != nil {
+			return err
+		}
+		if arm := v.Select(value); arm != nil {
+			return in.execScope(arm.Scope)
+		}
+	case *NodeStmtBreak:
+		return errBreak
+	case *NodeStmtContinue:
+		return errContinue
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// interpret checks and runs src, returning its exit code.
+func interpret(t *testing.T, src string) int64 {
+	t.Helper()
+	prog, err := NewStreamParser(NewTokenizer(src)).ParseProg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewChecker().Check(prog); err != nil {
+		t.Fatal(err)
+	}
+	code, err := NewInterpreter().Run(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestComparisons(t *testing.T) {
+	tests := []struct {
+		expr string
+		want int64
+	}{
+		{"1 == 1", 1},
+		{"1 == 2", 0},
+		{"1 != 2", 1},
+		{"2 != 2", 0},
+		{"0 - 1 < 0", 1},
+		{"0 < 0 - 1", 0},
+		{"2 <= 2", 1},
+		{"3 <= 2", 0},
+		{"3 > 2", 1},
+		{"2 > 2", 0},
+		{"2 >= 2", 1},
+		{"1 >= 2", 0},
+		// Comparisons bind looser than arithmetic and shifts but tighter
+		// than the bitwise operators
+		{"1 + 1 == 2", 1},
+		{"1 << 2 > 3", 1},
+		{"1 | 2 == 2", 1},
+		{"(1 | 2) == 2", 0},
+		{"1 < 2 == 1", 1},
+		{"&x == &x", 1},
+		{"p != 0", 1},
+		{"0 == p", 0},
+	}
+	for _, test := range tests {
+		src := "let mut x = 0;\nlet p = &x;\nexit(" + test.expr + ");"
+		if got := interpret(t, src); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestComparisonLoop(t *testing.T) {
+	src := "let n = 5;\nlet mut total = 0;\nfor (let mut i = 0; i < n; i++) {\n    total += i;\n}\nexit(total);"
+	if got := interpret(t, src); got != 10 {
+		t.Errorf("got %d, want 10", got)
+	}
+}
+
+func TestComparisonErrors(t *testing.T) {
+	tests := []struct {
+		expr    string
+		message string
+	}{
+		{"p < 1", "Cannot use *i64 as an operand of `<`"},
+		{"1 >= p", "Cannot use *i64 as an operand of `>=`"},
+		{"p == 1", "Cannot use i64 as *i64"},
+	}
+	for _, test := range tests {
+		src := "let mut x = 0;\nlet p = &x;\nexit(" + test.expr + ");"
+		prog, err := NewStreamParser(NewTokenizer(src)).ParseProg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = NewChecker().Check(prog)
+		if err == nil || !strings.HasPrefix(err.Error(), test.message) {
+			t.Errorf("%s: got error %v, want %q", test.expr, err, test.message)
+		}
+	}
+}
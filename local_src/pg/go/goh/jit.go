@@ -0,0 +1,21 @@
+package main
+
+// JIT compiles a program to x86-64 machine code in memory and runs it in
+// the current process, without writing anything to disk. It is only
+// available on linux/amd64; elsewhere Run returns an error. A fault in the
+// generated code would crash the compiler, so it is always built with the
+// checks --debug adds: an index out of bounds or a null pointer dereference
+// makes Run return a *faultError.
+type JIT struct {
+	stackSize int
+}
+
+// jitStackSize is the size of the stack the generated code runs on. Like
+// a process stack it is reserved lazily, so unused pages cost nothing.
+const jitStackSize = 8 << 20
+
+func NewJIT() *JIT {
+	return &JIT{
+		stackSize: jitStackSize,
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// jitCall switches to the stack whose top is stack, calls code and returns
+// the rax and rdx it hands back. Implemented in jit_linux_amd64.s.
+func jitCall(code uintptr, stack uintptr) (value int64, status int64)
+
+// Run compiles prog, which must already have passed the Checker, and
+// returns the value it passes to `exit`, or 0 if it runs off the end.
+func (j *JIT) Run(prog NodeProg) (int64, error) {
+	generator := NewHostGenerator(prog)
+	instrs := Peephole(generator.GenProg())
+	encoder := NewEncoder()
+	code, err := encoder.Encode(instrs)
+	if err != nil {
+		return 0, err
+	}
+
+	text, err := syscall.Mmap(-1, 0, len(code), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return 0, fmt.Errorf("mapping code: %w", err)
+	}
+	defer syscall.Munmap(text)
+	copy(text, code)
+	encoder.Relocate(text, uintptr(unsafe.Pointer(&text[0])))
+	if err := syscall.Mprotect(text[:encoder.DataStart()], syscall.PROT_READ|syscall.PROT_EXEC); err != nil {
+		return 0, fmt.Errorf("protecting code: %w", err)
+	}
+
+	stack, err := syscall.Mmap(-1, 0, j.stackSize, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANON|syscall.MAP_NORESERVE|syscall.MAP_STACK)
+	if err != nil {
+		return 0, fmt.Errorf("mapping stack: %w", err)
+	}
+	defer syscall.Munmap(stack)
+
+	stackTop := uintptr(unsafe.Pointer(&stack[0])) + uintptr(len(stack))
+	value, status := jitCall(uintptr(unsafe.Pointer(&text[0])), stackTop)
+	switch status {
+	case hostStatusExit:
+		return value, nil
+	case hostStatusDivFault:
+		return 0, errDivFault
+	case hostStatusBoundsFault:
+		return 0, &faultError{kind: faultBounds, line: int(value)}
+	case hostStatusNullFault:
+		return 0, &faultError{kind: faultNull, line: int(value)}
+	}
+	return 0, fmt.Errorf("unknown status %d from generated code", status)
+}
@@ -0,0 +1,17 @@
+#include "textflag.h"
+
+// func jitCall(code uintptr, stack uintptr) (value int64, status int64)
+//
+// The generated code pushes freely and uses rax, rbx, rcx, rdx, rdi and
+// r13, so it runs on its own stack and the Go stack pointer is kept in
+// r12, which it never touches.
+TEXT ·jitCall(SB), NOSPLIT, $0-32
+	MOVQ code+0(FP), AX
+	MOVQ stack+8(FP), CX
+	MOVQ SP, R12
+	MOVQ CX, SP
+	CALL AX
+	MOVQ R12, SP
+	MOVQ AX, value+16(FP)
+	MOVQ DX, status+24(FP)
+	RET
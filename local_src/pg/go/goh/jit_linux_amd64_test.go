@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestJITFaults checks that faults in the generated code come back as
+// errors rather than signals that would take down the test binary.
+func TestJITFaults(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want error
+	}{
+		{"null pointer", "let mut x = 1;\nlet mut p = &x;\np = 0;\nexit(*p);", &faultError{kind: faultNull, line: 4}},
+		{"null store", "let mut x = 1;\nlet mut p = &x;\np = 0;\n*p += 1;\nexit(x);", &faultError{kind: faultNull, line: 4}},
+		{"index out of bounds", "let a = [1, 2, 3];\nlet mut i = 0;\ni = i - 1;\nexit(a[i]);", &faultError{kind: faultBounds, line: 4}},
+		{"division by zero", "let mut x = 0;\nx = x * 2;\nexit(1 / x);", errDivFault},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewJIT().Run(compile(t, test.src, 1))
+			var fault *faultError
+			if errors.As(err, &fault) {
+				if want, ok := test.want.(*faultError); !ok || *fault != *want {
+					t.Errorf("got %v, want %v", err, test.want)
+				}
+				return
+			}
+			if err != test.want {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
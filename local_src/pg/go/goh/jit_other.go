@@ -0,0 +1,9 @@
+//go:build !(linux && amd64)
+
+package main
+
+import "errors"
+
+func (j *JIT) Run(prog NodeProg) (int64, error) {
+	return 0, errors.New("the JIT is only supported on linux/amd64")
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Binding is a single `let` declaration as seen by the liveness analysis.
+type Binding struct {
+	Name  string
+	Decl  Token
+	Reads int
+}
+
+type liveSet map[*Binding]bool
+
+func (s liveSet) with(b *Binding) liveSet {
+	out := make(liveSet, len(s)+1)
+	for k := range s {
+		out[k] = true
+	}
+	out[b] = true
+	return out
+}
+
+func (s liveSet) without(b *Binding) liveSet {
+	out := make(liveSet, len(s))
+	for k := range s {
+		if k != b {
+			out[k] = true
+		}
+	}
+	return out
+}
+
+func (s liveSet) equal(other liveSet) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for k := range s {
+		if !other[k] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s liveSet) union(other liveSet) liveSet {
+	out := make(liveSet, len(s)+len(other))
+	for k := range s {
+		out[k] = true
+	}
+	for k := range other {
+		out[k] = true
+	}
+	return out
+}
+
+// liveLoop holds the variables live where `break` and `continue` jump to
+// in a loop.
+type liveLoop struct {
+	brk  liveSet
+	cont liveSet
+}
+
+// Liveness resolves every identifier to its `let` using the same vars/scopes
+// bookkeeping as the Generator, then runs a backward liveness pass over the
+// program to find variables that are never read and stores that are dead.
+// Loops are iterated to a fixpoint. Statics, arrays and variables whose
+// address is taken get no binding, so stores to them are never dead. An
+// update such as `x++` is a store whose read of x only feeds the store
+// itself, so it neither counts as a use nor keeps an earlier store alive
+// unless its own result is read.
+type Liveness struct {
+	vars     []*Binding
+	scopes   []int
+	bindings map[interface{}]*Binding // Keyed by *NodeTermIdent, *NodeStmtLet, *NodeStmtAssign or *NodeStmtUpdate
+	dead     map[interface{}]bool     // Keyed by *NodeStmtLet, *NodeStmtAssign or *NodeStmtUpdate
+	order    []*Binding
+	warnings []Diagnostic
+	loops    []liveLoop
+	// Nonzero while a loop body is visited before its live sets have
+	// settled, when dead stores must not be recorded yet
+	quiet int
+}
+
+func NewLiveness() *Liveness {
+	return &Liveness{
+		vars:     make([]*Binding, 0),
+		scopes:   make([]int, 0),
+		bindings: make(map[interface{}]*Binding),
+		dead:     make(map[interface{}]bool),
+	}
+}
+
+// Analyze runs the analysis over prog and returns its warnings ordered by
+// line, placed at the variable they are about.
+func (l *Liveness) Analyze(prog NodeProg) []Diagnostic {
+	l.beginScope()
+	for _, stmt := range prog.Stmts {
+		l.resolveStmt(stmt)
+	}
+	l.endScope()
+
+	l.liveStmts(prog.Stmts, liveSet{})
+
+	for _, b := range l.order {
+		if b.Reads == 0 {
+			l.warn(b.Decl, fmt.Sprintf("variable `%s` is never used", b.Name))
+		}
+	}
+	sort.SliceStable(l.warnings, func(i, j int) bool {
+		return l.warnings[i].Line < l.warnings[j].Line
+	})
+	return l.warnings
+}
+
+// Eliminate removes the dead stores found by Analyze whose right-hand side
+// has no side effects. A dead `let` keeps its stack slot, without evaluating
+// its initializer, if the variable is still assigned or read later on.
+func (l *Liveness) Eliminate(prog *NodeProg) {
+	kept := make(map[*Binding]int)
+	l.countKeptAssigns(prog.Stmts, kept)
+	prog.Stmts = l.eliminateStmts(prog.Stmts, kept)
+}
+
+func (l *Liveness) warn(token Token, message string) {
+	l.warnings = append(l.warnings, tokenDiagnostic(token, fmt.Sprintf("[Warning] %s on line %d", message, token.Line)))
+}
+
+func (l *Liveness) lookup(name string) *Binding {
+	for i := len(l.vars) - 1; i >= 0; i-- {
+		if l.vars[i].Name == name {
+			return l.vars[i]
+		}
+	}
+	return nil
+}
+
+func (l *Liveness) resolveExpr(expr *NodeExpr) {
+	switch v := expr.Var.(type) {
+	case *NodeTerm:
+		switch t := v.Var.(type) {
+		case *NodeTermIdent:
+			if b := l.lookup(*t.Ident.Value); b != nil {
+				b.Reads++
+				l.bindings[t] = b
+			}
+		case *NodeTermIndex:
+			l.resolveExpr(t.Index)
+		case *NodeTermAddr:
+			if t.Index != nil {
+				l.resolveExpr(t.Index)
+			}
+		case *NodeTermDeref:
+			l.resolveExpr(t.Expr)
+		case *NodeTermParen:
+			l.resolveExpr(t.Expr)
+		case *NodeTermBitNot:
+			l.resolveExpr(t.Expr)
+		}
+	case *NodeBinExpr:
+		lhs, rhs := binOperands(v)
+		l.resolveExpr(lhs)
+		l.resolveExpr(rhs)
+	}
+}
+
+func (l *Liveness) resolveScope(scope *NodeScope) {
+	l.beginScope()
+	for _, stmt := range scope.Stmts {
+		l.resolveStmt(stmt)
+	}
+	l.endScope()
+}
+
+func (l *Liveness) resolveIfPred(pred *NodeIfPred) {
+	switch v := pred.Var.(type) {
+	case *NodeIfPredElif:
+		l.resolveExpr(v.Expr)
+		l.resolveScope(v.Scope)
+		if v.Pred != nil {
+			l.resolveIfPred(v.Pred)
+		}
+	case *NodeIfPredElse:
+		l.resolveScope(v.Scope)
+	}
+}
+
+func (l *Liveness) resolveStmt(stmt *NodeStmt) {
+	switch v := stmt.Var.(type) {
+	case *NodeStmtExit:
+		l.resolveExpr(v.Expr)
+	case *NodeStmtLet:
+		if letLen(v) > 0 {
+			if v.Array != nil {
+				for _, elem := range v.Array.Elems {
+					l.resolveExpr(elem)
+				}
+			}
+			return
+		}
+		if v.Expr != nil {
+			l.resolveExpr(v.Expr)
+		}
+		if v.Addressed {
+			return
+		}
+		b := &Binding{Name: *v.Ident.Value, Decl: v.Ident}
+		l.vars = append(l.vars, b)
+		l.order = append(l.order, b)
+		l.bindings[v] = b
+	case *NodeStmtAssign:
+		l.resolveExpr(v.Expr)
+		if v.Deref != nil {
+			l.resolveExpr(v.Deref.Expr)
+		} else if v.Index != nil {
+			l.resolveExpr(v.Index)
+		} else if b := l.lookup(*v.Ident.Value); b != nil {
+			l.bindings[v] = b
+		}
+	case *NodeStmtUpdate:
+		l.resolveExpr(v.Expr)
+		if v.Deref != nil {
+			l.resolveExpr(v.Deref.Expr)
+		} else if v.Index != nil {
+			l.resolveExpr(v.Index)
+		} else if b := l.lookup(*v.Ident.Value); b != nil {
+			l.bindings[v] = b
+		}
+	case *NodeScope:
+		l.resolveScope(v)
+	case *NodeStmtIf:
+		l.resolveExpr(v.Expr)
+		l.resolveScope(v.Scope)
+		if v.Pred != nil {
+			l.resolveIfPred(v.Pred)
+		}
+	case *NodeStmtFor:
+		l.beginScope()
+		if v.Init != nil {
+			l.resolveStmt(v.Init)
+		}
+		if v.Cond != nil {
+			l.resolveExpr(v.Cond)
+		}
+		l.resolveScope(v.Scope)
+		if v.Step != nil {
+			l.resolveStmt(v.Step)
+		}
+		l.endScope()
+	case *NodeStmtMatch:
+		l.resolveExpr(v.Expr)
+		for _, arm := range v.Arms {
+			l.resolveScope(arm.Scope)
+		}
+	}
+}
+
+func (l *Liveness) beginScope() {
+	l.scopes = append(l.scopes, len(l.vars))
+}
+
+func (l *Liveness) endScope() {
+	l.vars = l.vars[:l.scopes[len(l.scopes)-1]]
+	l.scopes = l.scopes[:len(l.scopes)-1]
+}
+
+// uses adds the variables read by expr to live.
+func (l *Liveness) uses(expr *NodeExpr, live liveSet) liveSet {
+	switch v := expr.Var.(type) {
+	case *NodeTerm:
+		switch t := v.Var.(type) {
+		case *NodeTermIdent:
+			if b, ok := l.bindings[t]; ok {
+				return live.with(b)
+			}
+		case *NodeTermIndex:
+			return l.uses(t.Index, live)
+		case *NodeTermAddr:
+			if t.Index != nil {
+				return l.uses(t.Index, live)
+			}
+		case *NodeTermDeref:
+			return l.uses(t.Expr, live)
+		case *NodeTermParen:
+			return l.uses(t.Expr, live)
+		case *NodeTermBitNot:
+			return l.uses(t.Expr, live)
+		}
+	case *NodeBinExpr:
+		lhs, rhs := binOperands(v)
+		return l.uses(rhs, l.uses(lhs, live))
+	}
+	return live
+}
+
+// store handles a write to the variable bound to node, given the variables
+// live after it, and returns the variables live before it.
+func (l *Liveness) store(node interface{}, target Token, expr *NodeExpr, out liveSet) liveSet {
+	b, ok := l.bindings[node]
+	if !ok {
+		return l.uses(expr, out)
+	}
+	in := out
+	if out[b] {
+		in = out.without(b)
+	} else if l.quiet == 0 {
+		l.dead[node] = true
+		if b.Reads > 0 {
+			l.warn(target, fmt.Sprintf("value assigned to `%s` is never read", b.Name))
+		}
+	}
+	if expr == nil {
+		return in
+	}
+	return l.uses(expr, in)
+}
+
+func (l *Liveness) liveStmts(stmts []*NodeStmt, out liveSet) liveSet {
+	for i := len(stmts) - 1; i >= 0; i-- {
+		out = l.liveStmt(stmts[i], out)
+	}
+	return out
+}
+
+func (l *Liveness) liveIfPred(pred *NodeIfPred, out liveSet) liveSet {
+	if pred == nil {
+		return out
+	}
+	switch v := pred.Var.(type) {
+	case *NodeIfPredElif:
+		in := l.liveStmts(v.Scope.Stmts, out).union(l.liveIfPred(v.Pred, out))
+		return l.uses(v.Expr, in)
+	case *NodeIfPredElse:
+		return l.liveStmts(v.Scope.Stmts, out)
+	}
+	return out
+}
+
+func (l *Liveness) liveStmt(stmt *NodeStmt, out liveSet) liveSet {
+	switch v := stmt.Var.(type) {
+	case *NodeStmtExit:
+		return l.uses(v.Expr, liveSet{})
+	case *NodeStmtLet:
+		if v.Array != nil {
+			for i := len(v.Array.Elems) - 1; i >= 0; i-- {
+				out = l.uses(v.Array.Elems[i], out)
+			}
+		}
+		if letLen(v) > 0 {
+			return out
+		}
+		return l.store(v, v.Ident, v.Expr, out)
+	case *NodeStmtAssign:
+		if v.Deref != nil {
+			return l.uses(v.Deref.Expr, l.uses(v.Expr, out))
+		}
+		if v.Index != nil {
+			return l.uses(v.Index, l.uses(v.Expr, out))
+		}
+		return l.store(v, v.Ident, v.Expr, out)
+	case *NodeStmtUpdate:
+		if v.Deref != nil {
+			return l.uses(v.Deref.Expr, l.uses(v.Expr, out))
+		}
+		if v.Index != nil {
+			return l.uses(v.Index, l.uses(v.Expr, out))
+		}
+		// The update reads the variable only if its own result is read
+		in := l.store(v, v.Ident, v.Expr, out)
+		if b, ok := l.bindings[v]; ok && out[b] {
+			in = in.with(b)
+		}
+		return in
+	case *NodeScope:
+		return l.liveStmts(v.Stmts, out)
+	case *NodeStmtIf:
+		in := l.liveStmts(v.Scope.Stmts, out).union(l.liveIfPred(v.Pred, out))
+		return l.uses(v.Expr, in)
+	case *NodeStmtFor:
+		return l.liveFor(v, out)
+	case *NodeStmtMatch:
+		return l.liveMatch(v, out)
+	case *NodeStmtBreak:
+		return l.loops[len(l.loops)-1].brk
+	case *NodeStmtContinue:
+		return l.loops[len(l.loops)-1].cont
+	}
+	return out
+}
+
+// liveMatch joins the arms of a match, and what follows it when no arm
+// runs for some values.
+func (l *Liveness) liveMatch(stmtMatch *NodeStmtMatch, out liveSet) liveSet {
+	in := liveSet{}
+	hasDefault := false
+	for _, arm := range stmtMatch.Arms {
+		in = in.union(l.liveStmts(arm.Scope.Stmts, out))
+		hasDefault = hasDefault || arm.IsDefault()
+	}
+	if !hasDefault {
+		in = in.union(out)
+	}
+	return l.uses(stmtMatch.Expr, in)
+}
+
+// liveFor grows the set of variables live at the top of a loop, where the
+// condition is tested, until another trip through the loop adds nothing.
+// Only the final trip, made with the settled set, records dead stores.
+func (l *Liveness) liveFor(stmtFor *NodeStmtFor, out liveSet) liveSet {
+	head := liveSet{}
+	l.quiet++
+	for {
+		in := l.liveLoopTrip(stmtFor, head, out)
+		if in.equal(head) {
+			break
+		}
+		head = in
+	}
+	l.quiet--
+	head = l.liveLoopTrip(stmtFor, head, out)
+	if stmtFor.Init == nil {
+		return head
+	}
+	return l.liveStmt(stmtFor.Init, head)
+}
+
+// liveLoopTrip returns the variables live at the top of a loop, given
+// those live there on the next trip and those live after the loop.
+func (l *Liveness) liveLoopTrip(stmtFor *NodeStmtFor, head liveSet, out liveSet) liveSet {
+	cont := head
+	if stmtFor.Step != nil {
+		cont = l.liveStmt(stmtFor.Step, head)
+	}
+	l.loops = append(l.loops, liveLoop{brk: out, cont: cont})
+	in := l.liveStmts(stmtFor.Scope.Stmts, cont)
+	l.loops = l.loops[:len(l.loops)-1]
+	if stmtFor.Cond == nil {
+		return in
+	}
+	return l.uses(stmtFor.Cond, in.union(out))
+}
+
+func (l *Liveness) removable(node interface{}, expr *NodeExpr) bool {
+	return l.dead[node] && (expr == nil || !hasSideEffects(expr))
+}
+
+// removableUpdate is removable for updates, which can also fault by
+// dividing the variable.
+func (l *Liveness) removableUpdate(update *NodeStmtUpdate) bool {
+	op := updateOp(update)
+	return l.removable(update, update.Expr) && op != TokenFslash && op != TokenPercent
+}
+
+func (l *Liveness) countKeptAssigns(stmts []*NodeStmt, kept map[*Binding]int) {
+	for _, stmt := range stmts {
+		switch v := stmt.Var.(type) {
+		case *NodeStmtAssign:
+			if b, ok := l.bindings[v]; ok && !l.removable(v, v.Expr) {
+				kept[b]++
+			}
+		case *NodeStmtUpdate:
+			if b, ok := l.bindings[v]; ok && !l.removableUpdate(v) {
+				kept[b]++
+			}
+		case *NodeScope:
+			l.countKeptAssigns(v.Stmts, kept)
+		case *NodeStmtFor:
+			for _, clause := range []*NodeStmt{v.Init, v.Step} {
+				if clause != nil {
+					l.countKeptAssigns([]*NodeStmt{clause}, kept)
+				}
+			}
+			l.countKeptAssigns(v.Scope.Stmts, kept)
+		case *NodeStmtMatch:
+			for _, arm := range v.Arms {
+				l.countKeptAssigns(arm.Scope.Stmts, kept)
+			}
+		case *NodeStmtIf:
+			l.countKeptAssigns(v.Scope.Stmts, kept)
+			for pred := v.Pred; pred != nil; {
+				switch p := pred.Var.(type) {
+				case *NodeIfPredElif:
+					l.countKeptAssigns(p.Scope.Stmts, kept)
+					pred = p.Pred
+				case *NodeIfPredElse:
+					l.countKeptAssigns(p.Scope.Stmts, kept)
+					pred = nil
+				}
+			}
+		}
+	}
+}
+
+func (l *Liveness) eliminateStmts(stmts []*NodeStmt, kept map[*Binding]int) []*NodeStmt {
+	out := stmts[:0]
+	for _, stmt := range stmts {
+		switch v := stmt.Var.(type) {
+		case *NodeStmtLet:
+			if l.removable(v, v.Expr) {
+				b := l.bindings[v]
+				if b.Reads == 0 && kept[b] == 0 {
+					continue
+				}
+				v.Expr = nil
+			}
+		case *NodeStmtAssign:
+			if l.removable(v, v.Expr) {
+				continue
+			}
+		case *NodeStmtUpdate:
+			if l.removableUpdate(v) {
+				continue
+			}
+		case *NodeScope:
+			v.Stmts = l.eliminateStmts(v.Stmts, kept)
+		case *NodeStmtFor:
+			v.Init = l.eliminateClause(v.Init, kept)
+			v.Step = l.eliminateClause(v.Step, kept)
+			v.Scope.Stmts = l.eliminateStmts(v.Scope.Stmts, kept)
+		case *NodeStmtMatch:
+			for _, arm := range v.Arms {
+				arm.Scope.Stmts = l.eliminateStmts(arm.Scope.Stmts, kept)
+			}
+		case *NodeStmtIf:
+			v.Scope.Stmts = l.eliminateStmts(v.Scope.Stmts, kept)
+			for pred := v.Pred; pred != nil; {
+				switch p := pred.Var.(type) {
+				case *NodeIfPredElif:
+					p.Scope.Stmts = l.eliminateStmts(p.Scope.Stmts, kept)
+					pred = p.Pred
+				case *NodeIfPredElse:
+					p.Scope.Stmts = l.eliminateStmts(p.Scope.Stmts, kept)
+					pred = nil
+				}
+			}
+		}
+		out = append(out, stmt)
+	}
+	return out
+}
+
+// eliminateClause returns the init or step clause of a loop, or nil if it
+// is removed.
+func (l *Liveness) eliminateClause(clause *NodeStmt, kept map[*Binding]int) *NodeStmt {
+	if clause == nil {
+		return nil
+	}
+	if stmts := l.eliminateStmts([]*NodeStmt{clause}, kept); len(stmts) > 0 {
+		return stmts[0]
+	}
+	return nil
+}
+
+// hasSideEffects reports whether evaluating expr can do anything besides
+// produce a value. Division, remainder, indexing and dereferencing can
+// fault, so they count as side effects.
+func hasSideEffects(expr *NodeExpr) bool {
+	switch v := expr.Var.(type) {
+	case *NodeTerm:
+		switch t := v.Var.(type) {
+		case *NodeTermIndex, *NodeTermDeref:
+			return true
+		case *NodeTermAddr:
+			return t.Index != nil
+		case *NodeTermParen:
+			return hasSideEffects(t.Expr)
+		case *NodeTermBitNot:
+			return hasSideEffects(t.Expr)
+		}
+		return false
+	case *NodeBinExpr:
+		switch v.Var.(type) {
+		case *NodeBinExprDiv, *NodeBinExprMod:
+			return true
+		}
+		lhs, rhs := binOperands(v)
+		return hasSideEffects(lhs) || hasSideEffects(rhs)
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// analyze parses and checks src and returns the liveness warnings for it.
+func analyze(t *testing.T, src string) []Diagnostic {
+	t.Helper()
+	prog, err := NewStreamParser(NewTokenizer(src)).ParseProg()
+	if err != nil {
+		t.Fatalf("%q: %v", src, err)
+	}
+	if err := NewChecker().Check(prog); err != nil {
+		t.Fatalf("%q: %v", src, err)
+	}
+	return NewLiveness().Analyze(prog)
+}
+
+func TestLivenessWarnings(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"used", "let x = 1;\nexit(x);", nil},
+		{"unused", "let x = 1;\nexit(0);", []string{"[Warning] variable `x` is never used on line 1"}},
+		{"dead assign", "let mut x = 1;\nx = 2;\nx = 3;\nexit(x);", []string{"[Warning] value assigned to `x` is never read on line 1", "[Warning] value assigned to `x` is never read on line 2"}},
+		{"dead let", "let mut x = 1;\nx = 2;\nexit(x);", []string{"[Warning] value assigned to `x` is never read on line 1"}},
+		{"update only", "let mut x = 0;\nx++;\nexit(0);", []string{"[Warning] variable `x` is never used on line 1"}},
+		{"compound update only", "let mut x = 0;\nx += 2;\nx *= 3;\nexit(0);", []string{"[Warning] variable `x` is never used on line 1"}},
+		{"update read", "let mut x = 0;\nx++;\nexit(x);", nil},
+		{"dead update", "let mut x = 0;\nexit(x);\nx++;", []string{"[Warning] value assigned to `x` is never read on line 3"}},
+		{"loop counter", "let mut n = 0;\nfor (let mut i = 0; 3 - i; i++) {\n    n += 2;\n}\nexit(n);", nil},
+		{"loop update only", "let mut n = 0;\nfor (let mut i = 0; 3 - i; i++) {\n    n += 2;\n}\nexit(0);", []string{"[Warning] variable `n` is never used on line 1"}},
+		{"branches", "let mut x = 1;\nif (x) {\n    x = 2;\n} else {\n    x = 3;\n}\nexit(x);", nil},
+		{"addressed", "let mut x = 1;\nlet p = &x;\nx = 2;\nexit(*p);", nil},
+		{"static", "static s = 1;\ns = 2;\nexit(0);", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, warning := range analyze(t, test.src) {
+				got = append(got, warning.Message)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLivenessWarningPosition(t *testing.T) {
+	warnings := analyze(t, "let mut x = 0;\n    x = 1;\nlet  y = 2;\nexit(x);")
+	want := []Diagnostic{
+		{Line: 1, Col: 9, Len: 1, Message: "[Warning] value assigned to `x` is never read on line 1"},
+		{Line: 3, Col: 6, Len: 1, Message: "[Warning] variable `y` is never used on line 3"},
+	}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("got %+v, want %+v", warnings, want)
+	}
+}
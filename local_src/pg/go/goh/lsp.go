@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// LSP wire types. Only the fields the server reads or writes are declared.
+
+type lspMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range              lspRange                          `json:"range"`
+	Severity           int                               `json:"severity"`
+	Source             string                            `json:"source"`
+	Message            string                            `json:"message"`
+	RelatedInformation []lspDiagnosticRelatedInformation `json:"relatedInformation,omitempty"`
+}
+
+type lspDiagnosticRelatedInformation struct {
+	Location lspLocation `json:"location"`
+	Message  string      `json:"message"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string   `json:"name"`
+	Detail         string   `json:"detail"`
+	Kind           int      `json:"kind"`
+	Range          lspRange `json:"range"`
+	SelectionRange lspRange `json:"selectionRange"`
+}
+
+type lspTextDocumentParams struct {
+	TextDocument struct {
+		URI  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+	Position lspPosition `json:"position"`
+	Context  struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+}
+
+const (
+	lspErrorMethodNotFound = -32601
+	lspErrorInvalidParams  = -32602
+	lspSeverityError       = 1
+	lspSeverityWarning     = 2
+	lspSymbolKindVariable  = 13
+	lspSyncFull            = 1
+)
+
+// lspDocument is an open file along with what the front end made of it.
+type lspDocument struct {
+	lines      []string
+	diagnostic *Diagnostic
+	warnings   []Diagnostic
+	symbols    []*Symbol
+}
+
+// LSPServer speaks the Language Server Protocol over a pair of streams,
+// running the tokenizer, parser and checker on every change to publish
+// diagnostics and answer questions about variables.
+type LSPServer struct {
+	reader    *bufio.Reader
+	writer    io.Writer
+	documents map[string]*lspDocument
+	shutdown  bool
+}
+
+func NewLSPServer(in io.Reader, out io.Writer) *LSPServer {
+	return &LSPServer{
+		reader:    bufio.NewReader(in),
+		writer:    out,
+		documents: make(map[string]*lspDocument),
+		shutdown:  false,
+	}
+}
+
+// Run serves requests until the client sends `exit`. It returns an error
+// if the stream breaks or the client exits without a shutdown request.
+func (s *LSPServer) Run() error {
+	for {
+		msg, err := s.read()
+		if err != nil {
+			return err
+		}
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return errors.New("exit without shutdown")
+			}
+			return nil
+		}
+		result, rpcErr, err := s.handle(msg)
+		if err != nil {
+			return err
+		}
+		if msg.ID == nil {
+			continue // Notifications get no response
+		}
+		response := lspMessage{JSONRPC: "2.0", ID: msg.ID, Result: result, Error: rpcErr}
+		if rpcErr == nil && result == nil {
+			// A null result still has to be sent as "result": null
+			response.Result = json.RawMessage("null")
+		}
+		if err := s.write(response); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *LSPServer) read() (*lspMessage, error) {
+	header, err := textproto.NewReader(s.reader).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("bad Content-Length: %w", err)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.reader, body); err != nil {
+		return nil, err
+	}
+	var msg lspMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (s *LSPServer) write(msg lspMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.writer, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = s.writer.Write(body)
+	return err
+}
+
+func (s *LSPServer) notify(method string, params interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return s.write(lspMessage{JSONRPC: "2.0", Method: method, Params: data})
+}
+
+// handle answers a request or acts on a notification. Failing to publish
+// diagnostics is returned as err, since the stream to the client is broken.
+func (s *LSPServer) handle(msg *lspMessage) (result interface{}, rpcErr *lspError, err error) {
+	var params lspTextDocumentParams
+	if len(msg.Params) > 0 && strings.HasPrefix(msg.Method, "textDocument/") {
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{Code: lspErrorInvalidParams, Message: err.Error()}, nil
+		}
+	}
+	uri := params.TextDocument.URI
+	doc := s.documents[uri]
+
+	switch msg.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       lspSyncFull,
+				"definitionProvider":     true,
+				"referencesProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "goh"},
+		}, nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil, nil
+	case "textDocument/didOpen":
+		return nil, nil, s.update(uri, params.TextDocument.Text)
+	case "textDocument/didChange":
+		if n := len(params.ContentChanges); n > 0 {
+			return nil, nil, s.update(uri, params.ContentChanges[n-1].Text)
+		}
+		return nil, nil, nil
+	case "textDocument/didClose":
+		delete(s.documents, uri)
+		return nil, nil, s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+			"uri":         uri,
+			"diagnostics": []lspDiagnostic{},
+		})
+	case "textDocument/definition":
+		symbol, _ := doc.symbolAt(params.Position)
+		if symbol == nil {
+			return nil, nil, nil
+		}
+		return lspLocation{URI: uri, Range: doc.tokenRange(symbol.Decl)}, nil, nil
+	case "textDocument/references":
+		symbol, _ := doc.symbolAt(params.Position)
+		if symbol == nil {
+			return nil, nil, nil
+		}
+		locations := make([]lspLocation, 0, len(symbol.Refs)+1)
+		if params.Context.IncludeDeclaration {
+			locations = append(locations, lspLocation{URI: uri, Range: doc.tokenRange(symbol.Decl)})
+		}
+		for _, ref := range symbol.Refs {
+			locations = append(locations, lspLocation{URI: uri, Range: doc.tokenRange(ref)})
+		}
+		return locations, nil, nil
+	case "textDocument/hover":
+		symbol, token := doc.symbolAt(params.Position)
+		if symbol == nil {
+			return nil, nil, nil
+		}
+		decl := fmt.Sprintf("%s %s: %s", symbol.Keyword(), *symbol.Decl.Value, symbol.Type)
+		if symbol.Const {
+			decl += fmt.Sprintf(" = %d", symbol.Value)
+		}
+		return map[string]interface{}{
+			"contents": map[string]string{
+				"kind":  "markdown",
+				"value": fmt.Sprintf("```hy\n%s\n```\nDeclared on line %d", decl, symbol.Decl.Line),
+			},
+			"range": doc.tokenRange(token),
+		}, nil, nil
+	case "textDocument/documentSymbol":
+		symbols := make([]lspDocumentSymbol, 0)
+		if doc != nil {
+			for _, symbol := range doc.symbols {
+				symbols = append(symbols, lspDocumentSymbol{
+					Name:           *symbol.Decl.Value,
+					Detail:         symbol.Keyword(),
+					Kind:           lspSymbolKindVariable,
+					Range:          doc.tokenRange(symbol.Decl),
+					SelectionRange: doc.tokenRange(symbol.Decl),
+				})
+			}
+		}
+		return symbols, nil, nil
+	}
+	if msg.ID != nil {
+		return nil, &lspError{Code: lspErrorMethodNotFound, Message: "method not found: " + msg.Method}, nil
+	}
+	return nil, nil, nil
+}
+
+// update reanalyzes a document and publishes its diagnostics.
+func (s *LSPServer) update(uri string, text string) error {
+	doc := analyzeDocument(text)
+	s.documents[uri] = doc
+
+	diagnostics := make([]lspDiagnostic, 0, 1+len(doc.warnings))
+	if doc.diagnostic != nil {
+		diagnostics = append(diagnostics, doc.newDiagnostic(uri, *doc.diagnostic, lspSeverityError))
+	}
+	for _, warning := range doc.warnings {
+		diagnostics = append(diagnostics, doc.newDiagnostic(uri, warning, lspSeverityWarning))
+	}
+	return s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+		"uri":         uri,
+		"diagnostics": diagnostics,
+	})
+}
+
+func (doc *lspDocument) newDiagnostic(uri string, d Diagnostic, severity int) lspDiagnostic {
+	diagnostic := lspDiagnostic{
+		Range:    doc.diagnosticRange(d),
+		Severity: severity,
+		Source:   "goh",
+		Message:  d.Message,
+	}
+	for _, related := range d.Related {
+		diagnostic.RelatedInformation = append(diagnostic.RelatedInformation, lspDiagnosticRelatedInformation{
+			Location: lspLocation{URI: uri, Range: doc.diagnosticRange(related)},
+			Message:  related.Message,
+		})
+	}
+	return diagnostic
+}
+
+func (doc *lspDocument) diagnosticRange(d Diagnostic) lspRange {
+	return lspRange{Start: doc.position(d.Line, d.Col), End: doc.position(d.Line, d.Col+d.Len)}
+}
+
+// position converts a 1-based line and column counted in characters, as the
+// tokenizer reports them, to an LSP position, whose character offset counts
+// UTF-16 code units. Columns past the end of the line count one unit each.
+func (doc *lspDocument) position(line int, col int) lspPosition {
+	text := ""
+	if line >= 1 && line <= len(doc.lines) {
+		text = doc.lines[line-1]
+	}
+	character := 0
+	for n := 1; n < col; n++ {
+		ch, size := utf8.DecodeRuneInString(text)
+		text = text[size:]
+		character++
+		if ch > 0xFFFF {
+			character++ // Encoded as a surrogate pair
+		}
+	}
+	return lspPosition{Line: line - 1, Character: character}
+}
+
+// analyzeDocument runs the front end over text, stopping at the first
+// stage that reports an error. Symbols resolved before a checker error are
+// still returned, and a program that checks also gets the liveness warnings.
+func analyzeDocument(text string) *lspDocument {
+	doc := &lspDocument{lines: strings.Split(text, "\n")}
+	var diag Diagnostic
+
+	prog, err := NewStreamParser(NewTokenizer(text)).ParseProg()
+	if errors.As(err, &diag) {
+		doc.diagnostic = &diag
+		return doc
+	}
+	checker := NewChecker()
+	if err := checker.Check(prog); errors.As(err, &diag) {
+		doc.diagnostic = &diag
+		doc.warnings = checker.Warnings
+	} else {
+		doc.warnings = append(checker.Warnings, NewLiveness().Analyze(prog)...)
+	}
+	doc.symbols = checker.Symbols
+	return doc
+}
+
+// symbolAt returns the symbol whose declaration or reference covers pos,
+// along with that token. doc may be nil for a file that is not open.
+func (doc *lspDocument) symbolAt(pos lspPosition) (*Symbol, Token) {
+	if doc == nil {
+		return nil, Token{}
+	}
+	for _, symbol := range doc.symbols {
+		if doc.tokenContains(symbol.Decl, pos) {
+			return symbol, symbol.Decl
+		}
+		for _, ref := range symbol.Refs {
+			if doc.tokenContains(ref, pos) {
+				return symbol, ref
+			}
+		}
+	}
+	return nil, Token{}
+}
+
+func (doc *lspDocument) tokenRange(token Token) lspRange {
+	return lspRange{Start: doc.position(token.Line, token.Col), End: doc.position(token.Line, token.Col+token.Len())}
+}
+
+// tokenContains reports whether pos lies on token, counting the position
+// just past its end so a cursor at the end of a name still finds it.
+func (doc *lspDocument) tokenContains(token Token, pos lspPosition) bool {
+	r := doc.tokenRange(token)
+	return pos.Line == r.Start.Line && pos.Character >= r.Start.Character && pos.Character <= r.End.Character
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const lspTestURI = "file:///test.hy"
+
+// lspSession runs a server over the given messages, each sent with an id
+// unless it is a notification, and returns everything the server wrote.
+func lspSession(t *testing.T, messages ...lspMessage) []lspMessage {
+	t.Helper()
+	var in bytes.Buffer
+	messages = append(messages, lspMessage{Method: "shutdown", ID: lspID(len(messages) + 1)}, lspMessage{Method: "exit"})
+	for _, msg := range messages {
+		msg.JSONRPC = "2.0"
+		body, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	var out bytes.Buffer
+	if err := NewLSPServer(&in, &out).Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	var replies []lspMessage
+	reader := bufio.NewReader(&out)
+	for {
+		var length int
+		if _, err := fmt.Fscanf(reader, "Content-Length: %d\r\n\r\n", &length); err != nil {
+			break
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			t.Fatal(err)
+		}
+		var reply lspMessage
+		if err := json.Unmarshal(body, &reply); err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+func lspID(id int) *json.RawMessage {
+	raw := json.RawMessage(fmt.Sprint(id))
+	return &raw
+}
+
+func lspRequest(id int, method string, params interface{}) lspMessage {
+	msg := lspNotification(method, params)
+	msg.ID = lspID(id)
+	return msg
+}
+
+func lspNotification(method string, params interface{}) lspMessage {
+	data, _ := json.Marshal(params)
+	return lspMessage{Method: method, Params: data}
+}
+
+func lspOpen(text string) lspMessage {
+	return lspNotification("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]string{"uri": lspTestURI, "text": text},
+	})
+}
+
+func lspAt(line, character int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]string{"uri": lspTestURI},
+		"position":     lspPosition{Line: line, Character: character},
+		"context":      map[string]bool{"includeDeclaration": true},
+	}
+}
+
+// lspResult decodes the result of the reply to request id into result.
+func lspResult(t *testing.T, replies []lspMessage, id int, result interface{}) {
+	t.Helper()
+	for _, reply := range replies {
+		if reply.ID == nil || string(*reply.ID) != fmt.Sprint(id) {
+			continue
+		}
+		if reply.Error != nil {
+			t.Fatalf("request %d: %s", id, reply.Error.Message)
+		}
+		data, _ := json.Marshal(reply.Result)
+		if err := json.Unmarshal(data, result); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	t.Fatalf("no reply to request %d", id)
+}
+
+// lspPublished returns the diagnostics in the last publishDiagnostics.
+func lspPublished(t *testing.T, replies []lspMessage) []lspDiagnostic {
+	t.Helper()
+	var diagnostics []lspDiagnostic
+	found := false
+	for _, reply := range replies {
+		if reply.Method != "textDocument/publishDiagnostics" {
+			continue
+		}
+		var params struct {
+			URI         string          `json:"uri"`
+			Diagnostics []lspDiagnostic `json:"diagnostics"`
+		}
+		if err := json.Unmarshal(reply.Params, &params); err != nil {
+			t.Fatal(err)
+		}
+		if params.URI != lspTestURI {
+			t.Errorf("published for %s", params.URI)
+		}
+		diagnostics, found = params.Diagnostics, true
+	}
+	if !found {
+		t.Fatal("no diagnostics published")
+	}
+	return diagnostics
+}
+
+func lspSpan(line, start, end int) lspRange {
+	return lspRange{Start: lspPosition{Line: line, Character: start}, End: lspPosition{Line: line, Character: end}}
+}
+
+func TestLSPInitialize(t *testing.T) {
+	replies := lspSession(t, lspRequest(1, "initialize", map[string]interface{}{}))
+	var result struct {
+		Capabilities map[string]interface{} `json:"capabilities"`
+	}
+	lspResult(t, replies, 1, &result)
+	for _, capability := range []string{"textDocumentSync", "definitionProvider", "referencesProvider", "hoverProvider", "documentSymbolProvider"} {
+		if result.Capabilities[capability] == nil {
+			t.Errorf("missing capability %s", capability)
+		}
+	}
+}
+
+func TestLSPDiagnostics(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []lspDiagnostic
+	}{
+		{"clean", "let x = 1;\nexit(x);", []lspDiagnostic{}},
+		{"parse error", "exit(1", []lspDiagnostic{
+			{Range: lspSpan(0, 5, 6), Severity: lspSeverityError, Source: "goh", Message: "[Parse Error] Expected `)` on line 1"},
+		}},
+		{"checker error", "exit(y);", []lspDiagnostic{
+			{Range: lspSpan(0, 5, 6), Severity: lspSeverityError, Source: "goh", Message: "Undeclared identifier: y on line 1"},
+		}},
+		{"liveness warning", "let x = 1;\nexit(0);", []lspDiagnostic{
+			{Range: lspSpan(0, 4, 5), Severity: lspSeverityWarning, Source: "goh", Message: "[Warning] variable `x` is never used on line 1"},
+		}},
+		// é is one UTF-16 unit and 𝑥 is two
+		{"utf-16 columns", "/* é𝑥 */ let ñ𝑥 = 1;\nexit(0);", []lspDiagnostic{
+			{Range: lspSpan(0, 14, 17), Severity: lspSeverityWarning, Source: "goh", Message: "[Warning] variable `ñ𝑥` is never used on line 1"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := lspPublished(t, lspSession(t, lspOpen(test.text)))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLSPClose(t *testing.T) {
+	got := lspPublished(t, lspSession(t,
+		lspOpen("exit(y);"),
+		lspNotification("textDocument/didClose", map[string]interface{}{"textDocument": map[string]string{"uri": lspTestURI}}),
+	))
+	if len(got) != 0 {
+		t.Errorf("got %+v after close, want none", got)
+	}
+}
+
+func TestLSPNavigation(t *testing.T) {
+	text := "let é = 1;\nlet 𝑥x = é;\nexit(𝑥x + é);"
+	replies := lspSession(t,
+		lspOpen(text),
+		lspRequest(1, "textDocument/definition", lspAt(2, 11)),
+		lspRequest(2, "textDocument/references", lspAt(1, 4)),
+		lspRequest(3, "textDocument/definition", lspAt(2, 9)),
+	)
+
+	var definition lspLocation
+	lspResult(t, replies, 1, &definition)
+	if want := (lspLocation{URI: lspTestURI, Range: lspSpan(0, 4, 5)}); definition != want {
+		t.Errorf("definition of é: got %+v, want %+v", definition, want)
+	}
+
+	var references []lspLocation
+	lspResult(t, replies, 2, &references)
+	want := []lspLocation{
+		{URI: lspTestURI, Range: lspSpan(1, 4, 7)},
+		{URI: lspTestURI, Range: lspSpan(2, 5, 8)},
+	}
+	if !reflect.DeepEqual(references, want) {
+		t.Errorf("references of 𝑥x: got %+v, want %+v", references, want)
+	}
+
+	var none *lspLocation
+	lspResult(t, replies, 3, &none)
+	if none != nil {
+		t.Errorf("definition of `+`: got %+v, want null", none)
+	}
+}
+
+func TestLSPDeclarationKinds(t *testing.T) {
+	text := "static s = 1;\nconst c = 2;\nlet mut m = 3;\nlet l = s + c + m;\nexit(l);"
+	tests := []struct {
+		line  int
+		hover string
+	}{
+		{0, "```hy\nstatic s: i64\n```\nDeclared on line 1"},
+		{1, "```hy\nconst c: i64 = 2\n```\nDeclared on line 2"},
+		{2, "```hy\nlet mut m: i64\n```\nDeclared on line 3"},
+		{3, "```hy\nlet l: i64\n```\nDeclared on line 4"},
+	}
+	messages := []lspMessage{lspOpen(text), lspRequest(1, "textDocument/documentSymbol", lspAt(0, 0))}
+	for i, test := range tests {
+		column := strings.Index(strings.Split(text, "\n")[test.line], " = ") - 1
+		messages = append(messages, lspRequest(2+i, "textDocument/hover", lspAt(test.line, column)))
+	}
+	replies := lspSession(t, messages...)
+
+	var symbols []lspDocumentSymbol
+	lspResult(t, replies, 1, &symbols)
+	var details []string
+	for _, symbol := range symbols {
+		details = append(details, symbol.Name+": "+symbol.Detail)
+	}
+	if want := []string{"s: static", "c: const", "m: let mut", "l: let"}; !reflect.DeepEqual(details, want) {
+		t.Errorf("symbols: got %q, want %q", details, want)
+	}
+
+	for i, test := range tests {
+		var hover struct {
+			Contents struct {
+				Value string `json:"value"`
+			} `json:"contents"`
+		}
+		lspResult(t, replies, 2+i, &hover)
+		if hover.Contents.Value != test.hover {
+			t.Errorf("hover on line %d: got %q, want %q", test.line+1, hover.Contents.Value, test.hover)
+		}
+	}
+}
+
+// failingWriter refuses every write, like a client that went away.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestLSPNotifyError(t *testing.T) {
+	body, _ := json.Marshal(lspOpen("exit(0);"))
+	in := strings.NewReader(fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body))
+	if err := NewLSPServer(in, failingWriter{}).Run(); err == nil || err.Error() != "broken pipe" {
+		t.Errorf("got %v, want broken pipe", err)
+	}
+}
@@ -1,76 +1,290 @@
 package main
 
 import (
-	"bufio"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"regexp"
+	"runtime"
 )
 
-func main() {
-	if len(os.Args) != 2 {
-		fmt.Fprintf(os.Stderr, "Incorrect usage. Correct usage is...\n")
-		fmt.Fprintf(os.Stderr, "hydro <input.hy>\n")
-		os.Exit(1)
+var optFlagRe = regexp.MustCompile(`^-O[0-9]$`)
+
+// splitOptFlags rewrites compiler-style `-O1` arguments into `-O=1` so the
+// flag package can parse them.
+func splitOptFlags(args []string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		if optFlagRe.MatchString(arg) {
+			arg = arg[:2] + "=" + arg[2:]
+		}
+		out[i] = arg
 	}
+	return out
+}
 
-	var contents string
-	{
-		file, err := os.Open(os.Args[1])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error opening file: %v\n", err)
+// Options selects what the compiler generates once a program has been
+// parsed and checked.
+type Options struct {
+	Target   string
+	Asm      string
+	OptLevel int
+	Stats    bool
+	Debug    bool
+}
+
+type outputFile struct {
+	Name string
+	Data []byte
+}
+
+// gnuCommands returns the binutils invocations that assemble and link out.s,
+// using the cross-prefixed tools unless we are running on goarch.
+func gnuCommands(goarch string, prefix string) [][]string {
+	if runtime.GOARCH == goarch {
+		prefix = ""
+	}
+	return [][]string{{prefix + "as", "-o", "out.o", "out.s"}, {prefix + "ld", "-o", "out", "out.o"}}
+}
+
+// genTarget generates assembly or source for target and returns the files
+// to write along with the commands that turn them into an executable.
+func genTarget(prog NodeProg, opts Options) ([]outputFile, [][]string) {
+	switch opts.Target {
+	case "x86_64-linux":
+		generator := NewGenerator(prog)
+		generator.Debug = opts.Debug
+		instrs := generator.GenProg()
+		before := CountInstrs(instrs)
+		if opts.OptLevel >= 1 {
+			instrs = Peephole(instrs)
+		}
+		if opts.Stats {
+			fmt.Fprintf(os.Stderr, "instructions: %d before peephole, %d after\n", before, CountInstrs(instrs))
+		}
+		dialect, ok := DialectByName(opts.Asm)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown assembler: %s\n", opts.Asm)
 			os.Exit(1)
 		}
-		defer file.Close()
+		if opts.Asm == "gas" {
+			return []outputFile{{"out.s", []byte(FormatInstrs(instrs, dialect))}},
+				gnuCommands("amd64", "x86_64-linux-gnu-")
+		}
+		return []outputFile{{"out.asm", []byte(FormatInstrs(instrs, dialect))}},
+			[][]string{{"nasm", "-felf64", "out.asm"}, {"ld", "-o", "out", "out.o"}}
+	case "aarch64-linux":
+		generator := NewAArch64Generator(prog)
+		generator.Debug = opts.Debug
+		return []outputFile{{"out.s", []byte(generator.GenProg())}},
+			gnuCommands("arm64", "aarch64-linux-gnu-")
+	case "riscv64-linux":
+		generator := NewRISCVGenerator(prog)
+		generator.Debug = opts.Debug
+		return []outputFile{{"out.s", []byte(generator.GenProg())}},
+			gnuCommands("riscv64", "riscv64-linux-gnu-")
+	case "c":
+		generator := NewCGenerator(prog)
+		generator.Debug = opts.Debug
+		return []outputFile{{"out.c", []byte(generator.GenProg())}},
+			[][]string{{"cc", "-o", "out", "out.c"}}
+	case "wasm32-wasi":
+		generator := NewWasmGenerator(prog)
+		generator.Debug = opts.Debug
+		instrs := generator.GenProg()
+		module := generator.Module()
+		return []outputFile{
+			{"out.wat", []byte(FormatWat(instrs, module))},
+			{"out.wasm", EncodeWasm(instrs, module)},
+		}, nil
+	}
+	fmt.Fprintf(os.Stderr, "Unknown target: %s\n", opts.Target)
+	os.Exit(1)
+	return nil, nil
+}
+
+// fmtMain implements `fmt`, which formats the named files, or standard
+// input, like gofmt, and returns the exit status.
+func fmtMain(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := flags.Bool("w", false, "write the result back to each file instead of printing it")
+	diff := flags.Bool("d", false, "print a diff of the changes instead of the result")
+	flags.Parse(args)
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			contents += scanner.Text() + "\n"
+	if flags.NArg() == 0 {
+		if *write {
+			fmt.Fprintf(os.Stderr, "Cannot use -w with standard input\n")
+			return 1
 		}
-		if err := scanner.Err(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
-			os.Exit(1)
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading standard input: %v\n", err)
+			return 1
+		}
+		formatted, err := Format(string(src))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "<standard input>: %v\n", err)
+			return 1
+		}
+		if *diff {
+			fmt.Print(unifiedDiff("<standard input>.orig", "<standard input>", string(src), formatted))
+		} else {
+			fmt.Print(formatted)
+		}
+		return 0
+	}
+
+	status := 0
+	for _, name := range flags.Args() {
+		src, err := os.ReadFile(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening file: %v\n", err)
+			status = 1
+			continue
+		}
+		formatted, err := Format(string(src))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		if *diff {
+			fmt.Print(unifiedDiff(name+".orig", name, string(src), formatted))
+		}
+		if *write {
+			if formatted != string(src) {
+				if err := os.WriteFile(name, []byte(formatted), 0644); err != nil {
+					fmt.Fprintf(os.Stderr, "Error writing to output file: %v\n", err)
+					status = 1
+				}
+			}
+		} else if !*diff {
+			fmt.Print(formatted)
+		}
+	}
+	return status
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "repl":
+			NewREPL(os.Stdin, os.Stdout).Run()
+			return
+		case "fmt":
+			os.Exit(fmtMain(os.Args[2:]))
+		case "lsp":
+			if err := NewLSPServer(os.Stdin, os.Stdout).Run(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error serving LSP: %v\n", err)
+				os.Exit(1)
+			}
+			return
 		}
 	}
 
-	tokenizer := NewTokenizer(contents)
-	tokens := tokenizer.Tokenize()
+	stats := flag.Bool("stats", false, "report instruction counts before and after the peephole pass")
+	target := flag.String("target", "x86_64-linux", "target to generate code for: x86_64-linux, aarch64-linux, riscv64-linux, wasm32-wasi or c")
+	asmSyntax := flag.String("asm", "nasm", "x86-64 assembler to target: nasm, or gas for GNU as")
+	emit := flag.String("emit", "asm", "what to produce: asm for the selected target, or llvm for LLVM IR in out.ll")
+	jit := flag.Bool("jit", false, "compile to memory and run the program in-process instead of writing files (linux/amd64 only)")
+	optLevel := flag.Int("O", 1, "optimization level; 0 disables the peephole pass and dead store elimination")
+	debug := flag.Bool("debug", false, fmt.Sprintf("check array indices and pointers at run time, as --jit always does, exiting with status %d when an index is out of bounds and %d when a null pointer is dereferenced", exitBoundsFault, exitNullFault))
+	flag.CommandLine.Parse(splitOptFlags(os.Args[1:]))
 
-	parser := NewParser(tokens)
-	prog, ok := parser.ParseProg()
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Incorrect usage. Correct usage is...\n")
+		fmt.Fprintf(os.Stderr, "hydro [-O0|-O1|-O2] [--stats] [--debug] [--target=<target>] [--asm=nasm|gas] [--emit=asm|llvm] [--jit] <input.hy>\n")
+		fmt.Fprintf(os.Stderr, "hydro repl\n")
+		fmt.Fprintf(os.Stderr, "hydro fmt [-w] [-d] [<input.hy> ...]\n")
+		fmt.Fprintf(os.Stderr, "hydro lsp\n")
+		os.Exit(1)
+	}
 
-	if !ok {
-		fmt.Fprintf(os.Stderr, "Invalid program\n")
+	contents, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
 		os.Exit(1)
 	}
 
-	{
-		generator := NewGenerator(prog)
-		file, err := os.Create("out.asm")
+	parser := NewStreamParser(NewTokenizer(string(contents)))
+	prog, err := parser.ParseProg()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	checker := NewChecker()
+	if err := checker.Check(prog); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, warning := range checker.Warnings {
+		fmt.Fprintln(os.Stderr, warning)
+	}
+
+	liveness := NewLiveness()
+	for _, warning := range liveness.Analyze(prog) {
+		fmt.Fprintln(os.Stderr, warning)
+	}
+	if *optLevel >= 1 {
+		liveness.Eliminate(&prog)
+	}
+
+	if *jit {
+		value, err := NewJIT().Run(prog)
+		var fault *faultError
+		if errors.As(err, &fault) {
+			fmt.Fprintln(os.Stderr, fault)
+			os.Exit(fault.status())
+		}
+		if errors.Is(err, errDivFault) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitDivFault)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error running program: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(int(value & 0xff))
+	}
+
+	var outputs []outputFile
+	var commands [][]string
+	switch *emit {
+	case "asm":
+		outputs, commands = genTarget(prog, Options{Target: *target, Asm: *asmSyntax, OptLevel: *optLevel, Stats: *stats, Debug: *debug})
+	case "llvm":
+		generator := NewLLVMGenerator(prog)
+		generator.Debug = *debug
+		outputs = []outputFile{{"out.ll", []byte(generator.GenProg())}}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown output kind: %s\n", *emit)
+		os.Exit(1)
+	}
+
+	for _, output := range outputs {
+		file, err := os.Create(output.Name)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
 			os.Exit(1)
 		}
 		defer file.Close()
 
-		_, err = file.WriteString(generator.GenProg())
+		_, err = file.Write(output.Data)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error writing to output file: %v\n", err)
 			os.Exit(1)
 		}
 	}
 
-	cmd1 := exec.Command("nasm", "-felf64", "out.asm")
-	err := cmd1.Run()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error running nasm: %v\n", err)
-		os.Exit(1)
-	}
-
-	cmd2 := exec.Command("ld", "-o", "out", "out.o")
-	err = cmd2.Run()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error running ld: %v\n", err)
-		os.Exit(1)
+	for _, args := range commands {
+		cmd := exec.Command(args[0], args[1:]...)
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error running %s: %v\n", args[0], err)
+			os.Exit(1)
+		}
 	}
-}
\ No newline at end of file
+}
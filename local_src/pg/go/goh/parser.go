@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"os"
 )
 
 // AST Node types
@@ -18,6 +17,27 @@ type NodeTermParen struct {
 	Expr *NodeExpr
 }
 
+// NodeTermIndex reads the element of an array at Index.
+type NodeTermIndex struct {
+	Ident Token
+	Index *NodeExpr
+}
+
+// NodeTermAddr is `&x`, the address of a variable, or `&a[i]`, that of
+// the element of an array at Index.
+type NodeTermAddr struct {
+	Amp   Token
+	Ident Token
+	Index *NodeExpr
+}
+
+// NodeTermDeref is `*p`, the value p points to. Expr is always a single
+// term.
+type NodeTermDeref struct {
+	Star Token
+	Expr *NodeExpr
+}
+
 type NodeBinExprAdd struct {
 	Lhs *NodeExpr
 	Rhs *NodeExpr
@@ -38,12 +58,88 @@ type NodeBinExprDiv struct {
 	Rhs *NodeExpr
 }
 
+type NodeBinExprMod struct {
+	Lhs *NodeExpr
+	Rhs *NodeExpr
+}
+
+type NodeBinExprAnd struct {
+	Lhs *NodeExpr
+	Rhs *NodeExpr
+}
+
+type NodeBinExprOr struct {
+	Lhs *NodeExpr
+	Rhs *NodeExpr
+}
+
+type NodeBinExprXor struct {
+	Lhs *NodeExpr
+	Rhs *NodeExpr
+}
+
+type NodeBinExprShl struct {
+	Lhs *NodeExpr
+	Rhs *NodeExpr
+}
+
+// NodeBinExprShr is `>>`, an arithmetic shift that copies the sign bit.
+type NodeBinExprShr struct {
+	Lhs *NodeExpr
+	Rhs *NodeExpr
+}
+
+// NodeBinExprUshr is `>>>`, a logical shift that fills with zeros.
+type NodeBinExprUshr struct {
+	Lhs *NodeExpr
+	Rhs *NodeExpr
+}
+
+// NodeBinExprEq is `==`. Like the other comparisons it is 1 when it holds
+// and 0 otherwise.
+type NodeBinExprEq struct {
+	Lhs *NodeExpr
+	Rhs *NodeExpr
+}
+
+type NodeBinExprNe struct {
+	Lhs *NodeExpr
+	Rhs *NodeExpr
+}
+
+// NodeBinExprLt is `<`. The ordered comparisons are signed.
+type NodeBinExprLt struct {
+	Lhs *NodeExpr
+	Rhs *NodeExpr
+}
+
+type NodeBinExprLe struct {
+	Lhs *NodeExpr
+	Rhs *NodeExpr
+}
+
+type NodeBinExprGt struct {
+	Lhs *NodeExpr
+	Rhs *NodeExpr
+}
+
+type NodeBinExprGe struct {
+	Lhs *NodeExpr
+	Rhs *NodeExpr
+}
+
 type NodeBinExpr struct {
-	Var interface{} // One of: *NodeBinExprAdd, *NodeBinExprMulti, *NodeBinExprSub, *NodeBinExprDiv
+	Var interface{} // One of: *NodeBinExprAdd, *NodeBinExprMulti, *NodeBinExprSub, *NodeBinExprDiv, *NodeBinExprMod, *NodeBinExprAnd, *NodeBinExprOr, *NodeBinExprXor, *NodeBinExprShl, *NodeBinExprShr, *NodeBinExprUshr, *NodeBinExprEq, *NodeBinExprNe, *NodeBinExprLt, *NodeBinExprLe, *NodeBinExprGt, *NodeBinExprGe
+}
+
+// NodeTermBitNot is `~`, which flips every bit of its operand. Expr is
+// always a single term.
+type NodeTermBitNot struct {
+	Expr *NodeExpr
 }
 
 type NodeTerm struct {
-	Var interface{} // One of: *NodeTermIntLit, *NodeTermIdent, *NodeTermParen
+	Var interface{} // One of: *NodeTermIntLit, *NodeTermIdent, *NodeTermParen, *NodeTermBitNot, *NodeTermIndex, *NodeTermAddr, *NodeTermDeref
 }
 
 type NodeExpr struct {
@@ -54,8 +150,55 @@ type NodeStmtExit struct {
 	Expr *NodeExpr
 }
 
+// NodeStmtLet declares a variable, which can only be assigned to again
+// when declared with `let mut`. An array is initialized from Array, or
+// zeroed when there is no initializer; any other variable from Expr.
+// The Checker fills in VarType, which may be inferred from Expr, and sets
+// Addressed when `&` takes the address of a variable that is not an array.
 type NodeStmtLet struct {
+	Ident     Token
+	Mut       bool
+	Type      *NodeType
+	Expr      *NodeExpr
+	Array     *NodeArrayLit
+	VarType   *Type
+	Addressed bool
+}
+
+// NodeArrayLit is `[a, b, c]`, which can only initialize an array.
+type NodeArrayLit struct {
+	Open  Token
+	Elems []*NodeExpr
+}
+
+// NodeType is a type written out in a declaration: `i64`, a pointer
+// `*elem`, or an array `[elem; len]` whose length is a constant
+// expression.
+type NodeType struct {
+	Token Token // `i64`, the `*` of a pointer or the `[` of an array
+	Elem  *NodeType
+	Len   *NodeExpr
+}
+
+func (nodeType *NodeType) IsArray() bool {
+	return nodeType.Token.Type == TokenOpenBracket
+}
+
+// NodeStmtStatic declares a variable that lives for the whole program
+// rather than in the enclosing scope. Expr, if given, is a constant
+// expression; without it the variable starts at zero.
+type NodeStmtStatic struct {
 	Ident Token
+	Type  *NodeType
+	Expr  *NodeExpr
+}
+
+// NodeStmtConst names the value of a constant expression. The Checker
+// substitutes the value for every use, so generators have nothing to do
+// for it.
+type NodeStmtConst struct {
+	Ident Token
+	Type  *NodeType
 	Expr  *NodeExpr
 }
 
@@ -83,51 +226,257 @@ type NodeStmtIf struct {
 	Pred  *NodeIfPred
 }
 
+// NodeStmtAssign stores to a variable, or to the element of an array at
+// Index when that is set. When Deref is set it stores through a pointer
+// instead, as in `*p = expr;`, and Ident is unset.
 type NodeStmtAssign struct {
 	Ident Token
+	Index *NodeExpr
+	Deref *NodeTermDeref
 	Expr  *NodeExpr
 }
 
+// NodeStmtUpdate applies a binary operator to a variable in place, as in
+// `x += expr;` or `x++;`. For `++` and `--` the parser supplies a literal 1
+// as Expr.
+type NodeStmtUpdate struct {
+	Ident Token
+	Index *NodeExpr      // Element of an array to update, if set
+	Deref *NodeTermDeref // Pointer to update through, set instead of Ident
+	Op    Token
+	Expr  *NodeExpr
+}
+
+// NodeStmtFor is `for (init; cond; step) scope`. Each clause may be left
+// out: Init is a `let`, assignment or update, Step an assignment or update,
+// and a missing Cond loops until `break` or `exit`. A variable declared by
+// Init is scoped to the loop.
+type NodeStmtFor struct {
+	Init  *NodeStmt
+	Cond  *NodeExpr
+	Step  *NodeStmt
+	Scope *NodeScope
+}
+
+// NodeStmtBreak leaves the innermost enclosing loop.
+type NodeStmtBreak struct {
+	Token Token
+}
+
+// NodeStmtContinue jumps to the step clause of the innermost enclosing
+// loop.
+type NodeStmtContinue struct {
+	Token Token
+}
+
+// NodeMatchArm is one arm of a `match`. Patterns are the int and character
+// literals it matches, written separated by `|`; an arm with a `_` pattern
+// is the default.
+type NodeMatchArm struct {
+	Patterns []Token
+	Scope    *NodeScope
+}
+
+func (arm *NodeMatchArm) IsDefault() bool {
+	for _, pattern := range arm.Patterns {
+		if pattern.Type == TokenUnderscore {
+			return true
+		}
+	}
+	return false
+}
+
+// NodeStmtMatch runs the first arm with a pattern equal to Expr, or the
+// default arm if none is. Without a default arm it does nothing.
+type NodeStmtMatch struct {
+	Match Token
+	Expr  *NodeExpr
+	Arms  []*NodeMatchArm
+}
+
+// Select returns the arm that runs for value, or nil if none does.
+func (stmtMatch *NodeStmtMatch) Select(value int64) *NodeMatchArm {
+	var fallback *NodeMatchArm
+	for _, arm := range stmtMatch.Arms {
+		for _, pattern := range arm.Patterns {
+			if pattern.Type == TokenUnderscore {
+				if fallback == nil {
+					fallback = arm
+				}
+			} else if pattern.Int == value {
+				return arm
+			}
+		}
+	}
+	return fallback
+}
+
 type NodeStmt struct {
-	Var interface{} // One of: *NodeStmtExit, *NodeStmtLet, *NodeScope, *NodeStmtIf, *NodeStmtAssign
+	Var interface{} // One of: *NodeStmtExit, *NodeStmtLet, *NodeScope, *NodeStmtIf, *NodeStmtAssign, *NodeStmtUpdate, *NodeStmtFor, *NodeStmtBreak, *NodeStmtContinue, *NodeStmtMatch, *NodeStmtStatic, *NodeStmtConst
 }
 
 type NodeProg struct {
 	Stmts []*NodeStmt
 }
 
+func binOperands(binExpr *NodeBinExpr) (*NodeExpr, *NodeExpr) {
+	switch v := binExpr.Var.(type) {
+	case *NodeBinExprAdd:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprMulti:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprSub:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprDiv:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprMod:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprAnd:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprOr:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprXor:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprShl:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprShr:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprUshr:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprEq:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprNe:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprLt:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprLe:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprGt:
+		return v.Lhs, v.Rhs
+	case *NodeBinExprGe:
+		return v.Lhs, v.Rhs
+	}
+	panic("Unreachable")
+}
+
+// updateOp returns the binary operator of an update statement.
+func updateOp(update *NodeStmtUpdate) TokenType {
+	op, _ := UpdateOp(update.Op.Type)
+	return op
+}
+
+// intLitValue returns the value of an integer literal, which the
+// tokenizer has already checked fits in 64 bits.
+func intLitValue(intLit Token) int64 {
+	return intLit.Int
+}
+
+// tokenSpan holds the indices of the first and last token of a node.
+type tokenSpan struct {
+	first int
+	last  int
+}
+
 type Parser struct {
-	tokens    []Token
-	index     int
-	allocator *ArenaAllocator
+	tokens []Token
+	base   int // Index of tokens[0] in the whole token stream
+	index  int
+	// With a source, tokens is filled from it as the parser looks ahead,
+	// dropping the tokens already parsed unless KeepTokens is set
+	source     *Tokenizer
+	KeepTokens bool
+	allocator  *ArenaAllocator
+	// Where each statement and scope came from, for tools that need to
+	// relate nodes back to the token stream
+	stmtSpans  map[*NodeStmt]tokenSpan
+	scopeSpans map[*NodeScope]tokenSpan
 }
 
+// The parser's arena holds a few nodes per token on top of a fixed base.
+const (
+	parserArenaBase     = 1024 * 1024 * 4 // 4 MB
+	parserArenaPerToken = 256
+)
+
 func NewParser(tokens []Token) *Parser {
 	return &Parser{
-		tokens:    tokens,
-		index:     0,
-		allocator: NewArenaAllocator(1024 * 1024 * 4), // 4 MB
+		tokens:     tokens,
+		index:      0,
+		allocator:  NewArenaAllocator(parserArenaBase + parserArenaPerToken*uintptr(len(tokens))),
+		stmtSpans:  make(map[*NodeStmt]tokenSpan),
+		scopeSpans: make(map[*NodeScope]tokenSpan),
 	}
 }
 
+// NewStreamParser returns a parser that pulls tokens from tokenizer as it
+// needs them instead of tokenizing the whole source first.
+func NewStreamParser(tokenizer *Tokenizer) *Parser {
+	p := NewParser(nil)
+	p.source = tokenizer
+	// Every token takes at least one byte of source
+	p.allocator = NewArenaAllocator(parserArenaBase + parserArenaPerToken*uintptr(len(tokenizer.src)))
+	return p
+}
+
 func (p *Parser) errorExpected(msg string) {
 	token := p.peek(-1)
-	line := 0
-	if token != nil {
-		line = token.Line
+	if token == nil {
+		token = p.peek(0)
 	}
-	fmt.Fprintf(os.Stderr, "[Parse Error] Expected %s on line %d\n", msg, line)
-	os.Exit(1)
+	if token == nil {
+		panic(Diagnostic{Line: 1, Col: 1, Message: fmt.Sprintf("[Parse Error] Expected %s on line 1", msg)})
+	}
+	panic(tokenDiagnostic(*token, fmt.Sprintf("[Parse Error] Expected %s on line %d", msg, token.Line)))
 }
 
 func (p *Parser) parseTerm() *NodeTerm {
-	if intLit := p.tryConsume(TokenIntLit); intLit != nil {
+	if p.tryConsume(TokenTilde) != nil {
+		operand := p.parseTerm()
+		if operand == nil {
+			p.errorExpected("term")
+		}
+		expr, _ := Emplace(p.allocator, NodeExpr{Var: operand})
+		bitNot, _ := Emplace(p.allocator, NodeTermBitNot{Expr: expr})
+		term, _ := Emplace(p.allocator, NodeTerm{Var: bitNot})
+		return term
+	}
+
+	if star := p.tryConsume(TokenStar); star != nil {
+		operand := p.parseTerm()
+		if operand == nil {
+			p.errorExpected("term")
+		}
+		expr, _ := Emplace(p.allocator, NodeExpr{Var: operand})
+		deref, _ := Emplace(p.allocator, NodeTermDeref{Star: *star, Expr: expr})
+		term, _ := Emplace(p.allocator, NodeTerm{Var: deref})
+		return term
+	}
+
+	if amp := p.tryConsume(TokenAmp); amp != nil {
+		addr, _ := Emplace(p.allocator, NodeTermAddr{Amp: *amp})
+		addr.Ident = p.tryConsumeErr(TokenIdent)
+		addr.Index = p.parseIndex()
+		term, _ := Emplace(p.allocator, NodeTerm{Var: addr})
+		return term
+	}
+
+	intLit := p.tryConsume(TokenIntLit)
+	if intLit == nil {
+		// A character literal is just another way to write an integer
+		intLit = p.tryConsume(TokenCharLit)
+	}
+	if intLit != nil {
 		termIntLit, _ := Emplace(p.allocator, NodeTermIntLit{IntLit: *intLit})
 		term, _ := Emplace(p.allocator, NodeTerm{Var: termIntLit})
 		return term
 	}
 
 	if ident := p.tryConsume(TokenIdent); ident != nil {
+		if index := p.parseIndex(); index != nil {
+			termIndex, _ := Emplace(p.allocator, NodeTermIndex{Ident: *ident, Index: index})
+			term, _ := Emplace(p.allocator, NodeTerm{Var: termIndex})
+			return term
+		}
 		exprIdent, _ := Emplace(p.allocator, NodeTermIdent{Ident: *ident})
 		term, _ := Emplace(p.allocator, NodeTerm{Var: exprIdent})
 		return term
@@ -147,6 +496,20 @@ func (p *Parser) parseTerm() *NodeTerm {
 	return nil
 }
 
+// parseIndex parses `[expr]` after the name of an array, returning nil if
+// there is no `[`.
+func (p *Parser) parseIndex() *NodeExpr {
+	if p.tryConsume(TokenOpenBracket) == nil {
+		return nil
+	}
+	index := p.parseExpr(0)
+	if index == nil {
+		p.errorExpected("expression")
+	}
+	p.tryConsumeErr(TokenCloseBracket)
+	return index
+}
+
 func (p *Parser) parseExpr(minPrec int) *NodeExpr {
 	termLhs := p.parseTerm()
 	if termLhs == nil {
@@ -193,6 +556,58 @@ func (p *Parser) parseExpr(minPrec int) *NodeExpr {
 			exprLhs2.Var = exprLhs.Var
 			div, _ := Emplace(p.allocator, NodeBinExprDiv{Lhs: exprLhs2, Rhs: exprRhs})
 			expr.Var = div
+		} else if token.Type == TokenPercent {
+			exprLhs2.Var = exprLhs.Var
+			mod, _ := Emplace(p.allocator, NodeBinExprMod{Lhs: exprLhs2, Rhs: exprRhs})
+			expr.Var = mod
+		} else if token.Type == TokenAmp {
+			exprLhs2.Var = exprLhs.Var
+			and, _ := Emplace(p.allocator, NodeBinExprAnd{Lhs: exprLhs2, Rhs: exprRhs})
+			expr.Var = and
+		} else if token.Type == TokenPipe {
+			exprLhs2.Var = exprLhs.Var
+			or, _ := Emplace(p.allocator, NodeBinExprOr{Lhs: exprLhs2, Rhs: exprRhs})
+			expr.Var = or
+		} else if token.Type == TokenCaret {
+			exprLhs2.Var = exprLhs.Var
+			xor, _ := Emplace(p.allocator, NodeBinExprXor{Lhs: exprLhs2, Rhs: exprRhs})
+			expr.Var = xor
+		} else if token.Type == TokenShl {
+			exprLhs2.Var = exprLhs.Var
+			shl, _ := Emplace(p.allocator, NodeBinExprShl{Lhs: exprLhs2, Rhs: exprRhs})
+			expr.Var = shl
+		} else if token.Type == TokenShr {
+			exprLhs2.Var = exprLhs.Var
+			shr, _ := Emplace(p.allocator, NodeBinExprShr{Lhs: exprLhs2, Rhs: exprRhs})
+			expr.Var = shr
+		} else if token.Type == TokenUshr {
+			exprLhs2.Var = exprLhs.Var
+			ushr, _ := Emplace(p.allocator, NodeBinExprUshr{Lhs: exprLhs2, Rhs: exprRhs})
+			expr.Var = ushr
+		} else if token.Type == TokenEqEq {
+			exprLhs2.Var = exprLhs.Var
+			eq, _ := Emplace(p.allocator, NodeBinExprEq{Lhs: exprLhs2, Rhs: exprRhs})
+			expr.Var = eq
+		} else if token.Type == TokenNe {
+			exprLhs2.Var = exprLhs.Var
+			ne, _ := Emplace(p.allocator, NodeBinExprNe{Lhs: exprLhs2, Rhs: exprRhs})
+			expr.Var = ne
+		} else if token.Type == TokenLt {
+			exprLhs2.Var = exprLhs.Var
+			lt, _ := Emplace(p.allocator, NodeBinExprLt{Lhs: exprLhs2, Rhs: exprRhs})
+			expr.Var = lt
+		} else if token.Type == TokenLe {
+			exprLhs2.Var = exprLhs.Var
+			le, _ := Emplace(p.allocator, NodeBinExprLe{Lhs: exprLhs2, Rhs: exprRhs})
+			expr.Var = le
+		} else if token.Type == TokenGt {
+			exprLhs2.Var = exprLhs.Var
+			gt, _ := Emplace(p.allocator, NodeBinExprGt{Lhs: exprLhs2, Rhs: exprRhs})
+			expr.Var = gt
+		} else if token.Type == TokenGe {
+			exprLhs2.Var = exprLhs.Var
+			ge, _ := Emplace(p.allocator, NodeBinExprGe{Lhs: exprLhs2, Rhs: exprRhs})
+			expr.Var = ge
 		} else {
 			panic("Unreachable")
 		}
@@ -202,6 +617,7 @@ func (p *Parser) parseExpr(minPrec int) *NodeExpr {
 }
 
 func (p *Parser) parseScope() *NodeScope {
+	first := p.index
 	if p.tryConsume(TokenOpenCurly) == nil {
 		return nil
 	}
@@ -215,6 +631,7 @@ func (p *Parser) parseScope() *NodeScope {
 		scope.Stmts = append(scope.Stmts, stmt)
 	}
 	p.tryConsumeErr(TokenCloseCurly)
+	p.scopeSpans[scope] = tokenSpan{first: first, last: p.index - 1}
 	return scope
 }
 
@@ -255,37 +672,81 @@ func (p *Parser) parseIfPred() *NodeIfPred {
 	return nil
 }
 
-func (p *Parser) parseStmt() *NodeStmt {
-	if p.peek(0) != nil && p.peek(0).Type == TokenExit && p.peek(1) != nil && p.peek(1).Type == TokenOpenParen {
-		p.consume()
-		p.consume()
-		stmtExit, _ := Emplace(p.allocator, NodeStmtExit{})
-		if nodeExpr := p.parseExpr(0); nodeExpr != nil {
-			stmtExit.Expr = nodeExpr
-		} else {
-			p.errorExpected("expression")
+// parseSimpleStmt parses a `let`, an assignment or an update without its
+// closing `;`, as the clauses of a `for` are written.
+func (p *Parser) parseSimpleStmt() *NodeStmt {
+	if p.tryConsume(TokenLet) != nil {
+		stmtLet, _ := Emplace(p.allocator, NodeStmtLet{})
+		stmtLet.Mut = p.tryConsume(TokenMut) != nil
+		stmtLet.Ident = p.tryConsumeErr(TokenIdent)
+		if p.tryConsume(TokenColon) != nil {
+			stmtLet.Type = p.parseType()
+		}
+		// Only an array can go without an initializer, and starts out zeroed
+		if stmtLet.Type == nil || !stmtLet.Type.IsArray() || (p.peek(0) != nil && p.peek(0).Type == TokenEq) {
+			p.tryConsumeErr(TokenEq)
+			if p.peek(0) != nil && p.peek(0).Type == TokenOpenBracket {
+				stmtLet.Array = p.parseArrayLit()
+			} else if expr := p.parseExpr(0); expr != nil {
+				stmtLet.Expr = expr
+			} else {
+				p.errorExpected("expression")
+			}
 		}
-		p.tryConsumeErr(TokenCloseParen)
-		p.tryConsumeErr(TokenSemi)
 		stmt, _ := Emplace(p.allocator, NodeStmt{})
-		stmt.Var = stmtExit
+		stmt.Var = stmtLet
 		return stmt
 	}
 
-	if p.peek(0) != nil && p.peek(0).Type == TokenLet && p.peek(1) != nil && p.peek(1).Type == TokenIdent && p.peek(2) != nil && p.peek(2).Type == TokenEq {
-		p.consume()
-		stmtLet, _ := Emplace(p.allocator, NodeStmtLet{})
-		stmtLet.Ident = p.consume()
-		p.consume()
-		if expr := p.parseExpr(0); expr != nil {
-			stmtLet.Expr = expr
-		} else {
-			p.errorExpected("expression")
+	// An element of an array is the target of an assignment or an update
+	if p.peek(0) != nil && p.peek(0).Type == TokenIdent && p.peek(1) != nil && p.peek(1).Type == TokenOpenBracket {
+		ident := p.consume()
+		index := p.parseIndex()
+		if p.tryConsume(TokenEq) != nil {
+			assign, _ := Emplace(p.allocator, NodeStmtAssign{Ident: ident, Index: index})
+			if expr := p.parseExpr(0); expr != nil {
+				assign.Expr = expr
+			} else {
+				p.errorExpected("expression")
+			}
+			stmt, _ := Emplace(p.allocator, NodeStmt{Var: assign})
+			return stmt
 		}
-		p.tryConsumeErr(TokenSemi)
-		stmt, _ := Emplace(p.allocator, NodeStmt{})
-		stmt.Var = stmtLet
-		return stmt
+		if p.peek(0) != nil {
+			if _, ok := UpdateOp(p.peek(0).Type); ok {
+				update, _ := Emplace(p.allocator, NodeStmtUpdate{Ident: ident, Index: index})
+				update.Op = p.consume()
+				p.parseUpdateExpr(update)
+				stmt, _ := Emplace(p.allocator, NodeStmt{Var: update})
+				return stmt
+			}
+		}
+		p.errorExpected("`=`")
+	}
+
+	// So is the value a pointer points to
+	if p.peek(0) != nil && p.peek(0).Type == TokenStar {
+		deref := p.parseTerm().Var.(*NodeTermDeref)
+		if p.tryConsume(TokenEq) != nil {
+			assign, _ := Emplace(p.allocator, NodeStmtAssign{Deref: deref})
+			if expr := p.parseExpr(0); expr != nil {
+				assign.Expr = expr
+			} else {
+				p.errorExpected("expression")
+			}
+			stmt, _ := Emplace(p.allocator, NodeStmt{Var: assign})
+			return stmt
+		}
+		if p.peek(0) != nil {
+			if _, ok := UpdateOp(p.peek(0).Type); ok {
+				update, _ := Emplace(p.allocator, NodeStmtUpdate{Deref: deref})
+				update.Op = p.consume()
+				p.parseUpdateExpr(update)
+				stmt, _ := Emplace(p.allocator, NodeStmt{Var: update})
+				return stmt
+			}
+		}
+		p.errorExpected("`=`")
 	}
 
 	if p.peek(0) != nil && p.peek(0).Type == TokenIdent && p.peek(1) != nil && p.peek(1).Type == TokenEq {
@@ -297,11 +758,86 @@ func (p *Parser) parseStmt() *NodeStmt {
 		} else {
 			p.errorExpected("expression")
 		}
-		p.tryConsumeErr(TokenSemi)
 		stmt, _ := Emplace(p.allocator, NodeStmt{Var: assign})
 		return stmt
 	}
 
+	if p.peek(0) != nil && p.peek(0).Type == TokenIdent && p.peek(1) != nil {
+		if _, ok := UpdateOp(p.peek(1).Type); ok {
+			update, _ := Emplace(p.allocator, NodeStmtUpdate{})
+			update.Ident = p.consume()
+			update.Op = p.consume()
+			p.parseUpdateExpr(update)
+			stmt, _ := Emplace(p.allocator, NodeStmt{Var: update})
+			return stmt
+		}
+	}
+
+	return nil
+}
+
+// parseUpdateExpr parses the operand following an update's operator.
+func (p *Parser) parseUpdateExpr(update *NodeStmtUpdate) {
+	if update.Op.Type == TokenPlusPlus || update.Op.Type == TokenMinusMinus {
+		one := "1"
+		intLit, _ := Emplace(p.allocator, NodeTermIntLit{IntLit: Token{Type: TokenIntLit, Line: update.Op.Line, Col: update.Op.Col, Value: &one, Int: 1}})
+		term, _ := Emplace(p.allocator, NodeTerm{Var: intLit})
+		update.Expr, _ = Emplace(p.allocator, NodeExpr{Var: term})
+	} else if expr := p.parseExpr(0); expr != nil {
+		update.Expr = expr
+	} else {
+		p.errorExpected("expression")
+	}
+}
+
+// parseArrayLit parses `[a, b, c]`. A trailing comma is allowed.
+func (p *Parser) parseArrayLit() *NodeArrayLit {
+	arrayLit, _ := Emplace(p.allocator, NodeArrayLit{Open: p.consume()})
+	for p.peek(0) != nil && p.peek(0).Type != TokenCloseBracket {
+		expr := p.parseExpr(0)
+		if expr == nil {
+			p.errorExpected("expression")
+		}
+		arrayLit.Elems = append(arrayLit.Elems, expr)
+		if p.tryConsume(TokenComma) == nil {
+			break
+		}
+	}
+	p.tryConsumeErr(TokenCloseBracket)
+	return arrayLit
+}
+
+func (p *Parser) parseStmt() *NodeStmt {
+	first := p.index
+	stmt := p.parseStmtBody()
+	if stmt != nil {
+		p.stmtSpans[stmt] = tokenSpan{first: first, last: p.index - 1}
+	}
+	return stmt
+}
+
+func (p *Parser) parseStmtBody() *NodeStmt {
+	if p.peek(0) != nil && p.peek(0).Type == TokenExit && p.peek(1) != nil && p.peek(1).Type == TokenOpenParen {
+		p.consume()
+		p.consume()
+		stmtExit, _ := Emplace(p.allocator, NodeStmtExit{})
+		if nodeExpr := p.parseExpr(0); nodeExpr != nil {
+			stmtExit.Expr = nodeExpr
+		} else {
+			p.errorExpected("expression")
+		}
+		p.tryConsumeErr(TokenCloseParen)
+		p.tryConsumeErr(TokenSemi)
+		stmt, _ := Emplace(p.allocator, NodeStmt{})
+		stmt.Var = stmtExit
+		return stmt
+	}
+
+	if stmt := p.parseSimpleStmt(); stmt != nil {
+		p.tryConsumeErr(TokenSemi)
+		return stmt
+	}
+
 	if p.peek(0) != nil && p.peek(0).Type == TokenOpenCurly {
 		if scope := p.parseScope(); scope != nil {
 			stmt, _ := Emplace(p.allocator, NodeStmt{Var: scope})
@@ -329,11 +865,171 @@ func (p *Parser) parseStmt() *NodeStmt {
 		return stmt
 	}
 
+	if p.tryConsume(TokenFor) != nil {
+		p.tryConsumeErr(TokenOpenParen)
+		stmtFor, _ := Emplace(p.allocator, NodeStmtFor{})
+		stmtFor.Init = p.parseForClause()
+		p.tryConsumeErr(TokenSemi)
+		stmtFor.Cond = p.parseExpr(0)
+		p.tryConsumeErr(TokenSemi)
+		if p.peek(0) != nil && p.peek(0).Type == TokenLet {
+			p.errorExpected("assignment or update")
+		}
+		stmtFor.Step = p.parseForClause()
+		p.tryConsumeErr(TokenCloseParen)
+		if scope := p.parseScope(); scope != nil {
+			stmtFor.Scope = scope
+		} else {
+			p.errorExpected("scope")
+		}
+		stmt, _ := Emplace(p.allocator, NodeStmt{Var: stmtFor})
+		return stmt
+	}
+
+	if token := p.tryConsume(TokenMatch); token != nil {
+		stmtMatch, _ := Emplace(p.allocator, NodeStmtMatch{Match: *token})
+		p.tryConsumeErr(TokenOpenParen)
+		if expr := p.parseExpr(0); expr != nil {
+			stmtMatch.Expr = expr
+		} else {
+			p.errorExpected("expression")
+		}
+		p.tryConsumeErr(TokenCloseParen)
+		p.tryConsumeErr(TokenOpenCurly)
+		for p.peek(0) != nil && p.peek(0).Type != TokenCloseCurly {
+			stmtMatch.Arms = append(stmtMatch.Arms, p.parseMatchArm())
+		}
+		p.tryConsumeErr(TokenCloseCurly)
+		stmt, _ := Emplace(p.allocator, NodeStmt{Var: stmtMatch})
+		return stmt
+	}
+
+	if p.tryConsume(TokenStatic) != nil {
+		stmtStatic, _ := Emplace(p.allocator, NodeStmtStatic{})
+		stmtStatic.Ident = p.tryConsumeErr(TokenIdent)
+		if p.tryConsume(TokenColon) != nil {
+			stmtStatic.Type = p.parseType()
+		}
+		// Without a type there has to be an initializer to go by
+		if stmtStatic.Type == nil || (p.peek(0) != nil && p.peek(0).Type == TokenEq) {
+			p.tryConsumeErr(TokenEq)
+			if expr := p.parseExpr(0); expr != nil {
+				stmtStatic.Expr = expr
+			} else {
+				p.errorExpected("expression")
+			}
+		}
+		p.tryConsumeErr(TokenSemi)
+		stmt, _ := Emplace(p.allocator, NodeStmt{Var: stmtStatic})
+		return stmt
+	}
+
+	if p.tryConsume(TokenConst) != nil {
+		stmtConst, _ := Emplace(p.allocator, NodeStmtConst{})
+		stmtConst.Ident = p.tryConsumeErr(TokenIdent)
+		if p.tryConsume(TokenColon) != nil {
+			stmtConst.Type = p.parseType()
+		}
+		p.tryConsumeErr(TokenEq)
+		if expr := p.parseExpr(0); expr != nil {
+			stmtConst.Expr = expr
+		} else {
+			p.errorExpected("expression")
+		}
+		p.tryConsumeErr(TokenSemi)
+		stmt, _ := Emplace(p.allocator, NodeStmt{Var: stmtConst})
+		return stmt
+	}
+
+	if token := p.tryConsume(TokenBreak); token != nil {
+		stmtBreak, _ := Emplace(p.allocator, NodeStmtBreak{Token: *token})
+		p.tryConsumeErr(TokenSemi)
+		stmt, _ := Emplace(p.allocator, NodeStmt{Var: stmtBreak})
+		return stmt
+	}
+
+	if token := p.tryConsume(TokenContinue); token != nil {
+		stmtContinue, _ := Emplace(p.allocator, NodeStmtContinue{Token: *token})
+		p.tryConsumeErr(TokenSemi)
+		stmt, _ := Emplace(p.allocator, NodeStmt{Var: stmtContinue})
+		return stmt
+	}
+
+	return nil
+}
+
+func (p *Parser) parseType() *NodeType {
+	if star := p.tryConsume(TokenStar); star != nil {
+		nodeType, _ := Emplace(p.allocator, NodeType{Token: *star})
+		nodeType.Elem = p.parseType()
+		return nodeType
+	}
+	if open := p.tryConsume(TokenOpenBracket); open != nil {
+		nodeType, _ := Emplace(p.allocator, NodeType{Token: *open})
+		nodeType.Elem = p.parseType()
+		p.tryConsumeErr(TokenSemi)
+		if expr := p.parseExpr(0); expr != nil {
+			nodeType.Len = expr
+		} else {
+			p.errorExpected("expression")
+		}
+		p.tryConsumeErr(TokenCloseBracket)
+		return nodeType
+	}
+	if ident := p.peek(0); ident != nil && ident.Type == TokenIdent && *ident.Value == "i64" {
+		nodeType, _ := Emplace(p.allocator, NodeType{Token: p.consume()})
+		return nodeType
+	}
+	// Point at an unknown type name rather than the `:` before it
+	p.tryConsume(TokenIdent)
+	p.errorExpected("type")
 	return nil
 }
 
-func (p *Parser) ParseProg() (NodeProg, bool) {
-	prog := NodeProg{}
+func (p *Parser) parseMatchArm() *NodeMatchArm {
+	arm, _ := Emplace(p.allocator, NodeMatchArm{})
+	for {
+		switch pattern := p.peek(0); {
+		case pattern == nil:
+			p.errorExpected("pattern")
+		case pattern.Type == TokenIntLit, pattern.Type == TokenCharLit, pattern.Type == TokenUnderscore:
+			arm.Patterns = append(arm.Patterns, p.consume())
+		case pattern.Type == TokenMinus && p.peek(1) != nil && p.peek(1).Type == TokenIntLit:
+			// A negative pattern becomes a single literal spanning the `-`.
+			minus, lit := p.consume(), p.consume()
+			lit.Int = -lit.Int
+			lit.Raw = "-" + lit.Text()
+			lit.Line, lit.Col = minus.Line, minus.Col
+			arm.Patterns = append(arm.Patterns, lit)
+		default:
+			p.errorExpected("pattern")
+		}
+		if p.tryConsume(TokenPipe) == nil {
+			break
+		}
+	}
+	p.tryConsumeErr(TokenFatArrow)
+	if scope := p.parseScope(); scope != nil {
+		arm.Scope = scope
+	} else {
+		p.errorExpected("scope")
+	}
+	return arm
+}
+
+// parseForClause parses the optional init or step clause of a `for`,
+// recording its span like any other statement's.
+func (p *Parser) parseForClause() *NodeStmt {
+	first := p.index
+	stmt := p.parseSimpleStmt()
+	if stmt != nil {
+		p.stmtSpans[stmt] = tokenSpan{first: first, last: p.index - 1}
+	}
+	return stmt
+}
+
+func (p *Parser) ParseProg() (prog NodeProg, err error) {
+	defer recoverDiagnostic(&err)
 	for p.peek(0) != nil {
 		if stmt := p.parseStmt(); stmt != nil {
 			prog.Stmts = append(prog.Stmts, stmt)
@@ -341,18 +1037,67 @@ func (p *Parser) ParseProg() (NodeProg, bool) {
 			p.errorExpected("statement")
 		}
 	}
-	return prog, true
+	return prog, nil
+}
+
+// ParseExpr parses input made up of a lone expression, optionally followed
+// by `;`.
+func (p *Parser) ParseExpr() (expr *NodeExpr, err error) {
+	defer recoverDiagnostic(&err)
+	if expr = p.parseExpr(0); expr == nil {
+		p.errorExpected("expression")
+	}
+	p.tryConsume(TokenSemi)
+	if p.peek(0) != nil {
+		p.errorExpected("end of input")
+	}
+	return expr, nil
+}
+
+// ParseStmt parses a single statement, returning nil at the end of input.
+func (p *Parser) ParseStmt() (stmt *NodeStmt, err error) {
+	defer recoverDiagnostic(&err)
+	if p.peek(0) == nil {
+		return nil, nil
+	}
+	if stmt = p.parseStmt(); stmt == nil {
+		p.errorExpected("statement")
+	}
+	return stmt, nil
 }
 
 func (p *Parser) peek(offset int) *Token {
-	if p.index+offset >= len(p.tokens) {
+	i := p.index + offset - p.base
+	for p.source != nil && i >= len(p.tokens) {
+		token := p.source.Next()
+		if token.Type == TokenEOF {
+			p.source = nil
+			break
+		}
+		if len(p.tokens) == cap(p.tokens) && !p.KeepTokens {
+			p.trim()
+			i = p.index + offset - p.base
+		}
+		p.tokens = append(p.tokens, token)
+	}
+	if i < 0 || i >= len(p.tokens) {
 		return nil
 	}
-	return &p.tokens[p.index+offset]
+	return &p.tokens[i]
+}
+
+// trim drops the tokens before the previous one, which errorExpected may
+// still point at. The rest move to a new buffer so that tokens returned
+// by peek stay valid.
+func (p *Parser) trim() {
+	keep := max(p.index-1, p.base)
+	live := p.tokens[keep-p.base:]
+	p.tokens = append(make([]Token, 0, max(2*len(live), 64)), live...)
+	p.base = keep
 }
 
 func (p *Parser) consume() Token {
-	token := p.tokens[p.index]
+	token := p.tokens[p.index-p.base]
 	p.index++
 	return token
 }
@@ -366,9 +1111,9 @@ func (p *Parser) tryConsumeErr(tokenType TokenType) Token {
 }
 
 func (p *Parser) tryConsume(tokenType TokenType) *Token {
-	if p.peek(0) != nil && p.peek(0).Type == tokenType {
-		token := p.consume()
-		return &token
+	if token := p.peek(0); token != nil && token.Type == tokenType {
+		p.consume()
+		return token
 	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,202 @@
+package main
+
+import "math"
+
+// Peephole rewrites short windows of generated instructions into cheaper
+// equivalents. It makes a single pass, copying instructions to the output
+// and applying the rules to the window that ends at the instruction just
+// copied until none applies, so a rewrite can enable another on the
+// instructions before it. Comments are transparent to the rules; labels,
+// jumps and syscalls end a window.
+func Peephole(instrs []Instr) []Instr {
+	out := make([]Instr, 0, len(instrs))
+	for i, instr := range instrs {
+		out = append(out, instr)
+		for {
+			rewritten, ok := peepholeTail(out, instrs[i+1:])
+			if !ok {
+				break
+			}
+			out = rewritten
+		}
+	}
+	return out
+}
+
+// peepholeTail applies the first rule that matches the window ending at the
+// last instruction of out, which is followed by rest. Only comments may
+// follow the instruction a window ends at.
+func peepholeTail(out []Instr, rest []Instr) ([]Instr, bool) {
+	k := prevReal(out, len(out))
+	if k < 0 {
+		return nil, false
+	}
+	c := out[k]
+
+	// jmp/jz to a label that immediately follows
+	if c.Op == OpLabel {
+		i := k - 1
+		for i >= 0 && !out[i].IsReal() {
+			i--
+		}
+		if i < 0 {
+			return nil, false
+		}
+		if a := out[i]; (a.Op == OpJmp || a.isCondJump()) && a.Args[0].Kind == OperandLabel && a.Args[0].Label == c.Text {
+			return append(out[:i], out[i+1:]...), true
+		}
+		return nil, false
+	}
+	if !c.IsReal() {
+		return nil, false
+	}
+
+	// mov into a register that is overwritten before it is read
+	if c.Op == OpMov && c.Args[0].Kind == OperandReg && c.Args[0].Reg != "rsp" && regDeadAfter(rest, c.Args[0].Reg) {
+		return splice(out, k, k), true
+	}
+
+	j := prevReal(out, k)
+	if j < 0 {
+		return nil, false
+	}
+	b := out[j]
+
+	// push X; pop Y
+	if b.Op == OpPush && c.Op == OpPop {
+		x, y := b.Args[0], c.Args[0]
+		if x == y {
+			return splice(out, j, k), true
+		}
+		if x.Kind != OperandMem || y.Kind != OperandMem {
+			return splice(out, j, k, Instr{Op: OpMov, Args: []Operand{y, x}}), true
+		}
+		return nil, false
+	}
+
+	// mov R, imm; push R
+	if b.Op == OpMov && b.Args[0].Kind == OperandReg && b.Args[1].Kind == OperandImm && fitsImm32(b.Args[1].Imm) &&
+		c.Op == OpPush && c.Args[0] == b.Args[0] && regDeadAfter(rest, b.Args[0].Reg) {
+		return splice(out, j, k, Instr{Op: OpPush, Args: []Operand{b.Args[1]}}), true
+	}
+
+	// mov R, imm; add/sub D, R
+	if b.Op == OpMov && b.Args[0].Kind == OperandReg && b.Args[1].Kind == OperandImm && fitsImm32(b.Args[1].Imm) &&
+		(c.Op == OpAdd || c.Op == OpSub) && c.Args[1] == b.Args[0] && !c.Args[0].usesReg(b.Args[0].Reg) &&
+		regDeadAfter(rest, b.Args[0].Reg) {
+		return splice(out, j, k, Instr{Op: c.Op, Args: []Operand{c.Args[0], b.Args[1]}}), true
+	}
+
+	// add rsp, a; add rsp, b
+	if b.Op == OpAdd && c.Op == OpAdd && b.Args[0] == Reg("rsp") && c.Args[0] == Reg("rsp") &&
+		b.Args[1].Kind == OperandImm && c.Args[1].Kind == OperandImm && fitsImm32(b.Args[1].Imm+c.Args[1].Imm) {
+		return splice(out, j, k, Instr{Op: OpAdd, Args: []Operand{Reg("rsp"), Imm(b.Args[1].Imm + c.Args[1].Imm)}}), true
+	}
+
+	// push X; I; pop Y where I does not touch Y or the pushed slot
+	if c.Op == OpPop && c.Args[0].Kind == OperandReg && !b.IsBarrier() {
+		i := prevReal(out, j)
+		if i < 0 || out[i].Op != OpPush {
+			return nil, false
+		}
+		x, y := out[i].Args[0], c.Args[0]
+		if b.reads(y.Reg) || b.writes(y.Reg) {
+			return nil, false
+		}
+		shifted, ok := shiftStack(b, -8)
+		if !ok {
+			return nil, false
+		}
+		mov := Instr{Op: OpMov, Args: []Operand{y, x}}
+		// X has to be read first if I writes a register it uses, such as
+		// the pointer it is loaded through, or could store to it
+		if ((x.Kind == OperandReg || x.Kind == OperandMem) && b.writes(x.Reg)) ||
+			(x.Kind == OperandMem && (b.writes(x.Index) || b.writesMem())) {
+			return splice(out, i, k, mov, shifted), true
+		}
+		return splice(out, i, k, shifted, mov), true
+	}
+
+	return nil, false
+}
+
+// splice replaces instrs[from..to] with repl, keeping any comments that sat
+// between or after the replaced instructions. The result reuses the storage
+// of instrs.
+func splice(instrs []Instr, from int, to int, repl ...Instr) []Instr {
+	var comments []Instr
+	for k := from + 1; k < len(instrs); k++ {
+		if k != to && instrs[k].Op == OpComment {
+			comments = append(comments, instrs[k])
+		}
+	}
+	out := append(instrs[:from], repl...)
+	return append(out, comments...)
+}
+
+// prevReal returns the index of the last instruction before instrs[i] that
+// is not a comment, or -1 if there is none.
+func prevReal(instrs []Instr, i int) int {
+	for k := i - 1; k >= 0; k-- {
+		if instrs[k].Op != OpComment {
+			return k
+		}
+	}
+	return -1
+}
+
+// regDeadAfter reports whether reg is written before it is read in instrs,
+// the code that follows. Only the rest of the basic block is scanned. The
+// generator keeps every value on the stack across labels, so no scratch
+// register is live at a label or at the target of a jump; past a
+// conditional jump the register could still be read on the fall-through
+// path, so it counts as live.
+func regDeadAfter(instrs []Instr, reg string) bool {
+	for _, instr := range instrs {
+		if instr.Op == OpComment {
+			continue
+		}
+		if instr.reads(reg) {
+			return false
+		}
+		if instr.writes(reg) {
+			return true
+		}
+		if instr.isCondJump() {
+			return false
+		}
+		if instr.IsBarrier() {
+			return isScratch(reg)
+		}
+	}
+	return true
+}
+
+// shiftStack adds delta to the rsp-relative displacements of instr, as
+// needed when the instructions around it move the stack pointer by -delta.
+// It fails if instr moves the stack pointer itself or would end up
+// addressing below it.
+func shiftStack(instr Instr, delta int) (Instr, bool) {
+	if instr.writes("rsp") {
+		return instr, false
+	}
+	args := make([]Operand, len(instr.Args))
+	for n, arg := range instr.Args {
+		if arg.Kind == OperandReg && arg.Reg == "rsp" {
+			return instr, false
+		}
+		if arg.Kind == OperandMem && arg.Reg == "rsp" {
+			arg.Disp += delta
+			if arg.Disp < 0 {
+				return instr, false
+			}
+		}
+		args[n] = arg
+	}
+	instr.Args = args
+	return instr, true
+}
+
+func fitsImm32(value int64) bool {
+	return value >= math.MinInt32 && value <= math.MaxInt32
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func instr(op Opcode, args ...Operand) Instr {
+	return Instr{Op: op, Args: args}
+}
+
+func TestPeephole(t *testing.T) {
+	label := Instr{Op: OpLabel, Text: "label0"}
+	comment := Instr{Op: OpComment, Text: "note"}
+	syscall := instr(OpSyscall)
+	tests := []struct {
+		name string
+		in   []Instr
+		want []string
+	}{
+		{
+			"push and pop the same register",
+			[]Instr{instr(OpPush, Reg("rax")), instr(OpPop, Reg("rax")), syscall},
+			[]string{"syscall"},
+		},
+		{
+			"push and pop become a mov",
+			[]Instr{instr(OpPush, Reg("rax")), comment, instr(OpPop, Reg("rbx")), syscall},
+			[]string{"mov rbx, rax", "# note", "syscall"},
+		},
+		{
+			"push and pop between memory stay",
+			[]Instr{instr(OpPush, Mem("rbx", 8)), instr(OpPop, Mem("rcx", 0)), syscall},
+			[]string{"push QWORD PTR [rbx + 8]", "pop QWORD PTR [rcx + 0]", "syscall"},
+		},
+		{
+			"push an immediate",
+			[]Instr{instr(OpMov, Reg("rax"), Imm(2)), instr(OpPush, Reg("rax")), instr(OpMov, Reg("rax"), Imm(60)), syscall},
+			[]string{"push 2", "mov rax, 60", "syscall"},
+		},
+		{
+			"immediate too wide to push",
+			[]Instr{instr(OpMov, Reg("rax"), Imm(1<<40)), instr(OpPush, Reg("rax")), instr(OpMov, Reg("rax"), Imm(60)), syscall},
+			[]string{"mov rax, 1099511627776", "push rax", "mov rax, 60", "syscall"},
+		},
+		{
+			"add an immediate",
+			[]Instr{instr(OpMov, Reg("rbx"), Imm(5)), instr(OpAdd, Reg("rax"), Reg("rbx")), instr(OpMov, Reg("rbx"), Imm(0)), syscall},
+			[]string{"add rax, 5", "mov rbx, 0", "syscall"},
+		},
+		{
+			"immediate still read later",
+			[]Instr{instr(OpMov, Reg("rbx"), Imm(5)), instr(OpSub, Reg("rax"), Reg("rbx")), syscall},
+			[]string{"mov rbx, 5", "sub rax, rbx", "syscall"},
+		},
+		{
+			"merge stack adjustments",
+			[]Instr{instr(OpAdd, Reg("rsp"), Imm(8)), instr(OpAdd, Reg("rsp"), Imm(16)), syscall},
+			[]string{"add rsp, 24", "syscall"},
+		},
+		{
+			"jump to the next label",
+			[]Instr{instr(OpJmp, LabelRef("label0")), comment, label, syscall},
+			[]string{"# note", "label0:", "syscall"},
+		},
+		{
+			"conditional jump to the next label",
+			[]Instr{instr(OpJz, LabelRef("label0")), label, syscall},
+			[]string{"label0:", "syscall"},
+		},
+		{
+			"overwritten mov",
+			[]Instr{instr(OpMov, Reg("rax"), Imm(1)), instr(OpMov, Reg("rax"), Imm(2)), syscall},
+			[]string{"mov rax, 2", "syscall"},
+		},
+		{
+			"scratch register dead at a jump",
+			[]Instr{instr(OpMov, Reg("rax"), Imm(1)), instr(OpJmp, LabelRef("label1")), label, syscall},
+			[]string{"jmp label1", "label0:", "syscall"},
+		},
+		{
+			"register live past a conditional jump",
+			[]Instr{instr(OpMov, Reg("rax"), Imm(1)), instr(OpJz, LabelRef("label1")), instr(OpMov, Reg("rax"), Imm(2)), syscall},
+			[]string{"mov rax, 1", "jz label1", "mov rax, 2", "syscall"},
+		},
+		{
+			"frame anchor live at a jump",
+			[]Instr{instr(OpMov, Reg("r13"), Reg("rsp")), instr(OpJmp, LabelRef("label1")), label, syscall},
+			[]string{"mov r13, rsp", "jmp label1", "label0:", "syscall"},
+		},
+		{
+			"pop past an instruction",
+			[]Instr{instr(OpPush, Reg("rax")), instr(OpMov, Reg("rcx"), Mem("rsp", 16)), instr(OpPop, Reg("rbx")), syscall},
+			[]string{"mov rcx, QWORD PTR [rsp + 8]", "mov rbx, rax", "syscall"},
+		},
+		{
+			"pop past an instruction that changes the pushed pointer",
+			[]Instr{instr(OpPush, Mem("rbx", 0)), instr(OpMov, Reg("rbx"), Reg("rcx")), instr(OpPop, Reg("rax")), syscall},
+			[]string{"mov rax, QWORD PTR [rbx + 0]", "mov rbx, rcx", "syscall"},
+		},
+		{
+			"pop past an instruction that reads the popped register",
+			[]Instr{instr(OpPush, Reg("rax")), instr(OpAdd, Reg("rcx"), Reg("rbx")), instr(OpPop, Reg("rbx")), syscall},
+			[]string{"push rax", "add rcx, rbx", "pop rbx", "syscall"},
+		},
+		{
+			"setcc keeps the rest of its register",
+			[]Instr{
+				instr(OpMov, Reg("rax"), Imm(7)), instr(OpCmp, Reg("rbx"), Reg("rcx")), instr(OpSete, Reg("al")),
+				instr(OpMovzx, Reg("rax"), Reg("al")), instr(OpPush, Reg("rax")), instr(OpPop, Reg("rdi")), syscall,
+			},
+			[]string{"mov rax, 7", "cmp rbx, rcx", "sete al", "movzx rax, al", "mov rdi, rax", "syscall"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, instr := range Peephole(test.in) {
+				got = append(got, strings.TrimSpace(FormatInstr(instr, GasDialect{})))
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const replHelp = `Enter statements to run them; let bindings are kept between inputs.
+An expression on its own prints its value. Input continues over several
+lines while a { ... } scope is open.
+
+:tokens  show the tokens of the last input
+:ast     show the syntax tree of the last input
+:asm     show the x86-64 assembly of the last input
+:help    show this message
+:quit    leave the REPL
+`
+
+// replInput is what each stage produced for one input, kept for the
+// meta-commands.
+type replInput struct {
+	tokens []Token
+	stmts  []*NodeStmt
+	expr   *NodeExpr
+	// Bindings in scope before the input ran, which its code refers to
+	bound []interpVar
+}
+
+// REPL reads statements from in and runs them with an Interpreter, so the
+// same session works on every platform.
+type REPL struct {
+	scanner *bufio.Scanner
+	out     io.Writer
+	interp  *Interpreter
+	last    replInput
+}
+
+func NewREPL(in io.Reader, out io.Writer) *REPL {
+	return &REPL{
+		scanner: bufio.NewScanner(in),
+		out:     out,
+		interp:  NewInterpreter(),
+	}
+}
+
+func (r *REPL) Run() {
+	fmt.Fprintln(r.out, "hydro REPL, :help for commands")
+	for {
+		src, ok := r.read()
+		if !ok {
+			fmt.Fprintln(r.out)
+			return
+		}
+		switch command := strings.TrimSpace(src); {
+		case command == "":
+		case command == ":quit":
+			return
+		case strings.HasPrefix(command, ":"):
+			r.command(command)
+		default:
+			r.eval(src)
+		}
+	}
+}
+
+// read returns the next input, reading more lines while it has unclosed
+// braces.
+func (r *REPL) read() (string, bool) {
+	fmt.Fprint(r.out, ">> ")
+	var src string
+	for r.scanner.Scan() {
+		src += r.scanner.Text() + "\n"
+		tokens, err := NewTokenizer(src).Tokenize()
+		if err != nil || strings.HasPrefix(strings.TrimSpace(src), ":") || braceDepth(tokens) <= 0 {
+			return src, true
+		}
+		fmt.Fprint(r.out, ".. ")
+	}
+	return src, src != ""
+}
+
+func braceDepth(tokens []Token) int {
+	depth := 0
+	for _, token := range tokens {
+		switch token.Type {
+		case TokenOpenCurly:
+			depth++
+		case TokenCloseCurly:
+			depth--
+		}
+	}
+	return depth
+}
+
+// isExprInput reports whether tokens should be read as a lone expression
+// rather than as statements.
+func isExprInput(tokens []Token) bool {
+	switch tokens[0].Type {
+	case TokenIntLit, TokenCharLit, TokenOpenParen, TokenTilde, TokenAmp:
+		return true
+	case TokenStar:
+		// A store through a pointer is the only thing with `=` in it
+		for _, token := range tokens {
+			if _, update := UpdateOp(token.Type); token.Type == TokenEq || update {
+				return false
+			}
+		}
+		return true
+	case TokenIdent:
+		// The target of an assignment may be an element of an array
+		next := 1
+		if next < len(tokens) && tokens[next].Type == TokenOpenBracket {
+			depth := 0
+			for ; next < len(tokens); next++ {
+				if tokens[next].Type == TokenOpenBracket {
+					depth++
+				} else if tokens[next].Type == TokenCloseBracket {
+					depth--
+				}
+				if depth == 0 {
+					next++
+					break
+				}
+			}
+		}
+		if next >= len(tokens) {
+			return true
+		}
+		_, update := UpdateOp(tokens[next].Type)
+		return tokens[next].Type != TokenEq && !update
+	}
+	return false
+}
+
+func (r *REPL) eval(src string) {
+	tokens, err := NewTokenizer(src).Tokenize()
+	if err != nil {
+		fmt.Fprintln(r.out, err)
+		return
+	}
+	r.last = replInput{tokens: tokens, bound: r.interp.Bindings()}
+	if len(tokens) == 0 {
+		return
+	}
+
+	checker := NewChecker()
+	for _, binding := range r.interp.Bindings() {
+		symbol := checker.declare(Token{Type: TokenIdent, Value: &binding.Name})
+		symbol.Mutable = binding.Mutable
+		symbol.Const = binding.Const
+		symbol.Static = binding.Static
+		symbol.Value = binding.Value
+		symbol.Type = binding.Type()
+	}
+	parser := NewParser(tokens)
+	if isExprInput(tokens) {
+		var typ *Type
+		expr, err := parser.ParseExpr()
+		if err == nil {
+			r.last.expr = expr
+			typ, err = checker.CheckExpr(expr)
+		}
+		if err != nil {
+			fmt.Fprintln(r.out, err)
+			return
+		}
+		value, err := r.interp.evalExpr(expr)
+		if err != nil {
+			fmt.Fprintln(r.out, err)
+			return
+		}
+		fmt.Fprintln(r.out, r.interp.FormatValue(typ, value))
+		return
+	}
+
+	var stmts []*NodeStmt
+	for {
+		stmt, err := parser.ParseStmt()
+		if err != nil {
+			fmt.Fprintln(r.out, err)
+			return
+		}
+		if stmt == nil {
+			break
+		}
+		stmts = append(stmts, stmt)
+	}
+	r.last.stmts = stmts
+	if err := checker.Check(NodeProg{Stmts: stmts}); err != nil {
+		fmt.Fprintln(r.out, err)
+		return
+	}
+
+	value, exited, err := r.interp.Exec(stmts)
+	switch {
+	case err != nil:
+		fmt.Fprintln(r.out, err)
+	case exited:
+		fmt.Fprintf(r.out, "exit(%d)\n", value)
+	default:
+		r.printBindings(stmts)
+	}
+}
+
+// printBindings shows the value of each variable stmts declared or assigned
+// at the top level. A store through a pointer names no variable, so shows
+// nothing.
+func (r *REPL) printBindings(stmts []*NodeStmt) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, stmt := range stmts {
+		var ident Token
+		switch v := stmt.Var.(type) {
+		case *NodeStmtLet:
+			ident = v.Ident
+		case *NodeStmtStatic:
+			ident = v.Ident
+		case *NodeStmtConst:
+			ident = v.Ident
+		case *NodeStmtAssign:
+			if v.Deref != nil {
+				continue
+			}
+			ident = v.Ident
+		case *NodeStmtUpdate:
+			if v.Deref != nil {
+				continue
+			}
+			ident = v.Ident
+		default:
+			continue
+		}
+		if !seen[*ident.Value] {
+			seen[*ident.Value] = true
+			names = append(names, *ident.Value)
+		}
+	}
+	for _, name := range names {
+		variable, _ := r.interp.Lookup(name)
+		if variable.Elems != nil {
+			fmt.Fprintf(r.out, "%s = %s\n", name, variable)
+		} else {
+			fmt.Fprintf(r.out, "%s = %s\n", name, r.interp.FormatValue(variable.Type(), variable.Value))
+		}
+	}
+}
+
+func (r *REPL) command(command string) {
+	switch command {
+	case ":help":
+		fmt.Fprint(r.out, replHelp)
+	case ":tokens":
+		for _, token := range r.last.tokens {
+			if token.Value != nil {
+				fmt.Fprintf(r.out, "%d\t%s %s\n", token.Line, token.Type, *token.Value)
+			} else {
+				fmt.Fprintf(r.out, "%d\t%s\n", token.Line, token.Type)
+			}
+		}
+	case ":ast":
+		var output strings.Builder
+		if r.last.expr != nil {
+			writeExprAST(&output, 0, r.last.expr)
+		}
+		for _, stmt := range r.last.stmts {
+			writeStmtAST(&output, 0, stmt)
+		}
+		fmt.Fprint(r.out, output.String())
+	case ":asm":
+		stmts := r.last.stmts
+		if r.last.expr != nil {
+			// An expression is shown as the program that exits with it
+			stmts = []*NodeStmt{{Var: &NodeStmtExit{Expr: r.last.expr}}}
+		}
+		if stmts == nil {
+			return
+		}
+		generator := NewGenerator(NodeProg{Stmts: stmts})
+		for _, binding := range r.last.bound {
+			switch {
+			case binding.Const:
+				// The Checker replaced every use of it with its value
+			case binding.Static:
+				generator.bindStatic(binding.Name, binding.Value)
+			default:
+				generator.bind(binding.Name, len(binding.Elems))
+			}
+		}
+		fmt.Fprint(r.out, FormatInstrs(Peephole(generator.GenProg()), NasmDialect{}))
+	default:
+		fmt.Fprintf(r.out, "Unknown command: %s\n", command)
+	}
+}
+
+func writeASTLine(output *strings.Builder, depth int, text string) {
+	output.WriteString(strings.Repeat("  ", depth) + text + "\n")
+}
+
+// writeIndexAST writes the index of an array element, if there is one.
+func writeIndexAST(output *strings.Builder, depth int, index *NodeExpr) {
+	if index != nil {
+		writeASTLine(output, depth, "Index")
+		writeExprAST(output, depth+1, index)
+	}
+}
+
+// writeDerefAST writes a dereference, whether read or stored to.
+func writeDerefAST(output *strings.Builder, depth int, deref *NodeTermDeref) {
+	writeASTLine(output, depth, "Deref")
+	writeExprAST(output, depth+1, deref.Expr)
+}
+
+func writeExprAST(output *strings.Builder, depth int, expr *NodeExpr) {
+	switch v := expr.Var.(type) {
+	case *NodeTerm:
+		switch t := v.Var.(type) {
+		case *NodeTermIntLit:
+			writeASTLine(output, depth, "IntLit "+*t.IntLit.Value)
+		case *NodeTermIdent:
+			writeASTLine(output, depth, "Ident "+*t.Ident.Value)
+		case *NodeTermIndex:
+			writeASTLine(output, depth, "Elem "+*t.Ident.Value)
+			writeIndexAST(output, depth+1, t.Index)
+		case *NodeTermAddr:
+			writeASTLine(output, depth, "Addr "+*t.Ident.Value)
+			writeIndexAST(output, depth+1, t.Index)
+		case *NodeTermDeref:
+			writeDerefAST(output, depth, t)
+		case *NodeTermParen:
+			writeASTLine(output, depth, "Paren")
+			writeExprAST(output, depth+1, t.Expr)
+		case *NodeTermBitNot:
+			writeASTLine(output, depth, "BitNot")
+			writeExprAST(output, depth+1, t.Expr)
+		}
+	case *NodeBinExpr:
+		switch v.Var.(type) {
+		case *NodeBinExprAdd:
+			writeASTLine(output, depth, "Add")
+		case *NodeBinExprSub:
+			writeASTLine(output, depth, "Sub")
+		case *NodeBinExprMulti:
+			writeASTLine(output, depth, "Multi")
+		case *NodeBinExprDiv:
+			writeASTLine(output, depth, "Div")
+		case *NodeBinExprMod:
+			writeASTLine(output, depth, "Mod")
+		case *NodeBinExprAnd:
+			writeASTLine(output, depth, "And")
+		case *NodeBinExprOr:
+			writeASTLine(output, depth, "Or")
+		case *NodeBinExprXor:
+			writeASTLine(output, depth, "Xor")
+		case *NodeBinExprShl:
+			writeASTLine(output, depth, "Shl")
+		case *NodeBinExprShr:
+			writeASTLine(output, depth, "Shr")
+		case *NodeBinExprUshr:
+			writeASTLine(output, depth, "Ushr")
+		case *NodeBinExprEq:
+			writeASTLine(output, depth, "Eq")
+		case *NodeBinExprNe:
+			writeASTLine(output, depth, "Ne")
+		case *NodeBinExprLt:
+			writeASTLine(output, depth, "Lt")
+		case *NodeBinExprLe:
+			writeASTLine(output, depth, "Le")
+		case *NodeBinExprGt:
+			writeASTLine(output, depth, "Gt")
+		case *NodeBinExprGe:
+			writeASTLine(output, depth, "Ge")
+		}
+		lhs, rhs := binOperands(v)
+		writeExprAST(output, depth+1, lhs)
+		writeExprAST(output, depth+1, rhs)
+	}
+}
+
+func writeScopeAST(output *strings.Builder, depth int, scope *NodeScope) {
+	writeASTLine(output, depth, "Scope")
+	for _, stmt := range scope.Stmts {
+		writeStmtAST(output, depth+1, stmt)
+	}
+}
+
+func writeIfPredAST(output *strings.Builder, depth int, pred *NodeIfPred) {
+	switch v := pred.Var.(type) {
+	case *NodeIfPredElif:
+		writeASTLine(output, depth, "Elif")
+		writeExprAST(output, depth+1, v.Expr)
+		writeScopeAST(output, depth+1, v.Scope)
+		if v.Pred != nil {
+			writeIfPredAST(output, depth, v.Pred)
+		}
+	case *NodeIfPredElse:
+		writeASTLine(output, depth, "Else")
+		writeScopeAST(output, depth+1, v.Scope)
+	}
+}
+
+func writeStmtAST(output *strings.Builder, depth int, stmt *NodeStmt) {
+	switch v := stmt.Var.(type) {
+	case *NodeStmtExit:
+		writeASTLine(output, depth, "Exit")
+		writeExprAST(output, depth+1, v.Expr)
+	case *NodeStmtLet:
+		if v.Mut {
+			writeASTLine(output, depth, "Let mut "+*v.Ident.Value)
+		} else {
+			writeASTLine(output, depth, "Let "+*v.Ident.Value)
+		}
+		if v.Type != nil {
+			writeASTLine(output, depth+1, "Type "+formatType(v.Type))
+		}
+		if v.Array != nil {
+			writeASTLine(output, depth+1, "Array")
+			for _, elem := range v.Array.Elems {
+				writeExprAST(output, depth+2, elem)
+			}
+		}
+		if v.Expr != nil {
+			writeExprAST(output, depth+1, v.Expr)
+		}
+	case *NodeStmtStatic:
+		line := "Static " + *v.Ident.Value
+		if v.Type != nil {
+			line += ": " + formatType(v.Type)
+		}
+		writeASTLine(output, depth, line)
+		if v.Expr != nil {
+			writeExprAST(output, depth+1, v.Expr)
+		}
+	case *NodeStmtConst:
+		line := "Const " + *v.Ident.Value
+		if v.Type != nil {
+			line += ": " + formatType(v.Type)
+		}
+		writeASTLine(output, depth, line)
+		writeExprAST(output, depth+1, v.Expr)
+	case *NodeStmtAssign:
+		if v.Deref != nil {
+			writeASTLine(output, depth, "Assign")
+			writeDerefAST(output, depth+1, v.Deref)
+		} else {
+			writeASTLine(output, depth, "Assign "+*v.Ident.Value)
+			writeIndexAST(output, depth+1, v.Index)
+		}
+		writeExprAST(output, depth+1, v.Expr)
+	case *NodeStmtUpdate:
+		if v.Deref != nil {
+			writeASTLine(output, depth, "Update "+v.Op.Text())
+			writeDerefAST(output, depth+1, v.Deref)
+		} else {
+			writeASTLine(output, depth, "Update "+*v.Ident.Value+" "+v.Op.Text())
+			writeIndexAST(output, depth+1, v.Index)
+		}
+		writeExprAST(output, depth+1, v.Expr)
+	case *NodeScope:
+		writeScopeAST(output, depth, v)
+	case *NodeStmtIf:
+		writeASTLine(output, depth, "If")
+		writeExprAST(output, depth+1, v.Expr)
+		writeScopeAST(output, depth+1, v.Scope)
+		if v.Pred != nil {
+			writeIfPredAST(output, depth+1, v.Pred)
+		}
+	case *NodeStmtFor:
+		writeASTLine(output, depth, "For")
+		if v.Init != nil {
+			writeStmtAST(output, depth+1, v.Init)
+		}
+		if v.Cond != nil {
+			writeExprAST(output, depth+1, v.Cond)
+		}
+		if v.Step != nil {
+			writeStmtAST(output, depth+1, v.Step)
+		}
+		writeScopeAST(output, depth+1, v.Scope)
+	case *NodeStmtMatch:
+		writeASTLine(output, depth, "Match")
+		writeExprAST(output, depth+1, v.Expr)
+		for _, arm := range v.Arms {
+			patterns := make([]string, len(arm.Patterns))
+			for i, pattern := range arm.Patterns {
+				patterns[i] = pattern.Text()
+			}
+			writeASTLine(output, depth+1, "Arm "+strings.Join(patterns, " | "))
+			writeScopeAST(output, depth+2, arm.Scope)
+		}
+	case *NodeStmtBreak:
+		writeASTLine(output, depth, "Break")
+	case *NodeStmtContinue:
+		writeASTLine(output, depth, "Continue")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// runREPL runs a REPL session on input and returns everything it printed.
+func runREPL(input string) string {
+	var out strings.Builder
+	NewREPL(strings.NewReader(input), &out).Run()
+	return out.String()
+}
+
+func TestREPL(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			"bindings kept across inputs",
+			"let mut x = 2;\nx += 3;\nx * 2\n",
+			">> x = 2\n>> x = 5\n>> 10\n>> \n",
+		},
+		{
+			"scope continues over lines",
+			"let mut n = 0;\n{\n    n = 4;\n}\nn\n",
+			">> n = 0\n>> .. .. >> 4\n>> \n",
+		},
+		{
+			"errors",
+			"let y = z;\n:bogus\n",
+			">> Undeclared identifier: z on line 1\n>> Unknown command: :bogus\n>> \n",
+		},
+		{
+			"quit",
+			"let x = 1;\n:quit\nx\n",
+			">> x = 1\n>> ",
+		},
+		{
+			"tokens",
+			"let x = 1 + 2;\n:tokens\n",
+			">> x = 3\n>> 1\t`let`\n1\tidentifier x\n1\t`=`\n1\tint literal 1\n1\t`+`\n1\tint literal 2\n1\t`;`\n>> \n",
+		},
+		{
+			"ast of a statement",
+			"let x = 1 + 2;\n:ast\n",
+			">> x = 3\n>> Let x\n  Add\n    IntLit 1\n    IntLit 2\n>> \n",
+		},
+		{
+			"ast of an expression",
+			"let x = 5;\nx - 1\n:ast\n",
+			">> x = 5\n>> 4\n>> Sub\n  Ident x\n  IntLit 1\n>> \n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := "hydro REPL, :help for commands\n" + test.want
+			if got := runREPL(test.input); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// TestREPLAsm checks that :asm shows an expression as the program that
+// exits with it, reading a binding from an earlier input off the stack.
+func TestREPLAsm(t *testing.T) {
+	got := runREPL("let x = 5;\nx - 1\n:asm\n")
+	for _, want := range []string{
+		"_start:\n",
+		"    mov rax, QWORD [rsp + 0]\n",
+		"    sub rax, rbx\n",
+		"    mov rdi, rax\n    mov rax, 60\n    syscall\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q is missing %q", got, want)
+		}
+	}
+}
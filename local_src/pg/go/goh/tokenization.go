@@ -2,8 +2,12 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"strconv"
+	"strings"
 	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 type TokenType int
@@ -26,6 +30,48 @@ const (
 	TokenIf
 	TokenElif
 	TokenElse
+	TokenCharLit
+	TokenPercent
+	TokenPlusEq
+	TokenMinusEq
+	TokenStarEq
+	TokenFslashEq
+	TokenPercentEq
+	TokenPlusPlus
+	TokenMinusMinus
+	TokenAmp
+	TokenPipe
+	TokenCaret
+	TokenTilde
+	TokenShl
+	TokenShr
+	TokenUshr
+	TokenAmpEq
+	TokenPipeEq
+	TokenCaretEq
+	TokenShlEq
+	TokenShrEq
+	TokenUshrEq
+	TokenFor
+	TokenBreak
+	TokenContinue
+	TokenEqEq
+	TokenNe
+	TokenLt
+	TokenLe
+	TokenGt
+	TokenGe
+	TokenMatch
+	TokenFatArrow
+	TokenUnderscore
+	TokenStatic
+	TokenColon
+	TokenMut
+	TokenConst
+	TokenOpenBracket
+	TokenCloseBracket
+	TokenComma
+	TokenEOF // Returned by Tokenizer.Next at the end of the source
 )
 
 func (t TokenType) String() string {
@@ -64,154 +110,710 @@ func (t TokenType) String() string {
 		return "`elif`"
 	case TokenElse:
 		return "`else`"
+	case TokenCharLit:
+		return "character literal"
+	case TokenPercent:
+		return "`%`"
+	case TokenPlusEq:
+		return "`+=`"
+	case TokenMinusEq:
+		return "`-=`"
+	case TokenStarEq:
+		return "`*=`"
+	case TokenFslashEq:
+		return "`/=`"
+	case TokenPercentEq:
+		return "`%=`"
+	case TokenPlusPlus:
+		return "`++`"
+	case TokenMinusMinus:
+		return "`--`"
+	case TokenAmp:
+		return "`&`"
+	case TokenPipe:
+		return "`|`"
+	case TokenCaret:
+		return "`^`"
+	case TokenTilde:
+		return "`~`"
+	case TokenShl:
+		return "`<<`"
+	case TokenShr:
+		return "`>>`"
+	case TokenUshr:
+		return "`>>>`"
+	case TokenAmpEq:
+		return "`&=`"
+	case TokenPipeEq:
+		return "`|=`"
+	case TokenCaretEq:
+		return "`^=`"
+	case TokenShlEq:
+		return "`<<=`"
+	case TokenShrEq:
+		return "`>>=`"
+	case TokenUshrEq:
+		return "`>>>=`"
+	case TokenFor:
+		return "`for`"
+	case TokenBreak:
+		return "`break`"
+	case TokenContinue:
+		return "`continue`"
+	case TokenEqEq:
+		return "`==`"
+	case TokenNe:
+		return "`!=`"
+	case TokenLt:
+		return "`<`"
+	case TokenLe:
+		return "`<=`"
+	case TokenGt:
+		return "`>`"
+	case TokenGe:
+		return "`>=`"
+	case TokenMatch:
+		return "`match`"
+	case TokenFatArrow:
+		return "`=>`"
+	case TokenUnderscore:
+		return "`_`"
+	case TokenStatic:
+		return "`static`"
+	case TokenColon:
+		return "`:`"
+	case TokenMut:
+		return "`mut`"
+	case TokenConst:
+		return "`const`"
+	case TokenOpenBracket:
+		return "`[`"
+	case TokenCloseBracket:
+		return "`]`"
+	case TokenComma:
+		return "`,`"
+	case TokenEOF:
+		return "end of file"
 	}
 	panic("invalid token type")
 }
 
+// BinPrec returns the precedence of a binary operator, following C: `|`
+// binds loosest, then `^`, `&`, `== !=`, `< <= > >=`, the shifts, `+ -`
+// and `* / %`.
 func BinPrec(tokenType TokenType) (int, bool) {
 	switch tokenType {
-	case TokenMinus, TokenPlus:
+	case TokenPipe:
 		return 0, true
-	case TokenFslash, TokenStar:
+	case TokenCaret:
 		return 1, true
+	case TokenAmp:
+		return 2, true
+	case TokenEqEq, TokenNe:
+		return 3, true
+	case TokenLt, TokenLe, TokenGt, TokenGe:
+		return 4, true
+	case TokenShl, TokenShr, TokenUshr:
+		return 5, true
+	case TokenMinus, TokenPlus:
+		return 6, true
+	case TokenFslash, TokenStar, TokenPercent:
+		return 7, true
+	default:
+		return 0, false
+	}
+}
+
+// UpdateOp returns the binary operator an in-place update statement
+// applies to its variable. `++` and `--` add and subtract one.
+func UpdateOp(tokenType TokenType) (TokenType, bool) {
+	switch tokenType {
+	case TokenPlusEq, TokenPlusPlus:
+		return TokenPlus, true
+	case TokenMinusEq, TokenMinusMinus:
+		return TokenMinus, true
+	case TokenStarEq:
+		return TokenStar, true
+	case TokenFslashEq:
+		return TokenFslash, true
+	case TokenPercentEq:
+		return TokenPercent, true
+	case TokenAmpEq:
+		return TokenAmp, true
+	case TokenPipeEq:
+		return TokenPipe, true
+	case TokenCaretEq:
+		return TokenCaret, true
+	case TokenShlEq:
+		return TokenShl, true
+	case TokenShrEq:
+		return TokenShr, true
+	case TokenUshrEq:
+		return TokenUshr, true
 	default:
 		return 0, false
 	}
 }
 
+type TriviaKind int
+
+const (
+	TriviaComment TriviaKind = iota
+	TriviaNewline
+	TriviaWhitespace
+)
+
+// Trivia is source text between tokens that the parser does not need.
+// Text is exactly what appeared in the source: a comment including its
+// delimiters, a line break, or a run of other whitespace.
+type Trivia struct {
+	Kind TriviaKind
+	Text string
+}
+
 type Token struct {
 	Type  TokenType
 	Line  int
+	Col   int // 1-based, counted in characters
 	Value *string
+	Raw   string // Source text, when it is not fixed by Type
+	Int   int64  // Value of an int or character literal
+	// With Tokenizer.KeepTrivia, Trailing holds the trivia after the token
+	// up to the end of its line and Leading everything before it since the
+	// previous token's Trailing.
+	Leading  []Trivia
+	Trailing []Trivia
 }
 
+// Text returns the token as it appears in the source.
+func (t Token) Text() string {
+	if t.Raw != "" {
+		return t.Raw
+	}
+	if t.Value != nil {
+		return *t.Value
+	}
+	return strings.Trim(t.Type.String(), "`")
+}
+
+// Len returns the number of characters the token spans in the source.
+func (t Token) Len() int {
+	return utf8.RuneCountInString(t.Text())
+}
+
+// Untokenize rebuilds the source of tokens produced with KeepTrivia, along
+// with the tokenizer's EOFTrivia. The result is identical to the input.
+func Untokenize(tokens []Token, eofTrivia []Trivia) string {
+	var output strings.Builder
+	for _, token := range tokens {
+		for _, trivia := range token.Leading {
+			output.WriteString(trivia.Text)
+		}
+		output.WriteString(token.Text())
+		for _, trivia := range token.Trailing {
+			output.WriteString(trivia.Text)
+		}
+	}
+	for _, trivia := range eofTrivia {
+		output.WriteString(trivia.Text)
+	}
+	return output.String()
+}
+
+// Tokenizer turns source into tokens one at a time. Identifier and
+// literal text is sliced from the source rather than copied, and each
+// distinct spelling shares one interned Value.
 type Tokenizer struct {
-	src   string
-	index int
+	src       string
+	index     int
+	line      int
+	column    int // Characters consumed on the current line
+	lineStart int // Byte index where the current line starts
+	names     map[string]*string
+	// KeepTrivia attaches comments and whitespace to the tokens around them
+	// instead of dropping them, for tools that rewrite the source.
+	KeepTrivia bool
+	// EOFTrivia is the trivia after the last token's Trailing, set once
+	// Next returns TokenEOF.
+	EOFTrivia []Trivia
 }
 
 func NewTokenizer(src string) *Tokenizer {
 	return &Tokenizer{
-		src:   src,
-		index: 0,
+		src:       src,
+		index:     0,
+		line:      1,
+		lineStart: 0,
+		names:     make(map[string]*string),
 	}
 }
 
-func (t *Tokenizer) Tokenize() []Token {
-	var tokens []Token
-	var buf string
-	lineCount := 1
+// eof is what peek returns past the end of the source. It is not a valid
+// character, so no character class matches it.
+const eof rune = -1
 
-	for t.peek(0) != nil {
-		ch := *t.peek(0)
+// isIdentStart and isIdentPart follow Unicode's identifier syntax closely
+// enough to accept any name written in letters, including those that use
+// combining marks before NFC normalization.
+func isIdentStart(ch rune) bool {
+	return unicode.IsLetter(ch)
+}
 
-		if unicode.IsLetter(ch) {
-			buf += string(t.consume())
-			for t.peek(0) != nil && (unicode.IsLetter(*t.peek(0)) || unicode.IsDigit(*t.peek(0))) {
-				buf += string(t.consume())
-			}
+func isIdentPart(ch rune) bool {
+	return unicode.IsLetter(ch) || unicode.IsDigit(ch) || unicode.In(ch, unicode.Mn, unicode.Mc)
+}
 
-			if buf == "exit" {
-				tokens = append(tokens, Token{Type: TokenExit, Line: lineCount})
-			} else if buf == "let" {
-				tokens = append(tokens, Token{Type: TokenLet, Line: lineCount})
-			} else if buf == "if" {
-				tokens = append(tokens, Token{Type: TokenIf, Line: lineCount})
-			} else if buf == "elif" {
-				tokens = append(tokens, Token{Type: TokenElif, Line: lineCount})
-			} else if buf == "else" {
-				tokens = append(tokens, Token{Type: TokenElse, Line: lineCount})
-			} else {
-				value := buf
-				tokens = append(tokens, Token{Type: TokenIdent, Line: lineCount, Value: &value})
-			}
-			buf = ""
-		} else if unicode.IsDigit(ch) {
-			buf += string(t.consume())
-			for t.peek(0) != nil && unicode.IsDigit(*t.peek(0)) {
-				buf += string(t.consume())
+func isDigit(ch rune) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isASCIILetter(ch rune) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+// digitValue returns the value of ch as a digit in bases up to 36.
+func digitValue(ch byte) int {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return int(ch - '0')
+	case ch >= 'a' && ch <= 'z':
+		return int(ch-'a') + 10
+	case ch >= 'A' && ch <= 'Z':
+		return int(ch-'A') + 10
+	}
+	return 36
+}
+
+// intLitBases maps the second character of a 0x, 0b or 0o prefix to its
+// base and the name used in diagnostics.
+var intLitBases = map[byte]struct {
+	base int
+	name string
+}{
+	'x': {16, "hexadecimal"},
+	'X': {16, "hexadecimal"},
+	'b': {2, "binary"},
+	'B': {2, "binary"},
+	'o': {8, "octal"},
+	'O': {8, "octal"},
+}
+
+// parseIntLit returns the value of an int literal token. Literals are
+// decimal unless they start with 0x, 0b or 0o, and may put a single `_`
+// between digits or after the prefix. A prefixed literal may set the sign
+// bit, so 0xFFFF_FFFF_FFFF_FFFF is -1. Anything else, including a value
+// that does not fit in 64 bits, is reported at its position.
+func parseIntLit(token Token) int64 {
+	raw := token.Raw
+	base, name := 10, "decimal"
+	digits := 0
+	if len(raw) >= 2 && raw[0] == '0' {
+		if prefix, ok := intLitBases[raw[1]]; ok {
+			base, name = prefix.base, prefix.name
+			digits = 2
+		}
+	}
+
+	// The literal is ASCII, so byte offsets are also column offsets
+	fail := func(offset int, length int, message string) {
+		panic(Diagnostic{Line: token.Line, Col: token.Col + offset, Len: length, Message: fmt.Sprintf("%s on line %d", message, token.Line)})
+	}
+	var clean []byte
+	for i := digits; i < len(raw); i++ {
+		ch := raw[i]
+		if ch == '_' {
+			if i+1 == len(raw) || raw[i+1] == '_' {
+				fail(i, 1, "`_` must separate successive digits")
 			}
-			value := buf
-			tokens = append(tokens, Token{Type: TokenIntLit, Line: lineCount, Value: &value})
-			buf = ""
-		} else if ch == '/' && t.peek(1) != nil && *t.peek(1) == '/' {
-			// Single line comment
-			t.consume()
-			t.consume()
-			for t.peek(0) != nil && *t.peek(0) != '\n' {
-				t.consume()
+			continue
+		}
+		if digitValue(ch) >= base {
+			fail(i, 1, fmt.Sprintf("Invalid digit %q in %s literal", ch, name))
+		}
+		clean = append(clean, ch)
+	}
+	if len(clean) == 0 {
+		fail(0, len(raw), fmt.Sprintf("%s literal has no digits", strings.ToUpper(name[:1])+name[1:]))
+	}
+
+	if base == 10 {
+		value, err := strconv.ParseInt(string(clean), base, 64)
+		if err != nil {
+			fail(0, len(raw), fmt.Sprintf("Integer literal out of range: %s", raw))
+		}
+		return value
+	}
+	// A prefixed literal spells out the bits, so it may use all 64 of them
+	value, err := strconv.ParseUint(string(clean), base, 64)
+	if err != nil {
+		fail(0, len(raw), fmt.Sprintf("Integer literal out of range: %s", raw))
+	}
+	return int64(value)
+}
+
+// Tokenize returns all of the remaining tokens.
+func (t *Tokenizer) Tokenize() (tokens []Token, err error) {
+	defer recoverDiagnostic(&err)
+	// Source averages about four bytes a token, so sizing the slice for
+	// that saves growing it, and copying every token so far, as it fills
+	tokens = make([]Token, 0, (len(t.src)-t.index)/4)
+	for {
+		token := t.Next()
+		if token.Type == TokenEOF {
+			return tokens, nil
+		}
+		tokens = append(tokens, token)
+	}
+}
+
+// Next returns the next token, or one of type TokenEOF at the end of the
+// source. It panics with a Diagnostic on malformed input.
+func (t *Tokenizer) Next() Token {
+	var leading []Trivia
+	for t.peek(0) != eof {
+		token, trivia, ok := t.scan()
+		if !ok {
+			if t.KeepTrivia {
+				leading = append(leading, trivia)
 			}
-		} else if ch == '/' && t.peek(1) != nil && *t.peek(1) == '*' {
-			// Multi-line comment
+			continue
+		}
+		if t.KeepTrivia {
+			token.Leading = leading
+			token.Trailing = t.trailing()
+		}
+		return token
+	}
+	t.EOFTrivia = leading
+	return Token{Type: TokenEOF, Line: t.line, Col: t.col()}
+}
+
+// trailing consumes the trivia after a token up to and including the end
+// of its line.
+func (t *Tokenizer) trailing() []Trivia {
+	var trailing []Trivia
+	for t.atTrivia() {
+		_, trivia, _ := t.scan()
+		trailing = append(trailing, trivia)
+		if trivia.Kind == TriviaNewline {
+			break
+		}
+	}
+	return trailing
+}
+
+func (t *Tokenizer) atTrivia() bool {
+	ch := t.peek(0)
+	if ch == '/' {
+		return t.peek(1) == '/' || t.peek(1) == '*'
+	}
+	return unicode.IsSpace(ch)
+}
+
+// intern returns the shared Value for a spelling of an identifier or
+// literal. Spellings that differ only in composition name the same
+// variable, so identifiers are compared in NFC.
+func (t *Tokenizer) intern(raw string) *string {
+	if value, ok := t.names[raw]; ok {
+		return value
+	}
+	normal := norm.NFC.String(raw)
+	if normal == raw {
+		value := &normal
+		t.names[raw] = value
+		return value
+	}
+	value, ok := t.names[normal]
+	if !ok {
+		value = &normal
+		t.names[normal] = value
+	}
+	t.names[raw] = value
+	return value
+}
+
+// scan consumes one token or one piece of trivia, reporting which with ok.
+func (t *Tokenizer) scan() (token Token, trivia Trivia, ok bool) {
+	ch := t.peek(0)
+	line, col := t.line, t.col()
+	start := t.index
+
+	if isIdentStart(ch) {
+		t.consume()
+		for isIdentPart(t.peek(0)) {
 			t.consume()
+		}
+		raw := t.src[start:t.index]
+		value := t.intern(raw)
+
+		if *value == "exit" {
+			return Token{Type: TokenExit, Line: line, Col: col, Raw: raw}, trivia, true
+		} else if *value == "let" {
+			return Token{Type: TokenLet, Line: line, Col: col, Raw: raw}, trivia, true
+		} else if *value == "if" {
+			return Token{Type: TokenIf, Line: line, Col: col, Raw: raw}, trivia, true
+		} else if *value == "elif" {
+			return Token{Type: TokenElif, Line: line, Col: col, Raw: raw}, trivia, true
+		} else if *value == "else" {
+			return Token{Type: TokenElse, Line: line, Col: col, Raw: raw}, trivia, true
+		} else if *value == "for" {
+			return Token{Type: TokenFor, Line: line, Col: col, Raw: raw}, trivia, true
+		} else if *value == "break" {
+			return Token{Type: TokenBreak, Line: line, Col: col, Raw: raw}, trivia, true
+		} else if *value == "continue" {
+			return Token{Type: TokenContinue, Line: line, Col: col, Raw: raw}, trivia, true
+		} else if *value == "match" {
+			return Token{Type: TokenMatch, Line: line, Col: col, Raw: raw}, trivia, true
+		} else if *value == "static" {
+			return Token{Type: TokenStatic, Line: line, Col: col, Raw: raw}, trivia, true
+		} else if *value == "mut" {
+			return Token{Type: TokenMut, Line: line, Col: col, Raw: raw}, trivia, true
+		} else if *value == "const" {
+			return Token{Type: TokenConst, Line: line, Col: col, Raw: raw}, trivia, true
+		}
+		return Token{Type: TokenIdent, Line: line, Col: col, Raw: raw, Value: value}, trivia, true
+	} else if isDigit(ch) {
+		// Take every character that could continue a number, so that a
+		// stray letter is reported as a bad digit rather than starting an
+		// identifier
+		for isDigit(t.peek(0)) || isASCIILetter(t.peek(0)) || t.peek(0) == '_' {
 			t.consume()
-			for t.peek(0) != nil {
-				if *t.peek(0) == '*' && t.peek(1) != nil && *t.peek(1) == '/' {
-					break
-				}
-				t.consume()
-			}
-			if t.peek(0) != nil {
-				t.consume()
+		}
+		raw := t.src[start:t.index]
+		token := Token{Type: TokenIntLit, Line: line, Col: col, Raw: raw, Value: t.intern(raw)}
+		token.Int = parseIntLit(token)
+		return token, trivia, true
+	} else if ch == '\'' {
+		t.consume()
+		count := 0
+		var value rune
+		for t.peek(0) != '\'' {
+			if t.peek(0) == eof || t.peek(0) == '\n' {
+				panic(Diagnostic{Line: line, Col: col, Len: 1, Message: fmt.Sprintf("Unterminated character literal on line %d", line)})
 			}
-			if t.peek(0) != nil {
-				t.consume()
+			value = t.scanChar()
+			count++
+		}
+		t.consume()
+		raw := t.src[start:t.index]
+		if count != 1 {
+			message := "Empty character literal"
+			if count > 1 {
+				message = "Character literal has more than one character"
 			}
-		} else if ch == '(' {
-			t.consume()
-			tokens = append(tokens, Token{Type: TokenOpenParen, Line: lineCount})
-		} else if ch == ')' {
-			t.consume()
-			tokens = append(tokens, Token{Type: TokenCloseParen, Line: lineCount})
-		} else if ch == ';' {
-			t.consume()
-			tokens = append(tokens, Token{Type: TokenSemi, Line: lineCount})
-		} else if ch == '=' {
-			t.consume()
-			tokens = append(tokens, Token{Type: TokenEq, Line: lineCount})
-		} else if ch == '+' {
-			t.consume()
-			tokens = append(tokens, Token{Type: TokenPlus, Line: lineCount})
-		} else if ch == '*' {
-			t.consume()
-			tokens = append(tokens, Token{Type: TokenStar, Line: lineCount})
-		} else if ch == '-' {
-			t.consume()
-			tokens = append(tokens, Token{Type: TokenMinus, Line: lineCount})
-		} else if ch == '/' {
-			t.consume()
-			tokens = append(tokens, Token{Type: TokenFslash, Line: lineCount})
-		} else if ch == '{' {
+			panic(Diagnostic{Line: line, Col: col, Len: utf8.RuneCountInString(raw), Message: fmt.Sprintf("%s on line %d", message, line)})
+		}
+		return Token{Type: TokenCharLit, Line: line, Col: col, Raw: raw, Value: t.intern(raw), Int: int64(value)}, trivia, true
+	} else if ch == '/' && t.peek(1) == '/' {
+		// Single line comment
+		t.consume()
+		t.consume()
+		for t.peek(0) != eof && t.peek(0) != '\n' {
 			t.consume()
-			tokens = append(tokens, Token{Type: TokenOpenCurly, Line: lineCount})
-		} else if ch == '}' {
+		}
+		return token, Trivia{Kind: TriviaComment, Text: t.src[start:t.index]}, false
+	} else if ch == '/' && t.peek(1) == '*' {
+		// Multi-line comment
+		t.consume()
+		t.consume()
+		for t.peek(0) != eof {
+			if t.peek(0) == '*' && t.peek(1) == '/' {
+				break
+			}
 			t.consume()
-			tokens = append(tokens, Token{Type: TokenCloseCurly, Line: lineCount})
-		} else if ch == '\n' {
+		}
+		if t.peek(0) == eof {
+			panic(Diagnostic{Line: line, Col: col, Len: 2, Message: fmt.Sprintf("Unterminated comment on line %d", line)})
+		}
+		t.consume()
+		t.consume()
+		return token, Trivia{Kind: TriviaComment, Text: t.src[start:t.index]}, false
+	} else if ch == '\n' {
+		t.consume()
+		return token, Trivia{Kind: TriviaNewline, Text: "\n"}, false
+	} else if unicode.IsSpace(ch) {
+		for t.peek(0) != '\n' && unicode.IsSpace(t.peek(0)) {
 			t.consume()
-			lineCount++
-		} else if unicode.IsSpace(ch) {
+		}
+		return token, Trivia{Kind: TriviaWhitespace, Text: t.src[start:t.index]}, false
+	}
+
+	var tokenType TokenType
+	if ch == '(' {
+		tokenType = TokenOpenParen
+	} else if ch == ')' {
+		tokenType = TokenCloseParen
+	} else if ch == ';' {
+		tokenType = TokenSemi
+	} else if ch == ':' {
+		tokenType = TokenColon
+	} else if ch == '[' {
+		tokenType = TokenOpenBracket
+	} else if ch == ']' {
+		tokenType = TokenCloseBracket
+	} else if ch == ',' {
+		tokenType = TokenComma
+	} else if ch == '=' && t.peek(1) == '>' {
+		t.consume()
+		tokenType = TokenFatArrow
+	} else if ch == '=' {
+		tokenType = t.operator(TokenEq, TokenEqEq, -1)
+	} else if ch == '!' && t.peek(1) == '=' {
+		t.consume()
+		tokenType = TokenNe
+	} else if ch == '+' {
+		tokenType = t.operator(TokenPlus, TokenPlusEq, TokenPlusPlus)
+	} else if ch == '*' {
+		tokenType = t.operator(TokenStar, TokenStarEq, -1)
+	} else if ch == '-' {
+		tokenType = t.operator(TokenMinus, TokenMinusEq, TokenMinusMinus)
+	} else if ch == '/' {
+		tokenType = t.operator(TokenFslash, TokenFslashEq, -1)
+	} else if ch == '%' {
+		tokenType = t.operator(TokenPercent, TokenPercentEq, -1)
+	} else if ch == '&' {
+		tokenType = t.operator(TokenAmp, TokenAmpEq, -1)
+	} else if ch == '|' {
+		tokenType = t.operator(TokenPipe, TokenPipeEq, -1)
+	} else if ch == '^' {
+		tokenType = t.operator(TokenCaret, TokenCaretEq, -1)
+	} else if ch == '~' {
+		tokenType = TokenTilde
+	} else if ch == '_' {
+		tokenType = TokenUnderscore
+	} else if ch == '<' && t.peek(1) == '<' {
+		t.consume()
+		tokenType = t.operator(TokenShl, TokenShlEq, -1)
+	} else if ch == '>' && t.peek(1) == '>' {
+		t.consume()
+		if t.peek(1) == '>' {
 			t.consume()
+			tokenType = t.operator(TokenUshr, TokenUshrEq, -1)
 		} else {
-			fmt.Fprintf(os.Stderr, "Invalid token\n")
-			os.Exit(1)
+			tokenType = t.operator(TokenShr, TokenShrEq, -1)
 		}
+	} else if ch == '<' {
+		tokenType = t.operator(TokenLt, TokenLe, -1)
+	} else if ch == '>' {
+		tokenType = t.operator(TokenGt, TokenGe, -1)
+	} else if ch == '{' {
+		tokenType = TokenOpenCurly
+	} else if ch == '}' {
+		tokenType = TokenCloseCurly
+	} else {
+		panic(Diagnostic{Line: line, Col: col, Len: 1, Message: fmt.Sprintf("Invalid token %q on line %d", ch, line)})
+	}
+	t.consume()
+	return Token{Type: tokenType, Line: line, Col: col}, trivia, true
+}
+
+// operator consumes the second character of an operator that is followed
+// by `=` or doubled, returning single, withEq or doubled accordingly.
+// doubled is -1 for operators that cannot be doubled.
+func (t *Tokenizer) operator(single TokenType, withEq TokenType, doubled TokenType) TokenType {
+	next := t.peek(1)
+	if next == '=' {
+		t.consume()
+		return withEq
 	}
+	if next == t.peek(0) && doubled >= 0 {
+		t.consume()
+		return doubled
+	}
+	return single
+}
 
-	t.index = 0
-	return tokens
+// charEscapes maps the character after a backslash in a character literal
+// to the character it stands for. `\x` is handled separately.
+var charEscapes = map[rune]rune{
+	'0':  0,
+	'a':  '\a',
+	'b':  '\b',
+	'f':  '\f',
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+	'v':  '\v',
+	'\\': '\\',
+	'\'': '\'',
+	'"':  '"',
 }
 
-func (t *Tokenizer) peek(offset int) *rune {
-	if t.index+offset >= len(t.src) {
-		return nil
+// scanChar consumes one character of a character literal, decoding an
+// escape sequence if it starts with a backslash.
+func (t *Tokenizer) scanChar() rune {
+	line, col := t.line, t.col()
+	ch := t.consume()
+	if ch != '\\' {
+		return ch
+	}
+
+	escape := t.peek(0)
+	if escape == eof || escape == '\n' {
+		panic(Diagnostic{Line: line, Col: col, Len: 1, Message: fmt.Sprintf("Unterminated escape sequence on line %d", line)})
+	}
+	t.consume()
+	if value, ok := charEscapes[escape]; ok {
+		return value
+	}
+	if escape != 'x' {
+		panic(Diagnostic{Line: line, Col: col, Len: 2, Message: fmt.Sprintf("Invalid escape sequence `\\%c` on line %d", escape, line)})
 	}
-	ch := rune(t.src[t.index+offset])
-	return &ch
+	var value rune
+	for i := 0; i < 2; i++ {
+		digit := t.peek(0)
+		if digit >= utf8.RuneSelf || digit == eof || digitValue(byte(digit)) >= 16 {
+			panic(Diagnostic{Line: line, Col: col, Len: 2 + i, Message: fmt.Sprintf("`\\x` must be followed by two hexadecimal digits on line %d", line)})
+		}
+		t.consume()
+		value = value*16 + rune(digitValue(byte(digit)))
+	}
+	return value
+}
+
+// col returns the 1-based column of the next character, counted in
+// characters rather than bytes.
+func (t *Tokenizer) col() int {
+	return t.column + 1
+}
+
+// decode returns the character at byte index i and its length in bytes,
+// rejecting bytes that are not valid UTF-8.
+func (t *Tokenizer) decode(i int) (rune, int) {
+	if t.src[i] < utf8.RuneSelf {
+		return rune(t.src[i]), 1
+	}
+	ch, size := utf8.DecodeRuneInString(t.src[i:])
+	if ch == utf8.RuneError && size == 1 {
+		col := utf8.RuneCountInString(t.src[t.lineStart:i]) + 1
+		panic(Diagnostic{Line: t.line, Col: col, Len: 1, Message: fmt.Sprintf("Invalid UTF-8 byte 0x%02x on line %d, column %d", t.src[i], t.line, col)})
+	}
+	return ch, size
+}
+
+// peek returns the character offset characters ahead, or eof past the end
+// of the source.
+func (t *Tokenizer) peek(offset int) rune {
+	i := t.index
+	for ; offset > 0 && i < len(t.src); offset-- {
+		_, size := t.decode(i)
+		i += size
+	}
+	if i >= len(t.src) {
+		return eof
+	}
+	ch, _ := t.decode(i)
+	return ch
 }
 
 func (t *Tokenizer) consume() rune {
-	ch := rune(t.src[t.index])
-	t.index++
+	ch, size := t.decode(t.index)
+	t.index += size
+	t.column++
+	if ch == '\n' {
+		t.line++
+		t.column = 0
+		t.lineStart = t.index
+	}
 	return ch
-}
\ No newline at end of file
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseIntLit(t *testing.T) {
+	tests := []struct {
+		src  string
+		want int64
+	}{
+		{"0", 0},
+		{"1_000", 1000},
+		{"9223372036854775807", 9223372036854775807},
+		{"0x7FFF_FFFF_FFFF_FFFF", 9223372036854775807},
+		{"0x8000_0000_0000_0000", -9223372036854775808},
+		{"0xFFFF_FFFF_FFFF_FFFF", -1},
+		{"0b" + strings.Repeat("1", 64), -1},
+		{"0b1" + strings.Repeat("0", 63), -9223372036854775808},
+		{"0o1777777777777777777777", -1},
+	}
+	for _, test := range tests {
+		tokens, err := NewTokenizer(test.src).Tokenize()
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		if len(tokens) != 1 || tokens[0].Type != TokenIntLit || tokens[0].Int != test.want {
+			t.Errorf("%s: got %v, want %d", test.src, tokens, test.want)
+		}
+	}
+}
+
+func TestParseIntLitErrors(t *testing.T) {
+	tests := []struct {
+		src     string
+		message string
+	}{
+		{"9223372036854775808", "Integer literal out of range"},
+		{"0x1_0000_0000_0000_0000", "Integer literal out of range"},
+		{"0b1" + strings.Repeat("0", 64), "Integer literal out of range"},
+		{"0x", "Hexadecimal literal has no digits"},
+		{"0b102", "Invalid digit '2' in binary literal"},
+		{"1__0", "`_` must separate successive digits"},
+	}
+	for _, test := range tests {
+		_, err := NewTokenizer(test.src).Tokenize()
+		if err == nil || !strings.HasPrefix(err.Error(), test.message) {
+			t.Errorf("%s: got error %v, want %q", test.src, err, test.message)
+		}
+	}
+}
+
+func TestUntokenize(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"empty", ""},
+		{"only trivia", "  // nothing\n\n/* at all */\t\n"},
+		{"program", "let mut x = 0x1F;\nx += 'a';\nexit(x);\n"},
+		{"no final newline", "exit(0);"},
+		{"odd spacing", "\t let  x=1 ;\r\n\r\nexit ( x )  ;  \n\n\n"},
+		{"comments", "// head\nlet x = 1; // trailing\n/* block\n   spanning lines */ exit(x /* inner */);\n// tail"},
+		{"literals", "let c = '\\n';\nlet d = '\\x41';\nlet e = 1_000_000 + 0b1010 + 0o17;\nexit(c + d + e);"},
+		{"unicode", "let é = 1; // ünïcödé 𝑥\nlet 𝑥 = é;\nexit(𝑥);"},
+		{"operators", "let mut a = [1, 2];\na[0] <<= 2;\na[1] >>>= 1;\nexit(~a[0] ^ a[1] | 3 & &a[0] >> 1 % 2);"},
+		{"comparisons", "let b = 1<2 == (2>=1) != (3 <= 4);\nexit(b>0);"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokenizer := NewTokenizer(test.src)
+			tokenizer.KeepTrivia = true
+			tokens, err := tokenizer.Tokenize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Untokenize(tokens, tokenizer.EOFTrivia); got != test.src {
+				t.Errorf("got %q, want %q", got, test.src)
+			}
+		})
+	}
+}
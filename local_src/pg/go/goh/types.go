@@ -0,0 +1,51 @@
+package main
+
+import "fmt"
+
+type TypeKind int
+
+const (
+	TypeI64 TypeKind = iota
+	TypeArray
+	TypePointer
+)
+
+// Type is the type of a variable or expression. An array can only be
+// indexed, and its elements are i64; a pointer can only be dereferenced,
+// compared with zero as a condition or stored.
+type Type struct {
+	Kind TypeKind
+	Elem *Type // Element type of an array, or the type a pointer points to
+	Len  int   // Number of elements of an array
+}
+
+var typeI64 = &Type{Kind: TypeI64}
+
+// maxArrayLen bounds the length of an array, which lives on the stack.
+const maxArrayLen = 1 << 20
+
+func arrayType(elem *Type, length int) *Type {
+	return &Type{Kind: TypeArray, Elem: elem, Len: length}
+}
+
+func pointerType(elem *Type) *Type {
+	return &Type{Kind: TypePointer, Elem: elem}
+}
+
+// Equal reports whether t and u are the same type.
+func (t *Type) Equal(u *Type) bool {
+	if t.Kind != u.Kind || t.Len != u.Len {
+		return false
+	}
+	return t.Elem == nil || t.Elem.Equal(u.Elem)
+}
+
+func (t *Type) String() string {
+	switch t.Kind {
+	case TypeArray:
+		return fmt.Sprintf("[%s; %d]", t.Elem, t.Len)
+	case TypePointer:
+		return "*" + t.Elem.String()
+	}
+	return "i64"
+}
@@ -0,0 +1,225 @@
+package main
+
+import "encoding/binary"
+
+const (
+	wasmTypeI32  = 0x7f
+	wasmTypeI64  = 0x7e
+	wasmTypeFunc = 0x60
+	wasmVoid     = 0x40
+)
+
+func (o WasmOp) opcode() byte {
+	switch o {
+	case WasmI64Const:
+		return 0x42
+	case WasmLocalGet:
+		return 0x20
+	case WasmLocalSet:
+		return 0x21
+	case WasmLocalTee:
+		return 0x22
+	case WasmI32Const:
+		return 0x41
+	case WasmGlobalGet:
+		return 0x23
+	case WasmGlobalSet:
+		return 0x24
+	case WasmI64Load:
+		return 0x29
+	case WasmI64Store:
+		return 0x37
+	case WasmMemoryFill:
+		return 0xfc // Followed by its index among the 0xfc instructions
+	case WasmI64Add:
+		return 0x7c
+	case WasmI64Sub:
+		return 0x7d
+	case WasmI64Mul:
+		return 0x7e
+	case WasmI64DivS:
+		return 0x7f
+	case WasmI64RemS:
+		return 0x81
+	case WasmI64And:
+		return 0x83
+	case WasmI64Or:
+		return 0x84
+	case WasmI64Xor:
+		return 0x85
+	case WasmI64Shl:
+		return 0x86
+	case WasmI64ShrS:
+		return 0x87
+	case WasmI64ShrU:
+		return 0x88
+	case WasmI64Eqz:
+		return 0x50
+	case WasmI64Eq:
+		return 0x51
+	case WasmI64Ne:
+		return 0x52
+	case WasmI64LtS:
+		return 0x53
+	case WasmI64GtS:
+		return 0x55
+	case WasmI64LeS:
+		return 0x57
+	case WasmI64GeS:
+		return 0x59
+	case WasmI64GtU:
+		return 0x56
+	case WasmI64ExtendI32U:
+		return 0xad
+	case WasmI32Eqz:
+		return 0x45
+	case WasmI32WrapI64:
+		return 0xa7
+	case WasmIf:
+		return 0x04
+	case WasmElse:
+		return 0x05
+	case WasmEnd:
+		return 0x0b
+	case WasmBlock:
+		return 0x02
+	case WasmLoop:
+		return 0x03
+	case WasmBr:
+		return 0x0c
+	case WasmBrIf:
+		return 0x0d
+	case WasmBrTable:
+		return 0x0e
+	case WasmCall:
+		return 0x10
+	case WasmDrop:
+		return 0x1a
+	case WasmUnreachable:
+		return 0x00
+	}
+	panic("invalid wasm op")
+}
+
+// EncodeWasm assembles a _start body into a binary module with the same
+// layout FormatWat describes.
+func EncodeWasm(instrs []WasmInstr, module WasmModule) []byte {
+	out := []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+
+	// Type 0 is proc_exit's (i32) -> (), type 1 is _start's () -> () and
+	// type 2 is fd_write's (i32, i32, i32, i32) -> i32
+	out = wasmSection(out, 1, wasmVec(3,
+		[]byte{wasmTypeFunc, 1, wasmTypeI32, 0},
+		[]byte{wasmTypeFunc, 0, 0},
+		[]byte{wasmTypeFunc, 4, wasmTypeI32, wasmTypeI32, wasmTypeI32, wasmTypeI32, 1, wasmTypeI32},
+	))
+
+	imports := [][]byte{wasmImport("proc_exit", 0)}
+	if module.FdWrite {
+		imports = append(imports, wasmImport("fd_write", 2))
+	}
+	out = wasmSection(out, 2, wasmVec(len(imports), imports...))
+
+	out = wasmSection(out, 3, wasmVec(1, []byte{1}))
+	out = wasmSection(out, 5, wasmVec(1, binary.AppendUvarint([]byte{0x00}, uint64(module.Pages))))
+
+	if len(module.Statics) > 0 {
+		var globals [][]byte
+		for _, static := range module.Statics {
+			global := []byte{wasmTypeI64, 1, WasmI64Const.opcode()} // mutable
+			global = appendSleb128(global, static.Value)
+			globals = append(globals, append(global, WasmEnd.opcode()))
+		}
+		out = wasmSection(out, 6, wasmVec(len(globals), globals...))
+	}
+
+	memory := append(wasmName(nil, "memory"), 0x02, 0)
+	start := append(wasmName(nil, "_start"), 0x00, byte(len(imports)))
+	out = wasmSection(out, 7, wasmVec(2, memory, start))
+
+	var body []byte
+	if module.NumLocals > 0 {
+		body = binary.AppendUvarint(body, 1)
+		body = binary.AppendUvarint(body, uint64(module.NumLocals))
+		body = append(body, wasmTypeI64)
+	} else {
+		body = binary.AppendUvarint(body, 0)
+	}
+	for _, instr := range instrs {
+		if instr.Op == WasmComment {
+			continue
+		}
+		body = append(body, instr.Op.opcode())
+		switch instr.Op {
+		case WasmI64Const, WasmI32Const:
+			body = appendSleb128(body, instr.Imm)
+		case WasmI64Load, WasmI64Store:
+			body = append(body, 3) // Aligned to 8 bytes
+			body = binary.AppendUvarint(body, uint64(instr.Imm))
+		case WasmMemoryFill:
+			body = append(body, 11, 0) // Memory 0
+		case WasmLocalGet, WasmLocalSet, WasmLocalTee, WasmGlobalGet, WasmGlobalSet, WasmCall, WasmBr, WasmBrIf:
+			body = binary.AppendUvarint(body, uint64(instr.Imm))
+		case WasmBrTable:
+			body = binary.AppendUvarint(body, uint64(len(instr.Targets)))
+			for _, target := range instr.Targets {
+				body = binary.AppendUvarint(body, uint64(target))
+			}
+			body = binary.AppendUvarint(body, uint64(instr.Imm))
+		case WasmIf, WasmBlock, WasmLoop:
+			body = append(body, wasmVoid)
+		}
+	}
+	body = append(body, WasmEnd.opcode())
+	code := binary.AppendUvarint(nil, uint64(len(body)))
+	out = wasmSection(out, 10, wasmVec(1, append(code, body...)))
+
+	if len(module.Data) > 0 {
+		segment := []byte{0x00, WasmI32Const.opcode()} // Active, in memory 0
+		segment = appendSleb128(segment, int64(module.DataStart))
+		segment = append(segment, WasmEnd.opcode())
+		segment = binary.AppendUvarint(segment, uint64(len(module.Data)))
+		out = wasmSection(out, 11, wasmVec(1, append(segment, module.Data...)))
+	}
+
+	return out
+}
+
+// wasmImport imports a function of WASI with the given type.
+func wasmImport(name string, typeIndex byte) []byte {
+	out := wasmName(nil, "wasi_snapshot_preview1")
+	out = wasmName(out, name)
+	return append(out, 0x00, typeIndex)
+}
+
+func wasmSection(out []byte, id byte, contents []byte) []byte {
+	out = append(out, id)
+	out = binary.AppendUvarint(out, uint64(len(contents)))
+	return append(out, contents...)
+}
+
+func wasmVec(count int, items ...[]byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(count))
+	for _, item := range items {
+		out = append(out, item...)
+	}
+	return out
+}
+
+func wasmName(out []byte, name string) []byte {
+	out = binary.AppendUvarint(out, uint64(len(name)))
+	return append(out, name...)
+}
+
+// appendSleb128 appends value in signed LEB128, which binary.AppendVarint's
+// zig-zag encoding is not.
+func appendSleb128(out []byte, value int64) []byte {
+	for {
+		b := byte(value & 0x7f)
+		value >>= 7
+		if (value == 0 && b&0x40 == 0) || (value == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAppendSleb128(t *testing.T) {
+	tests := []struct {
+		value int64
+		want  string
+	}{
+		{0, "00"},
+		{63, "3f"},
+		{64, "c0 00"},
+		{127, "ff 00"},
+		{-1, "7f"},
+		{-64, "40"},
+		{-65, "bf 7f"},
+		{624485, "e5 8e 26"},
+		{math.MaxInt64, "ff ff ff ff ff ff ff ff ff 00"},
+		{math.MinInt64, "80 80 80 80 80 80 80 80 80 7f"},
+	}
+	for _, test := range tests {
+		if got := spacedHex(appendSleb128(nil, test.value)); got != test.want {
+			t.Errorf("%d: got %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+// TestWasmOpcodes checks each instruction's opcode against the one the
+// specification gives its text name.
+func TestWasmOpcodes(t *testing.T) {
+	want := map[string]byte{
+		"unreachable": 0x00, "block": 0x02, "loop": 0x03, "if": 0x04, "else": 0x05, "end": 0x0b,
+		"br": 0x0c, "br_if": 0x0d, "br_table": 0x0e, "call": 0x10, "drop": 0x1a,
+		"local.get": 0x20, "local.set": 0x21, "local.tee": 0x22, "global.get": 0x23, "global.set": 0x24,
+		"i64.load": 0x29, "i64.store": 0x37, "i32.const": 0x41, "i64.const": 0x42,
+		"i32.eqz": 0x45, "i64.eqz": 0x50, "i64.eq": 0x51, "i64.ne": 0x52, "i64.lt_s": 0x53,
+		"i64.gt_s": 0x55, "i64.gt_u": 0x56, "i64.le_s": 0x57, "i64.ge_s": 0x59,
+		"i64.add": 0x7c, "i64.sub": 0x7d, "i64.mul": 0x7e, "i64.div_s": 0x7f, "i64.rem_s": 0x81,
+		"i64.and": 0x83, "i64.or": 0x84, "i64.xor": 0x85, "i64.shl": 0x86, "i64.shr_s": 0x87, "i64.shr_u": 0x88,
+		"i32.wrap_i64": 0xa7, "i64.extend_i32_u": 0xad, "memory.fill": 0xfc,
+	}
+	for op := WasmComment + 1; op <= WasmUnreachable; op++ {
+		opcode, ok := want[op.String()]
+		if !ok {
+			t.Errorf("%s: not in the table", op)
+			continue
+		}
+		if op.opcode() != opcode {
+			t.Errorf("%s: got %#x, want %#x", op, op.opcode(), opcode)
+		}
+	}
+}
+
+func TestEncodeWasm(t *testing.T) {
+	const header = "\x00asm\x01\x00\x00\x00"
+	const types = "\x01\x10\x03\x60\x01\x7f\x00\x60\x00\x00\x60\x04\x7f\x7f\x7f\x7f\x01\x7f"
+	const procExit = "\x16wasi_snapshot_preview1\x09proc_exit\x00\x00"
+	const functions = "\x03\x02\x01\x01"
+	tests := []struct {
+		name   string
+		instrs []WasmInstr
+		module WasmModule
+		want   string
+	}{
+		{
+			"exit",
+			[]WasmInstr{{Op: WasmI64Const, Imm: 3}, {Op: WasmI32WrapI64}, {Op: WasmComment, Text: "exit"}, {Op: WasmCall, Imm: wasmProcExitFunc}},
+			WasmModule{Pages: 1},
+			header + types +
+				"\x02\x24\x01" + procExit +
+				functions +
+				"\x05\x03\x01\x00\x01" +
+				"\x07\x13\x02\x06memory\x02\x00\x06_start\x00\x01" +
+				"\x0a\x09\x01\x07\x00\x42\x03\xa7\x10\x00\x0b",
+		},
+		{
+			"every section",
+			[]WasmInstr{
+				{Op: WasmLocalGet, Imm: 1},
+				{Op: WasmI64Load, Imm: 16},
+				{Op: WasmBrTable, Targets: []int64{0, 1}, Imm: 2},
+				{Op: WasmMemoryFill},
+				{Op: WasmBlock},
+				{Op: WasmEnd},
+			},
+			WasmModule{NumLocals: 2, Statics: []Static{{Name: "s", Value: -1}}, Pages: 2, FdWrite: true, DataStart: 8, Data: []byte("hi")},
+			header + types +
+				"\x02\x46\x02" + procExit + "\x16wasi_snapshot_preview1\x08fd_write\x00\x02" +
+				functions +
+				"\x05\x03\x01\x00\x02" +
+				"\x06\x06\x01\x7e\x01\x42\x7f\x0b" +
+				"\x07\x13\x02\x06memory\x02\x00\x06_start\x00\x02" +
+				"\x0a\x16\x01\x14\x01\x02\x7e\x20\x01\x29\x03\x10\x0e\x02\x00\x01\x02\xfc\x0b\x00\x02\x40\x0b\x0b" +
+				"\x0b\x08\x01\x00\x41\x08\x0b\x02hi",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := EncodeWasm(test.instrs, test.module); string(got) != test.want {
+				t.Errorf("got\n%s\nwant\n%s", spacedHex(got), spacedHex([]byte(test.want)))
+			}
+		})
+	}
+}